@@ -1,6 +1,7 @@
 package api
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -124,3 +125,20 @@ type AuditRequest struct {
 	Status int    `json:"status" binding:"required"` // 1: 通过, 2: 拒绝
 	Remark string `json:"remark"`
 }
+
+// 事件类型
+type EventTypeRequest struct {
+	Name           string          `json:"name" binding:"required"`
+	Description    string          `json:"description"`
+	Schema         json.RawMessage `json:"schema" binding:"required"`        // JSON Schema
+	AllowedRoles   []int           `json:"allowed_roles" binding:"required"` // 允许提交的用户类型
+	AffectsCustody bool            `json:"affects_custody"`                  // 为 true 时事件内容必须包含 to_user_id
+	Disabled       bool            `json:"disabled"`
+}
+
+// 提交事件
+type SubmitEventRequest struct {
+	EventType  string          `json:"event_type" binding:"required"`
+	ProductSKU string          `json:"product_sku" binding:"required"`
+	Data       json.RawMessage `json:"data" binding:"required"`
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"back_Blockchain_cold_chain_traceability_system/configs"
 	"back_Blockchain_cold_chain_traceability_system/service"
+	"context"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
@@ -28,6 +29,117 @@ func main() {
 		log.Println("Redis 初始化成功")
 	}
 
+	// 用旧哈希方案重新验证迁移前的区块
+	verified, unverifiable, err := service.MigrateLegacyBlocks()
+	if err != nil {
+		log.Printf("旧版区块迁移失败: %v", err)
+	} else if verified+unverifiable > 0 {
+		log.Printf("旧版区块迁移完成: %d 个验证通过, %d 个无法复现", verified, unverifiable)
+	}
+
+	// 写入内置事件类型
+	err = service.InitEventTypes()
+	if err != nil {
+		log.Fatalf("未能初始化事件类型: %v", err)
+	}
+
+	// 加载托管私钥的加密密钥，缺失或无法解密已有私钥时拒绝启动
+	err = configs.LoadLedgerConfigFromEnv()
+	if err != nil {
+		log.Fatalf("未能加载托管私钥的加密密钥: %v", err)
+	}
+	if oldSecret := configs.GlobalLedgerConfig.OldKeySecret; oldSecret != "" {
+		count, err := service.ReencryptUserKeys(oldSecret)
+		if err != nil {
+			log.Fatalf("托管私钥重新加密失败: %v", err)
+		}
+		log.Printf("托管私钥重新加密完成: %d 个", count)
+	}
+	err = service.CheckCustodialKeys()
+	if err != nil {
+		log.Fatalf("托管私钥检查失败: %v", err)
+	}
+
+	// 加载服务端签名密钥
+	err = service.InitServerKey(configs.GlobalLedgerConfig.ServerKeyFile)
+	if err != nil {
+		log.Fatalf("未能加载服务端签名密钥: %v", err)
+	}
+
+	// 打开冷存储中的归档账本，需在读写账本之前
+	err = service.OpenLedgerArchive(configs.GlobalLedgerConfig.ArchiveDir)
+	if err != nil {
+		log.Fatalf("未能打开归档账本: %v", err)
+	}
+
+	// 启动出块器
+	service.StartBlockProducer(context.Background())
+
+	// 启动与MySQL并行的文件账本
+	_, err = service.StartLedgerMirror(context.Background())
+	if err != nil {
+		log.Fatalf("未能打开文件账本: %v", err)
+	}
+
+	// 启动多节点共识
+	configs.LoadConsensusConfigFromEnv()
+	_, err = service.StartConsensus(context.Background())
+	if err != nil {
+		log.Fatalf("未能启动共识节点: %v", err)
+	}
+
+	// 定期生成签名检查点
+	service.StartCheckpointJob(context.Background())
+
+	// 为打包区块和检查点申请可信时间戳
+	configs.LoadTimestampConfigFromEnv()
+	_, err = service.StartTimestamper(context.Background())
+	if err != nil {
+		log.Fatalf("未能启动时间戳服务: %v", err)
+	}
+
+	// 定期把链头锚定到外部链
+	err = configs.LoadAnchorConfigFromEnv()
+	if err != nil {
+		log.Fatalf("未能加载锚定配置: %v", err)
+	}
+	_, err = service.StartAnchorer(context.Background())
+	if err != nil {
+		log.Fatalf("未能启动外部链锚定: %v", err)
+	}
+
+	// 定期比对业务表与账本
+	service.StartReconcileJob(context.Background())
+
+	// 定期清理不再被引用的上传文件
+	service.StartUploadGC(context.Background())
+
+	// 重放账本事件，维护产品状态和物流历史投影
+	service.StartProjector(context.Background())
+
+	// 打开温湿度读数的时序存储，定期清理过期数据
+	configs.LoadTelemetryConfigFromEnv()
+	_, err = service.OpenTelemetryStore()
+	if err != nil {
+		log.Fatalf("未能打开遥测存储: %v", err)
+	}
+	service.StartTelemetryRetention(context.Background())
+
+	// 为还没有保存保质期的产品按温度历史计算一次，之后写入温度记录时在保存的结果上累加
+	count, err := service.BackfillShelfLife()
+	if err != nil {
+		log.Printf("计算产品保质期失败: %v", err)
+	} else if count > 0 {
+		log.Printf("已为 %d 个产品计算保质期", count)
+	}
+
+	// 订阅冷藏车和冷库传感器的MQTT主题
+	configs.LoadMQTTConfigFromEnv()
+	_, err = service.StartMQTTBridge(context.Background())
+	if err != nil {
+		log.Fatalf("未能启动MQTT桥接: %v", err)
+	}
+
 	// 初始化上传目录
 	ensureDir("./uploads/products")
 	ensureDir("./uploads/logistics")
@@ -61,6 +173,9 @@ func main() {
 	service.SetupQueryRoutes(r)
 	service.SetupBlockchainRoutes(r)
 	service.SetupAdminRoutes(r)
+	service.SetupConsensusRoutes(r)
+	service.SetupEventRoutes(r)
+	service.SetupTelemetryRoutes(r)
 
 	// 初始化管理员账户
 	initAdminUser()
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/service"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// 离线验证证据包，不需要数据库和网络
+// 用法: verify -server-key 公钥hex evidence.json|evidence.zip
+func main() {
+	serverKey := flag.String("server-key", "", "信任的服务端公钥(hex)，必填，可从 /api/blockchain/server-key 获取")
+	flag.Parse()
+
+	// 证据包附带的公钥只能证明内容未被修改，不能证明出自可信服务端，必须由验证方指定
+	if flag.NArg() != 1 || *serverKey == "" {
+		fmt.Fprintln(os.Stderr, "用法: verify -server-key 公钥hex <证据包文件>")
+		os.Exit(2)
+	}
+
+	data, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "读取证据包失败: %v\n", err)
+		os.Exit(2)
+	}
+
+	signed, err := service.ReadEvidenceBundle(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "解析证据包失败: %v\n", err)
+		os.Exit(2)
+	}
+
+	bundle, report := service.VerifyEvidenceBundle(signed, *serverKey)
+
+	if bundle != nil {
+		fmt.Printf("SKU: %s\n", bundle.ProductSKU)
+		fmt.Printf("区块数: %d, 物流记录: %d, 交接记录: %d\n", len(bundle.Blocks), len(bundle.Logistics), len(bundle.Transfers))
+	}
+	fmt.Printf("服务端公钥: %s\n", signed.ServerKey)
+	for _, check := range report.Checks {
+		status := "通过"
+		if !check.Passed {
+			status = "失败"
+		}
+		if check.Detail != "" {
+			fmt.Printf("[%s] %s: %s\n", status, check.Name, check.Detail)
+		} else {
+			fmt.Printf("[%s] %s\n", status, check.Name)
+		}
+	}
+
+	if !report.Valid {
+		fmt.Println("验证结果: 证据包无效")
+		os.Exit(1)
+	}
+	fmt.Println("验证结果: 证据包有效")
+}
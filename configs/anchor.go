@@ -0,0 +1,59 @@
+package configs
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"time"
+)
+
+type AnchorConfig struct {
+	Enabled       bool
+	RPCURL        string        // 以太坊兼容链的JSON-RPC地址，如本地 anvil/ganache 的 http://127.0.0.1:8545
+	From          string        // 发送锚定交易的账户，验证锚定时核对交易的发送者
+	PrivateKey    string        // From 账户的secp256k1私钥，交易在本地签名后发送
+	To            string        // 锚定交易的接收地址，为空时发给 From 自己
+	Confirmations int64         // 交易所在区块算起的确认区块数，达到后才视为已确认
+	Interval      time.Duration // 锚定间隔
+	Timeout       time.Duration // 单次RPC调用超时
+}
+
+var GlobalAnchorConfig = AnchorConfig{
+	Enabled:       false,
+	RPCURL:        "http://127.0.0.1:8545",
+	Confirmations: 12,
+	Interval:      10 * time.Minute,
+	Timeout:       10 * time.Second,
+}
+
+// LoadAnchorConfigFromEnv 从环境变量读取锚定配置，设置 ANCHOR_FROM 后启用，
+// 私钥从 ANCHOR_PRIVATE_KEY 或 ANCHOR_PRIVATE_KEY_FILE 读取
+// 例如: ANCHOR_RPC_URL=http://127.0.0.1:8545 ANCHOR_FROM=0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266 ANCHOR_PRIVATE_KEY_FILE=/run/secrets/anchor_key
+func LoadAnchorConfigFromEnv() error {
+	from := os.Getenv("ANCHOR_FROM")
+	if from == "" {
+		return nil
+	}
+	privateKey, err := secretFromEnv("ANCHOR_PRIVATE_KEY")
+	if err != nil {
+		return err
+	}
+	if privateKey == "" {
+		return errors.New("设置了 ANCHOR_FROM 但没有提供 ANCHOR_PRIVATE_KEY")
+	}
+
+	GlobalAnchorConfig.Enabled = true
+	GlobalAnchorConfig.From = from
+	GlobalAnchorConfig.PrivateKey = privateKey
+	GlobalAnchorConfig.To = os.Getenv("ANCHOR_TO")
+	if url := os.Getenv("ANCHOR_RPC_URL"); url != "" {
+		GlobalAnchorConfig.RPCURL = url
+	}
+	if interval, err := time.ParseDuration(os.Getenv("ANCHOR_INTERVAL")); err == nil && interval > 0 {
+		GlobalAnchorConfig.Interval = interval
+	}
+	if confirmations, err := strconv.ParseInt(os.Getenv("ANCHOR_CONFIRMATIONS"), 10, 64); err == nil && confirmations > 0 {
+		GlobalAnchorConfig.Confirmations = confirmations
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package configs
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+type ConsensusConfig struct {
+	Enabled         bool
+	NodeID          string
+	Peers           map[string]string // 其他节点ID -> 节点地址，如 http://10.0.0.2:8080
+	DataDir         string
+	ClusterToken    string // 节点间通信使用的共享令牌，共识模式下必须通过 CONSENSUS_TOKEN 设置
+	ElectionTimeout time.Duration
+	ProposeTimeout  time.Duration // 等待多数节点确认区块的超时时间
+}
+
+var GlobalConsensusConfig = ConsensusConfig{
+	Enabled:         false,
+	Peers:           map[string]string{},
+	DataDir:         "./consensus",
+	ElectionTimeout: 300 * time.Millisecond,
+	ProposeTimeout:  5 * time.Second,
+}
+
+// LoadConsensusConfigFromEnv 从环境变量读取共识配置
+// 每个参与方运行一个 cmd/main.go 实例，例如:
+// CONSENSUS_NODE_ID=factory CONSENSUS_PEERS=saler=http://10.0.0.2:8080,regulator=http://10.0.0.3:8080 CONSENSUS_TOKEN=<随机令牌>
+func LoadConsensusConfigFromEnv() {
+	nodeID := os.Getenv("CONSENSUS_NODE_ID")
+	if nodeID == "" {
+		return
+	}
+
+	GlobalConsensusConfig.Enabled = true
+	GlobalConsensusConfig.NodeID = nodeID
+
+	for _, peer := range strings.Split(os.Getenv("CONSENSUS_PEERS"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(peer), "=", 2)
+		if len(parts) == 2 && parts[0] != "" && parts[0] != nodeID {
+			GlobalConsensusConfig.Peers[parts[0]] = strings.TrimRight(parts[1], "/")
+		}
+	}
+	if dir := os.Getenv("CONSENSUS_DATA_DIR"); dir != "" {
+		GlobalConsensusConfig.DataDir = dir
+	}
+	if token := os.Getenv("CONSENSUS_TOKEN"); token != "" {
+		GlobalConsensusConfig.ClusterToken = token
+	}
+}
@@ -0,0 +1,74 @@
+package configs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+type LedgerConfig struct {
+	BatchInterval    time.Duration // 打包区块的时间间隔
+	BatchSize        int           // 待打包记录达到该数量时立即封块
+	KeyEncryptSecret string        // 加密托管私钥的密钥，必须通过环境变量或密钥文件提供
+	OldKeySecret     string        // 更换加密密钥时的旧密钥，启动时用它解密已有私钥并用新密钥重新加密
+	MirrorDir        string        // 文件账本目录，为空时不启用与MySQL并行的文件账本
+	MirrorSegment    int64         // 文件账本单个段文件的大小上限(字节)
+	ServerKeyFile    string        // 服务端签名密钥，用于签名检查点
+	CheckpointEvery  time.Duration // 生成检查点的时间间隔
+	ReconcileEvery   time.Duration // 业务表与账本对账的时间间隔，0 表示不定期对账
+	ArchiveDir       string        // 冷存储目录，快照之前的区块归档后从MySQL中移到这里
+}
+
+var GlobalLedgerConfig = LedgerConfig{
+	BatchInterval:   30 * time.Second,
+	BatchSize:       100,
+	MirrorDir:       "./ledger",
+	MirrorSegment:   64 << 20,
+	ServerKeyFile:   "./keys/server_ed25519.key",
+	CheckpointEvery: time.Hour,
+	ReconcileEvery:  6 * time.Hour,
+	ArchiveDir:      "./ledger_archive",
+}
+
+// LoadLedgerConfigFromEnv 从环境变量读取托管私钥的加密密钥
+// LEDGER_KEY_SECRET 直接给出密钥，或用 LEDGER_KEY_SECRET_FILE 指定密钥文件
+// 更换密钥时同时设置 LEDGER_OLD_KEY_SECRET(_FILE)，启动时会把已有私钥重新加密，完成后即可去掉
+func LoadLedgerConfigFromEnv() error {
+	secret, err := secretFromEnv("LEDGER_KEY_SECRET")
+	if err != nil {
+		return err
+	}
+	if secret != "" {
+		GlobalLedgerConfig.KeyEncryptSecret = secret
+	}
+
+	oldSecret, err := secretFromEnv("LEDGER_OLD_KEY_SECRET")
+	if err != nil {
+		return err
+	}
+	if oldSecret != "" {
+		GlobalLedgerConfig.OldKeySecret = oldSecret
+	}
+	return nil
+}
+
+// 读取密钥，优先使用环境变量 name，否则读取 name_FILE 指定的文件
+func secretFromEnv(name string) (string, error) {
+	if secret := os.Getenv(name); secret != "" {
+		return secret, nil
+	}
+	file := os.Getenv(name + "_FILE")
+	if file == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("读取 %s 失败: %w", name+"_FILE", err)
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("%s 指定的密钥文件为空", name+"_FILE")
+	}
+	return secret, nil
+}
@@ -0,0 +1,53 @@
+package configs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadLedgerConfigFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secretFile, []byte("file-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(dir, "empty")
+	if err := os.WriteFile(emptyFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		env    map[string]string
+		secret string
+		old    string
+		err    bool
+	}{
+		{name: "未配置"},
+		{name: "环境变量", env: map[string]string{"LEDGER_KEY_SECRET": "env-secret"}, secret: "env-secret"},
+		{name: "密钥文件", env: map[string]string{"LEDGER_KEY_SECRET_FILE": secretFile}, secret: "file-secret"},
+		{name: "环境变量优先", env: map[string]string{"LEDGER_KEY_SECRET": "env-secret", "LEDGER_KEY_SECRET_FILE": secretFile}, secret: "env-secret"},
+		{name: "旧密钥", env: map[string]string{"LEDGER_KEY_SECRET": "new", "LEDGER_OLD_KEY_SECRET_FILE": secretFile}, secret: "new", old: "file-secret"},
+		{name: "密钥文件不存在", env: map[string]string{"LEDGER_KEY_SECRET_FILE": filepath.Join(dir, "missing")}, err: true},
+		{name: "密钥文件为空", env: map[string]string{"LEDGER_KEY_SECRET_FILE": emptyFile}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"LEDGER_KEY_SECRET", "LEDGER_KEY_SECRET_FILE", "LEDGER_OLD_KEY_SECRET", "LEDGER_OLD_KEY_SECRET_FILE"} {
+				t.Setenv(name, tt.env[name])
+			}
+			saved := GlobalLedgerConfig
+			defer func() { GlobalLedgerConfig = saved }()
+			GlobalLedgerConfig.KeyEncryptSecret, GlobalLedgerConfig.OldKeySecret = "", ""
+
+			err := LoadLedgerConfigFromEnv()
+			if tt.err != (err != nil) {
+				t.Fatalf("错误 %v", err)
+			}
+			if GlobalLedgerConfig.KeyEncryptSecret != tt.secret || GlobalLedgerConfig.OldKeySecret != tt.old {
+				t.Fatalf("密钥 %q 旧密钥 %q", GlobalLedgerConfig.KeyEncryptSecret, GlobalLedgerConfig.OldKeySecret)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package configs
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MQTTTopic 订阅的主题与设备的对应关系
+type MQTTTopic struct {
+	Filter string // 订阅过滤器，可以使用 + 和 # 通配符，如 coldchain/+/telemetry
+	Serial string // 设备编号模板，{1} 表示第一个通配符匹配的内容，如 reefer-{1}
+	Format string // 消息格式 json 或 csv，为空时按消息内容判断
+}
+
+type MQTTConfig struct {
+	Enabled        bool
+	Broker         string // 如 tcp://127.0.0.1:1883
+	ClientID       string
+	Username       string
+	Password       string
+	QoS            byte
+	Topics         []MQTTTopic
+	FlushInterval  time.Duration // 同一设备的读数合并为一个批次的最长等待时间
+	BatchSize      int           // 同一设备的读数达到该数量时立即保存
+	ConnectTimeout time.Duration
+}
+
+var GlobalMQTTConfig = MQTTConfig{
+	Enabled:  false,
+	Broker:   "tcp://127.0.0.1:1883",
+	ClientID: "cold-chain-bridge",
+	QoS:      1,
+	Topics: []MQTTTopic{
+		{Filter: "coldchain/devices/+/telemetry", Serial: "{1}"},
+	},
+	FlushInterval:  time.Minute,
+	BatchSize:      500,
+	ConnectTimeout: 10 * time.Second,
+}
+
+// LoadMQTTConfigFromEnv 从环境变量读取MQTT配置，设置 MQTT_BROKER 后启用
+// MQTT_TOPICS 以分号分隔多个映射，每个映射为 过滤器=设备编号模板[,格式]，例如:
+// MQTT_TOPICS="reefer/+/temp=reefer-{1},csv;warehouse/+/rooms/+=wh-{1}-{2}"
+func LoadMQTTConfigFromEnv() {
+	broker := os.Getenv("MQTT_BROKER")
+	if broker == "" {
+		return
+	}
+
+	GlobalMQTTConfig.Enabled = true
+	GlobalMQTTConfig.Broker = broker
+	if clientID := os.Getenv("MQTT_CLIENT_ID"); clientID != "" {
+		GlobalMQTTConfig.ClientID = clientID
+	}
+	GlobalMQTTConfig.Username = os.Getenv("MQTT_USERNAME")
+	GlobalMQTTConfig.Password = os.Getenv("MQTT_PASSWORD")
+	if qos, err := strconv.Atoi(os.Getenv("MQTT_QOS")); err == nil && qos >= 0 && qos <= 2 {
+		GlobalMQTTConfig.QoS = byte(qos)
+	}
+	if topics := os.Getenv("MQTT_TOPICS"); topics != "" {
+		GlobalMQTTConfig.Topics = nil
+		for _, entry := range strings.Split(topics, ";") {
+			filter, target, found := strings.Cut(strings.TrimSpace(entry), "=")
+			if !found || filter == "" {
+				continue
+			}
+			serial, format, _ := strings.Cut(target, ",")
+			GlobalMQTTConfig.Topics = append(GlobalMQTTConfig.Topics, MQTTTopic{
+				Filter: filter,
+				Serial: serial,
+				Format: format,
+			})
+		}
+	}
+	if interval, err := time.ParseDuration(os.Getenv("MQTT_FLUSH_INTERVAL")); err == nil && interval > 0 {
+		GlobalMQTTConfig.FlushInterval = interval
+	}
+	if size, err := strconv.Atoi(os.Getenv("MQTT_BATCH_SIZE")); err == nil && size > 0 {
+		GlobalMQTTConfig.BatchSize = size
+	}
+}
@@ -91,7 +91,8 @@ type ProductInfo struct {
 	SafetyTesting    string    `gorm:"size:500;not null"`
 	QualityRating    string    `gorm:"size:50;not null"`
 	ImageURL         string    `gorm:"size:500;not null"`
-	Status           int       `gorm:"default:0"` // 0: 待审核, 1: 已发布
+	ImageSHA256      string    `gorm:"size:64;index"` // 图片内容的SHA-256，同时也是文件名
+	Status           int       `gorm:"default:0"`     // 0: 待审核, 1: 已发布
 	AuditRemark      string
 }
 
@@ -103,6 +104,7 @@ type LogisticsRecord struct {
 	Temperature       float64 `gorm:"not null"`
 	Humidity          float64 `gorm:"not null"`
 	ImageURL          string  `gorm:"size:500;not null"`
+	ImageSHA256       string  `gorm:"size:64;index"` // 图片内容的SHA-256，同时也是文件名
 	OperatorID        uint    `gorm:"not null"`
 	OperatorType      int     `gorm:"not null"` // 1: 厂家, 2: 经销商
 }
@@ -118,20 +120,387 @@ type TransferRecord struct {
 
 type BlockchainLog struct {
 	gorm.Model
-	ProductSKU   string `gorm:"size:50;not null;index"`
+	ProductSKU   string `gorm:"size:50;not null;index;uniqueIndex:idx_sku_height,priority:1"`
 	RecordType   int    `gorm:"not null"` // 1: 产品创建, 2: 物流更新, 3: 确认交接
 	RecordData   string `gorm:"type:text;not null"`
-	Hash         string `gorm:"size:256;not null"`
+	Hash         string `gorm:"size:256;not null;index"`
 	PreviousHash string `gorm:"size:256"`
 	BlockHeight  int64
+	// 全局账本：所有SKU的区块按写入顺序串成一条链
+	GlobalHeight       int64  `gorm:"index"`
+	GlobalPreviousHash string `gorm:"size:256"`
+	HashVersion        int    `gorm:"default:0"` // 0: 旧版哈希, 1: 规范区块头
+	Timestamp          int64  // 区块时间戳(Unix纳秒)，参与哈希计算
+	LegacyStatus       int    `gorm:"default:0"`       // 仅旧版区块使用 0: 未检查, 1: 旧方案验证通过, 2: 旧方案无法复现，只是迁移记录，验证时不使用
+	SealedHeight       int64  `gorm:"index;default:0"` // 所属打包区块高度，0 表示尚未打包
+	LeafIndex          int    // 在打包区块Merkle树中的叶子序号
+	SignerID           uint   // 提交记录的用户
+	SignerKeyID        uint   // 签名使用的密钥
+	Signature          string `gorm:"size:128"` // 对规范区块头的Ed25519签名(hex)
+
+	// 唯一约束使用的生成列，数据库层面保证同一高度只有一个区块
+	// 旧版区块不受约束，它们写入时没有账本锁，可能已经存在重复高度
+	SKUHeightKey    *int64 `gorm:"->;type:bigint GENERATED ALWAYS AS (IF(hash_version = 0, NULL, block_height)) STORED;uniqueIndex:idx_sku_height,priority:2"`
+	GlobalHeightKey *int64 `gorm:"->;type:bigint GENERATED ALWAYS AS (IF(hash_version = 0, NULL, global_height)) STORED;uniqueIndex:idx_global_height"`
+}
+
+// 用户签名密钥，托管模式下私钥加密后保存在服务端
+type UserKey struct {
+	gorm.Model
+	UserID     uint   `gorm:"not null;index"`
+	Algorithm  string `gorm:"size:20;not null"`
+	PublicKey  string `gorm:"size:64;not null"` // hex
+	PrivateKey string `gorm:"type:text"`        // 加密后的私钥
+	ValidFrom  int64  `gorm:"not null"`         // 生效时间(Unix纳秒)
+	RevokedAt  int64  `gorm:"default:0"`        // 吊销时间(Unix纳秒)，0 表示仍然有效
+}
+
+// 打包区块，定期把待打包的记录构造成Merkle树后封块
+type SealedBlock struct {
+	gorm.Model
+	Height            int64  `gorm:"uniqueIndex;not null"`
+	MerkleRoot        string `gorm:"size:64;not null"`
+	PreviousHash      string `gorm:"size:256"`
+	Hash              string `gorm:"size:256;not null"`
+	RecordCount       int    `gorm:"not null"`
+	FirstGlobalHeight int64  // 包含记录的全局高度范围
+	LastGlobalHeight  int64
+	Timestamp         int64 // Unix纳秒
+
+	TSAToken string     `gorm:"type:text"` // RFC 3161 时间戳令牌(base64 DER)
+	TSATime  *time.Time // 时间戳服务给出的时间
+}
+
+// 账本检查点，定期对链头签名，供审计方离线保存
+type LedgerCheckpoint struct {
+	gorm.Model
+	GlobalHeight int64  `gorm:"not null;index"`
+	GlobalHash   string `gorm:"size:256"`
+	SealedHeight int64
+	SealedHash   string `gorm:"size:256"`
+	SKUCount     int
+	SKUHeadsRoot string `gorm:"size:64"`       // 各SKU链头的Merkle根
+	SKUHeads     string `gorm:"type:longtext"` // 各SKU链头(JSON)
+	Timestamp    int64  // Unix纳秒
+	ServerKey    string `gorm:"size:64"`  // 签名公钥(hex)
+	Signature    string `gorm:"size:128"` // 对检查点头的Ed25519签名(hex)
+
+	TSAToken string     `gorm:"type:text"` // RFC 3161 时间戳令牌(base64 DER)
+	TSATime  *time.Time // 时间戳服务给出的时间
+}
+
+// 账本快照，对某个打包区块边界处的链头签名，验证可以从快照开始，快照之前的区块可以归档到冷存储
+type LedgerSnapshot struct {
+	gorm.Model
+	PreviousHeight int64  // 上一个快照的全局高度，本快照覆盖 (PreviousHeight, GlobalHeight] 的区块
+	GlobalHeight   int64  `gorm:"uniqueIndex;not null"`
+	GlobalHash     string `gorm:"size:256"`
+	SealedHeight   int64
+	SealedHash     string `gorm:"size:256"`
+	BlockCount     int
+	BlocksRoot     string `gorm:"size:64"` // 覆盖区块哈希的Merkle根，用于证明归档区块
+	SKUCount       int
+	SKUHeadsRoot   string `gorm:"size:64"`       // 快照时各SKU链头的Merkle根
+	SKUHeads       string `gorm:"type:longtext"` // 快照时各SKU链头(JSON)
+	Timestamp      int64  // Unix纳秒
+	ServerKey      string `gorm:"size:64"`
+	Signature      string `gorm:"size:128"`
+
+	ArchivedAt *time.Time // 覆盖的区块移到冷存储的时间，为空表示尚未归档
+}
+
+// 对账记录，比对业务表与区块中的记录数据
+type ReconciliationRun struct {
+	gorm.Model
+	StartedAt     time.Time
+	FinishedAt    time.Time
+	BlocksScanned int
+	RowsScanned   int
+	OrphanRows    int
+	OrphanBlocks  int
+	Mismatches    int
+	Findings      string `gorm:"type:longtext"` // 发现的问题(JSON)
+	Error         string `gorm:"size:500"`
+}
+
+// 事件类型注册表，定义可以写入账本的事件
+type EventType struct {
+	gorm.Model
+	Name           string `gorm:"uniqueIndex;size:100;not null"`
+	Description    string `gorm:"size:500"`
+	RecordType     int    `gorm:"uniqueIndex;not null"` // 区块记录类型
+	Version        int    `gorm:"not null;default:1"`   // 每次修改Schema后递增
+	Schema         string `gorm:"type:text"`            // 事件内容的JSON Schema
+	AllowedRoles   string `gorm:"size:50;not null"`     // 允许提交的用户类型，逗号分隔
+	AffectsCustody bool   // 事件是否改变产品持有人
+	Builtin        bool   // 内置事件由各业务接口写入
+	Disabled       bool
+}
+
+// 账本锚定记录，把账本链头写入外部以太坊兼容链
+type LedgerAnchor struct {
+	gorm.Model
+	GlobalHeight int64  `gorm:"not null;index"`
+	GlobalHash   string `gorm:"size:256;not null"`
+	SealedHeight int64
+	SealedHash   string `gorm:"size:256"`
+	Digest       string `gorm:"size:64;not null"` // 锚定头的SHA-256，即交易data中的内容
+	ChainID      string `gorm:"size:20"`
+	FromAddress  string `gorm:"size:42"`
+	ToAddress    string `gorm:"size:42"`
+	TxHash       string `gorm:"size:66;index"`
+	BlockNumber  int64
+	BlockHash    string `gorm:"size:66"`
+	Status       int    `gorm:"default:0"` // 0: 待确认, 1: 已确认, 2: 失败
+	Error        string `gorm:"size:500"`
+	ConfirmedAt  *time.Time
+}
+
+// 产品状态投影，由账本事件重放得到，可以随时删除后重建
+type ProductProjection struct {
+	ID               uint   `gorm:"primaryKey"`
+	ProductSKU       string `gorm:"uniqueIndex;size:50;not null"`
+	ProductID        uint
+	Name             string `gorm:"size:100"`
+	BatchNumber      string `gorm:"size:50"`
+	ManufacturerID   uint
+	Status           int    // 与 ProductInfo.Status 相同，账本中有产品创建事件即为已发布
+	Stage            string `gorm:"size:20"` // created, in_transit, transferred
+	CustodianID      uint   `gorm:"index"`
+	CustodySource    string `gorm:"size:100"` // 最近一次改变持有人的事件类型
+	TransferID       uint   // 最近一次交接记录
+	LogisticsCount   int
+	TransferCount    int
+	EventCount       int
+	LastEventType    string `gorm:"size:100"`
+	LastBlockHeight  int64
+	LastGlobalHeight int64
+	LastBlockHash    string `gorm:"size:256"`
+	UpdatedAt        time.Time
+}
+
+// 物流历史投影，每条物流更新事件一行
+type LogisticsProjection struct {
+	ID                uint   `gorm:"primaryKey"`
+	ProductSKU        string `gorm:"size:50;not null;index"`
+	RecordID          uint   `gorm:"index"` // 对应的 LogisticsRecord
+	TrackingNo        string `gorm:"size:50"`
+	WarehouseLocation string `gorm:"size:200"`
+	Temperature       float64
+	Humidity          float64
+	ImageURL          string `gorm:"size:500"`
+	ImageSHA256       string `gorm:"size:64"`
+	OperatorID        uint
+	OperatorType      int
+	BlockHeight       int64
+	GlobalHeight      int64
+	BlockHash         string `gorm:"size:256"`
+	Timestamp         int64  // 区块时间戳(Unix纳秒)
+}
+
+// 持有人历史投影，产品每换一次持有人一行
+type CustodyProjection struct {
+	ID           uint   `gorm:"primaryKey"`
+	ProductSKU   string `gorm:"size:50;not null;index"`
+	CustodianID  uint
+	Source       string `gorm:"size:100"` // 改变持有人的事件类型
+	BlockHeight  int64
+	GlobalHeight int64
+	Timestamp    int64 // 区块时间戳(Unix纳秒)，持有从此时开始
+}
+
+// 投影进度，只有一行
+type ProjectionState struct {
+	ID           uint `gorm:"primaryKey"`
+	GlobalHeight int64
+	RebuiltAt    *time.Time
+	UpdatedAt    time.Time
 }
 
+// 温湿度记录设备，如数据记录仪、冷藏集装箱传感器
+type Device struct {
+	gorm.Model
+	SerialNo   string `gorm:"uniqueIndex;size:100;not null"`
+	Name       string `gorm:"size:100"`
+	Kind       string `gorm:"size:20;not null"` // logger: 数据记录仪, reefer: 冷藏箱传感器
+	OwnerID    uint   `gorm:"not null;index"`   // 所属机构（厂家或经销商用户）
+	KeyHash    string `gorm:"size:64;not null"` // 设备密钥的SHA-256(hex)
+	Disabled   bool
+	LastSeenAt *time.Time
+}
+
+// 设备与产品或运单的绑定，UnboundAt 为空表示仍在绑定中
+type DeviceBinding struct {
+	gorm.Model
+	DeviceID   uint   `gorm:"not null;index"`
+	ProductSKU string `gorm:"size:50;index"` // 绑定到产品
+	TrackingNo string `gorm:"size:50;index"` // 绑定到运单，运单下的所有产品
+	BoundAt    time.Time
+	UnboundAt  *time.Time
+}
+
+// 一次上报的读数批次，批次摘要写入绑定产品的账本
+type TelemetryBatch struct {
+	gorm.Model
+	DeviceID       uint   `gorm:"not null;uniqueIndex:idx_device_batch"`
+	BatchSHA256    string `gorm:"size:64;not null;uniqueIndex:idx_device_batch"`
+	ReadingCount   int
+	FirstAt        time.Time
+	LastAt         time.Time
+	MinTemperature float64
+	MaxTemperature float64
+}
+
+// 读数批次写入了账本的产品，每个产品一行
+type TelemetryBatchProduct struct {
+	ID         uint   `gorm:"primaryKey"`
+	BatchID    uint   `gorm:"not null;uniqueIndex:idx_batch_product"`
+	ProductSKU string `gorm:"size:50;not null;uniqueIndex:idx_batch_product;index"`
+}
+
+// 单条温湿度读数，遥测存储为 mysql 时保存在该表中
+type TelemetryReading struct {
+	ID          uint      `gorm:"primaryKey"`
+	DeviceID    uint      `gorm:"not null;index:idx_device_time"`
+	RecordedAt  time.Time `gorm:"not null;index:idx_device_time"`
+	BatchID     uint      `gorm:"not null;index"`
+	Temperature float64
+	Humidity    *float64 // 只测温度的设备为空
+}
+
+// MQTT桥接收到但尚未保存为批次的读数，确认消息前写入，保存为批次后删除
+type MQTTPendingReading struct {
+	ID          uint      `gorm:"primaryKey"`
+	DeviceID    uint      `gorm:"not null;index"`
+	RecordedAt  time.Time `gorm:"not null"`
+	Temperature float64
+	Humidity    *float64
+}
+
+// 读数按时间段的汇总，Resolution 为时间段长度（秒）
+type TelemetryRollup struct {
+	ID             uint      `gorm:"primaryKey"`
+	DeviceID       uint      `gorm:"not null;uniqueIndex:idx_rollup_bucket"`
+	Resolution     int       `gorm:"not null;uniqueIndex:idx_rollup_bucket"` // 60, 900, 3600
+	BucketStart    time.Time `gorm:"not null;uniqueIndex:idx_rollup_bucket"`
+	Count          int       `gorm:"not null"`
+	MinTemperature float64
+	MaxTemperature float64
+	SumTemperature float64
+	MinHumidity    float64 // HumidityCount 为0时无意义
+	MaxHumidity    float64
+	SumHumidity    float64
+	HumidityCount  int
+}
+
+// 产品的温湿度要求，没有配置时按产品的运输温度推算
+type TemperatureProfile struct {
+	gorm.Model
+	ProductSKU       string   `gorm:"uniqueIndex;size:50;not null"`
+	MinTemperature   float64  `gorm:"not null"`
+	MaxTemperature   float64  `gorm:"not null"`
+	AllowedExcursion int64    `gorm:"not null;default:0"` // 允许连续超出范围的时长（秒）
+	MinHumidity      *float64 // 为空表示不限制湿度
+	MaxHumidity      *float64
+	ActivationEnergy float64 `gorm:"not null;default:0"` // 计算平均动力学温度的活化能(kJ/mol)，0 表示使用默认值
+	Version          int     `gorm:"not null;default:0"` // 每次修改加1，与账本中的温湿度要求事件对应
+}
+
+// 温湿度超出要求范围的事件，EndedAt 为空表示仍未恢复
+type ExcursionIncident struct {
+	gorm.Model
+	ProductSKU     string     `gorm:"size:50;not null;index"`
+	Source         string     `gorm:"size:20;not null"` // logistics: 物流记录, telemetry: 设备读数
+	DeviceID       uint       `gorm:"index"`            // 设备读数的设备，物流记录为0
+	Metric         string     `gorm:"size:20;not null"` // temperature, humidity
+	Direction      string     `gorm:"size:10;not null"` // high: 高于上限, low: 低于下限
+	StartedAt      time.Time  `gorm:"not null"`
+	LastOutAt      time.Time  // 最后一条超出范围的读数
+	EndedAt        *time.Time // 恢复到范围内的第一条读数
+	PeakValue      float64    // 偏离范围最远的读数
+	LimitMin       float64
+	LimitMax       float64
+	AllowedSeconds int64
+	ReadingCount   int
+	Breach         bool   // 持续时长超过允许时长
+	ProfileVersion int    // 判断时使用的温湿度要求版本，0 表示按运输温度推算
+	BlockHash      string `gorm:"size:64"` // 最近一次写入账本的超温事件所在区块
+}
+
+// 按温度历史计算的保质期，物流记录或设备读数变化后重新计算
+type ShelfLifeState struct {
+	ID               uint      `gorm:"primaryKey"`
+	ProductSKU       string    `gorm:"uniqueIndex;size:50;not null"`
+	MeanKineticTemp  *float64  // 没有温度记录时为空
+	TimeAbove        int64     // 高于温度上限的累计时长（秒）
+	MonitoredSeconds int64     // 有温度记录覆盖的时长（秒）
+	LostSeconds      int64     // 因高于标示温度而损失的保质期（秒）
+	EffectiveExpiry  time.Time `gorm:"index"`
+	ComputedAt       time.Time
+
+	// 按时间顺序累计的中间结果，新的温度记录只在此基础上累加
+	// 累计到最后一条温度记录为止，最后一条记录持续的时间在计算时加上
+	KineticSum       float64    // Σ exp(-ΔH/RT)·dt
+	MonitoredSum     float64    // 秒
+	AboveSum         float64    // 秒
+	LostSum          float64    // 秒
+	LastAt           *time.Time // 最后一条温度记录的时间，没有记录时为空
+	LastTemperature  float64
+	Threshold        float64 // 累计时使用的温度上限、标示温度和活化能，变化时重新计算
+	ReferenceTemp    float64
+	ActivationEnergy float64
+}
+
+// 账本锁，追加区块时对这一行加排他锁，保证同一时刻只有一个写入者读取链头
+type LedgerLock struct {
+	ID uint `gorm:"primaryKey"`
+}
+
+// 账本锁所在行
+const (
+	LedgerLockID    = 1 // 追加记录
+	BlockSealLockID = 2 // 打包区块
+)
+
 func AutoMigrateTables() error {
-	return DB.AutoMigrate(
+	err := DB.AutoMigrate(
 		&User{},
 		&ProductInfo{},
 		&LogisticsRecord{},
 		&TransferRecord{},
 		&BlockchainLog{},
+		&LedgerLock{},
+		&SealedBlock{},
+		&UserKey{},
+		&LedgerCheckpoint{},
+		&ReconciliationRun{},
+		&EventType{},
+		&LedgerAnchor{},
+		&LedgerSnapshot{},
+		&ProductProjection{},
+		&LogisticsProjection{},
+		&CustodyProjection{},
+		&ProjectionState{},
+		&Device{},
+		&DeviceBinding{},
+		&TelemetryBatch{},
+		&TelemetryBatchProduct{},
+		&TelemetryReading{},
+		&MQTTPendingReading{},
+		&TelemetryRollup{},
+		&TemperatureProfile{},
+		&ExcursionIncident{},
+		&ShelfLifeState{},
 	)
+	if err != nil {
+		return err
+	}
+
+	// 确保账本锁行存在
+	for _, id := range []uint{LedgerLockID, BlockSealLockID} {
+		if err := DB.FirstOrCreate(&LedgerLock{ID: id}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,43 @@
+package configs
+
+import (
+	"os"
+	"time"
+)
+
+type TelemetryConfig struct {
+	Store             string        // 原始读数的存储方式，file: 本地文件, mysql: telemetry_readings 表
+	Dir               string        // 本地文件存储目录
+	RawRetention      time.Duration // 原始读数保留时长，0 表示永久保留
+	MinuteRetention   time.Duration // 1分钟汇总保留时长
+	QuarterRetention  time.Duration // 15分钟汇总保留时长，保质期计算使用该粒度，默认永久保留
+	HourRetention     time.Duration // 1小时汇总保留时长
+	RetentionInterval time.Duration // 清理过期数据的时间间隔
+}
+
+var GlobalTelemetryConfig = TelemetryConfig{
+	Store:             "file",
+	Dir:               "./telemetry",
+	RawRetention:      30 * 24 * time.Hour,
+	MinuteRetention:   180 * 24 * time.Hour,
+	QuarterRetention:  0,
+	HourRetention:     0,
+	RetentionInterval: time.Hour,
+}
+
+// LoadTelemetryConfigFromEnv 从环境变量读取遥测存储配置
+// 例如: TELEMETRY_STORE=mysql TELEMETRY_RAW_RETENTION=168h
+func LoadTelemetryConfigFromEnv() {
+	if store := os.Getenv("TELEMETRY_STORE"); store != "" {
+		GlobalTelemetryConfig.Store = store
+	}
+	if dir := os.Getenv("TELEMETRY_DIR"); dir != "" {
+		GlobalTelemetryConfig.Dir = dir
+	}
+	if retention, err := time.ParseDuration(os.Getenv("TELEMETRY_RAW_RETENTION")); err == nil && retention >= 0 {
+		GlobalTelemetryConfig.RawRetention = retention
+	}
+	if retention, err := time.ParseDuration(os.Getenv("TELEMETRY_MINUTE_RETENTION")); err == nil && retention >= 0 {
+		GlobalTelemetryConfig.MinuteRetention = retention
+	}
+}
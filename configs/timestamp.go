@@ -0,0 +1,52 @@
+package configs
+
+import (
+	"os"
+	"time"
+)
+
+type TimestampConfig struct {
+	Enabled    bool
+	URL        string        // RFC 3161 时间戳服务地址，为空时使用内置的本地时间戳服务
+	CertFile   string        // 时间戳服务证书(PEM)，可以是签名证书或其根证书，使用本地服务时自动生成
+	KeyFile    string        // 本地时间戳服务的签名私钥(PEM)
+	Interval   time.Duration // 补盖时间戳的检查间隔
+	Window     time.Duration // 封块后申请时间戳的期限，过期不再补盖，验证时过期仍缺少令牌视为失败
+	ClockSkew  time.Duration // 时间戳时间早于区块时间的容差
+	Timeout    time.Duration // 单次请求超时
+	ServeLocal bool          // 通过 /api/tsa 对外提供本地时间戳服务，默认关闭，只在内网或测试环境中打开
+}
+
+var GlobalTimestampConfig = TimestampConfig{
+	Enabled:   false,
+	CertFile:  "./keys/tsa_cert.pem",
+	KeyFile:   "./keys/tsa_key.pem",
+	Interval:  time.Minute,
+	Window:    time.Hour,
+	ClockSkew: time.Minute,
+	Timeout:   10 * time.Second,
+}
+
+// LoadTimestampConfigFromEnv 从环境变量读取时间戳配置
+// TSA_ENABLED=1 时使用本地时间戳服务，TSA_SERVE_LOCAL=1 时同时通过 /api/tsa 对外提供
+// 设置 TSA_URL 后使用外部服务，例如:
+// TSA_URL=https://freetsa.org/tsr TSA_CERT_FILE=./keys/freetsa_cacert.pem
+func LoadTimestampConfigFromEnv() {
+	url := os.Getenv("TSA_URL")
+	if url == "" && os.Getenv("TSA_ENABLED") == "" {
+		return
+	}
+
+	GlobalTimestampConfig.Enabled = true
+	GlobalTimestampConfig.URL = url
+	GlobalTimestampConfig.ServeLocal = url == "" && os.Getenv("TSA_SERVE_LOCAL") == "1"
+	if certFile := os.Getenv("TSA_CERT_FILE"); certFile != "" {
+		GlobalTimestampConfig.CertFile = certFile
+	}
+	if interval, err := time.ParseDuration(os.Getenv("TSA_INTERVAL")); err == nil && interval > 0 {
+		GlobalTimestampConfig.Interval = interval
+	}
+	if window, err := time.ParseDuration(os.Getenv("TSA_WINDOW")); err == nil && window > 0 {
+		GlobalTimestampConfig.Window = window
+	}
+}
@@ -0,0 +1,40 @@
+package configs
+
+import "testing"
+
+func TestLoadTimestampConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		enabled    bool
+		url        string
+		serveLocal bool
+	}{
+		{name: "未配置"},
+		{name: "本地时间戳服务", env: map[string]string{"TSA_ENABLED": "1"}, enabled: true},
+		{name: "对外提供本地时间戳服务", env: map[string]string{"TSA_ENABLED": "1", "TSA_SERVE_LOCAL": "1"}, enabled: true, serveLocal: true},
+		{
+			// 使用外部服务时不提供本地时间戳服务
+			name:    "外部时间戳服务",
+			env:     map[string]string{"TSA_URL": "https://tsa.example.com", "TSA_SERVE_LOCAL": "1"},
+			enabled: true,
+			url:     "https://tsa.example.com",
+		},
+		{name: "未启用时忽略", env: map[string]string{"TSA_SERVE_LOCAL": "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"TSA_ENABLED", "TSA_URL", "TSA_SERVE_LOCAL", "TSA_CERT_FILE", "TSA_INTERVAL"} {
+				t.Setenv(name, tt.env[name])
+			}
+			saved := GlobalTimestampConfig
+			defer func() { GlobalTimestampConfig = saved }()
+
+			LoadTimestampConfigFromEnv()
+			cfg := GlobalTimestampConfig
+			if cfg.Enabled != tt.enabled || cfg.URL != tt.url || cfg.ServeLocal != tt.serveLocal {
+				t.Fatalf("配置 %+v", cfg)
+			}
+		})
+	}
+}
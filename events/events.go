@@ -0,0 +1,197 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// 事件类型
+const (
+	TypeProductCreated         = "ProductCreated"
+	TypeLogisticsUpdated       = "LogisticsUpdated"
+	TypeCustodyTransferred     = "CustodyTransferred"
+	TypeTelemetryBatchRecorded = "TelemetryBatchRecorded"
+	TypeTemperatureExcursion   = "TemperatureExcursion"
+	TypeKeyRotated             = "KeyRotated"
+	TypeTemperatureProfileSet  = "TemperatureProfileSet"
+)
+
+// 区块记录类型，对应 BlockchainLog.RecordType
+const (
+	RecordProductCreated         = 1
+	RecordLogisticsUpdated       = 2
+	RecordCustodyTransferred     = 3
+	RecordTelemetryBatchRecorded = 4
+	RecordTemperatureExcursion   = 5
+	RecordKeyRotated             = 6
+	RecordTemperatureProfileSet  = 7
+)
+
+var (
+	// ErrUnknownEvent 未注册的事件类型或版本
+	ErrUnknownEvent = errors.New("未知的事件类型")
+	// ErrNotEnvelope 区块数据不是事件信封，一般是旧版直接序列化数据库模型的记录
+	ErrNotEnvelope = errors.New("区块数据不是事件格式")
+)
+
+// Event 写入账本的业务事件，事件内容一经发布不随数据库表结构变化
+type Event interface {
+	// EventType 事件类型名称
+	EventType() string
+	// EventVersion 事件结构版本，字段有不兼容变化时递增
+	EventVersion() int
+	// RecordType 对应的区块记录类型
+	RecordType() int
+	// Validate 写入前校验事件内容
+	Validate() error
+}
+
+// Envelope 区块中保存的事件信封
+type Envelope struct {
+	Type    string          `json:"type"`
+	Version int             `json:"version"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Record 解码后的事件，用于接口返回
+type Record struct {
+	Type    string `json:"type"`
+	Version int    `json:"version"`
+	Payload Event  `json:"payload"`
+}
+
+// 事件类型和版本对应的构造函数
+var registry = map[string]map[int]func() Event{
+	TypeProductCreated: {
+		1: func() Event { return &ProductCreatedV1{} },
+		2: func() Event { return &ProductCreated{} },
+	},
+	TypeLogisticsUpdated: {
+		1: func() Event { return &LogisticsUpdatedV1{} },
+		2: func() Event { return &LogisticsUpdated{} },
+	},
+	TypeCustodyTransferred:     {1: func() Event { return &CustodyTransferred{} }},
+	TypeTelemetryBatchRecorded: {1: func() Event { return &TelemetryBatchRecorded{} }},
+	TypeTemperatureExcursion: {
+		1: func() Event { return &TemperatureExcursionV1{} },
+		2: func() Event { return &TemperatureExcursion{} },
+	},
+	TypeKeyRotated:            {1: func() Event { return &KeyRotated{} }},
+	TypeTemperatureProfileSet: {1: func() Event { return &TemperatureProfileSet{} }},
+}
+
+// Upgrader 旧版本的事件，可以转换为下一个版本
+type Upgrader interface {
+	Upgrade() Event
+}
+
+// Latest 把旧版本的事件逐版转换为当前版本，按事件内容处理业务时使用
+// 区块中保存的版本不变，展示和验签仍使用解码出的原始版本
+func Latest(e Event) Event {
+	for {
+		old, ok := e.(Upgrader)
+		if !ok {
+			return e
+		}
+		e = old.Upgrade()
+	}
+}
+
+// LatestVersion 内置事件类型的当前版本，不是内置事件时返回0
+func LatestVersion(name string) int {
+	latest := 0
+	for version := range registry[name] {
+		if version > latest {
+			latest = version
+		}
+	}
+	return latest
+}
+
+// IsBuiltin 判断是否为内置事件类型，内置事件由各业务接口写入
+func IsBuiltin(name string) bool {
+	_, ok := registry[name]
+	return ok
+}
+
+// Marshal 校验事件并编码为规范JSON
+func Marshal(e Event) ([]byte, error) {
+	if err := e.Validate(); err != nil {
+		return nil, fmt.Errorf("%s 事件校验失败: %w", e.EventType(), err)
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(Envelope{Type: e.EventType(), Version: e.EventVersion(), Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+	return Canonical(data)
+}
+
+// Unmarshal 解码事件信封，不允许出现未定义的字段
+func Unmarshal(data []byte) (Event, error) {
+	if !IsEnvelope(data) {
+		return nil, ErrNotEnvelope
+	}
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+
+	versions, builtin := registry[env.Type]
+	if !builtin {
+		// 通过事件类型注册表定义的事件，内容由注册表中的JSON Schema约束
+		return &Custom{Name: env.Type, Version: env.Version, Data: env.Payload}, nil
+	}
+	factory, ok := versions[env.Version]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s v%d", ErrUnknownEvent, env.Type, env.Version)
+	}
+	e := factory()
+	decoder := json.NewDecoder(bytes.NewReader(env.Payload))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// IsEnvelope 判断区块数据是否为事件信封
+func IsEnvelope(data []byte) bool {
+	var probe struct {
+		Type    string          `json:"type"`
+		Version int             `json:"version"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return false
+	}
+	return probe.Type != "" && probe.Version > 0 && len(probe.Payload) > 0
+}
+
+// Canonical 把JSON转换为规范形式：对象键按字典序排列、无多余空白、数字保持原样
+func Canonical(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// NewRecord 构造接口返回的事件
+func NewRecord(e Event) Record {
+	return Record{Type: e.EventType(), Version: e.EventVersion(), Payload: e}
+}
@@ -0,0 +1,329 @@
+package events
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testProductCreated() *ProductCreated {
+	return &ProductCreated{
+		ProductID:      1,
+		SKU:            "SKU-1",
+		Name:           "牛奶",
+		BatchNumber:    "B1",
+		ManufacturerID: 2,
+		ProductionDate: "2026-01-01",
+		ExpirationDate: "2026-01-31",
+		TransportTemp:  4,
+		ImageURL:       "/uploads/a.jpg",
+		ApprovedBy:     3,
+	}
+}
+
+func testLogisticsUpdated() *LogisticsUpdated {
+	return &LogisticsUpdated{
+		RecordID:          1,
+		ProductSKU:        "SKU-1",
+		TrackingNo:        "T1",
+		WarehouseLocation: "一号仓",
+		Temperature:       4,
+		Humidity:          60,
+		OperatorID:        2,
+		OperatorType:      1,
+	}
+}
+
+func testExcursion(phase string, endedAt int64, breach bool) *TemperatureExcursion {
+	return &TemperatureExcursion{
+		IncidentID: 1, ProductSKU: "SKU-1", Phase: phase, Source: ExcursionSourceLogistics,
+		Metric: ExcursionMetricTemperature, Direction: "high", StartedAt: 2, EndedAt: endedAt,
+		PeakValue: 12, LimitMax: 8, ReadingCount: 1, Breach: breach,
+	}
+}
+
+// 温湿度要求事件，限制湿度上限
+func testProfileSet() *TemperatureProfileSet {
+	humidity := 80.0
+	return &TemperatureProfileSet{ProductSKU: "SKU-1", Version: 2, MinTemperature: 2, MaxTemperature: 8, AllowedSeconds: 600, MaxHumidity: &humidity, SetBy: 1}
+}
+
+// 轮换密钥事件，吊销密钥1并启用密钥2
+func testKeyRotated() *KeyRotated {
+	return &KeyRotated{UserID: 1, KeyID: 2, Algorithm: "ed25519", PublicKey: strings.Repeat("ab", 32), ValidFrom: 10, RevokedKeyID: 1, RevokedAt: 10}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	tests := []Event{
+		testProductCreated(),
+		testLogisticsUpdated(),
+		&CustodyTransferred{TransferID: 1, ProductSKU: "SKU-1", FromUserID: 1, ToUserID: 2, Remarks: "交接"},
+		&TelemetryBatchRecorded{
+			BatchID: 1, ProductSKU: "SKU-1", DeviceSerial: "D1", ReadingCount: 2,
+			FirstAt: 1, LastAt: 2, MinTemperature: 3, MaxTemperature: 5, BatchSHA256: strings.Repeat("ab", 32),
+		},
+		&TemperatureExcursion{
+			IncidentID: 1, ProductSKU: "SKU-1", Phase: ExcursionPhaseClosed, Source: ExcursionSourceTelemetry, DeviceSerial: "D1",
+			Metric: ExcursionMetricTemperature, Direction: "high", StartedAt: 1, EndedAt: 2,
+			PeakValue: 12, LimitMax: 8, ReadingCount: 3, Breach: true, ProfileVersion: 2,
+		},
+		testKeyRotated(),
+		testProfileSet(),
+	}
+
+	for _, event := range tests {
+		t.Run(event.EventType(), func(t *testing.T) {
+			data, err := Marshal(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !IsEnvelope(data) {
+				t.Fatalf("编码结果不是事件信封: %s", data)
+			}
+			// 编码结果已经是规范形式
+			canonical, err := Canonical(data)
+			if err != nil || string(canonical) != string(data) {
+				t.Fatalf("编码结果不是规范JSON: %s", data)
+			}
+
+			decoded, err := Unmarshal(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, event) {
+				t.Fatalf("解码结果 %+v，期望 %+v", decoded, event)
+			}
+		})
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr error
+		custom  bool
+	}{
+		{
+			name: "内置事件",
+			data: `{"payload":{"from_user_id":1,"product_sku":"S","remarks":"","to_user_id":2,"transfer_id":1},"type":"CustodyTransferred","version":1}`,
+		},
+		{
+			name:    "不是事件信封",
+			data:    `{"ID":1,"ProductSKU":"S"}`,
+			wantErr: ErrNotEnvelope,
+		},
+		{
+			name:    "未注册的版本",
+			data:    `{"payload":{"transfer_id":1},"type":"CustodyTransferred","version":99}`,
+			wantErr: ErrUnknownEvent,
+		},
+		{
+			name:    "未定义的字段",
+			data:    `{"payload":{"transfer_id":1,"extra":true},"type":"CustodyTransferred","version":1}`,
+			wantErr: errors.New("unknown field"),
+		},
+		{
+			// 注册表定义的事件原样保留内容
+			name:   "注册表事件",
+			data:   `{"payload":{"a":1},"type":"ColdRoomCleaned","version":2}`,
+			custom: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := Unmarshal([]byte(tt.data))
+			if tt.wantErr != nil {
+				if err == nil || (!errors.Is(err, tt.wantErr) && !strings.Contains(err.Error(), tt.wantErr.Error())) {
+					t.Fatalf("错误 %v，期望 %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			custom, ok := event.(*Custom)
+			if ok != tt.custom {
+				t.Fatalf("解码为 %T", event)
+			}
+			if ok && (custom.Name != "ColdRoomCleaned" || custom.Version != 2 || string(custom.Data) != `{"a":1}`) {
+				t.Fatalf("注册表事件 %+v", custom)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		event Event
+		valid bool
+	}{
+		{name: "完整的产品事件", event: testProductCreated(), valid: true},
+		{name: "缺少审核人", event: func() Event { e := testProductCreated(); e.ApprovedBy = 0; return e }()},
+		{name: "日期格式错误", event: func() Event { e := testProductCreated(); e.ProductionDate = "2026/01/01"; return e }()},
+		{name: "保质期早于生产日期", event: func() Event { e := testProductCreated(); e.ExpirationDate = "2025-12-31"; return e }()},
+		{name: "图片摘要格式错误", event: func() Event { e := testProductCreated(); e.ImageSHA256 = "abc"; return e }()},
+		{
+			name:  "图片摘要正确",
+			event: func() Event { e := testProductCreated(); e.ImageSHA256 = strings.Repeat("0f", 32); return e }(),
+			valid: true,
+		},
+		{name: "完整的物流事件", event: testLogisticsUpdated(), valid: true},
+		{name: "温度超出范围", event: func() Event { e := testLogisticsUpdated(); e.Temperature = 120; return e }()},
+		{name: "湿度超出范围", event: func() Event { e := testLogisticsUpdated(); e.Humidity = -1; return e }()},
+		{name: "未知的操作人类型", event: func() Event { e := testLogisticsUpdated(); e.OperatorType = 3; return e }()},
+		{name: "有摘要没有图片", event: func() Event { e := testLogisticsUpdated(); e.ImageSHA256 = strings.Repeat("0f", 32); return e }()},
+		{name: "交接给自己", event: &CustodyTransferred{TransferID: 1, ProductSKU: "S", FromUserID: 1, ToUserID: 1}},
+		{name: "批次摘要格式错误", event: &TelemetryBatchRecorded{BatchID: 1, ProductSKU: "S", DeviceSerial: "D", ReadingCount: 1, BatchSHA256: "x"}},
+		{
+			name: "设备超温缺少设备编号",
+			event: &TemperatureExcursion{
+				IncidentID: 1, ProductSKU: "S", Phase: ExcursionPhaseOpened, Source: ExcursionSourceTelemetry,
+				Metric: ExcursionMetricTemperature, Direction: "high", ReadingCount: 1,
+			},
+		},
+		{name: "超温开始", event: testExcursion(ExcursionPhaseOpened, 0, false), valid: true},
+		{name: "轮换密钥", event: testKeyRotated(), valid: true},
+		{name: "首次登记密钥", event: func() Event { e := testKeyRotated(); e.RevokedKeyID, e.RevokedAt = 0, 0; return e }(), valid: true},
+		{name: "登记服务端密钥", event: func() Event { e := testKeyRotated(); e.UserID = 0; return e }(), valid: true},
+		{name: "缺少密钥ID", event: func() Event { e := testKeyRotated(); e.KeyID = 0; return e }()},
+		{name: "公钥长度错误", event: func() Event { e := testKeyRotated(); e.PublicKey = "ab"; return e }()},
+		{name: "吊销的是新密钥本身", event: func() Event { e := testKeyRotated(); e.RevokedKeyID = 2; return e }()},
+		{name: "吊销晚于新密钥生效", event: func() Event { e := testKeyRotated(); e.RevokedAt = 11; return e }()},
+		{name: "超温开始时已有结束时间", event: testExcursion(ExcursionPhaseOpened, 5, false)},
+		{name: "超出允许时长", event: testExcursion(ExcursionPhaseBreached, 0, true), valid: true},
+		{name: "超出允许时长缺少超时标记", event: testExcursion(ExcursionPhaseBreached, 0, false)},
+		{name: "超温结束", event: testExcursion(ExcursionPhaseClosed, 5, false), valid: true},
+		{name: "结束时间早于开始时间", event: testExcursion(ExcursionPhaseClosed, 1, false)},
+		{name: "缺少阶段", event: testExcursion("", 5, false)},
+		{name: "撤销未结束的超温", event: testExcursion(ExcursionPhaseRetracted, 0, true), valid: true},
+		{name: "撤销的超温结束时间早于开始时间", event: testExcursion(ExcursionPhaseRetracted, 1, false)},
+		{name: "温湿度要求", event: testProfileSet(), valid: true},
+		{name: "温湿度要求缺少版本", event: func() Event { e := testProfileSet(); e.Version = 0; return e }()},
+		{name: "温度下限高于上限", event: func() Event { e := testProfileSet(); e.MinTemperature = 9; return e }()},
+		{name: "湿度下限高于上限", event: func() Event { e := testProfileSet(); h := 90.0; e.MinHumidity = &h; return e }()},
+		{name: "注册表事件内容不是对象", event: &Custom{Name: "X", Version: 1, Data: []byte(`[1]`)}},
+		{name: "注册表事件", event: &Custom{Name: "X", Version: 1, Data: []byte(`{"a":1}`)}, valid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.event.Validate()
+			if (err == nil) != tt.valid {
+				t.Fatalf("校验结果 %v", err)
+			}
+			// 校验失败的事件不能编码
+			if _, err := Marshal(tt.event); (err == nil) != tt.valid {
+				t.Fatalf("编码结果 %v", err)
+			}
+		})
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "键排序", in: `{"b":1,"a":{"d":2,"c":3}}`, want: `{"a":{"c":3,"d":2},"b":1}`},
+		{name: "去掉空白", in: "{ \"a\" : [ 1, 2 ] }\n", want: `{"a":[1,2]}`},
+		{name: "数字保持原样", in: `{"a":1.50,"b":12345678901234567890}`, want: `{"a":1.50,"b":12345678901234567890}`},
+		{name: "不转义HTML", in: `{"a":"<b>&"}`, want: `{"a":"<b>&"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Canonical([]byte(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("规范形式 %s，期望 %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventVersions(t *testing.T) {
+	productV1 := `{"payload":{"approved_by":3,"batch_number":"B1","brand":"","expiration_date":"2026-01-31","image_url":"/uploads/a.jpg","manufacturer_id":2,"material_source":"","name":"牛奶","process_location":"","process_method":"","product_id":1,"production_date":"2026-01-01","quality_rating":"","safety_testing":"","sku":"SKU-1","specification":"","storage_condition":"","transport_temp":4},"type":"ProductCreated","version":1}`
+	logisticsV1 := `{"payload":{"humidity":60,"image_url":"","operator_id":2,"operator_type":1,"product_sku":"SKU-1","record_id":1,"temperature":4,"tracking_no":"T1","warehouse_location":"一号仓"},"type":"LogisticsUpdated","version":1}`
+	excursionV1 := `{"payload":{"allowed_seconds":0,"breach":false,"direction":"high","ended_at":5,"incident_id":1,"limit_max":8,"limit_min":0,"metric":"temperature","peak_value":12,"product_sku":"SKU-1","reading_count":1,"source":"logistics","started_at":2},"type":"TemperatureExcursion","version":1}`
+
+	tests := []struct {
+		name    string
+		data    string
+		version int
+		latest  Event
+		wantErr bool
+	}{
+		{name: "第1版产品事件", data: productV1, version: 1, latest: testProductCreated()},
+		{name: "第1版物流事件", data: logisticsV1, version: 1, latest: testLogisticsUpdated()},
+		// 第1版超温事件都在超温结束时写入
+		{name: "第1版超温事件", data: excursionV1, version: 1, latest: testExcursion(ExcursionPhaseClosed, 5, false)},
+		{
+			// 第1版的结构不变，出现图片摘要仍按未定义字段拒绝
+			name:    "第1版产品事件带图片摘要",
+			data:    strings.Replace(productV1, `"image_url"`, `"image_sha256":"`+strings.Repeat("0f", 32)+`","image_url"`, 1),
+			wantErr: true,
+		},
+		{
+			name: "第2版产品事件",
+			data: func() string {
+				e := testProductCreated()
+				e.ImageSHA256 = strings.Repeat("0f", 32)
+				data, _ := Marshal(e)
+				return string(data)
+			}(),
+			version: 2,
+			latest: func() Event {
+				e := testProductCreated()
+				e.ImageSHA256 = strings.Repeat("0f", 32)
+				return e
+			}(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := Unmarshal([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("应返回错误，解码为 %+v", event)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.EventVersion() != tt.version {
+				t.Fatalf("解码版本 %d，期望 %d", event.EventVersion(), tt.version)
+			}
+			if err := event.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if latest := Latest(event); !reflect.DeepEqual(latest, tt.latest) {
+				t.Fatalf("转换为当前版本 %+v，期望 %+v", latest, tt.latest)
+			}
+
+			// 旧版本事件重新编码后与区块中的数据一致，签名和哈希仍可复现
+			data, err := Marshal(event)
+			if err != nil || string(data) != tt.data {
+				t.Fatalf("重新编码 %s %v", data, err)
+			}
+		})
+	}
+
+	// 新写入的事件使用当前版本
+	for name, want := range map[string]int{TypeProductCreated: 2, TypeLogisticsUpdated: 2, TypeCustodyTransferred: 1, TypeTemperatureExcursion: 2, TypeTemperatureProfileSet: 1, "ColdRoomCleaned": 0} {
+		if got := LatestVersion(name); got != want {
+			t.Fatalf("%s 的当前版本 %d，期望 %d", name, got, want)
+		}
+	}
+	if testProductCreated().EventVersion() != LatestVersion(TypeProductCreated) || testLogisticsUpdated().EventVersion() != LatestVersion(TypeLogisticsUpdated) {
+		t.Fatal("新写入的事件没有使用当前版本")
+	}
+}
@@ -0,0 +1,523 @@
+package events
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// 日期字段格式
+const DateLayout = "2006-01-02"
+
+// 温湿度的合理范围，超出范围的数据视为录入错误
+const (
+	minTemperature = -100
+	maxTemperature = 100
+	minHumidity    = 0
+	maxHumidity    = 100
+)
+
+// 校验文件摘要，有摘要时必须同时有文件地址
+func validateDigest(url, digest string) error {
+	if digest == "" {
+		return nil
+	}
+	if url == "" {
+		return errors.New("文件摘要缺少对应的文件地址")
+	}
+	if len(digest) != 64 {
+		return errors.New("文件摘要格式错误")
+	}
+	if _, err := hex.DecodeString(digest); err != nil {
+		return errors.New("文件摘要格式错误")
+	}
+	return nil
+}
+
+// ProductCreated 产品审核通过并上链，第2版增加了图片摘要
+type ProductCreated struct {
+	ProductID        uint    `json:"product_id"`
+	SKU              string  `json:"sku"`
+	Name             string  `json:"name"`
+	Brand            string  `json:"brand"`
+	Specification    string  `json:"specification"`
+	ProductionDate   string  `json:"production_date"` // 格式: 2006-01-02
+	ExpirationDate   string  `json:"expiration_date"` // 格式: 2006-01-02
+	BatchNumber      string  `json:"batch_number"`
+	ManufacturerID   uint    `json:"manufacturer_id"`
+	MaterialSource   string  `json:"material_source"`
+	ProcessLocation  string  `json:"process_location"`
+	ProcessMethod    string  `json:"process_method"`
+	TransportTemp    float64 `json:"transport_temp"`
+	StorageCondition string  `json:"storage_condition"`
+	SafetyTesting    string  `json:"safety_testing"`
+	QualityRating    string  `json:"quality_rating"`
+	ImageURL         string  `json:"image_url"`
+	ImageSHA256      string  `json:"image_sha256"` // 图片内容的SHA-256，第2版新增
+	ApprovedBy       uint    `json:"approved_by"`
+}
+
+func (e *ProductCreated) EventType() string { return TypeProductCreated }
+func (e *ProductCreated) EventVersion() int { return 2 }
+func (e *ProductCreated) RecordType() int   { return RecordProductCreated }
+
+// Validate 校验产品事件
+func (e *ProductCreated) Validate() error {
+	if e.ProductID == 0 || e.SKU == "" || e.Name == "" || e.BatchNumber == "" {
+		return errors.New("产品ID、SKU、名称和批次号不能为空")
+	}
+	if e.ManufacturerID == 0 || e.ApprovedBy == 0 {
+		return errors.New("生产商和审核人不能为空")
+	}
+	production, err := time.Parse(DateLayout, e.ProductionDate)
+	if err != nil {
+		return errors.New("生产日期格式错误")
+	}
+	expiration, err := time.Parse(DateLayout, e.ExpirationDate)
+	if err != nil {
+		return errors.New("保质期格式错误")
+	}
+	if expiration.Before(production) {
+		return errors.New("保质期早于生产日期")
+	}
+	if e.TransportTemp < minTemperature || e.TransportTemp > maxTemperature {
+		return errors.New("运输温度超出合理范围")
+	}
+	return validateDigest(e.ImageURL, e.ImageSHA256)
+}
+
+// LogisticsUpdated 物流节点记录，第2版增加了图片摘要
+type LogisticsUpdated struct {
+	RecordID          uint    `json:"record_id"`
+	ProductSKU        string  `json:"product_sku"`
+	TrackingNo        string  `json:"tracking_no"`
+	WarehouseLocation string  `json:"warehouse_location"`
+	Temperature       float64 `json:"temperature"`
+	Humidity          float64 `json:"humidity"`
+	ImageURL          string  `json:"image_url"`
+	ImageSHA256       string  `json:"image_sha256"` // 图片内容的SHA-256，第2版新增
+	OperatorID        uint    `json:"operator_id"`
+	OperatorType      int     `json:"operator_type"` // 1: 厂家, 2: 经销商
+}
+
+func (e *LogisticsUpdated) EventType() string { return TypeLogisticsUpdated }
+func (e *LogisticsUpdated) EventVersion() int { return 2 }
+func (e *LogisticsUpdated) RecordType() int   { return RecordLogisticsUpdated }
+
+// Validate 校验物流事件
+func (e *LogisticsUpdated) Validate() error {
+	if e.RecordID == 0 || e.ProductSKU == "" || e.TrackingNo == "" || e.WarehouseLocation == "" {
+		return errors.New("记录ID、SKU、物流单号和仓库位置不能为空")
+	}
+	if e.OperatorID == 0 || (e.OperatorType != 1 && e.OperatorType != 2) {
+		return errors.New("操作人信息错误")
+	}
+	if e.Temperature < minTemperature || e.Temperature > maxTemperature {
+		return errors.New("温度超出合理范围")
+	}
+	if e.Humidity < minHumidity || e.Humidity > maxHumidity {
+		return errors.New("湿度超出合理范围")
+	}
+	return validateDigest(e.ImageURL, e.ImageSHA256)
+}
+
+// ProductCreatedV1 第1版产品事件，没有图片摘要，只用于解码已写入账本的旧事件
+type ProductCreatedV1 struct {
+	ProductID        uint    `json:"product_id"`
+	SKU              string  `json:"sku"`
+	Name             string  `json:"name"`
+	Brand            string  `json:"brand"`
+	Specification    string  `json:"specification"`
+	ProductionDate   string  `json:"production_date"`
+	ExpirationDate   string  `json:"expiration_date"`
+	BatchNumber      string  `json:"batch_number"`
+	ManufacturerID   uint    `json:"manufacturer_id"`
+	MaterialSource   string  `json:"material_source"`
+	ProcessLocation  string  `json:"process_location"`
+	ProcessMethod    string  `json:"process_method"`
+	TransportTemp    float64 `json:"transport_temp"`
+	StorageCondition string  `json:"storage_condition"`
+	SafetyTesting    string  `json:"safety_testing"`
+	QualityRating    string  `json:"quality_rating"`
+	ImageURL         string  `json:"image_url"`
+	ApprovedBy       uint    `json:"approved_by"`
+}
+
+func (e *ProductCreatedV1) EventType() string { return TypeProductCreated }
+func (e *ProductCreatedV1) EventVersion() int { return 1 }
+func (e *ProductCreatedV1) RecordType() int   { return RecordProductCreated }
+
+// Validate 校验第1版产品事件
+func (e *ProductCreatedV1) Validate() error {
+	return e.Upgrade().Validate()
+}
+
+// Upgrade 转换为当前版本，图片摘要为空
+func (e *ProductCreatedV1) Upgrade() Event {
+	return &ProductCreated{
+		ProductID:        e.ProductID,
+		SKU:              e.SKU,
+		Name:             e.Name,
+		Brand:            e.Brand,
+		Specification:    e.Specification,
+		ProductionDate:   e.ProductionDate,
+		ExpirationDate:   e.ExpirationDate,
+		BatchNumber:      e.BatchNumber,
+		ManufacturerID:   e.ManufacturerID,
+		MaterialSource:   e.MaterialSource,
+		ProcessLocation:  e.ProcessLocation,
+		ProcessMethod:    e.ProcessMethod,
+		TransportTemp:    e.TransportTemp,
+		StorageCondition: e.StorageCondition,
+		SafetyTesting:    e.SafetyTesting,
+		QualityRating:    e.QualityRating,
+		ImageURL:         e.ImageURL,
+		ApprovedBy:       e.ApprovedBy,
+	}
+}
+
+// LogisticsUpdatedV1 第1版物流事件，没有图片摘要，只用于解码已写入账本的旧事件
+type LogisticsUpdatedV1 struct {
+	RecordID          uint    `json:"record_id"`
+	ProductSKU        string  `json:"product_sku"`
+	TrackingNo        string  `json:"tracking_no"`
+	WarehouseLocation string  `json:"warehouse_location"`
+	Temperature       float64 `json:"temperature"`
+	Humidity          float64 `json:"humidity"`
+	ImageURL          string  `json:"image_url"`
+	OperatorID        uint    `json:"operator_id"`
+	OperatorType      int     `json:"operator_type"`
+}
+
+func (e *LogisticsUpdatedV1) EventType() string { return TypeLogisticsUpdated }
+func (e *LogisticsUpdatedV1) EventVersion() int { return 1 }
+func (e *LogisticsUpdatedV1) RecordType() int   { return RecordLogisticsUpdated }
+
+// Validate 校验第1版物流事件
+func (e *LogisticsUpdatedV1) Validate() error {
+	return e.Upgrade().Validate()
+}
+
+// Upgrade 转换为当前版本，图片摘要为空
+func (e *LogisticsUpdatedV1) Upgrade() Event {
+	return &LogisticsUpdated{
+		RecordID:          e.RecordID,
+		ProductSKU:        e.ProductSKU,
+		TrackingNo:        e.TrackingNo,
+		WarehouseLocation: e.WarehouseLocation,
+		Temperature:       e.Temperature,
+		Humidity:          e.Humidity,
+		ImageURL:          e.ImageURL,
+		OperatorID:        e.OperatorID,
+		OperatorType:      e.OperatorType,
+	}
+}
+
+// CustodyTransferred 产品交接给下一个持有人
+type CustodyTransferred struct {
+	TransferID uint   `json:"transfer_id"`
+	ProductSKU string `json:"product_sku"`
+	FromUserID uint   `json:"from_user_id"`
+	ToUserID   uint   `json:"to_user_id"`
+	Remarks    string `json:"remarks"`
+}
+
+func (e *CustodyTransferred) EventType() string { return TypeCustodyTransferred }
+func (e *CustodyTransferred) EventVersion() int { return 1 }
+func (e *CustodyTransferred) RecordType() int   { return RecordCustodyTransferred }
+
+// Validate 校验交接事件
+func (e *CustodyTransferred) Validate() error {
+	if e.TransferID == 0 || e.ProductSKU == "" {
+		return errors.New("交接记录ID和SKU不能为空")
+	}
+	if e.FromUserID == 0 || e.ToUserID == 0 {
+		return errors.New("交接双方不能为空")
+	}
+	if e.FromUserID == e.ToUserID {
+		return errors.New("不能交接给自己")
+	}
+	return nil
+}
+
+// TelemetryBatchRecorded 设备上报的一批温湿度读数，读数本身保存在遥测存储中，账本只记录批次摘要
+type TelemetryBatchRecorded struct {
+	BatchID        uint    `json:"batch_id"`
+	ProductSKU     string  `json:"product_sku"`
+	DeviceSerial   string  `json:"device_serial"`
+	ReadingCount   int     `json:"reading_count"`
+	FirstAt        int64   `json:"first_at"` // Unix纳秒
+	LastAt         int64   `json:"last_at"`  // Unix纳秒
+	MinTemperature float64 `json:"min_temperature"`
+	MaxTemperature float64 `json:"max_temperature"`
+	BatchSHA256    string  `json:"batch_sha256"` // 批次中全部读数的SHA-256
+}
+
+func (e *TelemetryBatchRecorded) EventType() string { return TypeTelemetryBatchRecorded }
+func (e *TelemetryBatchRecorded) EventVersion() int { return 1 }
+func (e *TelemetryBatchRecorded) RecordType() int   { return RecordTelemetryBatchRecorded }
+
+// Validate 校验读数批次事件
+func (e *TelemetryBatchRecorded) Validate() error {
+	if e.BatchID == 0 || e.ProductSKU == "" || e.DeviceSerial == "" {
+		return errors.New("批次ID、SKU和设备编号不能为空")
+	}
+	if e.ReadingCount <= 0 || e.FirstAt > e.LastAt {
+		return errors.New("读数数量或时间范围错误")
+	}
+	if e.MinTemperature > e.MaxTemperature || e.MinTemperature < minTemperature || e.MaxTemperature > maxTemperature {
+		return errors.New("温度超出合理范围")
+	}
+	if _, err := hex.DecodeString(e.BatchSHA256); err != nil || len(e.BatchSHA256) != 64 {
+		return errors.New("批次摘要格式错误")
+	}
+	return nil
+}
+
+// 超温事件的数据来源和指标
+const (
+	ExcursionSourceLogistics = "logistics"
+	ExcursionSourceTelemetry = "telemetry"
+
+	ExcursionMetricTemperature = "temperature"
+	ExcursionMetricHumidity    = "humidity"
+)
+
+// 超温事件在超温过程中的阶段
+const (
+	ExcursionPhaseOpened    = "opened"    // 第一条超出范围的读数
+	ExcursionPhaseBreached  = "breached"  // 持续时长第一次超过允许时长
+	ExcursionPhaseClosed    = "closed"    // 恢复到范围内，迟到的读数重新判断后会再次写入修正后的结果
+	ExcursionPhaseRetracted = "retracted" // 迟到的读数重新判断后该超温不再存在，之前写入的阶段作废
+)
+
+// TemperatureExcursion 一次温湿度超出产品要求范围的过程，开始、第一次超出允许时长和结束时各写入一次账本
+// 第2版增加了阶段，同一超温记录以最后写入的事件为准，最后是撤销事件时该超温不计入
+type TemperatureExcursion struct {
+	IncidentID     uint    `json:"incident_id"`
+	ProductSKU     string  `json:"product_sku"`
+	Phase          string  `json:"phase"`                   // opened, breached, closed
+	Source         string  `json:"source"`                  // logistics: 物流记录, telemetry: 设备读数
+	DeviceSerial   string  `json:"device_serial,omitempty"` // 设备读数的设备编号
+	Metric         string  `json:"metric"`                  // temperature, humidity
+	Direction      string  `json:"direction"`               // high, low
+	StartedAt      int64   `json:"started_at"`              // Unix纳秒
+	EndedAt        int64   `json:"ended_at"`                // Unix纳秒，未结束时为0
+	PeakValue      float64 `json:"peak_value"`
+	LimitMin       float64 `json:"limit_min"`
+	LimitMax       float64 `json:"limit_max"`
+	AllowedSeconds int64   `json:"allowed_seconds"`
+	ReadingCount   int     `json:"reading_count"`
+	Breach         bool    `json:"breach"`                    // 持续时长超过允许时长
+	ProfileVersion int     `json:"profile_version,omitempty"` // 判断时使用的温湿度要求版本，0 表示按运输温度推算
+}
+
+func (e *TemperatureExcursion) EventType() string { return TypeTemperatureExcursion }
+func (e *TemperatureExcursion) EventVersion() int { return 2 }
+func (e *TemperatureExcursion) RecordType() int   { return RecordTemperatureExcursion }
+
+// Validate 校验超温事件
+func (e *TemperatureExcursion) Validate() error {
+	if e.IncidentID == 0 || e.ProductSKU == "" {
+		return errors.New("超温记录ID和SKU不能为空")
+	}
+	switch e.Source {
+	case ExcursionSourceLogistics:
+	case ExcursionSourceTelemetry:
+		if e.DeviceSerial == "" {
+			return errors.New("设备读数的超温事件缺少设备编号")
+		}
+	default:
+		return errors.New("未知的数据来源")
+	}
+	if e.Metric != ExcursionMetricTemperature && e.Metric != ExcursionMetricHumidity {
+		return errors.New("未知的超温指标")
+	}
+	if e.Direction != "high" && e.Direction != "low" {
+		return errors.New("超温方向错误")
+	}
+	switch e.Phase {
+	case ExcursionPhaseOpened, ExcursionPhaseBreached:
+		if e.EndedAt != 0 {
+			return errors.New("未结束的超温不能有结束时间")
+		}
+	case ExcursionPhaseClosed:
+		if e.StartedAt > e.EndedAt {
+			return errors.New("读数数量或时间范围错误")
+		}
+	case ExcursionPhaseRetracted:
+		if e.EndedAt != 0 && e.StartedAt > e.EndedAt {
+			return errors.New("读数数量或时间范围错误")
+		}
+	default:
+		return errors.New("未知的超温阶段")
+	}
+	if e.Phase == ExcursionPhaseBreached && !e.Breach {
+		return errors.New("超出允许时长的事件缺少超时标记")
+	}
+	if e.ReadingCount <= 0 {
+		return errors.New("读数数量或时间范围错误")
+	}
+	if e.LimitMin > e.LimitMax || e.AllowedSeconds < 0 || e.ProfileVersion < 0 {
+		return errors.New("温湿度要求范围错误")
+	}
+	return nil
+}
+
+// TemperatureExcursionV1 第1版超温事件，只在超温结束时写入，没有阶段，只用于解码已写入账本的旧事件
+type TemperatureExcursionV1 struct {
+	IncidentID     uint    `json:"incident_id"`
+	ProductSKU     string  `json:"product_sku"`
+	Source         string  `json:"source"`
+	DeviceSerial   string  `json:"device_serial,omitempty"`
+	Metric         string  `json:"metric"`
+	Direction      string  `json:"direction"`
+	StartedAt      int64   `json:"started_at"`
+	EndedAt        int64   `json:"ended_at"`
+	PeakValue      float64 `json:"peak_value"`
+	LimitMin       float64 `json:"limit_min"`
+	LimitMax       float64 `json:"limit_max"`
+	AllowedSeconds int64   `json:"allowed_seconds"`
+	ReadingCount   int     `json:"reading_count"`
+	Breach         bool    `json:"breach"`
+}
+
+func (e *TemperatureExcursionV1) EventType() string { return TypeTemperatureExcursion }
+func (e *TemperatureExcursionV1) EventVersion() int { return 1 }
+func (e *TemperatureExcursionV1) RecordType() int   { return RecordTemperatureExcursion }
+
+// Validate 校验第1版超温事件
+func (e *TemperatureExcursionV1) Validate() error {
+	return e.Upgrade().Validate()
+}
+
+// Upgrade 转换为当前版本，第1版事件都是超温结束时写入的
+func (e *TemperatureExcursionV1) Upgrade() Event {
+	return &TemperatureExcursion{
+		IncidentID:     e.IncidentID,
+		ProductSKU:     e.ProductSKU,
+		Phase:          ExcursionPhaseClosed,
+		Source:         e.Source,
+		DeviceSerial:   e.DeviceSerial,
+		Metric:         e.Metric,
+		Direction:      e.Direction,
+		StartedAt:      e.StartedAt,
+		EndedAt:        e.EndedAt,
+		PeakValue:      e.PeakValue,
+		LimitMin:       e.LimitMin,
+		LimitMax:       e.LimitMax,
+		AllowedSeconds: e.AllowedSeconds,
+		ReadingCount:   e.ReadingCount,
+		Breach:         e.Breach,
+	}
+}
+
+// TemperatureProfileSet 厂家设置或修改产品的温湿度要求，每次修改版本加1
+// 超温记录带有判断时的版本，放宽要求的时间和内容都留在账本中
+type TemperatureProfileSet struct {
+	ProductSKU       string   `json:"product_sku"`
+	Version          int      `json:"version"`
+	MinTemperature   float64  `json:"min_temperature"`
+	MaxTemperature   float64  `json:"max_temperature"`
+	AllowedSeconds   int64    `json:"allowed_seconds"`
+	MinHumidity      *float64 `json:"min_humidity"` // 为空表示不限制
+	MaxHumidity      *float64 `json:"max_humidity"`
+	ActivationEnergy float64  `json:"activation_energy"` // kJ/mol，0 表示使用默认值
+	SetBy            uint     `json:"set_by"`
+}
+
+func (e *TemperatureProfileSet) EventType() string { return TypeTemperatureProfileSet }
+func (e *TemperatureProfileSet) EventVersion() int { return 1 }
+func (e *TemperatureProfileSet) RecordType() int   { return RecordTemperatureProfileSet }
+
+// Validate 校验温湿度要求事件
+func (e *TemperatureProfileSet) Validate() error {
+	if e.ProductSKU == "" || e.Version <= 0 || e.SetBy == 0 {
+		return errors.New("SKU、版本和设置人不能为空")
+	}
+	if e.MinTemperature > e.MaxTemperature || e.MinTemperature < minTemperature || e.MaxTemperature > maxTemperature {
+		return errors.New("温度范围错误")
+	}
+	if e.AllowedSeconds < 0 || e.ActivationEnergy < 0 {
+		return errors.New("允许超温时长或活化能错误")
+	}
+	for _, h := range []*float64{e.MinHumidity, e.MaxHumidity} {
+		if h != nil && (*h < minHumidity || *h > maxHumidity) {
+			return errors.New("湿度超出合理范围")
+		}
+	}
+	if e.MinHumidity != nil && e.MaxHumidity != nil && *e.MinHumidity > *e.MaxHumidity {
+		return errors.New("湿度范围错误")
+	}
+	return nil
+}
+
+// KeyRotated 用户签名密钥的登记或轮换，首次生成密钥时没有被吊销的旧密钥
+// 验证区块签名时以账本中登记的公钥和有效期为准，不信任数据库中的密钥表
+// UserID 为0时登记的是服务端签名密钥，验证检查点和快照时以此为准
+type KeyRotated struct {
+	UserID       uint   `json:"user_id"`
+	KeyID        uint   `json:"key_id"`
+	Algorithm    string `json:"algorithm"`
+	PublicKey    string `json:"public_key"`     // hex
+	ValidFrom    int64  `json:"valid_from"`     // Unix纳秒
+	RevokedKeyID uint   `json:"revoked_key_id"` // 同时吊销的旧密钥，没有时为0
+	RevokedAt    int64  `json:"revoked_at"`     // 旧密钥的吊销时间(Unix纳秒)
+}
+
+func (e *KeyRotated) EventType() string { return TypeKeyRotated }
+func (e *KeyRotated) EventVersion() int { return 1 }
+func (e *KeyRotated) RecordType() int   { return RecordKeyRotated }
+
+// Validate 校验密钥事件
+func (e *KeyRotated) Validate() error {
+	if e.KeyID == 0 || e.Algorithm == "" {
+		return errors.New("密钥ID和算法不能为空")
+	}
+	if _, err := hex.DecodeString(e.PublicKey); err != nil || len(e.PublicKey) != 64 {
+		return errors.New("公钥格式错误")
+	}
+	if e.ValidFrom <= 0 {
+		return errors.New("生效时间不能为空")
+	}
+	if e.RevokedKeyID != 0 && (e.RevokedKeyID == e.KeyID || e.RevokedAt <= 0 || e.RevokedAt > e.ValidFrom) {
+		return errors.New("吊销的旧密钥或吊销时间错误")
+	}
+	return nil
+}
+
+// Custom 通过事件类型注册表定义的事件，Data 为事件内容本身
+type Custom struct {
+	Name    string
+	Version int
+	Record  int // 注册表分配的区块记录类型
+	Data    json.RawMessage
+}
+
+func (e *Custom) EventType() string { return e.Name }
+func (e *Custom) EventVersion() int { return e.Version }
+func (e *Custom) RecordType() int   { return e.Record }
+
+// Validate 只检查内容是JSON对象，字段由注册表中的JSON Schema校验
+func (e *Custom) Validate() error {
+	if e.Name == "" || e.Version <= 0 {
+		return errors.New("事件类型和版本不能为空")
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(e.Data, &fields); err != nil || fields == nil {
+		return errors.New("事件内容必须是JSON对象")
+	}
+	return nil
+}
+
+// MarshalJSON 事件内容即为信封中的 payload
+func (e *Custom) MarshalJSON() ([]byte, error) {
+	return e.Data, nil
+}
+
+// UnmarshalJSON 保存原始事件内容
+func (e *Custom) UnmarshalJSON(data []byte) error {
+	e.Data = append(json.RawMessage(nil), data...)
+	return nil
+}
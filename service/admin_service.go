@@ -3,9 +3,9 @@ package service
 import (
 	"back_Blockchain_cold_chain_traceability_system/api"
 	"back_Blockchain_cold_chain_traceability_system/configs"
-	"encoding/json"
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 	"net/http"
 	"strconv"
 )
@@ -172,6 +172,8 @@ func (s *AdminService) AdminAuditUser(c *gin.Context) {
 
 // AdminAuditProduct 审核产品
 func (s *AdminService) AdminAuditProduct(c *gin.Context) {
+	adminID, _ := c.Get("userID")
+
 	var req api.AuditRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, api.Response{
@@ -191,26 +193,29 @@ func (s *AdminService) AdminAuditProduct(c *gin.Context) {
 		return
 	}
 
-	// 更新审核状态
+	// 更新审核状态，审核通过时在同一事务中记录到区块链
 	product.Status = req.Status
 	product.AuditRemark = req.Remark
-	result = configs.DB.Save(&product)
-
-	if result.Error != nil {
+	blockchainService := &BlockchainService{}
+	err := ledgerTransaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&product).Error; err != nil {
+			return err
+		}
+
+		if req.Status != 1 {
+			return nil
+		}
+		_, err := blockchainService.AddEventTx(tx, product.SKU, productCreatedEvent(product, adminID.(uint)), adminID.(uint))
+		return err
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, api.Response{
 			Code:    500,
-			Message: "更新产品审核状态失败: " + result.Error.Error(),
+			Message: "更新产品审核状态失败: " + err.Error(),
 		})
 		return
 	}
 
-	// 如果审核通过，记录到区块链
-	if req.Status == 1 {
-		blockchainService := &BlockchainService{}
-		productData, _ := json.Marshal(product)
-		blockchainService.AddToBlockchain(product.SKU, 1, string(productData))
-	}
-
 	c.JSON(http.StatusOK, api.Response{
 		Code:    200,
 		Message: "产品审核操作成功",
@@ -345,5 +350,19 @@ func SetupAdminRoutes(router *gin.Engine) {
 		adminGroup.POST("/product/audit", adminService.AdminAuditProduct)
 		adminGroup.POST("/user/add", adminService.AdminAddUser)
 		adminGroup.GET("/dashboard", adminService.AdminDashboard)
+		adminGroup.POST("/reconcile", adminService.AdminReconcile)
+		adminGroup.GET("/reconcile/runs", adminService.AdminReconcileRuns)
+		adminGroup.GET("/event-types", adminService.AdminListEventTypes)
+		adminGroup.POST("/event-types", adminService.AdminCreateEventType)
+		adminGroup.PUT("/event-types/:id", adminService.AdminUpdateEventType)
+		adminGroup.DELETE("/event-types/:id", adminService.AdminDeleteEventType)
+		adminGroup.POST("/anchor", adminService.AdminAnchorNow)
+		adminGroup.POST("/files/verify", adminService.AdminVerifyFiles)
+		adminGroup.POST("/snapshots", adminService.AdminCreateSnapshot)
+		adminGroup.POST("/snapshots/:id/archive", adminService.AdminArchiveSnapshot)
+		adminGroup.POST("/projections/rebuild", adminService.AdminRebuildProjections)
+		adminGroup.GET("/projections/drift", adminService.AdminProjectionDrift)
+		adminGroup.GET("/devices", adminService.AdminGetDevices)
+		adminGroup.GET("/excursions", adminService.AdminGetExcursions)
 	}
 }
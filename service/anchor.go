@@ -0,0 +1,633 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/api"
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 锚定状态
+const (
+	AnchorPending   = 0
+	AnchorConfirmed = 1
+	AnchorFailed    = 2
+)
+
+// 锚定交易data的前缀，便于在链上识别本系统的锚定交易
+var anchorMagic = []byte("CCTA")
+
+// AnchorHeader 锚定到外部链的账本状态
+type AnchorHeader struct {
+	GlobalHeight int64
+	GlobalHash   string
+	SealedHeight int64
+	SealedHash   string
+}
+
+// Encode 按固定字段顺序编码锚定头
+func (h AnchorHeader) Encode() []byte {
+	buf := make([]byte, 0, 160)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.GlobalHeight))
+	buf = appendString(buf, h.GlobalHash)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.SealedHeight))
+	buf = appendString(buf, h.SealedHash)
+	return buf
+}
+
+// Digest 锚定头的SHA-256
+func (h AnchorHeader) Digest() string {
+	sum := sha256.Sum256(h.Encode())
+	return hex.EncodeToString(sum[:])
+}
+
+// 锚定交易的data字段
+func anchorTxData(digest string) string {
+	return "0x" + hex.EncodeToString(anchorMagic) + digest
+}
+
+// 以太坊JSON-RPC客户端，只实现锚定用到的方法
+type evmClient struct {
+	url    string
+	client *http.Client
+	nextID int64
+}
+
+func newEVMClient(url string, timeout time.Duration) *evmClient {
+	return &evmClient{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+type rpcRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      int64         `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (c *evmClient) call(ctx context.Context, method string, params []interface{}, result interface{}) error {
+	body, err := json.Marshal(rpcRequest{
+		JSONRPC: "2.0",
+		ID:      atomic.AddInt64(&c.nextID, 1),
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s 返回HTTP状态 %d", method, resp.StatusCode)
+	}
+
+	var res rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+	if res.Error != nil {
+		return fmt.Errorf("%s 失败: %s (%d)", method, res.Error.Message, res.Error.Code)
+	}
+	return json.Unmarshal(res.Result, result)
+}
+
+// 把十六进制数量转换为十进制
+func parseQuantity(quantity string) (*big.Int, error) {
+	n, ok := new(big.Int).SetString(strings.TrimPrefix(quantity, "0x"), 16)
+	if !ok {
+		return nil, errors.New("数值格式错误: " + quantity)
+	}
+	return n, nil
+}
+
+// 调用返回单个数量的方法
+func (c *evmClient) quantity(ctx context.Context, method string, params ...interface{}) (*big.Int, error) {
+	var quantity string
+	if err := c.call(ctx, method, params, &quantity); err != nil {
+		return nil, err
+	}
+	return parseQuantity(quantity)
+}
+
+func (c *evmClient) chainID(ctx context.Context) (*big.Int, error) {
+	return c.quantity(ctx, "eth_chainId")
+}
+
+func (c *evmClient) blockNumber(ctx context.Context) (*big.Int, error) {
+	return c.quantity(ctx, "eth_blockNumber")
+}
+
+// 账户的下一个nonce，包含交易池中尚未打包的交易
+func (c *evmClient) pendingNonce(ctx context.Context, address string) (*big.Int, error) {
+	return c.quantity(ctx, "eth_getTransactionCount", address, "pending")
+}
+
+func (c *evmClient) gasPrice(ctx context.Context) (*big.Int, error) {
+	return c.quantity(ctx, "eth_gasPrice")
+}
+
+func (c *evmClient) estimateGas(ctx context.Context, from, to, data string) (*big.Int, error) {
+	return c.quantity(ctx, "eth_estimateGas", map[string]string{"from": from, "to": to, "data": data})
+}
+
+func (c *evmClient) sendRawTransaction(ctx context.Context, raw []byte) (string, error) {
+	var txHash string
+	if err := c.call(ctx, "eth_sendRawTransaction", []interface{}{"0x" + hex.EncodeToString(raw)}, &txHash); err != nil {
+		return "", err
+	}
+	return txHash, nil
+}
+
+type evmReceipt struct {
+	BlockNumber string `json:"blockNumber"`
+	BlockHash   string `json:"blockHash"`
+	Status      string `json:"status"`
+}
+
+// 交易尚未打包时返回nil
+func (c *evmClient) transactionReceipt(ctx context.Context, txHash string) (*evmReceipt, error) {
+	var receipt *evmReceipt
+	if err := c.call(ctx, "eth_getTransactionReceipt", []interface{}{txHash}, &receipt); err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+type evmTransaction struct {
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Input       string `json:"input"`
+	BlockNumber string `json:"blockNumber"`
+	BlockHash   string `json:"blockHash"`
+}
+
+func (c *evmClient) transactionByHash(ctx context.Context, txHash string) (*evmTransaction, error) {
+	var tx *evmTransaction
+	if err := c.call(ctx, "eth_getTransactionByHash", []interface{}{txHash}, &tx); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// Anchorer 定期把账本链头写入外部链
+type Anchorer struct {
+	client        *evmClient
+	signer        *evmSigner
+	from          string
+	to            string
+	confirmations int64
+	interval      time.Duration
+	mu            sync.Mutex
+}
+
+// 当前运行的锚定服务
+var anchorer *Anchorer
+
+// NewAnchorer 创建锚定服务，交易由 privateKey 对应的账户在本地签名，
+// to 为空时交易发给发送账户自己，confirmations 小于1时按1个区块确认
+func NewAnchorer(rpcURL, privateKey, to string, confirmations int64, interval, timeout time.Duration) (*Anchorer, error) {
+	signer, err := newEVMSigner(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if to == "" {
+		to = signer.address
+	}
+	if _, err := parseEVMAddress(to); err != nil {
+		return nil, err
+	}
+	if confirmations < 1 {
+		confirmations = 1
+	}
+	return &Anchorer{
+		client:        newEVMClient(rpcURL, timeout),
+		signer:        signer,
+		from:          signer.address,
+		to:            to,
+		confirmations: confirmations,
+		interval:      interval,
+	}, nil
+}
+
+// StartAnchorer 按全局配置启动锚定服务，未启用时返回nil
+func StartAnchorer(ctx context.Context) (*Anchorer, error) {
+	cfg := configs.GlobalAnchorConfig
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	a, err := NewAnchorer(cfg.RPCURL, cfg.PrivateKey, cfg.To, cfg.Confirmations, cfg.Interval, cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(a.from, cfg.From) {
+		return nil, fmt.Errorf("锚定私钥对应的账户 %s 与 ANCHOR_FROM 不一致", a.from)
+	}
+	anchorer = a
+	go a.Run(ctx)
+	return a, nil
+}
+
+// Run 先确认待确认的锚定交易，再在链头变化时提交新的锚定
+func (a *Anchorer) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.ConfirmPending(ctx); err != nil {
+			log.Printf("确认锚定交易失败: %v", err)
+		}
+		if _, err := a.AnchorHead(ctx); err != nil {
+			log.Printf("锚定账本失败: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// AnchorHead 把当前链头写入外部链，链头与上次锚定相同时返回nil
+func (a *Anchorer) AnchorHead(ctx context.Context) (*configs.LedgerAnchor, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	head, err := NewGormLedger(configs.DB).Head("")
+	if errors.Is(err, ErrBlockNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var last configs.LedgerAnchor
+	result := configs.DB.Where("status <> ?", AnchorFailed).Order("id DESC").First(&last)
+	if result.Error == nil && last.GlobalHeight == head.GlobalHeight {
+		return nil, nil
+	}
+
+	header := AnchorHeader{GlobalHeight: head.GlobalHeight, GlobalHash: head.Hash}
+	var sealed configs.SealedBlock
+	if err := configs.DB.Order("height DESC").First(&sealed).Error; err == nil {
+		header.SealedHeight = sealed.Height
+		header.SealedHash = sealed.Hash
+	}
+
+	anchor := configs.LedgerAnchor{
+		GlobalHeight: header.GlobalHeight,
+		GlobalHash:   header.GlobalHash,
+		SealedHeight: header.SealedHeight,
+		SealedHash:   header.SealedHash,
+		Digest:       header.Digest(),
+		FromAddress:  a.from,
+		ToAddress:    a.to,
+	}
+
+	err = a.sendAnchorTx(ctx, &anchor)
+	if err != nil {
+		// 失败的锚定也记录下来，下次会重新提交
+		anchor.Status = AnchorFailed
+		anchor.Error = err.Error()
+	}
+
+	if dbErr := configs.DB.Create(&anchor).Error; dbErr != nil {
+		return nil, dbErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &anchor, nil
+}
+
+// 在本地签名锚定交易并发送，记录链ID和交易哈希
+func (a *Anchorer) sendAnchorTx(ctx context.Context, anchor *configs.LedgerAnchor) error {
+	data := anchorTxData(anchor.Digest)
+	chainID, err := a.client.chainID(ctx)
+	if err != nil {
+		return err
+	}
+	nonce, err := a.client.pendingNonce(ctx, a.from)
+	if err != nil {
+		return err
+	}
+	gasPrice, err := a.client.gasPrice(ctx)
+	if err != nil {
+		return err
+	}
+	gas, err := a.client.estimateGas(ctx, a.from, a.to, data)
+	if err != nil {
+		return err
+	}
+
+	to, _ := parseEVMAddress(a.to)
+	payload, _ := hex.DecodeString(strings.TrimPrefix(data, "0x"))
+	raw := a.signer.signTx(evmTx{
+		Nonce:    nonce.Uint64(),
+		GasPrice: gasPrice,
+		Gas:      gas.Uint64(),
+		To:       to,
+		Value:    new(big.Int),
+		Data:     payload,
+	}, chainID)
+
+	anchor.ChainID = chainID.String()
+	anchor.TxHash, err = a.client.sendRawTransaction(ctx, raw)
+	return err
+}
+
+// ConfirmPending 查询待确认锚定交易的回执，
+// 交易所在区块之上累计的区块数达到确认数后才更新状态，避免外部链重组后记录失效
+func (a *Anchorer) ConfirmPending(ctx context.Context) error {
+	var pending []configs.LedgerAnchor
+	if err := configs.DB.Where("status = ?", AnchorPending).Order("id").Find(&pending).Error; err != nil {
+		return err
+	}
+
+	var head *big.Int
+	for _, anchor := range pending {
+		receipt, err := a.client.transactionReceipt(ctx, anchor.TxHash)
+		if err != nil {
+			return err
+		}
+		if receipt == nil {
+			continue
+		}
+		number, err := parseQuantity(receipt.BlockNumber)
+		if err != nil {
+			return err
+		}
+		if head == nil {
+			if head, err = a.client.blockNumber(ctx); err != nil {
+				return err
+			}
+		}
+		if head.Int64()-number.Int64()+1 < a.confirmations {
+			continue
+		}
+
+		updates := map[string]interface{}{
+			"block_hash":   receipt.BlockHash,
+			"block_number": number.Int64(),
+		}
+		if receipt.Status == "0x1" {
+			now := time.Now()
+			updates["status"] = AnchorConfirmed
+			updates["confirmed_at"] = &now
+		} else {
+			updates["status"] = AnchorFailed
+			updates["error"] = "锚定交易执行失败"
+		}
+		if err := configs.DB.Model(&configs.LedgerAnchor{}).Where("id = ?", anchor.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 锚定证明：全局链在锚定高度的哈希已写入外部链，
+// 由于全局链逐块链接，该高度之前的所有区块都被这笔交易间接证明
+type anchorProof struct {
+	AnchorID     uint   `json:"anchor_id"`
+	GlobalHeight int64  `json:"global_height"`
+	GlobalHash   string `json:"global_hash"`
+	SealedHeight int64  `json:"sealed_height"`
+	SealedHash   string `json:"sealed_hash"`
+	Digest       string `json:"digest"`
+	TxData       string `json:"tx_data"`
+	ChainID      string `json:"chain_id"`
+	TxHash       string `json:"tx_hash"`
+	BlockNumber  int64  `json:"block_number"`
+	BlockHash    string `json:"block_hash"`
+	Status       int    `json:"status"`
+}
+
+func anchorProofOf(anchor configs.LedgerAnchor) anchorProof {
+	return anchorProof{
+		AnchorID:     anchor.ID,
+		GlobalHeight: anchor.GlobalHeight,
+		GlobalHash:   anchor.GlobalHash,
+		SealedHeight: anchor.SealedHeight,
+		SealedHash:   anchor.SealedHash,
+		Digest:       anchor.Digest,
+		TxData:       anchorTxData(anchor.Digest),
+		ChainID:      anchor.ChainID,
+		TxHash:       anchor.TxHash,
+		BlockNumber:  anchor.BlockNumber,
+		BlockHash:    anchor.BlockHash,
+		Status:       anchor.Status,
+	}
+}
+
+// 获取覆盖SKU最新区块的锚定证明：最早覆盖它的锚定和最新的锚定
+func anchorProofsFor(sku string) ([]anchorProof, error) {
+	head, err := NewGormLedger(configs.DB).Head(sku)
+	if errors.Is(err, ErrBlockNotFound) {
+		return []anchorProof{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	proofs := []anchorProof{}
+	var first, latest configs.LedgerAnchor
+	result := configs.DB.Where("status = ? AND global_height >= ?", AnchorConfirmed, head.GlobalHeight).
+		Order("global_height").
+		First(&first)
+	if result.Error != nil {
+		return proofs, nil
+	}
+	proofs = append(proofs, anchorProofOf(first))
+
+	result = configs.DB.Where("status = ?", AnchorConfirmed).Order("global_height DESC").First(&latest)
+	if result.Error == nil && latest.ID != first.ID {
+		proofs = append(proofs, anchorProofOf(latest))
+	}
+	return proofs, nil
+}
+
+// GetAnchors 获取锚定记录
+func (s *BlockchainService) GetAnchors(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 10
+	}
+
+	var total int64
+	configs.DB.Model(&configs.LedgerAnchor{}).Count(&total)
+
+	var anchors []configs.LedgerAnchor
+	result := configs.DB.Order("id DESC").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Find(&anchors)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "查询锚定记录失败",
+		})
+		return
+	}
+
+	list := make([]anchorProof, 0, len(anchors))
+	for _, anchor := range anchors {
+		list = append(list, anchorProofOf(anchor))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "获取锚定记录成功",
+		"data": gin.H{
+			"total":     total,
+			"page":      page,
+			"page_size": pageSize,
+			"anchors":   list,
+		},
+	})
+}
+
+// VerifyAnchor 从外部链重新读取锚定交易，核对交易内容和当前账本
+func (s *BlockchainService) VerifyAnchor(c *gin.Context) {
+	var anchor configs.LedgerAnchor
+	if err := configs.DB.First(&anchor, c.Query("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "锚定记录不存在",
+		})
+		return
+	}
+	if anchor.TxHash == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "该锚定没有成功提交交易",
+		})
+		return
+	}
+
+	cfg := configs.GlobalAnchorConfig
+	client := newEVMClient(cfg.RPCURL, cfg.Timeout)
+	tx, err := client.transactionByHash(c.Request.Context(), anchor.TxHash)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"code":    502,
+			"message": "查询锚定交易失败: " + err.Error(),
+		})
+		return
+	}
+
+	var problems []string
+	if tx == nil {
+		problems = append(problems, "外部链上找不到锚定交易")
+	} else {
+		// 任何账户都能发送同样内容的交易，只有配置的锚定账户发出的才算数
+		if cfg.From == "" || !strings.EqualFold(tx.From, cfg.From) {
+			problems = append(problems, "交易发送者不是配置的锚定账户")
+		}
+		if !strings.EqualFold(tx.Input, anchorTxData(anchor.Digest)) {
+			problems = append(problems, "交易内容与锚定摘要不一致")
+		}
+		if number, err := parseQuantity(tx.BlockNumber); err != nil || number.Int64() != anchor.BlockNumber {
+			problems = append(problems, "交易所在区块与记录不一致")
+		}
+	}
+
+	// 锚定头必须能由记录重新计算，且账本在该高度的区块未被改写
+	header := AnchorHeader{
+		GlobalHeight: anchor.GlobalHeight,
+		GlobalHash:   anchor.GlobalHash,
+		SealedHeight: anchor.SealedHeight,
+		SealedHash:   anchor.SealedHash,
+	}
+	if header.Digest() != anchor.Digest {
+		problems = append(problems, "锚定摘要与锚定头不一致")
+	}
+	block, err := NewGormLedger(configs.DB).Get(anchor.GlobalHeight)
+	if err != nil || block.Hash != anchor.GlobalHash {
+		problems = append(problems, "账本在锚定高度的区块不存在或已被改写")
+	}
+
+	message := "锚定验证通过"
+	if len(problems) > 0 {
+		message = "锚定验证失败"
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": message,
+		"data": gin.H{
+			"valid":    len(problems) == 0,
+			"problems": problems,
+			"anchor":   anchorProofOf(anchor),
+		},
+	})
+}
+
+// AdminAnchorNow 立即锚定当前链头
+func (s *AdminService) AdminAnchorNow(c *gin.Context) {
+	if anchorer == nil {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "未启用外部链锚定",
+		})
+		return
+	}
+
+	if err := anchorer.ConfirmPending(c.Request.Context()); err != nil {
+		log.Printf("确认锚定交易失败: %v", err)
+	}
+	anchor, err := anchorer.AnchorHead(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusBadGateway, api.Response{
+			Code:    502,
+			Message: "锚定失败: " + err.Error(),
+		})
+		return
+	}
+	if anchor == nil {
+		c.JSON(http.StatusOK, api.Response{
+			Code:    200,
+			Message: "链头未变化，无需锚定",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "锚定交易已提交",
+		Data:    anchorProofOf(*anchor),
+	})
+}
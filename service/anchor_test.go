@@ -0,0 +1,370 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 锚定集成测试使用的本地开发链，例如 anvil 或 ganache，未设置时跳过:
+// TEST_ANCHOR_RPC_URL=http://127.0.0.1:8545
+// TEST_ANCHOR_PRIVATE_KEY 为发送锚定交易的私钥，默认为 anvil 的第一个测试账户
+const testAnvilAccount = "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266"
+
+// 只实现锚定用到的JSON-RPC方法的模拟节点，交易在下一次查询回执时打包，
+// 每次查询链高都会出一个新区块
+type testEVMNode struct {
+	t       *testing.T
+	mu      sync.Mutex
+	txs     map[string]map[string]string
+	mined   map[string]int64
+	height  int64
+	revert  bool   // 交易执行失败
+	dropped bool   // 查询不到交易
+	stalled bool   // 不再出新区块
+	sender  string // 查询交易时返回的发送者，模拟其他账户发出的同样内容的交易
+}
+
+func newTestEVMNode(t *testing.T) *testEVMNode {
+	return &testEVMNode{t: t, txs: make(map[string]map[string]string), mined: make(map[string]int64)}
+}
+
+func (n *testEVMNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var req struct {
+		ID     int64             `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	param := func() string {
+		var s string
+		json.Unmarshal(req.Params[0], &s)
+		return s
+	}
+
+	var result interface{}
+	switch req.Method {
+	case "eth_chainId":
+		result = "0x7a69"
+	case "eth_blockNumber":
+		if !n.stalled {
+			n.height++
+		}
+		result = fmt.Sprintf("0x%x", n.height)
+	case "eth_getTransactionCount":
+		result = fmt.Sprintf("0x%x", len(n.txs))
+	case "eth_gasPrice":
+		result = "0x3b9aca00"
+	case "eth_estimateGas":
+		result = "0x7530"
+	case "eth_sendRawTransaction":
+		raw, err := hex.DecodeString(strings.TrimPrefix(param(), "0x"))
+		if err != nil {
+			n.t.Error(err)
+		}
+		// 从签名中恢复发送者，签名错误时恢复出的是别的地址
+		tx, from := testRecoverTx(n.t, raw)
+		if tx.Nonce != uint64(len(n.txs)) {
+			n.t.Errorf("交易nonce %d", tx.Nonce)
+		}
+		hash := fmt.Sprintf("0x%064x", len(n.txs)+1)
+		n.txs[hash] = map[string]string{
+			"from": from,
+			"to":   "0x" + hex.EncodeToString(tx.To),
+			"data": "0x" + hex.EncodeToString(tx.Data),
+		}
+		result = hash
+	case "eth_getTransactionReceipt":
+		hash := param()
+		if _, ok := n.txs[hash]; ok {
+			if _, mined := n.mined[hash]; !mined {
+				n.height++
+				n.mined[hash] = n.height
+			}
+			status := "0x1"
+			if n.revert {
+				status = "0x0"
+			}
+			result = map[string]string{
+				"blockNumber": fmt.Sprintf("0x%x", n.mined[hash]),
+				"blockHash":   fmt.Sprintf("0x%064x", n.mined[hash]),
+				"status":      status,
+			}
+		}
+	case "eth_getTransactionByHash":
+		hash := param()
+		if tx, ok := n.txs[hash]; ok && !n.dropped {
+			from := tx["from"]
+			if n.sender != "" {
+				from = n.sender
+			}
+			result = map[string]string{
+				"from":        from,
+				"to":          tx["to"],
+				"input":       tx["data"],
+				"blockNumber": fmt.Sprintf("0x%x", n.mined[hash]),
+				"blockHash":   fmt.Sprintf("0x%064x", n.mined[hash]),
+			}
+		}
+	default:
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":    req.ID,
+			"error": map[string]interface{}{"code": -32601, "message": "method not found"},
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": result})
+}
+
+// 把当前链头锚定到外部链并等待交易确认
+func testAnchorAndConfirm(t *testing.T, a *Anchorer) configs.LedgerAnchor {
+	t.Helper()
+	ctx := context.Background()
+	anchor, err := a.AnchorHead(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if anchor == nil || anchor.TxHash == "" || anchor.Status != AnchorPending {
+		t.Fatalf("锚定记录 %+v", anchor)
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		if err := a.ConfirmPending(ctx); err != nil {
+			t.Fatal(err)
+		}
+		var stored configs.LedgerAnchor
+		if err := configs.DB.First(&stored, anchor.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if stored.Status != AnchorPending {
+			return stored
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("锚定交易没有被打包")
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// 调用锚定验证接口，from 为配置的锚定账户
+func testVerifyAnchor(t *testing.T, rpcURL, from string, id uint) (bool, []string) {
+	t.Helper()
+	saved := configs.GlobalAnchorConfig
+	configs.GlobalAnchorConfig.RPCURL = rpcURL
+	configs.GlobalAnchorConfig.From = from
+	defer func() { configs.GlobalAnchorConfig = saved }()
+
+	w := testHandle((&BlockchainService{}).VerifyAnchor, configs.User{}, http.MethodGet, fmt.Sprintf("/api/blockchain/anchor/verify?id=%d", id), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("状态码 %d: %s", w.Code, w.Body.String())
+	}
+	var data struct {
+		Valid    bool     `json:"valid"`
+		Problems []string `json:"problems"`
+	}
+	testResponseData(t, w.Body.Bytes(), &data)
+	return data.Valid, data.Problems
+}
+
+// 写入两个SKU的区块，全局高度1是签名者首次签名时写入的密钥登记区块
+func testAnchorLedger(t *testing.T) configs.User {
+	t.Helper()
+	testDB(t)
+	user := testUser(t, 1)
+	for i, sku := range []string{"SKU-1", "SKU-2", "SKU-1"} {
+		if _, err := (&BlockchainService{}).AddToBlockchain(sku, 1, fmt.Sprintf(`{"n":%d}`, i), user.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return user
+}
+
+func TestAnchorer(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(node *testEVMNode)
+		tamper bool
+		status int
+		valid  bool
+	}{
+		{name: "锚定并验证", status: AnchorConfirmed, valid: true},
+		{name: "交易执行失败", setup: func(n *testEVMNode) { n.revert = true }, status: AnchorFailed},
+		{name: "外部链上找不到交易", setup: func(n *testEVMNode) { n.dropped = true }, status: AnchorConfirmed},
+		{name: "交易不是锚定账户发出的", setup: func(n *testEVMNode) { n.sender = "0x" + strings.Repeat("11", 20) }, status: AnchorConfirmed},
+		{name: "锚定之后账本被改写", tamper: true, status: AnchorConfirmed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testAnchorLedger(t)
+			node := newTestEVMNode(t)
+			if tt.setup != nil {
+				tt.setup(node)
+			}
+			server := httptest.NewServer(node)
+			defer server.Close()
+
+			a := testAnchorer(t, server.URL, 3)
+			anchor := testAnchorAndConfirm(t, a)
+			if anchor.Status != tt.status || anchor.ChainID != "31337" || anchor.GlobalHeight != 4 {
+				t.Fatalf("锚定记录 %+v", anchor)
+			}
+			tx := node.txs[anchor.TxHash]
+			if tx["data"] != anchorTxData(anchor.Digest) || !strings.EqualFold(tx["to"], testAnvilAccount) || !strings.EqualFold(tx["from"], testAnvilAccount) {
+				t.Fatalf("锚定交易 %v", tx)
+			}
+			if tt.status != AnchorConfirmed {
+				return
+			}
+
+			if tt.tamper {
+				configs.DB.Model(&configs.BlockchainLog{}).Where("global_height = ?", 4).Update("hash", hashData("x"))
+			}
+			valid, problems := testVerifyAnchor(t, server.URL, testAnvilAccount, anchor.ID)
+			if valid != tt.valid {
+				t.Fatalf("验证结果 %v: %v", valid, problems)
+			}
+
+			// 链头未变化时不重复锚定
+			again, err := a.AnchorHead(context.Background())
+			if err != nil || again != nil {
+				t.Fatalf("链头未变化时又锚定了 %+v %v", again, err)
+			}
+		})
+	}
+}
+
+// 交易打包之后还要等外部链再出足够的区块才确认
+func TestAnchorWaitsForConfirmations(t *testing.T) {
+	testAnchorLedger(t)
+	node := newTestEVMNode(t)
+	node.stalled = true
+	server := httptest.NewServer(node)
+	defer server.Close()
+	a := testAnchorer(t, server.URL, 3)
+
+	ctx := context.Background()
+	anchor, err := a.AnchorHead(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := func() configs.LedgerAnchor {
+		var stored configs.LedgerAnchor
+		if err := configs.DB.First(&stored, anchor.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		return stored
+	}
+	for i := 0; i < 3; i++ {
+		if err := a.ConfirmPending(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pending := stored(); pending.Status != AnchorPending || pending.BlockNumber != 0 {
+		t.Fatalf("确认数不足时更新了锚定 %+v", pending)
+	}
+
+	// 交易所在区块加上之后的两个区块
+	node.stalled = false
+	for i := 0; i < 2; i++ {
+		if err := a.ConfirmPending(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if confirmed := stored(); confirmed.Status != AnchorConfirmed || confirmed.BlockNumber != 1 {
+		t.Fatalf("锚定 %+v", confirmed)
+	}
+}
+
+// 用 anvil 第一个测试账户的私钥创建锚定服务
+func testAnchorer(t *testing.T, rpcURL string, confirmations int64) *Anchorer {
+	t.Helper()
+	a, err := NewAnchorer(rpcURL, testAnvilKey, "", confirmations, time.Hour, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAnchorProofsFor(t *testing.T) {
+	user := testAnchorLedger(t)
+	node := newTestEVMNode(t)
+	server := httptest.NewServer(node)
+	defer server.Close()
+	a := testAnchorer(t, server.URL, 1)
+
+	first := testAnchorAndConfirm(t, a)
+	if _, err := (&BlockchainService{}).AddToBlockchain("SKU-2", 1, `{"n":3}`, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	latest := testAnchorAndConfirm(t, a)
+
+	tests := []struct {
+		sku  string
+		want []uint // 最早覆盖链头的锚定和最新的锚定
+	}{
+		{sku: "SKU-1", want: []uint{first.ID, latest.ID}},
+		{sku: "SKU-2", want: []uint{latest.ID}},
+		{sku: "SKU-3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sku, func(t *testing.T) {
+			proofs, err := anchorProofsFor(tt.sku)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []uint
+			for _, proof := range proofs {
+				got = append(got, proof.AnchorID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("锚定证明 %v，期望 %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 在真实的本地开发链上锚定并核对交易回执
+func TestAnchorOnDevChain(t *testing.T) {
+	rpcURL := os.Getenv("TEST_ANCHOR_RPC_URL")
+	if rpcURL == "" {
+		t.Skip("未设置 TEST_ANCHOR_RPC_URL，跳过开发链锚定测试")
+	}
+	key := os.Getenv("TEST_ANCHOR_PRIVATE_KEY")
+	if key == "" {
+		key = testAnvilKey
+	}
+	testAnchorLedger(t)
+
+	a, err := NewAnchorer(rpcURL, key, "", 1, time.Hour, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anchor := testAnchorAndConfirm(t, a)
+	if anchor.Status != AnchorConfirmed || anchor.BlockNumber == 0 || anchor.BlockHash == "" {
+		t.Fatalf("锚定交易未成功: %+v", anchor)
+	}
+
+	// 回执中的区块与交易所在区块一致，交易内容就是锚定摘要
+	valid, problems := testVerifyAnchor(t, rpcURL, a.from, anchor.ID)
+	if !valid {
+		t.Fatalf("锚定验证失败: %v", problems)
+	}
+	proofs, err := anchorProofsFor("SKU-1")
+	if err != nil || len(proofs) != 1 || proofs[0].TxHash != anchor.TxHash {
+		t.Fatalf("锚定证明 %+v %v", proofs, err)
+	}
+}
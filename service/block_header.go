@@ -0,0 +1,150 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+)
+
+// 区块哈希方案版本
+const (
+	HashVersionLegacy    = 0 // 旧版: sha256(data + previousHash + globalPreviousHash + timestamp.String())
+	HashVersionCanonical = 1 // 规范区块头
+	HashVersionSigned    = 2 // 规范区块头，包含签名者和签名密钥
+)
+
+// 旧版区块的迁移状态
+const (
+	LegacyStatusUnchecked    = 0
+	LegacyStatusVerified     = 1
+	LegacyStatusUnverifiable = 2
+)
+
+// BlockHeader 规范区块头，所有参与哈希的字段都显式存储在区块中
+type BlockHeader struct {
+	Version            int
+	ProductSKU         string
+	RecordType         int
+	BlockHeight        int64
+	GlobalHeight       int64
+	PreviousHash       string
+	GlobalPreviousHash string
+	DataHash           string // RecordData 的 sha256
+	Timestamp          int64  // Unix纳秒
+	SignerID           uint   // 版本2起参与编码
+	SignerKeyID        uint
+}
+
+// Encode 按固定字段顺序编码区块头
+// 整数使用大端定长编码，字符串使用4字节长度前缀，保证编码结果唯一
+func (h BlockHeader) Encode() []byte {
+	buf := make([]byte, 0, 256)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(h.Version))
+	buf = appendString(buf, h.ProductSKU)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(int64(h.RecordType)))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.BlockHeight))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.GlobalHeight))
+	buf = appendString(buf, h.PreviousHash)
+	buf = appendString(buf, h.GlobalPreviousHash)
+	buf = appendString(buf, h.DataHash)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.Timestamp))
+	if h.Version >= HashVersionSigned {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(h.SignerID))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(h.SignerKeyID))
+	}
+	return buf
+}
+
+// Hash 计算区块头哈希
+func (h BlockHeader) Hash() string {
+	sum := sha256.Sum256(h.Encode())
+	return hex.EncodeToString(sum[:])
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+// 计算记录数据的哈希
+func hashData(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// 旧版哈希方案，仅用于验证迁移前的区块
+func legacyHash(data string, previousHash string, globalPreviousHash string, timestamp time.Time) string {
+	h := sha256.New()
+	h.Write([]byte(data + previousHash + globalPreviousHash + timestamp.String()))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// 从区块记录构造规范区块头
+func headerOf(block configs.BlockchainLog) BlockHeader {
+	return BlockHeader{
+		Version:            block.HashVersion,
+		ProductSKU:         block.ProductSKU,
+		RecordType:         block.RecordType,
+		BlockHeight:        block.BlockHeight,
+		GlobalHeight:       block.GlobalHeight,
+		PreviousHash:       block.PreviousHash,
+		GlobalPreviousHash: block.GlobalPreviousHash,
+		DataHash:           hashData(block.RecordData),
+		Timestamp:          block.Timestamp,
+		SignerID:           block.SignerID,
+		SignerKeyID:        block.SignerKeyID,
+	}
+}
+
+// 重新计算区块哈希，按区块的哈希版本选择方案
+func computeBlockHash(block configs.BlockchainLog) string {
+	if block.HashVersion == HashVersionLegacy {
+		return legacyHash(block.RecordData, block.PreviousHash, block.GlobalPreviousHash, block.CreatedAt)
+	}
+	return headerOf(block).Hash()
+}
+
+// SealedBlockHeader 打包区块的规范区块头
+type SealedBlockHeader struct {
+	Height            int64
+	PreviousHash      string
+	MerkleRoot        string
+	RecordCount       int
+	FirstGlobalHeight int64
+	LastGlobalHeight  int64
+	Timestamp         int64 // Unix纳秒
+}
+
+// Encode 按固定字段顺序编码打包区块头
+func (h SealedBlockHeader) Encode() []byte {
+	buf := make([]byte, 0, 192)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.Height))
+	buf = appendString(buf, h.PreviousHash)
+	buf = appendString(buf, h.MerkleRoot)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(int64(h.RecordCount)))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.FirstGlobalHeight))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.LastGlobalHeight))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.Timestamp))
+	return buf
+}
+
+// Hash 计算打包区块头哈希
+func (h SealedBlockHeader) Hash() string {
+	sum := sha256.Sum256(h.Encode())
+	return hex.EncodeToString(sum[:])
+}
+
+// 从打包区块记录构造区块头
+func sealedHeaderOf(block configs.SealedBlock) SealedBlockHeader {
+	return SealedBlockHeader{
+		Height:            block.Height,
+		PreviousHash:      block.PreviousHash,
+		MerkleRoot:        block.MerkleRoot,
+		RecordCount:       block.RecordCount,
+		FirstGlobalHeight: block.FirstGlobalHeight,
+		LastGlobalHeight:  block.LastGlobalHeight,
+		Timestamp:         block.Timestamp,
+	}
+}
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestBlockHeaderEncodeIsUnambiguous(t *testing.T) {
+	base := BlockHeader{
+		Version:            HashVersionSigned,
+		ProductSKU:         "SKU-1",
+		RecordType:         2,
+		BlockHeight:        3,
+		GlobalHeight:       40,
+		PreviousHash:       "ab",
+		GlobalPreviousHash: "c",
+		DataHash:           hashData("data"),
+		Timestamp:          1700000000123456789,
+		SignerID:           7,
+		SignerKeyID:        8,
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(*BlockHeader)
+	}{
+		{"版本", func(h *BlockHeader) { h.Version = HashVersionCanonical }},
+		{"SKU", func(h *BlockHeader) { h.ProductSKU = "SKU-2" }},
+		{"记录类型", func(h *BlockHeader) { h.RecordType = 3 }},
+		{"区块高度", func(h *BlockHeader) { h.BlockHeight = 4 }},
+		{"全局高度", func(h *BlockHeader) { h.GlobalHeight = 41 }},
+		{"字符串边界", func(h *BlockHeader) { h.PreviousHash, h.GlobalPreviousHash = "a", "bc" }},
+		{"数据哈希", func(h *BlockHeader) { h.DataHash = hashData("other") }},
+		{"时间戳", func(h *BlockHeader) { h.Timestamp++ }},
+		{"签名者", func(h *BlockHeader) { h.SignerID = 9 }},
+		{"签名密钥", func(h *BlockHeader) { h.SignerKeyID = 9 }},
+	}
+
+	encoded := base.Encode()
+	if !bytes.Equal(encoded, base.Encode()) {
+		t.Fatal("同一区块头的编码应相同")
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := base
+			tt.mutate(&h)
+			if bytes.Equal(h.Encode(), encoded) || h.Hash() == base.Hash() {
+				t.Fatal("修改字段后编码和哈希都应改变")
+			}
+		})
+	}
+}
+
+func TestBlockHeaderEncodeSignerOnlyFromVersion2(t *testing.T) {
+	h := BlockHeader{Version: HashVersionCanonical, ProductSKU: "SKU-1", SignerID: 1, SignerKeyID: 2}
+	other := h
+	other.SignerID, other.SignerKeyID = 3, 4
+	if !bytes.Equal(h.Encode(), other.Encode()) {
+		t.Fatal("版本1的区块头不应编码签名者")
+	}
+}
+
+// 构造一个旧版区块，哈希按旧方案计算
+func testLegacyBlock(data, previousHash string, createdAt time.Time) configs.BlockchainLog {
+	block := configs.BlockchainLog{
+		ProductSKU:   "SKU-LEGACY",
+		RecordType:   1,
+		RecordData:   data,
+		PreviousHash: previousHash,
+		HashVersion:  HashVersionLegacy,
+	}
+	block.CreatedAt = createdAt
+	block.Hash = legacyHash(data, previousHash, "", createdAt)
+	return block
+}
+
+func TestVerifyChainLegacyBlocks(t *testing.T) {
+	createdAt := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	first := testLegacyBlock(`{"n":1}`, "", createdAt)
+	second := testLegacyBlock(`{"n":2}`, first.Hash, createdAt.Add(time.Minute))
+
+	canonical := configs.BlockchainLog{
+		ProductSKU:   "SKU-LEGACY",
+		RecordType:   2,
+		RecordData:   `{"n":3}`,
+		PreviousHash: second.Hash,
+		BlockHeight:  3,
+		HashVersion:  HashVersionCanonical,
+		Timestamp:    createdAt.Add(2 * time.Minute).UnixNano(),
+	}
+	canonical.Hash = computeBlockHash(canonical)
+
+	tests := []struct {
+		name       string
+		mutate     func(blocks []configs.BlockchainLog) []configs.BlockchainLog
+		valid      bool
+		verified   bool
+		unverified int
+		reason     string
+	}{
+		{
+			name:     "旧方案可以复现",
+			mutate:   func(blocks []configs.BlockchainLog) []configs.BlockchainLog { return blocks },
+			valid:    true,
+			verified: true,
+		},
+		{
+			// 时间精度丢失时无法复现旧版哈希，只能校验链接关系
+			name: "旧方案无法复现",
+			mutate: func(blocks []configs.BlockchainLog) []configs.BlockchainLog {
+				blocks[0].CreatedAt = blocks[0].CreatedAt.Add(time.Millisecond)
+				return blocks
+			},
+			valid:      true,
+			unverified: 1,
+		},
+		{
+			// 无法复现的状态列可以被改写，不能让篡改过的旧版区块显示为完全验证
+			name: "篡改旧版区块并改写状态",
+			mutate: func(blocks []configs.BlockchainLog) []configs.BlockchainLog {
+				blocks[1].RecordData = `{"n":20}`
+				blocks[1].LegacyStatus = LegacyStatusUnverifiable
+				return blocks
+			},
+			valid:      true,
+			unverified: 1,
+		},
+		{
+			name: "新版区块的状态列不影响验证",
+			mutate: func(blocks []configs.BlockchainLog) []configs.BlockchainLog {
+				blocks[2].RecordData = `{"n":30}`
+				blocks[2].LegacyStatus = LegacyStatusUnverifiable
+				return blocks
+			},
+			reason: "区块哈希不匹配",
+		},
+		{
+			name: "旧版区块出现在新版区块之后",
+			mutate: func(blocks []configs.BlockchainLog) []configs.BlockchainLog {
+				return append(blocks, testLegacyBlock(`{"n":4}`, canonical.Hash, createdAt.Add(3*time.Minute)))
+			},
+			reason: "旧版区块出现在新版区块之后",
+		},
+		{
+			// 旧版区块写入时还没有全局链和签名
+			name: "旧版区块带有全局链字段",
+			mutate: func(blocks []configs.BlockchainLog) []configs.BlockchainLog {
+				blocks[1].GlobalHeight = 2
+				return blocks
+			},
+			reason: "旧版区块带有新版区块的字段，哈希版本可能被降级",
+		},
+		{
+			name: "旧版区块带有签名",
+			mutate: func(blocks []configs.BlockchainLog) []configs.BlockchainLog {
+				blocks[0].SignerID, blocks[0].SignerKeyID, blocks[0].Signature = 1, 1, "00"
+				return blocks
+			},
+			reason: "旧版区块带有新版区块的字段，哈希版本可能被降级",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocks := tt.mutate([]configs.BlockchainLog{first, second, canonical})
+			res := verifySKUChain(blocks, nil)
+			if res.Valid != tt.valid || res.Verified != tt.verified || res.LegacyUnverified != tt.unverified || res.Reason != tt.reason {
+				t.Fatalf("结果 %+v", res)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
+	"time"
+)
+
+// BlockProducer 出块器，按时间间隔或待打包数量把记录封装成打包区块
+type BlockProducer struct {
+	interval  time.Duration
+	batchSize int
+	notify    chan struct{}
+}
+
+// 当前运行的出块器，追加记录后通过它触发数量检查
+var blockProducer *BlockProducer
+
+// NewBlockProducer 创建出块器
+func NewBlockProducer(interval time.Duration, batchSize int) *BlockProducer {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	return &BlockProducer{
+		interval:  interval,
+		batchSize: batchSize,
+		notify:    make(chan struct{}, 1),
+	}
+}
+
+// StartBlockProducer 按全局配置启动出块器
+func StartBlockProducer(ctx context.Context) *BlockProducer {
+	producer := NewBlockProducer(configs.GlobalLedgerConfig.BatchInterval, configs.GlobalLedgerConfig.BatchSize)
+	blockProducer = producer
+	go producer.Run(ctx)
+	return producer
+}
+
+// 通知出块器和账本镜像有新记录
+func notifyLedgerWatchers() {
+	if blockProducer != nil {
+		blockProducer.Notify()
+	}
+	if ledgerMirror != nil {
+		ledgerMirror.Notify()
+	}
+	projector.Notify()
+}
+
+// Notify 通知出块器检查待打包数量，不会阻塞调用方
+func (p *BlockProducer) Notify() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run 运行出块循环，定时封装所有待打包记录，数量达到阈值时提前封块
+func (p *BlockProducer) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := p.SealPending(1); err != nil {
+				log.Printf("打包区块失败: %v", err)
+			}
+		case <-p.notify:
+			if _, err := p.SealPending(p.batchSize); err != nil {
+				log.Printf("打包区块失败: %v", err)
+			}
+		}
+	}
+}
+
+// SealPending 在待打包记录不少于 minRecords 时持续封块，每块最多 batchSize 条记录
+func (p *BlockProducer) SealPending(minRecords int) ([]configs.SealedBlock, error) {
+	var sealed []configs.SealedBlock
+	for {
+		block, err := p.sealOne(minRecords)
+		if err != nil {
+			return sealed, err
+		}
+		if block == nil {
+			return sealed, nil
+		}
+		sealed = append(sealed, *block)
+		notifyTimestamper()
+	}
+}
+
+// 封装一个打包区块，待打包记录不足时返回nil
+func (p *BlockProducer) sealOne(minRecords int) (*configs.SealedBlock, error) {
+	var sealed *configs.SealedBlock
+	err := configs.DB.Transaction(func(tx *gorm.DB) error {
+		// 多个实例同时出块时只有一个能拿到锁
+		var lock configs.LedgerLock
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&lock, configs.BlockSealLockID)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		var records []configs.BlockchainLog
+		result = tx.Where("sealed_height = 0 AND global_height > 0").
+			Order("global_height").
+			Limit(p.batchSize).
+			Find(&records)
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(records) == 0 || len(records) < minRecords {
+			return nil
+		}
+
+		leaves := make([]string, len(records))
+		for i, record := range records {
+			leaves[i] = record.Hash
+		}
+		root, err := MerkleRoot(leaves)
+		if err != nil {
+			return err
+		}
+
+		var previous configs.SealedBlock
+		var previousHash string
+		var height int64 = 1
+		result = tx.Order("height DESC").First(&previous)
+		if result.Error == nil {
+			previousHash = previous.Hash
+			height = previous.Height + 1
+		} else if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return result.Error
+		}
+
+		block := configs.SealedBlock{
+			Height:            height,
+			MerkleRoot:        root,
+			PreviousHash:      previousHash,
+			RecordCount:       len(records),
+			FirstGlobalHeight: records[0].GlobalHeight,
+			LastGlobalHeight:  records[len(records)-1].GlobalHeight,
+			Timestamp:         time.Now().UnixNano(),
+		}
+		block.Hash = sealedHeaderOf(block).Hash()
+
+		if err := tx.Create(&block).Error; err != nil {
+			return err
+		}
+
+		for i, record := range records {
+			result = tx.Model(&configs.BlockchainLog{}).
+				Where("id = ?", record.ID).
+				Updates(map[string]interface{}{
+					"sealed_height": height,
+					"leaf_index":    i,
+				})
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		sealed = &block
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sealed, nil
+}
+
+// 加载打包区块中的记录哈希，按叶子序号排列
+func sealedBlockLeaves(block configs.SealedBlock) ([]string, error) {
+	if block.LastGlobalHeight > 0 && block.LastGlobalHeight <= archivedHeight() {
+		// 记录已归档，按全局高度从冷存储读取，打包时叶子就是按全局高度排列的
+		return archivedLeaves(block.FirstGlobalHeight, block.LastGlobalHeight)
+	}
+
+	var leaves []string
+	result := configs.DB.Model(&configs.BlockchainLog{}).
+		Where("sealed_height = ?", block.Height).
+		Order("leaf_index").
+		Pluck("hash", &leaves)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return leaves, nil
+}
@@ -2,63 +2,511 @@ package service
 
 import (
 	"back_Blockchain_cold_chain_traceability_system/configs"
-	"crypto/sha256"
-	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"net/http"
+	"strconv"
 	"time"
 )
 
 // BlockchainService 实现区块链相关功能
 type BlockchainService struct{}
 
-// 生成哈希值
-func generateHash(data string, previousHash string, timestamp time.Time) string {
-	h := sha256.New()
-	h.Write([]byte(data + previousHash + timestamp.String()))
-	return hex.EncodeToString(h.Sum(nil))
-}
+// ErrLedgerWrite 区块写入失败
+var ErrLedgerWrite = errors.New("写入区块链失败")
 
 // AddToBlockchain 添加记录到区块链
-func (s *BlockchainService) AddToBlockchain(productSKU string, recordType int, data string) (string, error) {
-	// 获取最新的区块哈希作为前一个哈希
-	var lastBlock configs.BlockchainLog
+// signerID 为提交记录的用户，区块使用该用户的密钥签名
+func (s *BlockchainService) AddToBlockchain(productSKU string, recordType int, data string, signerID uint) (string, error) {
+	var hash string
+	err := ledgerTransaction(func(tx *gorm.DB) error {
+		var err error
+		hash, err = s.AddToBlockchainTx(tx, productSKU, recordType, data, signerID)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return hash, nil
+}
+
+// ledgerTransaction 在事务中写入业务记录和区块
+// 事务提交后才通知出块器、文件账本镜像和投影，它们读取时一定能看到新区块
+// 共识模式下由共识节点分两步提交到集群，见 ConsensusNode.transaction
+func ledgerTransaction(fn func(tx *gorm.DB) error) error {
+	var err error
+	if consensusNode != nil {
+		err = consensusNode.transaction(fn)
+	} else {
+		err = configs.DB.Transaction(fn)
+	}
+	if err != nil {
+		return err
+	}
+	notifyLedgerWatchers()
+	return nil
+}
+
+// AddToBlockchainTx 在调用方的事务中添加记录到区块链
+// 业务记录和区块在同一事务中写入，任何一步失败都会整体回滚
+// 事务需通过 ledgerTransaction 开启，提交后才会通知账本的订阅者
+func (s *BlockchainService) AddToBlockchainTx(tx *gorm.DB, productSKU string, recordType int, data string, signerID uint) (string, error) {
+	block, err := appendBlock(tx, productSKU, recordType, data, signerID)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrLedgerWrite, err)
+	}
+	return block.Hash, nil
+}
+
+// 锁定账本锁行，同一事务中可以重复锁定
+func lockLedger(tx *gorm.DB) error {
+	var lock configs.LedgerLock
+	return tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&lock, configs.LedgerLockID).Error
+}
+
+// 在事务中追加区块
+// 先锁定账本锁行，再读取链头，并发写入者会在锁上排队，不会基于同一个链头生成分叉区块
+func appendBlock(tx *gorm.DB, productSKU string, recordType int, data string, signerID uint) (*configs.BlockchainLog, error) {
+	if err := lockLedger(tx); err != nil {
+		return nil, err
+	}
+
+	// 共识模式下只有主节点可以追加区块，且本地账本必须已追上集群
+	write := ledgerWriteOf(tx)
+	if consensusNode != nil {
+		if write == nil {
+			return nil, errors.New("共识模式下区块必须在 ledgerTransaction 开启的事务中写入")
+		}
+		if !write.ready {
+			if err := consensusNode.prepareAppend(tx); err != nil {
+				return nil, err
+			}
+			write.ready = true
+		}
+	}
+
+	// 获取签名者的密钥，首次签名时生成的密钥会先写入登记区块，因此要在读取链头之前获取
+	key, err := activeUserKey(tx, signerID)
+	if err != nil {
+		return nil, err
+	}
+
+	ledger := NewGormLedger(tx)
+
+	// 获取该SKU最新的区块哈希作为前一个哈希
 	var previousHash string
 	var blockHeight int64 = 1 // 默认是第一个区块
 
-	result := configs.DB.Where("product_sku = ?", productSKU).
-		Order("created_at DESC").
-		First(&lastBlock)
-
-	if result.Error == nil {
+	lastBlock, err := ledger.Head(productSKU)
+	if err == nil {
 		previousHash = lastBlock.Hash
 		blockHeight = lastBlock.BlockHeight + 1
+	} else if !errors.Is(err, ErrBlockNotFound) {
+		return nil, err
 	}
 
-	// 生成当前区块哈希
-	timestamp := time.Now()
-	hash := generateHash(data, previousHash, timestamp)
+	// 获取全局账本最新的区块
+	var globalPreviousHash string
+	var globalHeight int64 = 1
+
+	lastGlobalBlock, err := ledger.Head("")
+	if err == nil {
+		globalPreviousHash = lastGlobalBlock.Hash
+		globalHeight = lastGlobalBlock.GlobalHeight + 1
+	} else if !errors.Is(err, ErrBlockNotFound) {
+		return nil, err
+	}
 
-	// 创建区块记录
+	// 创建区块记录，时间戳单独存储，保证验证时能逐字节复现区块头
 	block := configs.BlockchainLog{
-		ProductSKU:   productSKU,
-		RecordType:   recordType,
-		RecordData:   data,
-		Hash:         hash,
-		PreviousHash: previousHash,
-		BlockHeight:  blockHeight,
+		ProductSKU:         productSKU,
+		RecordType:         recordType,
+		RecordData:         data,
+		PreviousHash:       previousHash,
+		BlockHeight:        blockHeight,
+		GlobalHeight:       globalHeight,
+		GlobalPreviousHash: globalPreviousHash,
+		HashVersion:        HashVersionSigned,
+		Timestamp:          time.Now().UnixNano(),
+	}
+	if err := signBlock(&block, key); err != nil {
+		return nil, err
+	}
+	block.Hash = headerOf(block).Hash()
+
+	if err := ledger.Append(&block); err != nil {
+		return nil, err
+	}
+
+	// 区块在事务提交前由 ledgerTransaction 统一提交到集群
+	if consensusNode != nil {
+		write.blocks = append(write.blocks, block)
+	}
+
+	return &block, nil
+}
+
+// 链验证结果
+// Valid 只表示没有发现错误，Verified 表示每个区块的哈希（和签名）都已重新计算并通过
+type chainVerifyResult struct {
+	Valid            bool          `json:"valid"`
+	Verified         bool          `json:"verified"`
+	TotalBlocks      int           `json:"total_blocks"`
+	InvalidBlock     int           `json:"invalid_block,omitempty"` // 出错区块在链中的序号（从1开始）
+	Reason           string        `json:"reason,omitempty"`
+	LegacyUnverified int           `json:"legacy_unverified,omitempty"` // 旧方案无法复现哈希、只校验了链接关系的区块数
+	LegacyExcluded   int           `json:"legacy_excluded,omitempty"`   // 全局账本引入之前、不在全局链中的旧版区块数
+	Warning          string        `json:"warning,omitempty"`
+	Signers          []blockSigner `json:"signers,omitempty"`
+	SnapshotID       uint          `json:"snapshot_id,omitempty"`  // 从快照开始验证时的快照ID
+	StartHeight      int64         `json:"start_height,omitempty"` // 快照中的链头高度，验证从它之后的区块开始
+
+	// 打包区块的可信时间戳，只在验证打包区块链时填写
+	Timestamped        int    `json:"timestamped,omitempty"`         // 时间戳令牌验证通过的区块数
+	TimestampMissing   int    `json:"timestamp_missing,omitempty"`   // 尚未盖时间戳的区块数
+	TimestampUnchecked int    `json:"timestamp_unchecked,omitempty"` // 未配置时间戳服务证书、无法验证令牌的区块数
+	TimestampWarning   string `json:"timestamp_warning,omitempty"`
+}
+
+// 区块签名者
+type blockSigner struct {
+	Block       int    `json:"block"` // 区块在链中的序号（从1开始）
+	Hash        string `json:"hash"`
+	SignerID    uint   `json:"signer_id"`
+	SignerName  string `json:"signer_name"`
+	SignerKeyID uint   `json:"signer_key_id"`
+}
+
+// 验证单个SKU的区块链
+func verifySKUChain(blocks []configs.BlockchainLog, keys map[uint]configs.UserKey) chainVerifyResult {
+	return verifyChain(blocks, keys, false)
+}
+
+// 验证全局账本，区块高度必须从1开始连续，用于发现被整条删除的SKU链
+func verifyGlobalChain(blocks []configs.BlockchainLog, keys map[uint]configs.UserKey) chainVerifyResult {
+	return verifyChain(blocks, keys, true)
+}
+
+func verifyChain(blocks []configs.BlockchainLog, keys map[uint]configs.UserKey, global bool) chainVerifyResult {
+	v := newChainVerifier(global, chainStart{})
+	v.add(blocks, keys)
+	return v.res
+}
+
+// 链验证的起点，从快照开始验证时为快照中的链头，第一个待验证区块应接在它之后
+type chainStart struct {
+	Height int64
+	Hash   string
+}
+
+// 增量的链验证器，区块可以分批加入，避免一次加载整条链
+type chainVerifier struct {
+	global       bool
+	res          chainVerifyResult
+	checked      int   // 已检查的区块数
+	height       int64 // 全局链中上一个区块的高度
+	previousHash string
+	lastVersion  int
+	legacyCutoff uint                     // 第一个新版区块的ID，之后写入的区块不可能是旧版区块，0 表示不检查
+	keys         map[uint]configs.UserKey // 账本中登记的签名密钥，第一次加入区块时加载
+}
+
+func newChainVerifier(global bool, start chainStart) *chainVerifier {
+	return &chainVerifier{
+		global:       global,
+		res:          chainVerifyResult{Valid: true, Verified: true},
+		height:       start.Height,
+		previousHash: start.Hash,
+		lastVersion:  HashVersionLegacy,
+	}
+}
+
+// 加入一批区块，发现错误后返回false，之后加入的区块不再验证
+func (v *chainVerifier) add(blocks []configs.BlockchainLog, keys map[uint]configs.UserKey) bool {
+	v.res.TotalBlocks += len(blocks)
+	if !v.res.Valid {
+		return false
+	}
+
+	fail := func(reason string) bool {
+		v.res.Valid = false
+		v.res.Verified = false
+		v.res.InvalidBlock = v.checked
+		v.res.Reason = reason
+		return false
 	}
 
-	result = configs.DB.Create(&block)
+	for _, block := range blocks {
+		v.checked++
+		if v.global {
+			if block.GlobalHeight != v.height+1 {
+				return fail("全局区块高度不连续，可能有区块被删除")
+			}
+			if block.GlobalPreviousHash != v.previousHash {
+				return fail("全局前置哈希不匹配")
+			}
+			v.height = block.GlobalHeight
+		} else if block.PreviousHash != v.previousHash {
+			// 第一个区块的前置哈希应为空（或起点区块的哈希），其余区块的前置哈希应与上一区块匹配
+			return fail("前置哈希不匹配")
+		}
+
+		// 哈希版本只能升级，旧版区块不能出现在新版区块之后
+		if block.HashVersion < v.lastVersion {
+			return fail("旧版区块出现在新版区块之后")
+		}
+		v.lastVersion = block.HashVersion
+
+		// 把新版区块的哈希版本改为0就能跳过哈希检查，旧版区块不能带有新版区块才有的字段
+		if block.HashVersion == HashVersionLegacy && downgradedLegacyBlock(block, v.legacyCutoff) {
+			return fail("旧版区块带有新版区块的字段，哈希版本可能被降级")
+		}
+
+		// 检查哈希值是否正确
+		// 旧版区块的哈希依赖数据库时间精度，可能无法复现，此时只能检查链接关系，整条链不算完全验证
+		// legacy_status 不参与哈希、可以被随意改写，不能据此跳过检查
+		if computeBlockHash(block) != block.Hash {
+			if block.HashVersion != HashVersionLegacy {
+				return fail("区块哈希不匹配")
+			}
+			v.res.LegacyUnverified++
+		}
+
+		// 检查签名，不提供密钥时（如独立的文件账本）只验证哈希链
+		if block.HashVersion >= HashVersionSigned && keys != nil {
+			if reason := checkBlockSignature(block, keys); reason != "" {
+				return fail(reason)
+			}
+			v.res.Signers = append(v.res.Signers, blockSigner{
+				Block:       v.checked,
+				Hash:        block.Hash,
+				SignerID:    block.SignerID,
+				SignerKeyID: block.SignerKeyID,
+			})
+		}
+
+		v.previousHash = block.Hash
+	}
+	v.res.Verified = v.res.LegacyUnverified == 0
+	return true
+}
+
+// 旧版区块写入时还没有全局链、签名和打包，也不会写在第一个新版区块之后
+// 带有这些字段或ID在 cutoff 之后的旧版区块是被降级的新版区块
+func downgradedLegacyBlock(block configs.BlockchainLog, cutoff uint) bool {
+	if block.GlobalHeight != 0 || block.GlobalPreviousHash != "" || block.SealedHeight != 0 ||
+		block.SignerID != 0 || block.SignerKeyID != 0 || block.Signature != "" {
+		return true
+	}
+	return cutoff != 0 && block.ID >= cutoff
+}
+
+// 第一个新版区块的ID，没有新版区块时返回0
+// 归档只移走全局链中的区块，剩下的新版区块ID只会更大，不会把真正的旧版区块误判为降级
+func legacyCutoff(db *gorm.DB) (uint, error) {
+	var cutoff uint
+	err := db.Model(&configs.BlockchainLog{}).
+		Where("hash_version > ?", HashVersionLegacy).
+		Select("COALESCE(MIN(id), 0)").
+		Scan(&cutoff).Error
+	return cutoff, err
+}
+
+// 用账本中登记的签名密钥验证一批区块
+func (v *chainVerifier) addWithKeys(blocks []configs.BlockchainLog) (bool, error) {
+	if v.keys == nil {
+		keys, err := ledgerSignerKeys(configs.DB)
+		if err != nil {
+			return false, err
+		}
+		v.keys = keys
+	}
+	return v.add(blocks, v.keys), nil
+}
+
+// 结束验证并补全签名者名称
+func (v *chainVerifier) finish() (chainVerifyResult, error) {
+	res := v.res
+	if len(res.Signers) > 0 {
+		var ids []uint
+		for _, signer := range res.Signers {
+			ids = append(ids, signer.SignerID)
+		}
+		var users []configs.User
+		if err := configs.DB.Select("id, real_name").Where("id IN ?", ids).Find(&users).Error; err != nil {
+			return res, err
+		}
+		names := make(map[uint]string)
+		for _, user := range users {
+			names[user.ID] = user.RealName
+		}
+		for i := range res.Signers {
+			res.Signers[i].SignerName = names[res.Signers[i].SignerID]
+		}
+	}
+
+	return res, nil
+}
+
+// 验证区块链并补全签名者名称
+func verifyBlocks(blocks []configs.BlockchainLog, global bool) (chainVerifyResult, error) {
+	v := newChainVerifier(global, chainStart{})
+	cutoff, err := legacyCutoff(configs.DB)
+	if err != nil {
+		return chainVerifyResult{}, err
+	}
+	v.legacyCutoff = cutoff
+	if _, err := v.addWithKeys(blocks); err != nil {
+		return chainVerifyResult{}, err
+	}
+	return v.finish()
+}
+
+// MigrateLegacyBlocks 用旧哈希方案重新验证尚未检查过的旧版区块
+// 只回填时间戳并记录验证结果，不改写区块哈希，避免破坏已有的链接关系
+func MigrateLegacyBlocks() (verified int, unverifiable int, err error) {
+	var blocks []configs.BlockchainLog
+	result := configs.DB.Where("hash_version = ? AND legacy_status = ?", HashVersionLegacy, LegacyStatusUnchecked).
+		Order("id").
+		Find(&blocks)
 	if result.Error != nil {
-		return "", result.Error
+		return 0, 0, result.Error
 	}
 
-	return hash, nil
+	for _, block := range blocks {
+		status := LegacyStatusVerified
+		if computeBlockHash(block) != block.Hash {
+			status = LegacyStatusUnverifiable
+			unverifiable++
+		} else {
+			verified++
+		}
+
+		result = configs.DB.Model(&configs.BlockchainLog{}).
+			Where("id = ?", block.ID).
+			Updates(map[string]interface{}{
+				"legacy_status": status,
+				"timestamp":     block.CreatedAt.UnixNano(),
+			})
+		if result.Error != nil {
+			return verified, unverifiable, result.Error
+		}
+	}
+
+	return verified, unverifiable, nil
+}
+
+// 验证打包区块链，逐块重算Merkle根和区块哈希，并用时间戳服务证书验证时间戳令牌
+// 从快照开始验证时 start 为快照中的打包区块
+func verifySealedChain(blocks []configs.SealedBlock, start chainStart) (chainVerifyResult, error) {
+	res := chainVerifyResult{Valid: true, Verified: true, TotalBlocks: len(blocks), StartHeight: start.Height}
+	previousHash := start.Hash
+	trusted, trustErr := trustedTSACertificates()
+	// 封块后超过时间戳期限仍没有令牌的区块不会再补盖，只有启用时间戳服务之前封的区块允许缺少令牌
+	cfg := configs.GlobalTimestampConfig
+	deadline := time.Now().Add(-cfg.Window).UnixNano()
+	stamping := false
+
+	for i, block := range blocks {
+		res.InvalidBlock = i + 1
+		if block.Height != start.Height+int64(i+1) {
+			res.Valid = false
+			res.Verified = false
+			res.Reason = "打包区块高度不连续，可能有区块被删除"
+			return res, nil
+		}
+		if block.PreviousHash != previousHash {
+			res.Valid = false
+			res.Verified = false
+			res.Reason = "打包区块前置哈希不匹配"
+			return res, nil
+		}
+		if sealedHeaderOf(block).Hash() != block.Hash {
+			res.Valid = false
+			res.Verified = false
+			res.Reason = "打包区块哈希不匹配"
+			return res, nil
+		}
+
+		leaves, err := sealedBlockLeaves(block)
+		if err != nil {
+			return res, err
+		}
+		if len(leaves) != block.RecordCount {
+			res.Valid = false
+			res.Verified = false
+			res.Reason = "打包区块记录数不匹配"
+			return res, nil
+		}
+		root, err := MerkleRoot(leaves)
+		if err != nil || root != block.MerkleRoot {
+			res.Valid = false
+			res.Verified = false
+			res.Reason = "Merkle根不匹配"
+			return res, nil
+		}
+
+		switch {
+		case block.TSAToken == "" && stamping && trustErr == nil && block.Timestamp < deadline:
+			res.Valid = false
+			res.Verified = false
+			res.Reason = "打包区块缺少时间戳令牌"
+			return res, nil
+		case block.TSAToken == "":
+			res.TimestampMissing++
+		case trustErr != nil:
+			res.TimestampUnchecked++
+			res.TimestampWarning = trustErr.Error()
+		default:
+			digest, err := sealedBlockDigest(block)
+			var info *timestampInfo
+			if err == nil {
+				info, err = verifyTimestampToken(block.TSAToken, digest, trusted)
+			}
+			if err != nil {
+				res.Valid = false
+				res.Verified = false
+				res.Reason = "时间戳令牌无效: " + err.Error()
+				return res, nil
+			}
+			// 时间戳只在封块后的期限内申请，时间不在这个范围内说明区块被改写后重新盖了时间戳
+			sealedAt := time.Unix(0, block.Timestamp)
+			if info.Time.Before(sealedAt.Add(-cfg.ClockSkew)) || info.Time.After(sealedAt.Add(cfg.Window)) {
+				res.Valid = false
+				res.Verified = false
+				res.Reason = "时间戳时间与打包区块时间不符"
+				return res, nil
+			}
+			res.Timestamped++
+		}
+		if block.TSAToken != "" {
+			stamping = true
+		}
+
+		previousHash = block.Hash
+	}
+
+	res.InvalidBlock = 0
+	return res, nil
 }
 
 // VerifyBlockchain 验证区块链完整性
+// mode=global 时验证整个全局账本，mode=sealed 时验证打包区块链，否则验证指定SKU的链
 func (s *BlockchainService) VerifyBlockchain(c *gin.Context) {
+	switch c.Query("mode") {
+	case "global":
+		s.verifyGlobalLedger(c)
+		return
+	case "sealed":
+		s.verifySealedBlocks(c)
+		return
+	}
+
 	productSKU := c.Query("sku")
 	if productSKU == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -68,21 +516,17 @@ func (s *BlockchainService) VerifyBlockchain(c *gin.Context) {
 		return
 	}
 
-	// 查询所有区块
-	var blocks []configs.BlockchainLog
-	result := configs.DB.Where("product_sku = ?", productSKU).
-		Order("created_at").
-		Find(&blocks)
-
-	if result.Error != nil {
+	// 默认从最新快照开始验证，full=1 时从第一个区块开始，包括已归档的区块
+	res, found, err := verifySKULedger(productSKU, c.Query("full") == "1")
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    500,
-			"message": "查询区块链记录失败",
+			"message": "验证区块链失败",
 		})
 		return
 	}
 
-	if len(blocks) == 0 {
+	if !found {
 		c.JSON(http.StatusNotFound, gin.H{
 			"code":    404,
 			"message": "未找到区块链记录",
@@ -90,63 +534,253 @@ func (s *BlockchainService) VerifyBlockchain(c *gin.Context) {
 		return
 	}
 
-	// 验证每个区块
-	valid := true
-	invalidBlock := 0
-	var previousHash string
+	message := "区块链验证通过"
+	if !res.Valid {
+		message = "区块链验证失败"
+	} else if !res.Verified {
+		message = "区块链未发现错误，但部分区块未能完全验证"
+	}
 
-	for i, block := range blocks {
-		if i == 0 {
-			// 第一个区块，检查前置哈希是否为空
-			if block.PreviousHash != "" {
-				valid = false
-				invalidBlock = i + 1
-				break
-			}
-		} else {
-			// 检查前置哈希是否匹配
-			if block.PreviousHash != previousHash {
-				valid = false
-				invalidBlock = i + 1
-				break
-			}
-		}
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": message,
+		"data":    res,
+	})
+}
 
-		// 检查哈希值是否正确
-		calculatedHash := generateHash(block.RecordData, block.PreviousHash, block.CreatedAt)
-		if calculatedHash != block.Hash {
-			valid = false
-			invalidBlock = i + 1
-			break
+// 验证全局账本
+func (s *BlockchainService) verifyGlobalLedger(c *gin.Context) {
+	ledger := NewGormLedger(configs.DB)
+	head, err := ledger.Head("")
+	if err != nil {
+		if errors.Is(err, ErrBlockNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"code":    404,
+				"message": "未找到区块链记录",
+			})
+			return
 		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "查询区块链记录失败",
+		})
+		return
+	}
 
-		previousHash = block.Hash
+	// 默认从最新快照开始验证，full=1 时验证整个账本
+	var res chainVerifyResult
+	snapshot, err := latestSnapshot(configs.DB)
+	switch {
+	case errors.Is(err, ErrSnapshotUntrusted):
+		res = chainVerifyResult{Reason: err.Error()}
+	case err != nil:
+	case snapshot == nil || c.Query("full") == "1":
+		res, err = ledger.Verify()
+	default:
+		res, err = ledger.VerifyFrom(chainStart{Height: snapshot.GlobalHeight, Hash: snapshot.GlobalHash}, head.GlobalHeight)
+		res.SnapshotID = snapshot.ID
+		res.StartHeight = snapshot.GlobalHeight
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "验证全局账本失败",
+		})
+		return
 	}
 
-	if valid {
-		c.JSON(http.StatusOK, gin.H{
-			"code":    200,
-			"message": "区块链验证通过",
-			"data": gin.H{
-				"valid":        true,
-				"total_blocks": len(blocks),
-			},
+	// 全局账本引入之前的区块没有全局高度，只能按SKU验证
+	excluded, err := legacyExcludedBlocks(configs.DB)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "查询旧版区块失败",
 		})
-	} else {
+		return
+	}
+	if excluded > 0 {
+		res.LegacyExcluded = int(excluded)
+		res.Verified = false
+		res.Warning = fmt.Sprintf("%d 个全局账本引入之前的旧版区块不在全局链中，全局验证、快照和归档都不覆盖这些区块，请按SKU验证", excluded)
+	}
+
+	message := "全局账本验证通过"
+	if !res.Valid {
+		message = "全局账本验证失败"
+	} else if !res.Verified {
+		message = "全局账本未发现错误，但部分区块未能完全验证"
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": message,
+		"data":    res,
+	})
+}
+
+// 不在全局链中的旧版区块数
+// 这些区块的哈希计算时还没有全局前置哈希，补入全局链会使哈希无法复现，因此不做回填
+func legacyExcludedBlocks(db *gorm.DB) (int64, error) {
+	var count int64
+	err := db.Model(&configs.BlockchainLog{}).Where("global_height = 0").Count(&count).Error
+	return count, err
+}
+
+// 验证打包区块链
+func (s *BlockchainService) verifySealedBlocks(c *gin.Context) {
+	// 默认从最新快照中的打包区块之后开始验证，full=1 时验证全部打包区块
+	var start chainStart
+	var snapshotID uint
+	snapshot, err := latestSnapshot(configs.DB)
+	if errors.Is(err, ErrSnapshotUntrusted) {
 		c.JSON(http.StatusOK, gin.H{
 			"code":    200,
-			"message": "区块链验证失败",
-			"data": gin.H{
-				"valid":         false,
-				"invalid_block": invalidBlock,
-				"total_blocks":  len(blocks),
-				// 续上段代码
-			},
+			"message": "打包区块验证失败",
+			"data":    chainVerifyResult{Reason: err.Error()},
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "查询快照失败",
+		})
+		return
+	}
+	if snapshot != nil && c.Query("full") != "1" {
+		start = chainStart{Height: snapshot.SealedHeight, Hash: snapshot.SealedHash}
+		snapshotID = snapshot.ID
+	}
+
+	var blocks []configs.SealedBlock
+	result := configs.DB.Where("height > ?", start.Height).Order("height").Find(&blocks)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "查询打包区块失败",
 		})
+		return
+	}
+
+	if len(blocks) == 0 && snapshotID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "未找到打包区块",
+		})
+		return
+	}
+
+	res, err := verifySealedChain(blocks, start)
+	res.SnapshotID = snapshotID
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "查询打包区块记录失败",
+		})
+		return
+	}
+
+	message := "打包区块验证通过"
+	if !res.Valid {
+		message = "打包区块验证失败"
 	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": message,
+		"data":    res,
+	})
 }
 
-// GetBlockchainData 获取区块链数据
+// GetRecordProof 获取记录在打包区块中的Merkle包含证明
+func (s *BlockchainService) GetRecordProof(c *gin.Context) {
+	recordID, err := strconv.ParseUint(c.Query("record_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "请提供正确的记录ID",
+		})
+		return
+	}
+
+	// 已归档的记录从冷存储读取，打包区块的叶子同样从冷存储重建
+	record, _, err := blockByID(uint(recordID))
+	if errors.Is(err, ErrBlockNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "未找到区块链记录",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "查询区块链记录失败",
+		})
+		return
+	}
+
+	if record.SealedHeight == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "记录尚未打包进区块，请稍后再试",
+		})
+		return
+	}
+
+	var block configs.SealedBlock
+	result := configs.DB.Where("height = ?", record.SealedHeight).First(&block)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "查询打包区块失败",
+		})
+		return
+	}
+
+	leaves, err := sealedBlockLeaves(block)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "查询打包区块记录失败",
+		})
+		return
+	}
+
+	proof, err := MerkleProof(leaves, record.LeafIndex)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "生成Merkle证明失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "获取Merkle证明成功",
+		"data": gin.H{
+			"record_id":   record.ID,
+			"product_sku": record.ProductSKU,
+			"leaf_hash":   record.Hash,
+			"leaf_index":  record.LeafIndex,
+			"proof":       proof,
+			"merkle_root": block.MerkleRoot,
+			"block": gin.H{
+				"height":        block.Height,
+				"hash":          block.Hash,
+				"previous_hash": block.PreviousHash,
+				"record_count":  block.RecordCount,
+				"timestamp":     block.Timestamp,
+			},
+		},
+	})
+}
+
+// 分页获取区块链数据时每页的最大区块数
+const chainPageSize = 1000
+
+// GetBlockchainData 获取区块链数据，cursor 为上一页最后一个区块的区块高度
 func (s *BlockchainService) GetBlockchainData(c *gin.Context) {
 	productSKU := c.Query("sku")
 	if productSKU == "" {
@@ -157,13 +791,26 @@ func (s *BlockchainService) GetBlockchainData(c *gin.Context) {
 		return
 	}
 
-	// 查询所有区块
-	var blocks []configs.BlockchainLog
-	result := configs.DB.Where("product_sku = ?", productSKU).
-		Order("created_at ASC").
-		Find(&blocks)
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(chainPageSize)))
+	if limit < 1 || limit > chainPageSize {
+		limit = chainPageSize
+	}
+	var cursor int64
+	if value := c.Query("cursor"); value != "" {
+		var err error
+		cursor, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": "cursor 参数错误",
+			})
+			return
+		}
+	}
 
-	if result.Error != nil {
+	// 按区块高度分页查询，包括已归档的区块
+	blocks, err := skuBlocksPage(configs.DB, productSKU, cursor, limit)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    500,
 			"message": "查询区块链记录失败",
@@ -171,10 +818,95 @@ func (s *BlockchainService) GetBlockchainData(c *gin.Context) {
 		return
 	}
 
+	// 不足一页说明已经到链头
+	var nextCursor string
+	if len(blocks) == limit {
+		nextCursor = strconv.FormatInt(blocks[len(blocks)-1].BlockHeight, 10)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":        200,
+		"message":     "获取区块链数据成功",
+		"data":        withEvents(blocks),
+		"next_cursor": nextCursor,
+	})
+}
+
+// StreamBlockchain 以NDJSON格式逐行输出SKU的全部区块，包括已归档的区块，适合很长的链
+// 中途出错时输出一行 {"error": ...} 后结束
+func (s *BlockchainService) StreamBlockchain(c *gin.Context) {
+	productSKU := c.Query("sku")
+	if productSKU == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "请提供产品SKU",
+		})
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	encoder := json.NewEncoder(c.Writer)
+	var cursor int64
+	for {
+		blocks, err := skuBlocksPage(configs.DB, productSKU, cursor, chainPageSize)
+		if err != nil {
+			encoder.Encode(gin.H{"error": "查询区块链记录失败"})
+			return
+		}
+		for _, block := range withEvents(blocks) {
+			if err := encoder.Encode(block); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+		if len(blocks) < chainPageSize {
+			return
+		}
+		cursor = blocks[len(blocks)-1].BlockHeight
+	}
+}
+
+// GetSignerKeys 获取用户的全部签名公钥（含已吊销的），用于独立验证区块签名
+func (s *BlockchainService) GetSignerKeys(c *gin.Context) {
+	userID := c.Query("user_id")
+	if userID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "请提供用户ID",
+		})
+		return
+	}
+
+	var keys []configs.UserKey
+	result := configs.DB.Where("user_id = ?", userID).
+		Order("valid_from").
+		Find(&keys)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "查询签名密钥失败",
+		})
+		return
+	}
+
+	// 不返回托管私钥
+	var responseKeys []gin.H
+	for _, key := range keys {
+		responseKeys = append(responseKeys, gin.H{
+			"key_id":     key.ID,
+			"user_id":    key.UserID,
+			"algorithm":  key.Algorithm,
+			"public_key": key.PublicKey,
+			"valid_from": key.ValidFrom,
+			"revoked_at": key.RevokedAt,
+		})
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"code":    200,
-		"message": "获取区块链数据成功",
-		"data":    blocks,
+		"message": "获取签名密钥成功",
+		"data":    responseKeys,
 	})
 }
 
@@ -187,5 +919,30 @@ func SetupBlockchainRoutes(router *gin.Engine) {
 	{
 		publicGroup.GET("/verify", blockchainService.VerifyBlockchain)
 		publicGroup.GET("/data", blockchainService.GetBlockchainData)
+		publicGroup.GET("/stream", blockchainService.StreamBlockchain)
+		publicGroup.GET("/proof", blockchainService.GetRecordProof)
+		publicGroup.GET("/keys", blockchainService.GetSignerKeys)
+		publicGroup.GET("/crosscheck", blockchainService.CrossCheckLedger)
+		publicGroup.GET("/checkpoints", blockchainService.GetCheckpoints)
+		publicGroup.POST("/checkpoints/verify", blockchainService.VerifyCheckpoint)
+		publicGroup.GET("/server-key", blockchainService.GetServerKey)
+		publicGroup.GET("/export", blockchainService.ExportEvidence)
+		publicGroup.GET("/block", blockchainService.GetBlockByHash)
+		publicGroup.GET("/blocks", blockchainService.GetRecentBlocks)
+		publicGroup.GET("/summary", blockchainService.GetChainSummary)
+		publicGroup.GET("/stats", blockchainService.GetChainStats)
+		publicGroup.GET("/anchors", blockchainService.GetAnchors)
+		publicGroup.GET("/anchors/verify", blockchainService.VerifyAnchor)
+		publicGroup.GET("/tsa-cert", blockchainService.GetTSACertificate)
+		publicGroup.GET("/files/verify", blockchainService.VerifyFiles)
+		publicGroup.GET("/snapshots", blockchainService.GetSnapshots)
+		publicGroup.GET("/snapshots/:id", blockchainService.GetSnapshot)
+		publicGroup.GET("/archive/proof", blockchainService.GetArchiveProof)
+		publicGroup.GET("/state", blockchainService.GetProductState)
+	}
+
+	// 本地RFC 3161时间戳服务，请求体为DER编码的时间戳请求，需在配置中打开
+	if configs.GlobalTimestampConfig.ServeLocal {
+		router.POST("/api/tsa", blockchainService.TimestampQuery)
 	}
 }
@@ -0,0 +1,298 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 构造一条哈希正确的全局链，skus[i] 为第 i+1 个区块的SKU
+func testGlobalChain(skus ...string) []configs.BlockchainLog {
+	var blocks []configs.BlockchainLog
+	heads := make(map[string]configs.BlockchainLog)
+	for i, sku := range skus {
+		block := configs.BlockchainLog{
+			ProductSKU:   sku,
+			RecordType:   1,
+			RecordData:   `{"n":` + strconv.Itoa(i) + `}`,
+			GlobalHeight: int64(i + 1),
+			HashVersion:  HashVersionCanonical,
+			Timestamp:    int64(1700000000000000000 + i),
+		}
+		if i > 0 {
+			block.GlobalPreviousHash = blocks[i-1].Hash
+		}
+		if head, ok := heads[sku]; ok {
+			block.PreviousHash = head.Hash
+			block.BlockHeight = head.BlockHeight + 1
+		} else {
+			block.BlockHeight = 1
+		}
+		block.Hash = computeBlockHash(block)
+		heads[sku] = block
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+func TestVerifyGlobalChain(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func([]configs.BlockchainLog) []configs.BlockchainLog
+		valid   bool
+		invalid int
+		reason  string
+	}{
+		{
+			name:   "完整的链",
+			mutate: func(b []configs.BlockchainLog) []configs.BlockchainLog { return b },
+			valid:  true,
+		},
+		{
+			name: "删除中间区块",
+			mutate: func(b []configs.BlockchainLog) []configs.BlockchainLog {
+				return append(b[:2:2], b[3:]...)
+			},
+			invalid: 3,
+			reason:  "全局区块高度不连续，可能有区块被删除",
+		},
+		{
+			name: "删除整条SKU链",
+			mutate: func(b []configs.BlockchainLog) []configs.BlockchainLog {
+				var kept []configs.BlockchainLog
+				for _, block := range b {
+					if block.ProductSKU != "B" {
+						kept = append(kept, block)
+					}
+				}
+				return kept
+			},
+			invalid: 2,
+			reason:  "全局区块高度不连续，可能有区块被删除",
+		},
+		{
+			name: "改写全局前置哈希",
+			mutate: func(b []configs.BlockchainLog) []configs.BlockchainLog {
+				b[3].GlobalPreviousHash = "x"
+				return b
+			},
+			invalid: 4,
+			reason:  "全局前置哈希不匹配",
+		},
+		{
+			name: "篡改记录数据",
+			mutate: func(b []configs.BlockchainLog) []configs.BlockchainLog {
+				b[4].RecordData = `{"n":9}`
+				return b
+			},
+			invalid: 5,
+			reason:  "区块哈希不匹配",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocks := tt.mutate(testGlobalChain("A", "B", "A", "C", "A"))
+			res := verifyGlobalChain(blocks, nil)
+			if res.Valid != tt.valid || res.InvalidBlock != tt.invalid || res.Reason != tt.reason {
+				t.Fatalf("结果 %+v，期望 valid=%v invalid=%d reason=%q", res, tt.valid, tt.invalid, tt.reason)
+			}
+		})
+	}
+}
+
+func TestVerifyGlobalLedgerReportsLegacyBlocks(t *testing.T) {
+	testDB(t)
+	user := testUser(t, 1)
+
+	// 全局账本引入之前写入的区块没有全局高度
+	createdAt := time.Now().Truncate(time.Second)
+	legacy := configs.BlockchainLog{
+		ProductSKU: "SKU-LEGACY",
+		RecordType: 1,
+		RecordData: `{"legacy":true}`,
+	}
+	legacy.CreatedAt = createdAt
+	legacy.Hash = legacyHash(legacy.RecordData, "", "", createdAt)
+	if err := configs.DB.Create(&legacy).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	blockchainService := &BlockchainService{}
+	if _, err := blockchainService.AddToBlockchain("SKU-NEW", 1, `{"new":true}`, user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	SetupBlockchainRoutes(router)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/blockchain/verify?mode=global", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("状态码 %d: %s", w.Code, w.Body.String())
+	}
+
+	var body struct {
+		Data chainVerifyResult `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	// 新区块之前是签名者的密钥登记区块
+	if !body.Data.Valid || body.Data.TotalBlocks != 2 {
+		t.Fatalf("全局账本应只包含新区块且验证通过: %+v", body.Data)
+	}
+	if body.Data.Verified || body.Data.LegacyExcluded != 1 || body.Data.Warning == "" {
+		t.Fatalf("应报告不在全局链中的旧版区块: %+v", body.Data)
+	}
+}
+
+func TestVerifySKULedgerRejectsDowngradedBlocks(t *testing.T) {
+	tests := []struct {
+		name   string
+		before bool // 旧版区块是否写在第一个新版区块之前
+		valid  bool
+	}{
+		{name: "迁移前写入的旧版区块", before: true, valid: true},
+		// 字段全部清空的降级区块只能靠写入顺序发现
+		{name: "迁移后写入的旧版区块"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDB(t)
+			user := testUser(t, 1)
+			legacy := testLegacyBlock(`{"legacy":true}`, "", time.Now().Truncate(time.Second))
+			legacy.BlockHeight = 1
+			if tt.before {
+				configs.DB.Create(&legacy)
+			}
+			if _, err := (&BlockchainService{}).AddToBlockchain("SKU-NEW", 1, `{"new":true}`, user.ID); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.before {
+				configs.DB.Create(&legacy)
+			}
+
+			for _, full := range []bool{true, false} {
+				res, found, err := verifySKULedger(legacy.ProductSKU, full)
+				if err != nil || !found {
+					t.Fatalf("验证失败: %v", err)
+				}
+				if res.Valid != tt.valid || (!tt.valid && res.Reason != "旧版区块带有新版区块的字段，哈希版本可能被降级") {
+					t.Fatalf("full=%v 结果 %+v", full, res)
+				}
+			}
+		})
+	}
+}
+
+// 按接口验证区块链，返回验证结果
+func testVerifyRequest(t *testing.T, query string) chainVerifyResult {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	SetupBlockchainRoutes(router)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/blockchain/verify?"+query, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("状态码 %d: %s", w.Code, w.Body.String())
+	}
+	var body struct {
+		Data chainVerifyResult `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return body.Data
+}
+
+func TestConcurrentAppendsKeepChainsLinear(t *testing.T) {
+	testDB(t)
+	user := testUser(t, 2)
+
+	const workers, perWorker = 8, 15
+	blockchainService := &BlockchainService{}
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*perWorker)
+	hot := 0
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				// 大部分写入集中在同一个SKU，其余分散到各自的SKU，同时考验SKU链和全局链
+				sku := "SKU-HOT"
+				if i%3 == 0 {
+					sku = fmt.Sprintf("SKU-%d", w)
+				}
+				data := fmt.Sprintf(`{"worker":%d,"seq":%d}`, w, i)
+				if _, err := blockchainService.AddToBlockchain(sku, 2, data, user.ID); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	for i := 0; i < perWorker; i++ {
+		if i%3 != 0 {
+			hot += workers
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("并发写入失败: %v", err)
+	}
+
+	res := testVerifyRequest(t, "sku=SKU-HOT&full=1")
+	if !res.Valid || !res.Verified || res.TotalBlocks != hot {
+		t.Fatalf("SKU链验证失败: %+v", res)
+	}
+	res = testVerifyRequest(t, "mode=global&full=1")
+	if !res.Valid || !res.Verified || res.TotalBlocks != workers*perWorker {
+		t.Fatalf("全局账本验证失败: %+v", res)
+	}
+}
+
+func TestLedgerRejectsDuplicateHeights(t *testing.T) {
+	testDB(t)
+	user := testUser(t, 1)
+
+	blockchainService := &BlockchainService{}
+	if _, err := blockchainService.AddToBlockchain("SKU-1", 1, `{}`, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	var head configs.BlockchainLog
+	if err := configs.DB.First(&head).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// 绕过账本锁直接写入与链头高度相同的区块，数据库的唯一约束应拒绝
+	tests := []struct {
+		name  string
+		block configs.BlockchainLog
+	}{
+		{"SKU高度重复", configs.BlockchainLog{ProductSKU: "SKU-1", BlockHeight: head.BlockHeight, GlobalHeight: head.GlobalHeight + 1, HashVersion: HashVersionSigned, Hash: "fork"}},
+		{"全局高度重复", configs.BlockchainLog{ProductSKU: "SKU-2", BlockHeight: 1, GlobalHeight: head.GlobalHeight, HashVersion: HashVersionSigned, Hash: "fork"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := configs.DB.Create(&tt.block).Error; err == nil {
+				t.Fatal("重复高度的区块应被唯一约束拒绝")
+			}
+		})
+	}
+
+	// 旧版区块不受约束
+	legacy := configs.BlockchainLog{ProductSKU: "SKU-1", BlockHeight: head.BlockHeight, Hash: "legacy"}
+	if err := configs.DB.Create(&legacy).Error; err != nil {
+		t.Fatalf("旧版区块不应受唯一约束: %v", err)
+	}
+}
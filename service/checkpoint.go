@@ -0,0 +1,481 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// SKUHead 单个SKU的链头
+type SKUHead struct {
+	ProductSKU  string `json:"product_sku"`
+	BlockHeight int64  `json:"block_height"`
+	Hash        string `json:"hash"`
+}
+
+// Leaf SKU链头在Merkle树中的叶子哈希
+func (h SKUHead) Leaf() string {
+	buf := appendString(nil, h.ProductSKU)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.BlockHeight))
+	buf = appendString(buf, h.Hash)
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckpointHeader 检查点中被签名的部分，SKU链头通过Merkle根绑定
+type CheckpointHeader struct {
+	GlobalHeight int64
+	GlobalHash   string
+	SealedHeight int64
+	SealedHash   string
+	SKUCount     int
+	SKUHeadsRoot string
+	Timestamp    int64
+}
+
+// Encode 按固定字段顺序编码检查点头
+func (h CheckpointHeader) Encode() []byte {
+	buf := make([]byte, 0, 256)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.GlobalHeight))
+	buf = appendString(buf, h.GlobalHash)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.SealedHeight))
+	buf = appendString(buf, h.SealedHash)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(int64(h.SKUCount)))
+	buf = appendString(buf, h.SKUHeadsRoot)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.Timestamp))
+	return buf
+}
+
+// Checkpoint 对外发布的检查点，审计方可整体离线保存
+type Checkpoint struct {
+	ID           uint      `json:"id"`
+	GlobalHeight int64     `json:"global_height"`
+	GlobalHash   string    `json:"global_hash"`
+	SealedHeight int64     `json:"sealed_height"`
+	SealedHash   string    `json:"sealed_hash"`
+	SKUHeadsRoot string    `json:"sku_heads_root"`
+	SKUHeads     []SKUHead `json:"sku_heads"`
+	Timestamp    int64     `json:"timestamp"`
+	ServerKey    string    `json:"server_key"`
+	Signature    string    `json:"signature"`
+	TSAToken     string    `json:"tsa_token,omitempty"` // RFC 3161 时间戳令牌(base64 DER)，不在签名范围内
+}
+
+func (c Checkpoint) header() CheckpointHeader {
+	return CheckpointHeader{
+		GlobalHeight: c.GlobalHeight,
+		GlobalHash:   c.GlobalHash,
+		SealedHeight: c.SealedHeight,
+		SealedHash:   c.SealedHash,
+		SKUCount:     len(c.SKUHeads),
+		SKUHeadsRoot: c.SKUHeadsRoot,
+		Timestamp:    c.Timestamp,
+	}
+}
+
+// VerifySignature 验证检查点签名和SKU链头的Merkle根，签名公钥必须是账本中登记的服务端公钥
+// 检查点中附带的公钥由提交方提供，不能用来证明检查点出自本服务端
+// 更换服务端密钥之后，旧密钥在吊销之前签发的检查点仍然有效
+func (c Checkpoint) VerifySignature() error {
+	root := ""
+	if len(c.SKUHeads) > 0 {
+		leaves := make([]string, len(c.SKUHeads))
+		for i, head := range c.SKUHeads {
+			leaves[i] = head.Leaf()
+		}
+		var err error
+		root, err = MerkleRoot(leaves)
+		if err != nil {
+			return err
+		}
+	}
+	if root != c.SKUHeadsRoot {
+		return errors.New("SKU链头的Merkle根不匹配")
+	}
+	if err := checkServerKey(configs.DB, c.ServerKey, c.Timestamp); err != nil {
+		return err
+	}
+	if !verifyEd25519(c.ServerKey, c.Signature, c.header().Encode()) {
+		return errors.New("检查点签名无效")
+	}
+	return nil
+}
+
+func checkpointOf(record configs.LedgerCheckpoint) (Checkpoint, error) {
+	cp := Checkpoint{
+		ID:           record.ID,
+		GlobalHeight: record.GlobalHeight,
+		GlobalHash:   record.GlobalHash,
+		SealedHeight: record.SealedHeight,
+		SealedHash:   record.SealedHash,
+		SKUHeadsRoot: record.SKUHeadsRoot,
+		Timestamp:    record.Timestamp,
+		ServerKey:    record.ServerKey,
+		Signature:    record.Signature,
+		TSAToken:     record.TSAToken,
+	}
+	if record.SKUHeads != "" {
+		if err := json.Unmarshal([]byte(record.SKUHeads), &cp.SKUHeads); err != nil {
+			return cp, err
+		}
+	}
+	return cp, nil
+}
+
+// 查询所有SKU的链头，按SKU排序
+func loadSKUHeads(db *gorm.DB) ([]SKUHead, error) {
+	var heads []SKUHead
+	result := db.Raw(`SELECT b.product_sku, b.block_height, b.hash FROM blockchain_logs b
+		JOIN (SELECT product_sku, MAX(block_height) AS height FROM blockchain_logs
+			WHERE deleted_at IS NULL GROUP BY product_sku) m
+		ON b.product_sku = m.product_sku AND b.block_height = m.height
+		WHERE b.deleted_at IS NULL
+		ORDER BY b.product_sku`).Scan(&heads)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if archivedHeight() == 0 {
+		return heads, nil
+	}
+
+	// 全部区块都已归档的SKU不在数据库中，链头取自最新快照
+	snapshot, err := latestSnapshot(db)
+	if err != nil || snapshot == nil {
+		return heads, err
+	}
+	live := make(map[string]bool, len(heads))
+	for _, head := range heads {
+		live[head.ProductSKU] = true
+	}
+	for _, head := range snapshot.SKUHeads {
+		if !live[head.ProductSKU] {
+			heads = append(heads, head)
+		}
+	}
+	sort.Slice(heads, func(i, j int) bool {
+		return heads[i].ProductSKU < heads[j].ProductSKU
+	})
+	return heads, nil
+}
+
+// CreateCheckpoint 计算当前链头并用服务端密钥签名保存
+// 链头与上一个检查点相同时不重复生成，返回nil
+func CreateCheckpoint() (*configs.LedgerCheckpoint, error) {
+	var record *configs.LedgerCheckpoint
+	err := configs.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		record, err = createCheckpointTx(tx)
+		return err
+	})
+	if err != nil || record == nil {
+		return nil, err
+	}
+	notifyTimestamper()
+	return record, nil
+}
+
+// 持有账本锁读取全局链头、SKU链头和打包区块，读取期间没有新的区块写入，检查点中的链头相互一致
+func createCheckpointTx(tx *gorm.DB) (*configs.LedgerCheckpoint, error) {
+	if err := lockLedger(tx); err != nil {
+		return nil, err
+	}
+	ledger := NewGormLedger(tx)
+	head, err := ledger.Head("")
+	if errors.Is(err, ErrBlockNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var last configs.LedgerCheckpoint
+	result := tx.Order("id DESC").First(&last)
+	if result.Error == nil && last.GlobalHeight == head.GlobalHeight && last.GlobalHash == head.Hash {
+		return nil, nil
+	}
+
+	heads, err := loadSKUHeads(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	cp := Checkpoint{
+		GlobalHeight: head.GlobalHeight,
+		GlobalHash:   head.Hash,
+		SKUHeads:     heads,
+		Timestamp:    time.Now().UnixNano(),
+		ServerKey:    ServerPublicKey(),
+	}
+
+	var sealed configs.SealedBlock
+	if err := tx.Order("height DESC").First(&sealed).Error; err == nil {
+		cp.SealedHeight = sealed.Height
+		cp.SealedHash = sealed.Hash
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	if len(heads) > 0 {
+		leaves := make([]string, len(heads))
+		for i, h := range heads {
+			leaves[i] = h.Leaf()
+		}
+		cp.SKUHeadsRoot, err = MerkleRoot(leaves)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cp.Signature, err = signWithServerKey(cp.header().Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	headsJSON, err := json.Marshal(heads)
+	if err != nil {
+		return nil, err
+	}
+
+	record := configs.LedgerCheckpoint{
+		GlobalHeight: cp.GlobalHeight,
+		GlobalHash:   cp.GlobalHash,
+		SealedHeight: cp.SealedHeight,
+		SealedHash:   cp.SealedHash,
+		SKUCount:     len(heads),
+		SKUHeadsRoot: cp.SKUHeadsRoot,
+		SKUHeads:     string(headsJSON),
+		Timestamp:    cp.Timestamp,
+		ServerKey:    cp.ServerKey,
+		Signature:    cp.Signature,
+	}
+	if err := tx.Create(&record).Error; err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// StartCheckpointJob 定期生成检查点
+func StartCheckpointJob(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(configs.GlobalLedgerConfig.CheckpointEvery)
+		defer ticker.Stop()
+
+		for {
+			// 服务端公钥登记到账本之后签发的检查点才能通过验证，共识模式下只有主节点能登记成功
+			if err := RegisterServerKey(); err != nil {
+				log.Printf("登记服务端签名密钥失败: %v", err)
+			}
+			if _, err := CreateCheckpoint(); err != nil {
+				log.Printf("生成检查点失败: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// 检查点核对结果
+type checkpointCheckResult struct {
+	Consistent bool           `json:"consistent"`
+	Problems   []string       `json:"problems,omitempty"`
+	Timestamp  *timestampInfo `json:"timestamp,omitempty"` // 检查点附带时间戳令牌时的验证结果
+}
+
+// 核对检查点与当前账本，检查点中的每个链头都必须仍然存在且哈希不变
+// 由于区块通过哈希相互链接，链头不变且链验证通过就说明检查点之前的历史没有被改写
+func checkAgainstCheckpoint(cp Checkpoint) (checkpointCheckResult, error) {
+	res := checkpointCheckResult{Consistent: true}
+	problem := func(msg string) {
+		res.Consistent = false
+		res.Problems = append(res.Problems, msg)
+	}
+
+	ledger := NewGormLedger(configs.DB)
+	block, err := ledger.Get(cp.GlobalHeight)
+	if errors.Is(err, ErrBlockNotFound) {
+		problem("全局高度 " + strconv.FormatInt(cp.GlobalHeight, 10) + " 的区块不存在")
+	} else if err != nil {
+		return res, err
+	} else if block.Hash != cp.GlobalHash {
+		problem("全局高度 " + strconv.FormatInt(cp.GlobalHeight, 10) + " 的区块哈希已改变")
+	}
+
+	for _, head := range cp.SKUHeads {
+		var block configs.BlockchainLog
+		result := configs.DB.Where("product_sku = ? AND block_height = ?", head.ProductSKU, head.BlockHeight).First(&block)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) && archivedHeight() > 0 {
+			// 已归档的区块从冷存储查找
+			archived, err := ledgerArchive.SKUBlocksAfter(head.ProductSKU, head.BlockHeight-1, 1)
+			if err != nil {
+				return res, err
+			}
+			if len(archived) == 1 && archived[0].BlockHeight == head.BlockHeight {
+				block, result.Error = archived[0], nil
+			}
+		}
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			problem("SKU " + head.ProductSKU + " 高度 " + strconv.FormatInt(head.BlockHeight, 10) + " 的区块不存在")
+			continue
+		}
+		if result.Error != nil {
+			return res, result.Error
+		}
+		if block.Hash != head.Hash {
+			problem("SKU " + head.ProductSKU + " 高度 " + strconv.FormatInt(head.BlockHeight, 10) + " 的区块哈希已改变")
+		}
+	}
+
+	if cp.SealedHeight > 0 {
+		var sealed configs.SealedBlock
+		result := configs.DB.Where("height = ?", cp.SealedHeight).First(&sealed)
+		if result.Error != nil || sealed.Hash != cp.SealedHash {
+			problem("打包区块 " + strconv.FormatInt(cp.SealedHeight, 10) + " 不存在或哈希已改变")
+		}
+	}
+
+	verify, err := ledger.Verify()
+	if err != nil {
+		return res, err
+	}
+	if !verify.Valid {
+		problem("全局账本验证失败: " + verify.Reason)
+	}
+	return res, nil
+}
+
+// GetCheckpoints 获取检查点列表
+func (s *BlockchainService) GetCheckpoints(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 10
+	}
+	offset := (page - 1) * pageSize
+
+	var total int64
+	configs.DB.Model(&configs.LedgerCheckpoint{}).Count(&total)
+
+	var records []configs.LedgerCheckpoint
+	result := configs.DB.Order("id DESC").
+		Offset(offset).
+		Limit(pageSize).
+		Find(&records)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "查询检查点失败",
+		})
+		return
+	}
+
+	checkpoints := make([]Checkpoint, 0, len(records))
+	for _, record := range records {
+		cp, err := checkpointOf(record)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"code":    500,
+				"message": "解析检查点失败",
+			})
+			return
+		}
+		checkpoints = append(checkpoints, cp)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "获取检查点成功",
+		"data": gin.H{
+			"total":       total,
+			"page":        page,
+			"page_size":   pageSize,
+			"server_key":  ServerPublicKey(),
+			"checkpoints": checkpoints,
+		},
+	})
+}
+
+// VerifyCheckpoint 核对审计方离线保存的检查点，证明之后账本历史未被改写
+func (s *BlockchainService) VerifyCheckpoint(c *gin.Context) {
+	var cp Checkpoint
+	if err := c.ShouldBindJSON(&cp); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+
+	if err := cp.VerifySignature(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "检查点无效: " + err.Error(),
+		})
+		return
+	}
+
+	var stamp *timestampInfo
+	if cp.TSAToken != "" {
+		trusted, err := trustedTSACertificates()
+		if err == nil {
+			stamp, err = verifyTimestampToken(cp.TSAToken, checkpointDigest(cp), trusted)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": "检查点时间戳无效: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	res, err := checkAgainstCheckpoint(cp)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "核对检查点失败: " + err.Error(),
+		})
+		return
+	}
+	res.Timestamp = stamp
+
+	message := "账本与检查点一致"
+	if !res.Consistent {
+		message = "账本与检查点不一致"
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": message,
+		"data":    res,
+	})
+}
+
+// GetServerKey 获取检查点签名公钥
+func (s *BlockchainService) GetServerKey(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "获取服务端公钥成功",
+		"data": gin.H{
+			"algorithm":  KeyAlgorithmEd25519,
+			"public_key": ServerPublicKey(),
+		},
+	})
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 生成测试用的服务端签名密钥并登记到账本，全局高度1是服务端密钥的登记区块
+func testServerKey(t *testing.T) {
+	t.Helper()
+	if err := InitServerKey(filepath.Join(t.TempDir(), "server.key")); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterServerKey(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 构造由当前服务端密钥签名的检查点
+func testCheckpoint(t *testing.T) Checkpoint {
+	t.Helper()
+	cp := Checkpoint{
+		GlobalHeight: 3,
+		GlobalHash:   hashData("global"),
+		SealedHeight: 1,
+		SealedHash:   hashData("sealed"),
+		SKUHeads: []SKUHead{
+			{ProductSKU: "SKU-1", BlockHeight: 2, Hash: hashData("a")},
+			{ProductSKU: "SKU-2", BlockHeight: 1, Hash: hashData("b")},
+		},
+		Timestamp: 1700000000000000000,
+		ServerKey: ServerPublicKey(),
+	}
+	root, err := skuHeadsRoot(cp.SKUHeads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.SKUHeadsRoot = root
+	cp.Signature, err = signWithServerKey(cp.header().Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cp
+}
+
+func TestCheckpointVerifySignature(t *testing.T) {
+	testDB(t)
+	testServerKey(t)
+
+	tests := []struct {
+		name   string
+		mutate func(*Checkpoint)
+		valid  bool
+	}{
+		{name: "原始检查点", mutate: func(*Checkpoint) {}, valid: true},
+		{
+			// 用自己的密钥签名并附带公钥，签名本身有效但不是服务端签发的
+			name: "其他密钥签名",
+			mutate: func(cp *Checkpoint) {
+				pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+				cp.GlobalHeight = 100
+				cp.ServerKey = hex.EncodeToString(pub)
+				cp.Signature = hex.EncodeToString(ed25519.Sign(priv, cp.header().Encode()))
+			},
+		},
+		{name: "篡改全局链头", mutate: func(cp *Checkpoint) { cp.GlobalHash = hashData("forged") }},
+		{name: "篡改SKU链头", mutate: func(cp *Checkpoint) { cp.SKUHeads[0].BlockHeight = 1 }},
+		{name: "删除SKU链头", mutate: func(cp *Checkpoint) { cp.SKUHeads = cp.SKUHeads[:1] }},
+		{
+			name: "篡改签名",
+			mutate: func(cp *Checkpoint) {
+				sig, _ := hex.DecodeString(cp.Signature)
+				sig[0] ^= 1
+				cp.Signature = hex.EncodeToString(sig)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cp := testCheckpoint(t)
+			tt.mutate(&cp)
+			if err := cp.VerifySignature(); (err == nil) != tt.valid {
+				t.Fatalf("验证结果 %v", err)
+			}
+		})
+	}
+}
+
+// 更换服务端密钥后，旧密钥在吊销之前签发的检查点仍然可信
+func TestCheckpointTrustsHistoricalServerKeys(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(cp *Checkpoint, old ed25519.PrivateKey)
+		valid  bool
+	}{
+		{name: "吊销之前签发", mutate: func(*Checkpoint, ed25519.PrivateKey) {}, valid: true},
+		{
+			// 泄露的旧密钥不能再签发新的检查点
+			name: "吊销之后签发",
+			mutate: func(cp *Checkpoint, old ed25519.PrivateKey) {
+				cp.Timestamp = time.Now().Add(time.Hour).UnixNano()
+				cp.Signature = hex.EncodeToString(ed25519.Sign(old, cp.header().Encode()))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDB(t)
+			testServerKey(t)
+			cp := testCheckpoint(t)
+			old := serverKey
+
+			// 更换服务端密钥，新公钥登记到账本并吊销旧公钥
+			testServerKey(t)
+			if cp.ServerKey == ServerPublicKey() {
+				t.Fatal("服务端密钥没有更换")
+			}
+			tt.mutate(&cp, old)
+			if err := cp.VerifySignature(); (err == nil) != tt.valid {
+				t.Fatalf("验证结果 %v", err)
+			}
+		})
+	}
+}
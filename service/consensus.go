@@ -0,0 +1,704 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 复制日志的操作
+const (
+	proposalAppend  = "append"  // 追加已经写入数据库的区块
+	proposalPrepare = "prepare" // 准备写入区块，数据库事务提交之前
+	proposalCommit  = "commit"  // 数据库事务已提交，准备的区块生效
+	proposalAbort   = "abort"   // 数据库事务已回滚，丢弃准备的区块
+)
+
+// ErrCommitUnconfirmed 数据库事务已提交，但集群尚未确认
+var ErrCommitUnconfirmed = errors.New("区块已写入本地数据库，但集群尚未确认提交")
+
+// 复制日志中的一条操作
+// 早期的日志没有 op，只带一个 block，按 append 处理
+type ledgerProposal struct {
+	Op       string        `json:"op,omitempty"`
+	TxID     string        `json:"tx_id,omitempty"`
+	Proposer string        `json:"proposer"`
+	Block    *ledgerEntry  `json:"block,omitempty"`
+	Blocks   []ledgerEntry `json:"blocks,omitempty"`
+}
+
+func (p ledgerProposal) blocks() []configs.BlockchainLog {
+	var blocks []configs.BlockchainLog
+	if p.Block != nil {
+		blocks = append(blocks, p.Block.block())
+	}
+	for _, entry := range p.Blocks {
+		blocks = append(blocks, entry.block())
+	}
+	return blocks
+}
+
+// ConsensusNode 把Raft复制日志和本地账本连接起来
+// 区块只有在多数节点写入复制日志后才算最终确认，确认后写入每个节点的副本账本，再同步到本地MySQL
+// 写事务分两步提交: 业务写入成功后提交准备日志，数据库事务的结果确定后再提交确认或撤销日志，
+// 只有确认的区块才会写入副本账本，超时或回滚的事务不会出现在集群账本中
+type ConsensusNode struct {
+	id             string
+	raft           *RaftNode
+	replica        *FileLedger
+	proposeTimeout time.Duration
+	syncDB         bool
+	dbSync         chan struct{}
+
+	writeMu sync.Mutex // 本节点同一时刻只有一个写事务，准备、提交数据库和确认三步不会交错
+
+	mu      sync.Mutex
+	pending map[string][]configs.BlockchainLog // 已准备但尚未确认或撤销的事务，重启后通过重放日志恢复
+}
+
+// 当前运行的共识节点，为nil时表示单机模式
+var consensusNode *ConsensusNode
+
+// NewConsensusNode 创建共识节点，副本账本和Raft日志都保存在 dataDir 下
+// syncDB 为false时不访问数据库，便于在同一进程中启动多个节点测试
+func NewConsensusNode(id string, peers []string, dataDir string, transport RaftTransport, electionTimeout, proposeTimeout time.Duration, syncDB bool) (*ConsensusNode, error) {
+	replica, err := OpenFileLedger(filepath.Join(dataDir, "ledger"), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	node := &ConsensusNode{
+		id:             id,
+		replica:        replica,
+		proposeTimeout: proposeTimeout,
+		syncDB:         syncDB,
+		dbSync:         make(chan struct{}, 1),
+		pending:        make(map[string][]configs.BlockchainLog),
+	}
+	node.raft, err = NewRaftNode(RaftConfig{
+		ID:              id,
+		Peers:           peers,
+		DataDir:         filepath.Join(dataDir, "raft"),
+		ElectionTimeout: electionTimeout,
+	}, transport, node.applyEntry)
+	if err != nil {
+		replica.Close()
+		return nil, err
+	}
+	return node, nil
+}
+
+// StartConsensus 按全局配置启动共识节点，未启用时返回nil
+func StartConsensus(ctx context.Context) (*ConsensusNode, error) {
+	cfg := configs.GlobalConsensusConfig
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.ClusterToken == "" {
+		return nil, errors.New("共识模式需要通过 CONSENSUS_TOKEN 设置集群令牌")
+	}
+
+	var peers []string
+	for id := range cfg.Peers {
+		peers = append(peers, id)
+	}
+	sort.Strings(peers)
+
+	transport := NewHTTPRaftTransport(cfg.Peers, cfg.ClusterToken)
+	node, err := NewConsensusNode(cfg.NodeID, peers, cfg.DataDir, transport, cfg.ElectionTimeout, cfg.ProposeTimeout, true)
+	if err != nil {
+		return nil, err
+	}
+
+	consensusNode = node
+	node.Run(ctx)
+	return node, nil
+}
+
+// Run 启动Raft和数据库同步
+func (n *ConsensusNode) Run(ctx context.Context) {
+	go n.raft.Run(ctx)
+	if n.syncDB {
+		go n.dbSyncLoop(ctx)
+	}
+}
+
+// Raft 获取底层的Raft节点
+func (n *ConsensusNode) Raft() *RaftNode {
+	return n.raft
+}
+
+// Replica 获取已确认区块的副本账本
+func (n *ConsensusNode) Replica() *FileLedger {
+	return n.replica
+}
+
+// 应用已提交的日志，重启后从头重放日志，已写入副本账本的区块会被跳过
+func (n *ConsensusNode) applyEntry(entry RaftEntry) error {
+	if len(entry.Data) == 0 {
+		return nil
+	}
+
+	var proposal ledgerProposal
+	if err := json.Unmarshal(entry.Data, &proposal); err != nil {
+		return fmt.Errorf("%w: %v", ErrEntryRejected, err)
+	}
+
+	switch proposal.Op {
+	case "", proposalAppend:
+		return n.appendReplica(proposal.blocks())
+	case proposalPrepare:
+		n.mu.Lock()
+		n.pending[proposal.TxID] = proposal.blocks()
+		n.mu.Unlock()
+		return nil
+	case proposalAbort:
+		n.mu.Lock()
+		delete(n.pending, proposal.TxID)
+		n.mu.Unlock()
+		return nil
+	case proposalCommit:
+		n.mu.Lock()
+		blocks, ok := n.pending[proposal.TxID]
+		n.mu.Unlock()
+		if !ok {
+			return fmt.Errorf("%w: 事务 %s 没有准备或已撤销", ErrEntryRejected, proposal.TxID)
+		}
+		err := n.appendReplica(blocks)
+		if err == nil || errors.Is(err, ErrEntryRejected) {
+			n.mu.Lock()
+			delete(n.pending, proposal.TxID)
+			n.mu.Unlock()
+		}
+		return err
+	default:
+		return fmt.Errorf("%w: 未知操作 %s", ErrEntryRejected, proposal.Op)
+	}
+}
+
+// 把确认的区块写入副本账本
+// 已写入的高度只在哈希相同时跳过（重放日志），与已确认的区块冲突或接不上链头时拒绝整条日志
+func (n *ConsensusNode) appendReplica(blocks []configs.BlockchainLog) error {
+	var confirmed int64
+	var hash string
+	version := HashVersionCanonical
+	head, err := n.replica.Head("")
+	if err == nil {
+		confirmed, hash, version = head.GlobalHeight, head.Hash, head.HashVersion
+	} else if !errors.Is(err, ErrBlockNotFound) {
+		return err
+	}
+
+	height := confirmed
+	var fresh []configs.BlockchainLog
+	var keys map[uint]configs.UserKey
+	for _, block := range blocks {
+		if block.GlobalHeight <= confirmed {
+			existing, err := n.replica.Get(block.GlobalHeight)
+			if err != nil {
+				return err
+			}
+			if existing.Hash != block.Hash {
+				return fmt.Errorf("%w: 全局高度 %d 的区块与已确认的区块冲突", ErrEntryRejected, block.GlobalHeight)
+			}
+			continue
+		}
+		if block.GlobalHeight != height+1 || block.GlobalPreviousHash != hash {
+			return fmt.Errorf("%w: 全局高度 %d 的区块接不上已确认的链头", ErrEntryRejected, block.GlobalHeight)
+		}
+		if keys == nil {
+			if keys, err = n.replicaSignerKeys(); err != nil {
+				return err
+			}
+		}
+		if reason := checkReplicaBlock(block, version, keys); reason != "" {
+			return fmt.Errorf("%w: 全局高度 %d 的区块%s", ErrEntryRejected, block.GlobalHeight, reason)
+		}
+		fresh = append(fresh, block)
+		height, hash, version = block.GlobalHeight, block.Hash, block.HashVersion
+	}
+
+	for i := range fresh {
+		if err := n.replica.Append(&fresh[i]); err != nil {
+			return err
+		}
+	}
+	if len(fresh) > 0 {
+		select {
+		case n.dbSync <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// 副本账本密钥链中登记的签名密钥
+// 副本节点不一定能访问数据库，密钥只从已确认的区块中加载
+func (n *ConsensusNode) replicaSignerKeys() (map[uint]configs.UserKey, error) {
+	blocks, err := n.replica.SKUBlocks(SigningKeySKU)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[uint]configs.UserKey)
+	for _, block := range blocks {
+		if err := addSignerKey(keys, block); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// 按验证账本的规则检查待写入副本的区块，返回拒绝原因
+// 密钥链上的区块先登记其中的密钥，同一批中后面的区块可以用它签名
+func checkReplicaBlock(block configs.BlockchainLog, version int, keys map[uint]configs.UserKey) string {
+	if block.HashVersion == HashVersionLegacy {
+		return "是旧版区块，全局链中只能有规范区块"
+	}
+	if block.HashVersion < version {
+		return "的哈希版本低于已确认的链头"
+	}
+	if computeBlockHash(block) != block.Hash {
+		return "哈希不匹配"
+	}
+	if block.ProductSKU == SigningKeySKU {
+		if err := addSignerKey(keys, block); err != nil {
+			return err.Error()
+		}
+	}
+	if block.HashVersion >= HashVersionSigned {
+		return checkBlockSignature(block, keys)
+	}
+	return ""
+}
+
+// 提交一条操作到集群，等待多数节点确认并在本节点应用
+func (n *ConsensusNode) propose(proposal ledgerProposal) error {
+	proposal.Proposer = n.id
+	data, err := json.Marshal(proposal)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.proposeTimeout)
+	defer cancel()
+
+	_, err = n.raft.Propose(ctx, data)
+	if errors.Is(err, ErrNotLeader) {
+		return fmt.Errorf("%w，主节点为 %s", ErrNotLeader, n.raft.Status().LeaderID)
+	}
+	return err
+}
+
+// ProposeBlock 把已写入数据库的区块提交到集群，等待多数节点确认
+func (n *ConsensusNode) ProposeBlock(block *configs.BlockchainLog) error {
+	return n.propose(ledgerProposal{Op: proposalAppend, Blocks: []ledgerEntry{entryOf(*block)}})
+}
+
+// 提交事务的准备日志
+func (n *ConsensusNode) prepare(txID string, blocks []configs.BlockchainLog) error {
+	entries := make([]ledgerEntry, len(blocks))
+	for i, block := range blocks {
+		entries[i] = entryOf(block)
+	}
+	return n.propose(ledgerProposal{Op: proposalPrepare, TxID: txID, Blocks: entries})
+}
+
+// 数据库事务的结果确定后提交确认或撤销日志
+func (n *ConsensusNode) finish(txID string, commit bool) error {
+	op := proposalAbort
+	if commit {
+		op = proposalCommit
+	}
+	return n.propose(ledgerProposal{Op: op, TxID: txID})
+}
+
+// 处理之前的主节点遗留的准备日志，本地数据库中有这些区块时确认，否则撤销
+// 主节点在数据库提交之后、确认日志提交之前宕机时，新的主节点会撤销该事务，
+// 原主节点恢复后同步时会发现本地账本与集群账本不一致并报错，需要人工处理
+func (n *ConsensusNode) resolvePending(committed func(blocks []configs.BlockchainLog) (bool, error)) error {
+	n.mu.Lock()
+	txIDs := make([]string, 0, len(n.pending))
+	for txID := range n.pending {
+		txIDs = append(txIDs, txID)
+	}
+	pending := make(map[string][]configs.BlockchainLog, len(n.pending))
+	for txID, blocks := range n.pending {
+		pending[txID] = blocks
+	}
+	n.mu.Unlock()
+	sort.Strings(txIDs)
+
+	for _, txID := range txIDs {
+		ok, err := committed(pending[txID])
+		if err != nil {
+			return err
+		}
+		if err := n.finish(txID, ok); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 未确认的事务数
+func (n *ConsensusNode) pendingCount() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.pending)
+}
+
+// 数据库中是否已有这些区块
+func blocksInDB(tx *gorm.DB) func(blocks []configs.BlockchainLog) (bool, error) {
+	return func(blocks []configs.BlockchainLog) (bool, error) {
+		ledger := NewGormLedger(tx)
+		for _, block := range blocks {
+			existing, err := ledger.Get(block.GlobalHeight)
+			if errors.Is(err, ErrBlockNotFound) {
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			if existing.Hash != block.Hash {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+}
+
+// 一次写事务中追加的区块，通过事务的context传递
+type ledgerWrite struct {
+	txID   string
+	ready  bool // 已完成主节点追加区块前的准备
+	blocks []configs.BlockchainLog
+}
+
+type ledgerWriteKey struct{}
+
+func ledgerWriteOf(tx *gorm.DB) *ledgerWrite {
+	w, _ := tx.Statement.Context.Value(ledgerWriteKey{}).(*ledgerWrite)
+	return w
+}
+
+func newLedgerTxID(nodeID string) string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return nodeID + "-" + hex.EncodeToString(buf)
+}
+
+// 在共识模式下执行写事务
+// 业务写入成功后提交准备日志，多数节点确认后再提交数据库事务，结果确定后提交确认或撤销日志
+// 确认日志提交失败时准备日志保持待定，下一次写入前由主节点处理
+func (n *ConsensusNode) transaction(fn func(tx *gorm.DB) error) error {
+	n.writeMu.Lock()
+	defer n.writeMu.Unlock()
+
+	w := &ledgerWrite{txID: newLedgerTxID(n.id)}
+	ctx := context.WithValue(context.Background(), ledgerWriteKey{}, w)
+	proposed := false
+	err := configs.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if len(w.blocks) == 0 {
+			return nil
+		}
+		proposed = true
+		return n.prepare(w.txID, w.blocks)
+	})
+	if !proposed {
+		return err
+	}
+
+	// 准备日志超时后仍可能被提交，数据库回滚时同样要撤销
+	if finishErr := n.finish(w.txID, err == nil); finishErr != nil {
+		if err == nil {
+			log.Printf("事务 %s 已提交到数据库，确认日志提交失败: %v", w.txID, finishErr)
+			return fmt.Errorf("%w: %v", ErrCommitUnconfirmed, finishErr)
+		}
+		log.Printf("事务 %s 已回滚，撤销日志提交失败，将由主节点稍后撤销: %v", w.txID, finishErr)
+	}
+	return err
+}
+
+// 主节点追加区块前的准备，调用方需持有账本锁，每个写事务只需执行一次
+// 等待之前任期的日志全部应用，处理遗留的准备日志，把副本账本中缺失的区块补到数据库，
+// 再把数据库中尚未提交到集群的区块（如启用共识之前的区块）提交到集群
+func (n *ConsensusNode) prepareAppend(tx *gorm.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), n.proposeTimeout)
+	defer cancel()
+
+	if err := n.raft.WaitLeaderReady(ctx); err != nil {
+		if errors.Is(err, ErrNotLeader) {
+			return fmt.Errorf("%w，主节点为 %s", ErrNotLeader, n.raft.Status().LeaderID)
+		}
+		return err
+	}
+
+	if err := n.resolvePending(blocksInDB(tx)); err != nil {
+		return err
+	}
+
+	if err := syncDBFromReplica(tx, n.replica); err != nil {
+		return err
+	}
+
+	var from int64 = 1
+	if head, err := n.replica.Head(""); err == nil {
+		from = head.GlobalHeight + 1
+	}
+	pending, err := NewGormLedger(tx).Range(from, 1<<62)
+	if err != nil {
+		return err
+	}
+	for i := range pending {
+		if err := n.ProposeBlock(&pending[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 把副本账本中已确认、但本地数据库还没有的区块写入数据库
+func syncDBFromReplica(tx *gorm.DB, replica *FileLedger) error {
+	ledger := NewGormLedger(tx)
+
+	var dbHeight int64
+	dbHead, err := ledger.Head("")
+	if err == nil {
+		dbHeight = dbHead.GlobalHeight
+	} else if !errors.Is(err, ErrBlockNotFound) {
+		return err
+	}
+
+	replicaHead, err := replica.Head("")
+	if errors.Is(err, ErrBlockNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// 两边都有的最后一个区块必须一致
+	common := dbHeight
+	if replicaHead.GlobalHeight < common {
+		common = replicaHead.GlobalHeight
+	}
+	if common > 0 {
+		dbBlock, err := ledger.Get(common)
+		if err != nil {
+			return err
+		}
+		replicaBlock, err := replica.Get(common)
+		if err != nil {
+			return err
+		}
+		if dbBlock.Hash != replicaBlock.Hash {
+			return fmt.Errorf("本地账本与集群账本在全局高度 %d 处不一致", common)
+		}
+	}
+
+	for from := dbHeight + 1; from <= replicaHead.GlobalHeight; from += mirrorSyncBatch {
+		blocks, err := replica.Range(from, from+mirrorSyncBatch-1)
+		if err != nil {
+			return err
+		}
+		for i := range blocks {
+			if err := ledger.Append(&blocks[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 非主节点把确认的区块同步到本地数据库
+func (n *ConsensusNode) dbSyncLoop(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-n.dbSync:
+		}
+
+		err := ledgerTransaction(func(tx *gorm.DB) error {
+			var lock configs.LedgerLock
+			result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&lock, configs.LedgerLockID)
+			if result.Error != nil {
+				return result.Error
+			}
+			return syncDBFromReplica(tx, n.replica)
+		})
+		if err != nil {
+			log.Printf("同步集群区块到数据库失败: %v", err)
+		}
+	}
+}
+
+// HTTPRaftTransport 通过HTTP在节点间发送Raft消息
+type HTTPRaftTransport struct {
+	peers  map[string]string
+	token  string
+	client *http.Client
+}
+
+// NewHTTPRaftTransport 创建HTTP传输
+func NewHTTPRaftTransport(peers map[string]string, token string) *HTTPRaftTransport {
+	return &HTTPRaftTransport{
+		peers:  peers,
+		token:  token,
+		client: &http.Client{Timeout: time.Second},
+	}
+}
+
+func (t *HTTPRaftTransport) post(peer, path string, args, reply interface{}) error {
+	addr, ok := t.peers[peer]
+	if !ok {
+		return fmt.Errorf("未知节点 %s", peer)
+	}
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, addr+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Cluster-Token", t.token)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("节点 %s 返回 %d", peer, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+// RequestVote 发送投票请求
+func (t *HTTPRaftTransport) RequestVote(peer string, args RequestVoteArgs) (RequestVoteReply, error) {
+	var reply RequestVoteReply
+	err := t.post(peer, "/api/consensus/vote", args, &reply)
+	return reply, err
+}
+
+// AppendEntries 发送日志复制请求
+func (t *HTTPRaftTransport) AppendEntries(peer string, args AppendEntriesArgs) (AppendEntriesReply, error) {
+	var reply AppendEntriesReply
+	err := t.post(peer, "/api/consensus/append", args, &reply)
+	return reply, err
+}
+
+// ClusterAuthMiddleware 校验节点间通信令牌
+func ClusterAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.GetHeader("X-Cluster-Token")
+		expected := configs.GlobalConsensusConfig.ClusterToken
+		if consensusNode == nil || expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			c.JSON(http.StatusForbidden, gin.H{
+				"code":    403,
+				"message": "无效的集群令牌",
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// ConsensusService 实现节点间共识接口
+type ConsensusService struct{}
+
+// RequestVote 处理其他节点的投票请求
+func (s *ConsensusService) RequestVote(c *gin.Context) {
+	var args RequestVoteArgs
+	if err := c.ShouldBindJSON(&args); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, consensusNode.raft.HandleRequestVote(args))
+}
+
+// AppendEntries 处理主节点的日志复制请求
+func (s *ConsensusService) AppendEntries(c *gin.Context) {
+	var args AppendEntriesArgs
+	if err := c.ShouldBindJSON(&args); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, consensusNode.raft.HandleAppendEntries(args))
+}
+
+// GetStatus 获取本节点的共识状态
+func (s *ConsensusService) GetStatus(c *gin.Context) {
+	if consensusNode == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "未启用共识模式",
+		})
+		return
+	}
+
+	var height int64
+	if head, err := consensusNode.replica.Head(""); err == nil {
+		height = head.GlobalHeight
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "获取共识状态成功",
+		"data": gin.H{
+			"raft":             consensusNode.raft.Status(),
+			"confirmed_height": height,
+			"pending_txs":      consensusNode.pendingCount(),
+		},
+	})
+}
+
+// SetupConsensusRoutes 设置共识服务路由
+func SetupConsensusRoutes(router *gin.Engine) {
+	consensusService := &ConsensusService{}
+
+	publicGroup := router.Group("/api/consensus")
+	{
+		publicGroup.GET("/status", consensusService.GetStatus)
+	}
+
+	// 节点间接口
+	clusterGroup := router.Group("/api/consensus")
+	clusterGroup.Use(ClusterAuthMiddleware())
+	{
+		clusterGroup.POST("/vote", consensusService.RequestVote)
+		clusterGroup.POST("/append", consensusService.AppendEntries)
+	}
+}
@@ -0,0 +1,593 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 进程内的Raft网络，可以断开节点模拟网络分区
+type testRaftNetwork struct {
+	mu    sync.Mutex
+	nodes map[string]*RaftNode
+	down  map[string]bool
+}
+
+func (n *testRaftNetwork) peer(from, to string) (*RaftNode, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.down[from] || n.down[to] {
+		return nil, fmt.Errorf("节点 %s 与 %s 之间不通", from, to)
+	}
+	return n.nodes[to], nil
+}
+
+func (n *testRaftNetwork) setDown(id string, down bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down[id] = down
+}
+
+type testRaftTransport struct {
+	network *testRaftNetwork
+	from    string
+}
+
+func (t testRaftTransport) RequestVote(peer string, args RequestVoteArgs) (RequestVoteReply, error) {
+	node, err := t.network.peer(t.from, peer)
+	if err != nil {
+		return RequestVoteReply{}, err
+	}
+	return node.HandleRequestVote(args), nil
+}
+
+func (t testRaftTransport) AppendEntries(peer string, args AppendEntriesArgs) (AppendEntriesReply, error) {
+	node, err := t.network.peer(t.from, peer)
+	if err != nil {
+		return AppendEntriesReply{}, err
+	}
+	return node.HandleAppendEntries(args), nil
+}
+
+const (
+	testElectionTimeout = 100 * time.Millisecond
+	testProposeTimeout  = time.Second
+)
+
+// 在进程内启动一个集群，节点不访问数据库
+func testCluster(t *testing.T, ids ...string) (*testRaftNetwork, map[string]*ConsensusNode) {
+	t.Helper()
+	network := &testRaftNetwork{nodes: make(map[string]*RaftNode), down: make(map[string]bool)}
+	nodes := make(map[string]*ConsensusNode)
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, id := range ids {
+		var peers []string
+		for _, other := range ids {
+			if other != id {
+				peers = append(peers, other)
+			}
+		}
+		node, err := NewConsensusNode(id, peers, t.TempDir(), testRaftTransport{network: network, from: id}, testElectionTimeout, testProposeTimeout, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[id] = node
+		network.nodes[id] = node.Raft()
+	}
+	for _, node := range nodes {
+		node.Run(ctx)
+	}
+	t.Cleanup(func() {
+		cancel()
+		for _, node := range nodes {
+			node.Replica().Close()
+		}
+	})
+	return network, nodes
+}
+
+// 等待条件成立，超时后测试失败
+func testEventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待超时: %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 等待可达节点中选出主节点，且之前任期的日志已全部应用
+func testLeader(t *testing.T, network *testRaftNetwork, nodes map[string]*ConsensusNode) *ConsensusNode {
+	t.Helper()
+	var leader *ConsensusNode
+	testEventually(t, "选出主节点", func() bool {
+		for id, node := range nodes {
+			network.mu.Lock()
+			down := network.down[id]
+			network.mu.Unlock()
+			if !down && node.Raft().Status().State == "leader" {
+				ctx, cancel := context.WithTimeout(context.Background(), testProposeTimeout)
+				err := node.Raft().WaitLeaderReady(ctx)
+				cancel()
+				if err == nil {
+					leader = node
+					return true
+				}
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+// 等待所有节点的副本账本达到指定高度，且没有未确认的事务
+func testReplicasAt(t *testing.T, nodes map[string]*ConsensusNode, height int64) {
+	t.Helper()
+	testEventually(t, fmt.Sprintf("副本账本达到高度 %d", height), func() bool {
+		for _, node := range nodes {
+			var h int64
+			if head, err := node.Replica().Head(""); err == nil {
+				h = head.GlobalHeight
+			}
+			if h != height || node.pendingCount() != 0 {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestConsensusTwoPhaseCommit(t *testing.T) {
+	tests := []struct {
+		name   string
+		commit bool
+		height int64
+	}{
+		{name: "数据库提交后确认", commit: true, height: 1},
+		{name: "数据库回滚后撤销", commit: false, height: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network, nodes := testCluster(t, "a", "b", "c")
+			leader := testLeader(t, network, nodes)
+			block := testGlobalChain("SKU-1")[0]
+
+			if err := leader.prepare("tx-1", []configs.BlockchainLog{block}); err != nil {
+				t.Fatal(err)
+			}
+			// 准备的区块在确认之前不会写入任何副本账本
+			for id, node := range nodes {
+				if _, err := node.Replica().Head(""); !errors.Is(err, ErrBlockNotFound) {
+					t.Fatalf("节点 %s 在确认之前写入了区块", id)
+				}
+			}
+			if err := leader.finish("tx-1", tt.commit); err != nil {
+				t.Fatal(err)
+			}
+			testReplicasAt(t, nodes, tt.height)
+
+			// 撤销之后再确认不能让区块复活
+			if !tt.commit {
+				if err := leader.finish("tx-1", true); !errors.Is(err, ErrEntryRejected) {
+					t.Fatalf("撤销后的确认应被拒绝: %v", err)
+				}
+				testReplicasAt(t, nodes, 0)
+			}
+		})
+	}
+}
+
+func TestConsensusProposalTimeout(t *testing.T) {
+	t.Run("超时的准备日志之后仍被提交", func(t *testing.T) {
+		network, nodes := testCluster(t, "a", "b", "c")
+		leader := testLeader(t, network, nodes)
+		block := testGlobalChain("SKU-1")[0]
+
+		// 等待确认的时间极短，准备日志在返回超时之后才会被多数节点确认
+		leader.proposeTimeout = time.Nanosecond
+		err := leader.prepare("tx-1", []configs.BlockchainLog{block})
+		leader.proposeTimeout = testProposeTimeout
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("应等待超时: %v", err)
+		}
+
+		// 数据库事务随之回滚，撤销日志保证它不会留在集群中
+		if err := leader.finish("tx-1", false); err != nil {
+			t.Fatal(err)
+		}
+		testReplicasAt(t, nodes, 0)
+	})
+
+	t.Run("主节点被隔离时准备日志超时", func(t *testing.T) {
+		network, nodes := testCluster(t, "a", "b", "c")
+		leader := testLeader(t, network, nodes)
+		block := testGlobalChain("SKU-1")[0]
+
+		network.setDown(leader.id, true)
+		if err := leader.prepare("tx-1", []configs.BlockchainLog{block}); err == nil {
+			t.Fatal("隔离的主节点不应得到多数节点确认")
+		}
+
+		// 其余节点选出新的主节点并继续写入，原主节点未确认的日志被覆盖
+		newLeader := testLeader(t, network, nodes)
+		if newLeader == leader {
+			t.Fatal("应选出新的主节点")
+		}
+		other := testGlobalChain("SKU-2")[0]
+		if err := newLeader.prepare("tx-2", []configs.BlockchainLog{other}); err != nil {
+			t.Fatal(err)
+		}
+		if err := newLeader.finish("tx-2", true); err != nil {
+			t.Fatal(err)
+		}
+
+		network.setDown(leader.id, false)
+		// 原主节点可能还没发现新的任期，提案会被新的主节点覆盖
+		if err := leader.finish("tx-1", false); err == nil {
+			t.Fatal("原主节点已不是主节点，撤销日志不应被接受")
+		}
+		testReplicasAt(t, nodes, 1)
+		for id, node := range nodes {
+			head, _ := node.Replica().Head("")
+			if head.Hash != other.Hash {
+				t.Fatalf("节点 %s 的副本账本中是超时的区块", id)
+			}
+		}
+	})
+}
+
+func TestConsensusLeaderFailover(t *testing.T) {
+	tests := []struct {
+		name      string
+		committed bool // 新的主节点的数据库中是否有遗留事务的区块
+		height    int64
+	}{
+		{name: "遗留事务已写入数据库时确认", committed: true, height: 1},
+		{name: "遗留事务未写入数据库时撤销", committed: false, height: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network, nodes := testCluster(t, "a", "b", "c")
+			leader := testLeader(t, network, nodes)
+			block := testGlobalChain("SKU-1")[0]
+
+			// 准备日志已提交，主节点在确认之前宕机
+			if err := leader.prepare("tx-1", []configs.BlockchainLog{block}); err != nil {
+				t.Fatal(err)
+			}
+			network.setDown(leader.id, true)
+
+			newLeader := testLeader(t, network, nodes)
+			if newLeader.pendingCount() != 1 {
+				t.Fatalf("新的主节点应看到遗留的准备日志，实际 %d 个", newLeader.pendingCount())
+			}
+			err := newLeader.resolvePending(func(blocks []configs.BlockchainLog) (bool, error) {
+				return tt.committed, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// 原主节点恢复后追上集群，它迟到的确认日志不会被接受
+			network.setDown(leader.id, false)
+			if err := leader.finish("tx-1", true); err == nil {
+				t.Fatal("原主节点的确认日志不应被接受")
+			}
+			testReplicasAt(t, nodes, tt.height)
+		})
+	}
+}
+
+func TestConsensusRejectsConflictingBlocks(t *testing.T) {
+	network, nodes := testCluster(t, "a", "b", "c")
+	leader := testLeader(t, network, nodes)
+	blocks := testGlobalChain("SKU-1", "SKU-1")
+	fork := testGlobalChain("SKU-2")[0]
+
+	if err := leader.ProposeBlock(&blocks[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		block    configs.BlockchainLog
+		rejected bool
+	}{
+		{name: "重复提交同一个区块", block: blocks[0]},
+		{name: "同一高度的不同区块", block: fork, rejected: true},
+		{name: "跳过高度的区块", block: testGlobalChain("SKU-1", "SKU-1", "SKU-1")[2], rejected: true},
+		{name: "接上链头的区块", block: blocks[1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := leader.ProposeBlock(&tt.block)
+			if tt.rejected != errors.Is(err, ErrEntryRejected) || (!tt.rejected && err != nil) {
+				t.Fatalf("提交结果 %v", err)
+			}
+		})
+	}
+
+	// 被拒绝的日志不影响之后的日志，所有节点的副本账本一致
+	testReplicasAt(t, nodes, 2)
+	for id, node := range nodes {
+		res, err := node.Replica().Verify()
+		if err != nil || !res.Valid {
+			t.Fatalf("节点 %s 的副本账本验证失败: %+v %v", id, res, err)
+		}
+	}
+}
+
+// 密钥链登记签名密钥后写入一个签名区块
+func testSignedChain(t *testing.T) []configs.BlockchainLog {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := events.Marshal(&events.KeyRotated{UserID: 1, KeyID: 1, Algorithm: "ed25519", PublicKey: hex.EncodeToString(pub), ValidFrom: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := []configs.BlockchainLog{
+		{ProductSKU: SigningKeySKU, RecordType: events.RecordKeyRotated, RecordData: string(data)},
+		{ProductSKU: "SKU-1", RecordType: 1, RecordData: `{"n":1}`},
+	}
+	for i := range blocks {
+		block := &blocks[i]
+		block.BlockHeight = 1
+		block.GlobalHeight = int64(i + 1)
+		block.HashVersion = HashVersionSigned
+		block.Timestamp = int64(1700000000000000000 + i)
+		block.SignerID = 1
+		block.SignerKeyID = 1
+		if i > 0 {
+			block.GlobalPreviousHash = blocks[i-1].Hash
+		}
+		block.Signature = hex.EncodeToString(ed25519.Sign(priv, headerOf(*block).Encode()))
+		block.Hash = computeBlockHash(*block)
+	}
+	return blocks
+}
+
+func TestConsensusChecksBlockHashAndSignature(t *testing.T) {
+	tests := []struct {
+		name     string
+		blocks   func(t *testing.T) []configs.BlockchainLog
+		rejected bool
+	}{
+		{
+			name:   "密钥登记后签名的区块",
+			blocks: testSignedChain,
+		},
+		{
+			name: "数据被篡改的区块",
+			blocks: func(t *testing.T) []configs.BlockchainLog {
+				blocks := testGlobalChain("SKU-1")
+				blocks[0].RecordData = `{"n":9}`
+				return blocks
+			},
+			rejected: true,
+		},
+		{
+			name: "签名被篡改的区块",
+			blocks: func(t *testing.T) []configs.BlockchainLog {
+				blocks := testSignedChain(t)
+				other := testSignedChain(t)
+				blocks[1].Signature = other[1].Signature
+				return blocks
+			},
+			rejected: true,
+		},
+		{
+			// 签名者的密钥没有登记在副本账本的密钥链上
+			name: "签名密钥未登记的区块",
+			blocks: func(t *testing.T) []configs.BlockchainLog {
+				block := testSignedChain(t)[1]
+				block.GlobalHeight = 1
+				block.GlobalPreviousHash = ""
+				block.Hash = computeBlockHash(block)
+				return []configs.BlockchainLog{block}
+			},
+			rejected: true,
+		},
+		{
+			name: "降级为旧版哈希的区块",
+			blocks: func(t *testing.T) []configs.BlockchainLog {
+				blocks := testGlobalChain("SKU-1")
+				blocks[0].HashVersion = HashVersionLegacy
+				blocks[0].Hash = computeBlockHash(blocks[0])
+				return blocks
+			},
+			rejected: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network, nodes := testCluster(t, "a", "b", "c")
+			leader := testLeader(t, network, nodes)
+			blocks := tt.blocks(t)
+
+			if err := leader.prepare("tx-1", blocks); err != nil {
+				t.Fatal(err)
+			}
+			err := leader.finish("tx-1", true)
+			if tt.rejected != errors.Is(err, ErrEntryRejected) || (!tt.rejected && err != nil) {
+				t.Fatalf("提交结果 %v", err)
+			}
+			height := int64(len(blocks))
+			if tt.rejected {
+				height = 0
+			}
+			testReplicasAt(t, nodes, height)
+		})
+	}
+}
+
+// 任期、投票和日志无法落盘时不投票、不确认日志，内存中的状态保持不变
+func TestRaftRefusesUnpersistedWrites(t *testing.T) {
+	tests := []struct {
+		name   string
+		broken string // 替换为目录使写入失败的文件
+		handle func(n *RaftNode) bool
+	}{
+		{
+			name:   "投票无法落盘",
+			broken: raftStateFile,
+			handle: func(n *RaftNode) bool {
+				return n.HandleRequestVote(RequestVoteArgs{Term: 1, CandidateID: "b"}).VoteGranted
+			},
+		},
+		{
+			name:   "新任期无法落盘",
+			broken: raftStateFile,
+			handle: func(n *RaftNode) bool {
+				return n.HandleAppendEntries(AppendEntriesArgs{Term: 1, LeaderID: "b", Entries: []RaftEntry{{Index: 1, Term: 1}}, LeaderCommit: 1}).Success
+			},
+		},
+		{
+			name:   "日志无法落盘",
+			broken: raftLogFile,
+			handle: func(n *RaftNode) bool {
+				return n.HandleAppendEntries(AppendEntriesArgs{Entries: []RaftEntry{{Index: 1}}, LeaderCommit: 1}).Success
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			n, err := NewRaftNode(RaftConfig{ID: "a", Peers: []string{"b"}, DataDir: dir}, testRaftTransport{}, func(RaftEntry) error { return nil })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.MkdirAll(filepath.Join(dir, tt.broken, "x"), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.handle(n) {
+				t.Fatal("写入没有落盘就确认了")
+			}
+			status := n.Status()
+			if status.Term != 0 || status.LastIndex != 0 || status.CommitIndex != 0 || n.votedFor != "" {
+				t.Fatalf("内存中的状态被修改 %+v，投票给 %q", status, n.votedFor)
+			}
+		})
+	}
+}
+
+func TestConsensusReplayRestoresPending(t *testing.T) {
+	dir := t.TempDir()
+	open := func() (*ConsensusNode, context.CancelFunc) {
+		node, err := NewConsensusNode("a", nil, dir, testRaftTransport{}, testElectionTimeout, testProposeTimeout, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		node.Run(ctx)
+		return node, cancel
+	}
+
+	blocks := testGlobalChain("SKU-1", "SKU-1")
+	node, cancel := open()
+	testLeader(t, &testRaftNetwork{down: map[string]bool{}}, map[string]*ConsensusNode{"a": node})
+	if err := node.ProposeBlock(&blocks[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.prepare("tx-1", blocks[1:]); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	node.Replica().Close()
+
+	// 重启后重放日志，已写入的区块不会重复写入，未确认的事务仍然待定
+	node, cancel = open()
+	defer func() {
+		cancel()
+		node.Replica().Close()
+	}()
+	testLeader(t, &testRaftNetwork{down: map[string]bool{}}, map[string]*ConsensusNode{"a": node})
+	if node.pendingCount() != 1 {
+		t.Fatalf("重启后应恢复 1 个未确认的事务，实际 %d 个", node.pendingCount())
+	}
+	if err := node.finish("tx-1", true); err != nil {
+		t.Fatal(err)
+	}
+	head, err := node.Replica().Head("")
+	if err != nil || head.GlobalHeight != 2 || node.pendingCount() != 0 {
+		t.Fatalf("确认后副本账本高度 %v %v", head, err)
+	}
+}
+
+func TestConsensusLedgerTransaction(t *testing.T) {
+	tests := []struct {
+		name   string
+		fail   bool
+		height int64
+	}{
+		// 签名者的密钥登记区块和业务区块在同一个事务中提交
+		{name: "事务提交", height: 2},
+		{name: "业务写入失败", fail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDB(t)
+			user := testUser(t, 1)
+			_, nodes := testCluster(t, "a")
+			consensusNode = nodes["a"]
+			t.Cleanup(func() { consensusNode = nil })
+			testLeader(t, &testRaftNetwork{down: map[string]bool{}}, nodes)
+
+			err := ledgerTransaction(func(tx *gorm.DB) error {
+				if _, err := (&BlockchainService{}).AddToBlockchainTx(tx, "SKU-1", 1, `{}`, user.ID); err != nil {
+					return err
+				}
+				if tt.fail {
+					return errors.New("业务写入失败")
+				}
+				return nil
+			})
+			if tt.fail != (err != nil) {
+				t.Fatal(err)
+			}
+
+			var blocks int64
+			configs.DB.Model(&configs.BlockchainLog{}).Count(&blocks)
+			if blocks != tt.height {
+				t.Fatalf("数据库中有 %d 个区块", blocks)
+			}
+			testReplicasAt(t, nodes, tt.height)
+		})
+	}
+}
+
+func TestStartConsensusRequiresClusterToken(t *testing.T) {
+	saved := configs.GlobalConsensusConfig
+	t.Cleanup(func() { configs.GlobalConsensusConfig = saved })
+	configs.GlobalConsensusConfig.Enabled = true
+	configs.GlobalConsensusConfig.NodeID = "a"
+	configs.GlobalConsensusConfig.DataDir = t.TempDir()
+	configs.GlobalConsensusConfig.ClusterToken = ""
+
+	node, err := StartConsensus(context.Background())
+	if err == nil || node != nil || consensusNode != nil {
+		t.Fatal("没有集群令牌时不应启动共识节点")
+	}
+}
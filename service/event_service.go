@@ -0,0 +1,615 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/api"
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 自定义事件的区块记录类型从该值开始分配，之前的值留给内置事件
+const customRecordTypeStart = 100
+
+// 事件类型名称格式
+var eventTypeNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,99}$`)
+
+// 内置事件类型，启动时写入注册表
+var builtinEventTypes = []configs.EventType{
+	{
+		Name:         events.TypeProductCreated,
+		Description:  "产品审核通过",
+		RecordType:   events.RecordProductCreated,
+		AllowedRoles: "4",
+	},
+	{
+		Name:         events.TypeLogisticsUpdated,
+		Description:  "物流节点记录",
+		RecordType:   events.RecordLogisticsUpdated,
+		AllowedRoles: "1,2",
+	},
+	{
+		Name:           events.TypeCustodyTransferred,
+		Description:    "产品交接",
+		RecordType:     events.RecordCustodyTransferred,
+		AllowedRoles:   "1,2",
+		AffectsCustody: true,
+	},
+	{
+		Name:         events.TypeTelemetryBatchRecorded,
+		Description:  "设备温湿度读数批次",
+		RecordType:   events.RecordTelemetryBatchRecorded,
+		AllowedRoles: "1,2",
+	},
+	{
+		Name:         events.TypeTemperatureExcursion,
+		Description:  "温湿度超出产品要求范围",
+		RecordType:   events.RecordTemperatureExcursion,
+		AllowedRoles: "1,2",
+	},
+	{
+		Name:         events.TypeKeyRotated,
+		Description:  "签名密钥登记和轮换",
+		RecordType:   events.RecordKeyRotated,
+		AllowedRoles: "1,2,3,4",
+	},
+	{
+		Name:         events.TypeTemperatureProfileSet,
+		Description:  "产品温湿度要求",
+		RecordType:   events.RecordTemperatureProfileSet,
+		AllowedRoles: "1",
+	},
+}
+
+// InitEventTypes 确保内置事件类型已写入注册表，并更新为当前的事件版本
+func InitEventTypes() error {
+	for _, builtin := range builtinEventTypes {
+		builtin.Version = events.LatestVersion(builtin.Name)
+		builtin.Builtin = true
+		result := configs.DB.Where(configs.EventType{Name: builtin.Name}).
+			Assign(configs.EventType{Version: builtin.Version}).
+			FirstOrCreate(&builtin)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+// 已编译的JSON Schema，按事件类型和版本缓存
+var schemaCache sync.Map
+
+func compileSchema(name string, schema string) (*jsonschema.Schema, error) {
+	url := "mem://event-types/" + name + ".json"
+	compiler := jsonschema.NewCompiler()
+	compiler.Draft = jsonschema.Draft2020
+	if err := compiler.AddResource(url, strings.NewReader(schema)); err != nil {
+		return nil, err
+	}
+	return compiler.Compile(url)
+}
+
+// 获取事件类型的Schema
+func eventTypeSchema(t configs.EventType) (*jsonschema.Schema, error) {
+	key := t.Name + "@" + strconv.Itoa(t.Version)
+	if cached, ok := schemaCache.Load(key); ok {
+		return cached.(*jsonschema.Schema), nil
+	}
+	schema, err := compileSchema(t.Name, t.Schema)
+	if err != nil {
+		return nil, err
+	}
+	schemaCache.Store(key, schema)
+	return schema, nil
+}
+
+// 解析允许提交事件的用户类型
+func parseRoles(roles string) []int {
+	var list []int
+	for _, part := range strings.Split(roles, ",") {
+		if role, err := strconv.Atoi(strings.TrimSpace(part)); err == nil {
+			list = append(list, role)
+		}
+	}
+	return list
+}
+
+func formatRoles(roles []int) (string, error) {
+	if len(roles) == 0 {
+		return "", errors.New("至少需要一个允许提交的用户类型")
+	}
+	parts := make([]string, 0, len(roles))
+	for _, role := range roles {
+		if role < 1 || role > 4 {
+			return "", errors.New("用户类型只能是1-4")
+		}
+		parts = append(parts, strconv.Itoa(role))
+	}
+	return strings.Join(parts, ","), nil
+}
+
+func eventTypeView(t configs.EventType) gin.H {
+	var schema json.RawMessage
+	if t.Schema != "" {
+		schema = json.RawMessage(t.Schema)
+	}
+	return gin.H{
+		"id":              t.ID,
+		"name":            t.Name,
+		"description":     t.Description,
+		"record_type":     t.RecordType,
+		"version":         t.Version,
+		"schema":          schema,
+		"allowed_roles":   parseRoles(t.AllowedRoles),
+		"affects_custody": t.AffectsCustody,
+		"builtin":         t.Builtin,
+		"disabled":        t.Disabled,
+		"updated_at":      t.UpdatedAt,
+	}
+}
+
+// 检查请求中的Schema和用户类型，返回用于保存的值
+func checkEventTypeRequest(req api.EventTypeRequest) (string, string, error) {
+	if !eventTypeNamePattern.MatchString(req.Name) {
+		return "", "", errors.New("事件类型名称只能包含字母、数字和下划线，且以字母开头")
+	}
+	roles, err := formatRoles(req.AllowedRoles)
+	if err != nil {
+		return "", "", err
+	}
+	schema, err := events.Canonical(req.Schema)
+	if err != nil {
+		return "", "", errors.New("Schema不是合法的JSON")
+	}
+	if _, err := compileSchema(req.Name, string(schema)); err != nil {
+		return "", "", errors.New("Schema无效: " + err.Error())
+	}
+	return string(schema), roles, nil
+}
+
+// AdminListEventTypes 获取事件类型列表
+func (s *AdminService) AdminListEventTypes(c *gin.Context) {
+	var types []configs.EventType
+	result := configs.DB.Order("record_type").Find(&types)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "查询事件类型失败",
+		})
+		return
+	}
+
+	list := make([]gin.H, 0, len(types))
+	for _, t := range types {
+		list = append(list, eventTypeView(t))
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "获取事件类型成功",
+		Data:    list,
+	})
+}
+
+// AdminCreateEventType 新增事件类型
+func (s *AdminService) AdminCreateEventType(c *gin.Context) {
+	var req api.EventTypeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+
+	schema, roles, err := checkEventTypeRequest(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	eventType := configs.EventType{
+		Name:           req.Name,
+		Description:    req.Description,
+		Version:        1,
+		Schema:         schema,
+		AllowedRoles:   roles,
+		AffectsCustody: req.AffectsCustody,
+		Disabled:       req.Disabled,
+	}
+	err = configs.DB.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		tx.Unscoped().Model(&configs.EventType{}).Where("name = ?", req.Name).Count(&count)
+		if count > 0 {
+			return errors.New("事件类型已存在")
+		}
+
+		// 分配区块记录类型，已删除的类型也保留其记录类型，避免旧区块被误解
+		var maxType int
+		tx.Unscoped().Model(&configs.EventType{}).Select("COALESCE(MAX(record_type), 0)").Scan(&maxType)
+		eventType.RecordType = maxType + 1
+		if eventType.RecordType < customRecordTypeStart {
+			eventType.RecordType = customRecordTypeStart
+		}
+		return tx.Create(&eventType).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "新增事件类型失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "新增事件类型成功",
+		Data:    eventTypeView(eventType),
+	})
+}
+
+// AdminUpdateEventType 修改事件类型，名称和记录类型不能修改，Schema变化时版本加一
+func (s *AdminService) AdminUpdateEventType(c *gin.Context) {
+	var eventType configs.EventType
+	if err := configs.DB.First(&eventType, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, api.Response{
+			Code:    404,
+			Message: "事件类型不存在",
+		})
+		return
+	}
+	if eventType.Builtin {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "内置事件类型不能修改",
+		})
+		return
+	}
+
+	var req api.EventTypeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+	if req.Name != eventType.Name {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "事件类型名称不能修改",
+		})
+		return
+	}
+
+	schema, roles, err := checkEventTypeRequest(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	if schema != eventType.Schema {
+		eventType.Version++
+	}
+	eventType.Schema = schema
+	eventType.Description = req.Description
+	eventType.AllowedRoles = roles
+	eventType.AffectsCustody = req.AffectsCustody
+	eventType.Disabled = req.Disabled
+	if err := configs.DB.Save(&eventType).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "修改事件类型失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "修改事件类型成功",
+		Data:    eventTypeView(eventType),
+	})
+}
+
+// AdminDeleteEventType 删除事件类型，已写入账本的事件不受影响
+func (s *AdminService) AdminDeleteEventType(c *gin.Context) {
+	var eventType configs.EventType
+	if err := configs.DB.First(&eventType, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, api.Response{
+			Code:    404,
+			Message: "事件类型不存在",
+		})
+		return
+	}
+	if eventType.Builtin {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "内置事件类型不能删除",
+		})
+		return
+	}
+
+	if err := configs.DB.Delete(&eventType).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "删除事件类型失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "删除事件类型成功",
+	})
+}
+
+// 改变持有人的自定义事件类型
+func custodyEventTypes(db *gorm.DB) (map[string]bool, error) {
+	var names []string
+	result := db.Unscoped().Model(&configs.EventType{}).
+		Where("affects_custody = ? AND builtin = ?", true, false).
+		Pluck("name", &names)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	custody := make(map[string]bool)
+	for _, name := range names {
+		custody[name] = true
+	}
+	return custody, nil
+}
+
+// 自定义事件中的新持有人
+func customCustodian(e *events.Custom) uint {
+	var fields struct {
+		ToUserID uint `json:"to_user_id"`
+	}
+	if err := json.Unmarshal(e.Data, &fields); err != nil {
+		return 0
+	}
+	return fields.ToUserID
+}
+
+// 按账本中的事件顺序计算产品当前持有人
+func currentCustodian(db *gorm.DB, sku string) (uint, error) {
+	periods, err := custodyHistory(db, sku)
+	if err != nil || len(periods) == 0 {
+		return 0, err
+	}
+	return periods[len(periods)-1].CustodianID, nil
+}
+
+// EventService 通用事件提交
+type EventService struct{}
+
+// ListEventTypes 获取当前用户可以提交的事件类型
+func (s *EventService) ListEventTypes(c *gin.Context) {
+	userType, _ := c.Get("userType")
+
+	var types []configs.EventType
+	result := configs.DB.Where("builtin = ? AND disabled = ?", false, false).
+		Order("record_type").
+		Find(&types)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "查询事件类型失败",
+		})
+		return
+	}
+
+	list := make([]gin.H, 0, len(types))
+	for _, t := range types {
+		for _, role := range parseRoles(t.AllowedRoles) {
+			if role == userType.(int) {
+				list = append(list, eventTypeView(t))
+				break
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "获取事件类型成功",
+		Data:    list,
+	})
+}
+
+// SubmitEvent 按注册表校验事件并写入账本
+func (s *EventService) SubmitEvent(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	userType, _ := c.Get("userType")
+
+	var req api.SubmitEventRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+
+	var eventType configs.EventType
+	result := configs.DB.Where("name = ?", req.EventType).First(&eventType)
+	if result.Error != nil || eventType.Disabled {
+		c.JSON(http.StatusNotFound, api.Response{
+			Code:    404,
+			Message: "事件类型不存在或已停用",
+		})
+		return
+	}
+	if eventType.Builtin {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "内置事件请通过对应的业务接口提交",
+		})
+		return
+	}
+
+	allowed := false
+	for _, role := range parseRoles(eventType.AllowedRoles) {
+		if role == userType.(int) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, api.Response{
+			Code:    403,
+			Message: "当前用户不能提交该类型的事件",
+		})
+		return
+	}
+
+	var product configs.ProductInfo
+	result = configs.DB.Where("sku = ? AND status = 1", req.ProductSKU).First(&product)
+	if result.Error != nil {
+		c.JSON(http.StatusNotFound, api.Response{
+			Code:    404,
+			Message: "产品不存在或未上架",
+		})
+		return
+	}
+
+	// 按Schema校验事件内容
+	schema, err := eventTypeSchema(eventType)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "事件类型Schema无效: " + err.Error(),
+		})
+		return
+	}
+	decoder := json.NewDecoder(bytes.NewReader(req.Data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "事件内容不是合法的JSON",
+		})
+		return
+	}
+	if err := schema.Validate(value); err != nil {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "事件内容不符合Schema: " + err.Error(),
+		})
+		return
+	}
+
+	data, err := events.Canonical(req.Data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "事件内容不是合法的JSON",
+		})
+		return
+	}
+	event := &events.Custom{
+		Name:    eventType.Name,
+		Version: eventType.Version,
+		Record:  eventType.RecordType,
+		Data:    data,
+	}
+
+	// 改变持有人的事件必须由当前持有人提交，并指定已审核的新持有人
+	var toUserID uint
+	if eventType.AffectsCustody {
+		toUserID = customCustodian(event)
+		var target configs.User
+		if toUserID == 0 || configs.DB.Where("id = ? AND audit_status = 1", toUserID).First(&target).Error != nil {
+			c.JSON(http.StatusBadRequest, api.Response{
+				Code:    400,
+				Message: "事件内容中的 to_user_id 不是已审核的用户",
+			})
+			return
+		}
+		if toUserID == userID.(uint) {
+			c.JSON(http.StatusBadRequest, api.Response{
+				Code:    400,
+				Message: "不能交接给自己",
+			})
+			return
+		}
+	}
+
+	var hash string
+	var notHolder bool
+	blockchainService := &BlockchainService{}
+	err = ledgerTransaction(func(tx *gorm.DB) error {
+		if eventType.AffectsCustody {
+			// 先锁住账本，确保检查持有人和写入事件之间没有其他交接
+			var lock configs.LedgerLock
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&lock, configs.LedgerLockID).Error; err != nil {
+				return err
+			}
+			holder, err := currentCustodian(tx, req.ProductSKU)
+			if err != nil {
+				return err
+			}
+			if holder != userID.(uint) {
+				notHolder = true
+				return errors.New("当前用户不是产品持有人")
+			}
+		}
+
+		var err error
+		hash, err = blockchainService.AddEventTx(tx, req.ProductSKU, event, userID.(uint))
+		return err
+	})
+	if notHolder {
+		c.JSON(http.StatusForbidden, api.Response{
+			Code:    403,
+			Message: "只有产品当前持有人可以提交该事件",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "提交事件失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "提交事件成功",
+		Data: gin.H{
+			"event_type":  eventType.Name,
+			"version":     eventType.Version,
+			"record_type": eventType.RecordType,
+			"product_sku": req.ProductSKU,
+			"hash":        hash,
+		},
+	})
+}
+
+// SetupEventRoutes 设置通用事件路由
+func SetupEventRoutes(router *gin.Engine) {
+	eventService := &EventService{}
+
+	eventGroup := router.Group("/api/events")
+	eventGroup.Use(AuthMiddleware(), TypeAuthMiddleware(1, 2, 3, 4))
+	{
+		eventGroup.GET("/types", eventService.ListEventTypes)
+		eventGroup.POST("", eventService.SubmitEvent)
+	}
+}
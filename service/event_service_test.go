@@ -0,0 +1,259 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/api"
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestCheckEventTypeRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     api.EventTypeRequest
+		roles   string
+		wantErr bool
+	}{
+		{
+			name:  "合法的事件类型",
+			req:   api.EventTypeRequest{Name: "ColdRoomCleaned", Schema: json.RawMessage(`{"type": "object"}`), AllowedRoles: []int{2, 1}},
+			roles: "2,1",
+		},
+		{
+			name:    "名称以数字开头",
+			req:     api.EventTypeRequest{Name: "1Cleaned", Schema: json.RawMessage(`{}`), AllowedRoles: []int{1}},
+			wantErr: true,
+		},
+		{
+			name:    "名称包含空格",
+			req:     api.EventTypeRequest{Name: "Cold Room", Schema: json.RawMessage(`{}`), AllowedRoles: []int{1}},
+			wantErr: true,
+		},
+		{
+			name:    "没有用户类型",
+			req:     api.EventTypeRequest{Name: "A", Schema: json.RawMessage(`{}`)},
+			wantErr: true,
+		},
+		{
+			name:    "未知的用户类型",
+			req:     api.EventTypeRequest{Name: "A", Schema: json.RawMessage(`{}`), AllowedRoles: []int{5}},
+			wantErr: true,
+		},
+		{
+			name:    "Schema不是JSON",
+			req:     api.EventTypeRequest{Name: "A", Schema: json.RawMessage(`{`), AllowedRoles: []int{1}},
+			wantErr: true,
+		},
+		{
+			name:    "Schema无效",
+			req:     api.EventTypeRequest{Name: "A", Schema: json.RawMessage(`{"type": 1}`), AllowedRoles: []int{1}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema, roles, err := checkEventTypeRequest(tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("错误 %v", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			// 保存规范形式的Schema
+			if schema != `{"type":"object"}` || roles != tt.roles {
+				t.Fatalf("Schema %s 用户类型 %s", schema, roles)
+			}
+		})
+	}
+}
+
+// 通过管理接口新增事件类型
+func testCreateEventType(t *testing.T, admin configs.User, req api.EventTypeRequest) configs.EventType {
+	t.Helper()
+	w := testHandle((&AdminService{}).AdminCreateEventType, admin, http.MethodPost, "/api/admin/event-types", req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("新增事件类型失败 %d: %s", w.Code, w.Body.String())
+	}
+	var eventType configs.EventType
+	if err := configs.DB.Where("name = ?", req.Name).First(&eventType).Error; err != nil {
+		t.Fatal(err)
+	}
+	return eventType
+}
+
+func TestAdminCreateEventType(t *testing.T) {
+	testDB(t)
+	if err := InitEventTypes(); err != nil {
+		t.Fatal(err)
+	}
+	admin := testUser(t, 4)
+
+	req := api.EventTypeRequest{Name: "ColdRoomCleaned", Schema: json.RawMessage(`{"type":"object"}`), AllowedRoles: []int{1}}
+	first := testCreateEventType(t, admin, req)
+	if first.RecordType != customRecordTypeStart || first.Version != 1 || first.Builtin {
+		t.Fatalf("第一个自定义事件类型 %+v", first)
+	}
+
+	// 删除的事件类型仍占用记录类型，名称也不能复用
+	if err := configs.DB.Delete(&first).Error; err != nil {
+		t.Fatal(err)
+	}
+	w := testHandle((&AdminService{}).AdminCreateEventType, admin, http.MethodPost, "/api/admin/event-types", req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("重复名称的状态码 %d", w.Code)
+	}
+	req.Name = "PalletInspected"
+	second := testCreateEventType(t, admin, req)
+	if second.RecordType != customRecordTypeStart+1 {
+		t.Fatalf("第二个自定义事件类型的记录类型 %d", second.RecordType)
+	}
+}
+
+func TestSubmitEvent(t *testing.T) {
+	testDB(t)
+	if err := InitEventTypes(); err != nil {
+		t.Fatal(err)
+	}
+	admin := testUser(t, 4)
+	factory := testUser(t, 1)
+	saler := testUser(t, 2)
+	consumer := testUser(t, 3)
+	product := testProduct(t, "SKU-1", factory.ID)
+	if _, err := (&BlockchainService{}).AddEventTx(configs.DB, product.SKU, productCreatedEvent(product, admin.ID), admin.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	testCreateEventType(t, admin, api.EventTypeRequest{
+		Name:         "ColdRoomCleaned",
+		Schema:       json.RawMessage(`{"type":"object","required":["room"],"properties":{"room":{"type":"string"}},"additionalProperties":false}`),
+		AllowedRoles: []int{1, 2},
+	})
+	testCreateEventType(t, admin, api.EventTypeRequest{
+		Name:           "Consigned",
+		Schema:         json.RawMessage(`{"type":"object","required":["to_user_id"]}`),
+		AllowedRoles:   []int{1, 2},
+		AffectsCustody: true,
+	})
+	testCreateEventType(t, admin, api.EventTypeRequest{
+		Name:         "Retired",
+		Schema:       json.RawMessage(`{"type":"object"}`),
+		AllowedRoles: []int{1},
+		Disabled:     true,
+	})
+
+	// 子测试按顺序执行，交接事件会改变之后的持有人
+	tests := []struct {
+		name string
+		user configs.User
+		req  api.SubmitEventRequest
+		code int
+	}{
+		{
+			name: "符合Schema",
+			user: factory,
+			req:  api.SubmitEventRequest{EventType: "ColdRoomCleaned", ProductSKU: "SKU-1", Data: json.RawMessage(`{"room": "A1"}`)},
+			code: http.StatusOK,
+		},
+		{
+			name: "缺少必填字段",
+			user: factory,
+			req:  api.SubmitEventRequest{EventType: "ColdRoomCleaned", ProductSKU: "SKU-1", Data: json.RawMessage(`{}`)},
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "字段类型错误",
+			user: factory,
+			req:  api.SubmitEventRequest{EventType: "ColdRoomCleaned", ProductSKU: "SKU-1", Data: json.RawMessage(`{"room":1}`)},
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "多余字段",
+			user: factory,
+			req:  api.SubmitEventRequest{EventType: "ColdRoomCleaned", ProductSKU: "SKU-1", Data: json.RawMessage(`{"room":"A1","x":1}`)},
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "用户类型不允许",
+			user: consumer,
+			req:  api.SubmitEventRequest{EventType: "ColdRoomCleaned", ProductSKU: "SKU-1", Data: json.RawMessage(`{"room":"A1"}`)},
+			code: http.StatusForbidden,
+		},
+		{
+			name: "内置事件类型",
+			user: factory,
+			req:  api.SubmitEventRequest{EventType: events.TypeLogisticsUpdated, ProductSKU: "SKU-1", Data: json.RawMessage(`{}`)},
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "已停用的事件类型",
+			user: factory,
+			req:  api.SubmitEventRequest{EventType: "Retired", ProductSKU: "SKU-1", Data: json.RawMessage(`{}`)},
+			code: http.StatusNotFound,
+		},
+		{
+			name: "产品不存在",
+			user: factory,
+			req:  api.SubmitEventRequest{EventType: "ColdRoomCleaned", ProductSKU: "SKU-9", Data: json.RawMessage(`{"room":"A1"}`)},
+			code: http.StatusNotFound,
+		},
+		{
+			name: "非持有人交接",
+			user: saler,
+			req:  api.SubmitEventRequest{EventType: "Consigned", ProductSKU: "SKU-1", Data: json.RawMessage(fmt.Sprintf(`{"to_user_id":%d}`, consumer.ID))},
+			code: http.StatusForbidden,
+		},
+		{
+			name: "交接给未知用户",
+			user: factory,
+			req:  api.SubmitEventRequest{EventType: "Consigned", ProductSKU: "SKU-1", Data: json.RawMessage(`{"to_user_id":999999}`)},
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "持有人交接",
+			user: factory,
+			req:  api.SubmitEventRequest{EventType: "Consigned", ProductSKU: "SKU-1", Data: json.RawMessage(fmt.Sprintf(`{"to_user_id":%d}`, saler.ID))},
+			code: http.StatusOK,
+		},
+		{
+			// 交接之后原持有人不能再交接
+			name: "原持有人再次交接",
+			user: factory,
+			req:  api.SubmitEventRequest{EventType: "Consigned", ProductSKU: "SKU-1", Data: json.RawMessage(fmt.Sprintf(`{"to_user_id":%d}`, consumer.ID))},
+			code: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := testHandle((&EventService{}).SubmitEvent, tt.user, http.MethodPost, "/api/events", tt.req)
+			if w.Code != tt.code {
+				t.Fatalf("状态码 %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// 写入账本的是规范形式的事件，可以解码为注册表事件
+	var blocks []configs.BlockchainLog
+	if err := configs.DB.Where("record_type >= ?", customRecordTypeStart).Order("global_height").Find(&blocks).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 {
+		t.Fatalf("写入了 %d 个自定义事件区块", len(blocks))
+	}
+	event, err := decodeBlockEvent(blocks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom, ok := event.(*events.Custom)
+	if !ok || custom.Name != "ColdRoomCleaned" || string(custom.Data) != `{"room":"A1"}` || custom.Record != blocks[0].RecordType {
+		t.Fatalf("解码结果 %+v", event)
+	}
+	holder, err := currentCustodian(configs.DB, "SKU-1")
+	if err != nil || holder != saler.ID {
+		t.Fatalf("当前持有人 %d: %v", holder, err)
+	}
+}
@@ -0,0 +1,534 @@
+package service
+
+import (
+	"archive/zip"
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 证据包格式版本
+// 版本2起签名针对证据包JSON的原始字节，不再对解析后的结构重新编码
+const EvidenceBundleVersion = 2
+
+// 证据包在ZIP中的文件名
+const evidenceBundleFile = "bundle.json"
+
+// EvidenceBundle 单个SKU的自包含证据包，可在没有数据库和网络的环境下离线验证
+type EvidenceBundle struct {
+	Version     int                       `json:"version"`
+	ProductSKU  string                    `json:"product_sku"`
+	ExportedAt  int64                     `json:"exported_at"` // Unix纳秒
+	Product     configs.ProductInfo       `json:"product"`
+	Logistics   []configs.LogisticsRecord `json:"logistics"`
+	Transfers   []configs.TransferRecord  `json:"transfers"`
+	Blocks      []configs.BlockchainLog   `json:"blocks"`
+	SignerKeys  []configs.UserKey         `json:"signer_keys"` // 只包含公钥
+	Proofs      []EvidenceProof           `json:"proofs"`
+	Checkpoints []EvidenceCheckpoint      `json:"checkpoints"`
+}
+
+// SignedEvidence 导出的证据包文件，Bundle 保存证据包JSON原文，签名针对这段原始字节
+// 验证时先验签再解析，解析时丢弃的未知字段和编码差异都不会影响签名结果
+type SignedEvidence struct {
+	Version   int    `json:"version"`
+	ServerKey string `json:"server_key"`
+	Signature string `json:"signature"` // 服务端对 Bundle 字节的Ed25519签名(hex)
+	Bundle    string `json:"bundle"`
+}
+
+// EvidenceProof 区块在打包区块中的Merkle包含证明
+type EvidenceProof struct {
+	BlockHeight int64               `json:"block_height"`
+	LeafIndex   int                 `json:"leaf_index"`
+	Proof       []MerkleProofStep   `json:"proof"`
+	SealedBlock configs.SealedBlock `json:"sealed_block"`
+}
+
+// EvidenceCheckpoint 已签名的检查点头，以及本SKU链头在检查点中的Merkle证明
+type EvidenceCheckpoint struct {
+	ID           uint              `json:"id"`
+	GlobalHeight int64             `json:"global_height"`
+	GlobalHash   string            `json:"global_hash"`
+	SealedHeight int64             `json:"sealed_height"`
+	SealedHash   string            `json:"sealed_hash"`
+	SKUCount     int               `json:"sku_count"`
+	SKUHeadsRoot string            `json:"sku_heads_root"`
+	Timestamp    int64             `json:"timestamp"`
+	ServerKey    string            `json:"server_key"`
+	Signature    string            `json:"signature"`
+	SKUHead      SKUHead           `json:"sku_head"`
+	LeafIndex    int               `json:"leaf_index"`
+	Proof        []MerkleProofStep `json:"proof"`
+}
+
+func (c EvidenceCheckpoint) header() CheckpointHeader {
+	return CheckpointHeader{
+		GlobalHeight: c.GlobalHeight,
+		GlobalHash:   c.GlobalHash,
+		SealedHeight: c.SealedHeight,
+		SealedHash:   c.SealedHash,
+		SKUCount:     c.SKUCount,
+		SKUHeadsRoot: c.SKUHeadsRoot,
+		Timestamp:    c.Timestamp,
+	}
+}
+
+// SignEvidenceBundle 编码证据包并用服务端密钥签名编码后的字节
+func SignEvidenceBundle(bundle *EvidenceBundle) (*SignedEvidence, error) {
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := signWithServerKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedEvidence{
+		Version:   EvidenceBundleVersion,
+		ServerKey: ServerPublicKey(),
+		Signature: signature,
+		Bundle:    string(data),
+	}, nil
+}
+
+// BuildEvidenceBundle 导出SKU的证据包，签名由 SignEvidenceBundle 完成
+func BuildEvidenceBundle(sku string) (*EvidenceBundle, error) {
+	bundle := &EvidenceBundle{
+		Version:    EvidenceBundleVersion,
+		ProductSKU: sku,
+		ExportedAt: time.Now().UnixNano(),
+	}
+
+	if err := configs.DB.Where("sku = ?", sku).First(&bundle.Product).Error; err != nil {
+		return nil, err
+	}
+	if err := configs.DB.Where("product_sku = ?", sku).Order("created_at").Find(&bundle.Logistics).Error; err != nil {
+		return nil, err
+	}
+	if err := configs.DB.Where("product_sku = ?", sku).Order("created_at").Find(&bundle.Transfers).Error; err != nil {
+		return nil, err
+	}
+	blocks, err := skuBlocks(configs.DB, sku)
+	if err != nil {
+		return nil, err
+	}
+	bundle.Blocks = blocks
+
+	keys, err := loadSignerKeys(bundle.Blocks)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		key.PrivateKey = ""
+		bundle.SignerKeys = append(bundle.SignerKeys, key)
+	}
+	sort.Slice(bundle.SignerKeys, func(i, j int) bool {
+		return bundle.SignerKeys[i].ID < bundle.SignerKeys[j].ID
+	})
+
+	// 每个已打包的区块附带Merkle证明，同一打包区块的叶子只加载一次
+	leavesByHeight := make(map[int64][]string)
+	sealedByHeight := make(map[int64]configs.SealedBlock)
+	for _, block := range bundle.Blocks {
+		if block.SealedHeight == 0 {
+			continue
+		}
+		leaves, ok := leavesByHeight[block.SealedHeight]
+		if !ok {
+			var sealed configs.SealedBlock
+			if err := configs.DB.Where("height = ?", block.SealedHeight).First(&sealed).Error; err != nil {
+				return nil, err
+			}
+			leaves, err = sealedBlockLeaves(sealed)
+			if err != nil {
+				return nil, err
+			}
+			leavesByHeight[block.SealedHeight] = leaves
+			sealedByHeight[block.SealedHeight] = sealed
+		}
+		proof, err := MerkleProof(leaves, block.LeafIndex)
+		if err != nil {
+			return nil, err
+		}
+		bundle.Proofs = append(bundle.Proofs, EvidenceProof{
+			BlockHeight: block.BlockHeight,
+			LeafIndex:   block.LeafIndex,
+			Proof:       proof,
+			SealedBlock: sealedByHeight[block.SealedHeight],
+		})
+	}
+
+	// 附带最新的检查点，只给出本SKU链头的证明，不泄露其他SKU
+	var record configs.LedgerCheckpoint
+	if err := configs.DB.Order("id DESC").First(&record).Error; err == nil {
+		cp, err := checkpointOf(record)
+		if err != nil {
+			return nil, err
+		}
+		leaves := make([]string, len(cp.SKUHeads))
+		index := -1
+		for i, head := range cp.SKUHeads {
+			leaves[i] = head.Leaf()
+			if head.ProductSKU == sku {
+				index = i
+			}
+		}
+		if index >= 0 {
+			proof, err := MerkleProof(leaves, index)
+			if err != nil {
+				return nil, err
+			}
+			bundle.Checkpoints = append(bundle.Checkpoints, EvidenceCheckpoint{
+				ID:           cp.ID,
+				GlobalHeight: cp.GlobalHeight,
+				GlobalHash:   cp.GlobalHash,
+				SealedHeight: cp.SealedHeight,
+				SealedHash:   cp.SealedHash,
+				SKUCount:     len(cp.SKUHeads),
+				SKUHeadsRoot: cp.SKUHeadsRoot,
+				Timestamp:    cp.Timestamp,
+				ServerKey:    cp.ServerKey,
+				Signature:    cp.Signature,
+				SKUHead:      cp.SKUHeads[index],
+				LeafIndex:    index,
+				Proof:        proof,
+			})
+		}
+	}
+
+	return bundle, nil
+}
+
+// EvidenceCheck 单项检查结果
+type EvidenceCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// EvidenceReport 证据包验证报告
+type EvidenceReport struct {
+	Valid  bool              `json:"valid"`
+	Chain  chainVerifyResult `json:"chain"`
+	Checks []EvidenceCheck   `json:"checks"`
+}
+
+func (r *EvidenceReport) add(name string, passed bool, detail string) {
+	r.Checks = append(r.Checks, EvidenceCheck{Name: name, Passed: passed, Detail: detail})
+	if !passed {
+		r.Valid = false
+	}
+}
+
+// VerifyEvidenceBundle 离线验证证据包，与 VerifyBlockchain 使用相同的哈希和签名逻辑
+// 证据包和检查点都必须由 trustedKey 签名，证据包自带的公钥只能证明内容未被修改，不能证明出处
+// 证据包JSON无法解析时返回的证据包为nil
+func VerifyEvidenceBundle(signed *SignedEvidence, trustedKey string) (*EvidenceBundle, EvidenceReport) {
+	report := EvidenceReport{Valid: true}
+
+	if signed.Version != EvidenceBundleVersion {
+		report.add("证据包版本", false, "不支持的版本 "+strconv.Itoa(signed.Version))
+		return nil, report
+	}
+
+	// 服务端签名，针对证据包JSON的原始字节
+	switch {
+	case trustedKey == "":
+		report.add("服务端公钥", false, "未指定可信的服务端公钥")
+	case signed.ServerKey != trustedKey:
+		report.add("服务端公钥", false, "证据包签名公钥与指定的公钥不一致")
+	}
+	if !verifyEd25519(signed.ServerKey, signed.Signature, []byte(signed.Bundle)) {
+		report.add("服务端签名", false, "证据包签名无效，内容可能被修改")
+	} else {
+		report.add("服务端签名", true, "")
+	}
+
+	var bundle EvidenceBundle
+	if err := json.Unmarshal([]byte(signed.Bundle), &bundle); err != nil {
+		report.add("证据包内容", false, "无法解析: "+err.Error())
+		return nil, report
+	}
+	if bundle.Version != signed.Version {
+		report.add("证据包版本", false, "证据包内容的版本与文件不一致")
+	}
+
+	// 区块链哈希链和区块签名
+	keys := make(map[uint]configs.UserKey)
+	for _, key := range bundle.SignerKeys {
+		keys[key.ID] = key
+	}
+	report.Chain = verifySKUChain(bundle.Blocks, keys)
+	report.add("区块链", report.Chain.Valid, report.Chain.Reason)
+	if report.Chain.LegacyUnverified > 0 {
+		report.add("旧版区块哈希", false, strconv.Itoa(report.Chain.LegacyUnverified)+" 个旧版区块无法复现哈希，只校验了链接关系")
+	}
+
+	if bundle.Product.SKU != bundle.ProductSKU {
+		report.add("产品信息", false, "产品SKU与证据包不一致")
+	}
+	blocksByHeight := make(map[int64]configs.BlockchainLog)
+	for _, block := range bundle.Blocks {
+		if block.ProductSKU != bundle.ProductSKU {
+			report.add("区块归属", false, "区块 "+strconv.FormatInt(block.BlockHeight, 10)+" 不属于该SKU")
+		}
+		blocksByHeight[block.BlockHeight] = block
+	}
+
+	// 打包区块的Merkle包含证明
+	for _, proof := range bundle.Proofs {
+		name := "Merkle证明(区块 " + strconv.FormatInt(proof.BlockHeight, 10) + ")"
+		block, ok := blocksByHeight[proof.BlockHeight]
+		switch {
+		case !ok:
+			report.add(name, false, "证明对应的区块不存在")
+		case block.SealedHeight != proof.SealedBlock.Height:
+			report.add(name, false, "证明对应的打包区块高度不一致")
+		case sealedHeaderOf(proof.SealedBlock).Hash() != proof.SealedBlock.Hash:
+			report.add(name, false, "打包区块哈希不匹配")
+		case !VerifyMerkleProof(block.Hash, proof.Proof, proof.SealedBlock.MerkleRoot):
+			report.add(name, false, "Merkle证明无效")
+		default:
+			report.add(name, true, "")
+		}
+	}
+
+	// 检查点
+	for _, cp := range bundle.Checkpoints {
+		name := "检查点 " + strconv.FormatUint(uint64(cp.ID), 10)
+		block, ok := blocksByHeight[cp.SKUHead.BlockHeight]
+		switch {
+		case cp.ServerKey != trustedKey:
+			report.add(name, false, "检查点签名公钥与指定的公钥不一致")
+		case !verifyEd25519(cp.ServerKey, cp.Signature, cp.header().Encode()):
+			report.add(name, false, "检查点签名无效")
+		case cp.SKUHead.ProductSKU != bundle.ProductSKU:
+			report.add(name, false, "检查点中的链头不属于该SKU")
+		case !VerifyMerkleProof(cp.SKUHead.Leaf(), cp.Proof, cp.SKUHeadsRoot):
+			report.add(name, false, "SKU链头的Merkle证明无效")
+		case !ok || block.Hash != cp.SKUHead.Hash:
+			report.add(name, false, "检查点记录的链头与证据包中的区块不一致")
+		default:
+			report.add(name, true, "")
+		}
+	}
+
+	checkEvidenceRecords(&bundle, &report)
+	return &bundle, report
+}
+
+// 业务记录与区块中的事件逐字段比对，与对账任务使用相同的字段和忽略规则
+// 每个业务事件区块都要有对应的记录，每条应上链的记录也都要有对应的区块
+func checkEvidenceRecords(bundle *EvidenceBundle, report *EvidenceReport) {
+	rows := make(map[int]map[uint]reconcileRow)
+	addRow := func(recordType int, row reconcileRow) {
+		if rows[recordType] == nil {
+			rows[recordType] = make(map[uint]reconcileRow)
+		}
+		rows[recordType][row.id] = row
+	}
+	addRow(events.RecordProductCreated, reconcileRow{
+		id:          bundle.Product.ID,
+		sku:         bundle.Product.SKU,
+		event:       productCreatedEvent(bundle.Product, 0),
+		expectBlock: bundle.Product.Status == 1,
+	})
+	for _, record := range bundle.Logistics {
+		addRow(events.RecordLogisticsUpdated, reconcileRow{id: record.ID, sku: record.ProductSKU, event: logisticsUpdatedEvent(record), expectBlock: true})
+	}
+	for _, transfer := range bundle.Transfers {
+		addRow(events.RecordCustodyTransferred, reconcileRow{id: transfer.ID, sku: transfer.ProductSKU, event: custodyTransferredEvent(transfer), expectBlock: true})
+	}
+
+	for _, table := range reconcileTables {
+		// 同一业务记录有多个区块时以最新的为准
+		payloads := make(map[uint]ledgerPayload)
+		for _, block := range bundle.Blocks {
+			if block.RecordType != table.recordType {
+				continue
+			}
+			name := "业务事件(区块 " + strconv.FormatInt(block.BlockHeight, 10) + ")"
+			event, err := decodeBlockEvent(block)
+			if err != nil {
+				report.add(name, false, "区块数据无法解析: "+err.Error())
+				continue
+			}
+			id, sku := eventSubject(event)
+			if id == 0 || sku != bundle.ProductSKU {
+				report.add(name, false, "区块数据缺少记录ID或不属于该SKU")
+				continue
+			}
+			fields, err := eventFields(events.Latest(event))
+			if err != nil {
+				report.add(name, false, err.Error())
+				continue
+			}
+			if prev, ok := payloads[id]; !ok || block.BlockHeight > prev.block.BlockHeight {
+				payloads[id] = ledgerPayload{block: block, fields: fields}
+			}
+		}
+
+		ids := make([]uint, 0, len(rows[table.recordType]))
+		for id := range rows[table.recordType] {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			row := rows[table.recordType][id]
+			name := "业务记录(" + table.name + " " + strconv.FormatUint(uint64(id), 10) + ")"
+			payload, ok := payloads[id]
+			delete(payloads, id)
+			switch {
+			case !ok && row.expectBlock:
+				report.add(name, false, "记录没有对应的区块")
+				continue
+			case !ok:
+				continue
+			case !row.expectBlock:
+				report.add(name, false, "记录的当前状态不应有区块")
+				continue
+			}
+
+			fields, err := eventFields(row.event)
+			if err != nil {
+				report.add(name, false, err.Error())
+				continue
+			}
+			var mismatched []string
+			for field, value := range fields {
+				if !table.ignored[field] && !reflect.DeepEqual(payload.fields[field], value) {
+					mismatched = append(mismatched, field)
+				}
+			}
+			if len(mismatched) > 0 {
+				sort.Strings(mismatched)
+				report.add(name, false, "与区块中的记录不一致: "+strings.Join(mismatched, ", "))
+			} else {
+				report.add(name, true, "")
+			}
+		}
+
+		// 剩下的区块在证据包中找不到对应的记录
+		ids = ids[:0]
+		for id := range payloads {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			report.add("业务记录("+table.name+" "+strconv.FormatUint(uint64(id), 10)+")", false,
+				"区块 "+strconv.FormatInt(payloads[id].block.BlockHeight, 10)+" 中的记录不在证据包中")
+		}
+	}
+}
+
+// ReadEvidenceBundle 读取JSON或ZIP格式的证据包文件，证据包内容在验签之后才解析
+func ReadEvidenceBundle(data []byte) (*SignedEvidence, error) {
+	if bytes.HasPrefix(data, []byte("PK")) {
+		reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		f, err := reader.Open(evidenceBundleFile)
+		if err != nil {
+			return nil, errors.New("ZIP中缺少 " + evidenceBundleFile)
+		}
+		defer f.Close()
+		data, err = io.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var signed SignedEvidence
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, err
+	}
+	return &signed, nil
+}
+
+// ExportEvidence 导出SKU的证据包，format=zip 时打包为ZIP
+func (s *BlockchainService) ExportEvidence(c *gin.Context) {
+	sku := c.Query("sku")
+	if sku == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "请提供产品SKU",
+		})
+		return
+	}
+
+	var count int64
+	configs.DB.Model(&configs.ProductInfo{}).Where("sku = ?", sku).Count(&count)
+	if count == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "产品不存在",
+		})
+		return
+	}
+
+	bundle, err := BuildEvidenceBundle(sku)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "导出证据包失败: " + err.Error(),
+		})
+		return
+	}
+
+	signed, err := SignEvidenceBundle(bundle)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "签名证据包失败: " + err.Error(),
+		})
+		return
+	}
+
+	data, err := json.MarshalIndent(signed, "", "  ")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "编码证据包失败",
+		})
+		return
+	}
+
+	filename := "evidence-" + sku
+	if c.Query("format") != "zip" {
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+		c.Data(http.StatusOK, "application/json", data)
+		return
+	}
+
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	f, err := writer.Create(evidenceBundleFile)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "打包证据包失败",
+		})
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`.zip"`)
+	c.Data(http.StatusOK, "application/zip", buf.Bytes())
+}
@@ -0,0 +1,255 @@
+package service
+
+import (
+	"archive/zip"
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// 构造一个带打包区块和检查点的SKU，业务记录与区块一致，返回导出的证据包
+func testEvidenceBundle(t *testing.T) *EvidenceBundle {
+	t.Helper()
+	testReconcileData(t)
+	testServerKey(t)
+	user := testUser(t, 1)
+
+	if _, err := (&BlockchainService{}).AddToBlockchain("SKU-2", 1, `{"n":0}`, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBlockProducer(0, 2).SealPending(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle, err := BuildEvidenceBundle("SKU-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bundle.Blocks) != 3 || len(bundle.Proofs) != 3 || len(bundle.Checkpoints) != 1 || len(bundle.Logistics) != 1 || len(bundle.Transfers) != 1 {
+		t.Fatalf("证据包内容不完整: %d 个区块 %d 个证明 %d 个检查点", len(bundle.Blocks), len(bundle.Proofs), len(bundle.Checkpoints))
+	}
+	return bundle
+}
+
+// 用服务端密钥签名证据包
+func testSignBundle(t *testing.T, bundle *EvidenceBundle) *SignedEvidence {
+	t.Helper()
+	signed, err := SignEvidenceBundle(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestVerifyEvidenceBundle(t *testing.T) {
+	original := testEvidenceBundle(t)
+	originalSigned := testSignBundle(t, original)
+
+	tests := []struct {
+		name       string
+		mutate     func(*EvidenceBundle)
+		resign     bool                  // 篡改后用服务端密钥重新签名，只能由证据包内部的检查发现
+		signed     func(*SignedEvidence) // 直接修改证据包文件
+		trustedKey func() string
+		valid      bool
+	}{
+		{name: "原始证据包", valid: true},
+		{
+			name: "修改区块数据",
+			mutate: func(b *EvidenceBundle) {
+				b.Blocks[1].RecordData = `{"n":9}`
+			},
+		},
+		{
+			// 重新签名后包签名有效，但区块哈希链和Merkle证明无法通过
+			name: "修改区块数据并重新签名",
+			mutate: func(b *EvidenceBundle) {
+				b.Blocks[1].RecordData = `{"n":9}`
+			},
+			resign: true,
+		},
+		{
+			name: "删除区块并重新签名",
+			mutate: func(b *EvidenceBundle) {
+				b.Blocks = b.Blocks[:2]
+			},
+			resign: true,
+		},
+		{
+			name: "修改物流记录",
+			mutate: func(b *EvidenceBundle) {
+				b.Logistics = append(b.Logistics, configs.LogisticsRecord{ProductSKU: "SKU-1", WarehouseLocation: "伪造"})
+			},
+		},
+		{
+			// 区块链完好，但业务记录与区块中的事件不一致
+			name: "修改物流温度并重新签名",
+			mutate: func(b *EvidenceBundle) {
+				b.Logistics[0].Temperature = 25
+			},
+			resign: true,
+		},
+		{
+			name: "修改产品名称并重新签名",
+			mutate: func(b *EvidenceBundle) {
+				b.Product.Name = "伪造"
+			},
+			resign: true,
+		},
+		{
+			name: "删除交接记录并重新签名",
+			mutate: func(b *EvidenceBundle) {
+				b.Transfers = nil
+			},
+			resign: true,
+		},
+		{
+			name: "替换Merkle证明的打包区块并重新签名",
+			mutate: func(b *EvidenceBundle) {
+				b.Proofs[0].SealedBlock.MerkleRoot = hashData("root")
+			},
+			resign: true,
+		},
+		{
+			name: "检查点链头不属于该SKU并重新签名",
+			mutate: func(b *EvidenceBundle) {
+				b.Checkpoints[0].SKUHead.ProductSKU = "SKU-2"
+			},
+			resign: true,
+		},
+		{
+			// 签名针对原始字节，解析时会被丢弃的字段也在签名范围内
+			name: "附加未签名的字段",
+			signed: func(s *SignedEvidence) {
+				s.Bundle = strings.Replace(s.Bundle, "{", `{"note":"伪造",`, 1)
+			},
+		},
+		{
+			name:       "未指定服务端公钥",
+			trustedKey: func() string { return "" },
+		},
+		{
+			name: "其他服务端公钥",
+			trustedKey: func() string {
+				pub, _, _ := ed25519.GenerateKey(rand.Reader)
+				return hex.EncodeToString(pub)
+			},
+		},
+		{
+			// 攻击者用自己的密钥签名整个证据包，指定可信公钥后能发现
+			name: "攻击者重新签名",
+			signed: func(s *SignedEvidence) {
+				pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+				s.ServerKey = hex.EncodeToString(pub)
+				s.Signature = hex.EncodeToString(ed25519.Sign(priv, []byte(s.Bundle)))
+			},
+		},
+		{
+			name: "不支持的版本",
+			signed: func(s *SignedEvidence) {
+				s.Version = EvidenceBundleVersion + 1
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signed := *originalSigned
+			if tt.mutate != nil {
+				bundle := cloneEvidenceBundle(t, original)
+				tt.mutate(bundle)
+				data, err := json.Marshal(bundle)
+				if err != nil {
+					t.Fatal(err)
+				}
+				signed.Bundle = string(data)
+				if tt.resign {
+					signed = *testSignBundle(t, bundle)
+				}
+			}
+			if tt.signed != nil {
+				tt.signed(&signed)
+			}
+			trustedKey := ServerPublicKey()
+			if tt.trustedKey != nil {
+				trustedKey = tt.trustedKey()
+			}
+			_, report := VerifyEvidenceBundle(&signed, trustedKey)
+			if report.Valid != tt.valid {
+				t.Fatalf("验证结果 %v，期望 %v: %+v", report.Valid, tt.valid, report.Checks)
+			}
+		})
+	}
+}
+
+// 通过JSON深拷贝证据包，避免子测试之间互相影响
+func cloneEvidenceBundle(t *testing.T, bundle *EvidenceBundle) *EvidenceBundle {
+	t.Helper()
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clone EvidenceBundle
+	if err := json.Unmarshal(data, &clone); err != nil {
+		t.Fatal(err)
+	}
+	return &clone
+}
+
+func TestReadEvidenceBundle(t *testing.T) {
+	bundle := SignedEvidence{Version: EvidenceBundleVersion, Signature: "ab", Bundle: `{"product_sku":"SKU-1"}`}
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zipOf := func(name string) []byte {
+		var buf bytes.Buffer
+		writer := zip.NewWriter(&buf)
+		f, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(data)
+		writer.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{name: "JSON", data: data},
+		{name: "ZIP", data: zipOf(evidenceBundleFile)},
+		{name: "ZIP中缺少证据包文件", data: zipOf("other.json"), wantErr: true},
+		{name: "损坏的ZIP", data: []byte("PK\x03\x04broken"), wantErr: true},
+		{name: "无效JSON", data: []byte("{"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadEvidenceBundle(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("应返回错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Bundle != bundle.Bundle || got.Signature != bundle.Signature {
+				t.Fatalf("读取结果 %+v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"golang.org/x/crypto/sha3"
+	"math/big"
+	"strings"
+)
+
+// secp256k1 曲线参数，只实现签名锚定交易用到的运算
+var (
+	secpP, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEFFFFFC2F", 16)
+	secpN, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEBAAEDCE6AF48A03BBFD25E8CD0364141", 16)
+	secpGx, _ = new(big.Int).SetString("79BE667EF9DCBBAC55A06295CE870B07029BFCDB2DCE28D959F2815B16F81798", 16)
+	secpGy, _ = new(big.Int).SetString("483ADA7726A3C4655DA4FBFC0E1108A8FD17B448A68554199C47D08FFB10D4B8", 16)
+	secpHalfN = new(big.Int).Rsh(secpN, 1)
+)
+
+// 曲线上的点，x 为 nil 表示无穷远点
+type secpPoint struct {
+	x, y *big.Int
+}
+
+func secpAdd(a, b secpPoint) secpPoint {
+	if a.x == nil {
+		return b
+	}
+	if b.x == nil {
+		return a
+	}
+
+	var lambda *big.Int
+	if a.x.Cmp(b.x) == 0 {
+		if a.y.Cmp(b.y) != 0 || a.y.Sign() == 0 {
+			return secpPoint{}
+		}
+		// 倍点: λ = 3x² / 2y
+		num := new(big.Int).Mul(a.x, a.x)
+		num.Mul(num, big.NewInt(3))
+		den := new(big.Int).Lsh(a.y, 1)
+		lambda = num.Mul(num, den.ModInverse(den, secpP))
+	} else {
+		num := new(big.Int).Sub(b.y, a.y)
+		den := new(big.Int).Sub(b.x, a.x)
+		den.Mod(den, secpP)
+		lambda = num.Mul(num, den.ModInverse(den, secpP))
+	}
+	lambda.Mod(lambda, secpP)
+
+	x := new(big.Int).Mul(lambda, lambda)
+	x.Sub(x, a.x).Sub(x, b.x).Mod(x, secpP)
+	y := new(big.Int).Sub(a.x, x)
+	y.Mul(y, lambda).Sub(y, a.y).Mod(y, secpP)
+	return secpPoint{x: x, y: y}
+}
+
+func secpMul(k *big.Int, p secpPoint) secpPoint {
+	var r secpPoint
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		r = secpAdd(r, r)
+		if k.Bit(i) == 1 {
+			r = secpAdd(r, p)
+		}
+	}
+	return r
+}
+
+func secpBaseMul(k *big.Int) secpPoint {
+	return secpMul(k, secpPoint{x: secpGx, y: secpGy})
+}
+
+func keccak256(data ...[]byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// 公钥对应的以太坊地址：未压缩公钥的 Keccak-256 取后20字节
+func evmAddressOf(pub secpPoint) string {
+	return "0x" + hex.EncodeToString(keccak256(pub.x.FillBytes(make([]byte, 32)), pub.y.FillBytes(make([]byte, 32)))[12:])
+}
+
+// 解析 0x 开头的20字节地址
+func parseEVMAddress(address string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(address, "0x"))
+	if err != nil || len(b) != 20 {
+		return nil, errors.New("以太坊地址格式错误: " + address)
+	}
+	return b, nil
+}
+
+// 用RFC 6979生成确定性的签名随机数，同一私钥和消息得到相同的签名
+func rfc6979Nonce(key *big.Int, hash []byte, retry func(k *big.Int) bool) {
+	x := key.FillBytes(make([]byte, 32))
+	h := new(big.Int).SetBytes(hash)
+	h.Mod(h, secpN)
+	h1 := h.FillBytes(make([]byte, 32))
+
+	mac := func(k []byte, parts ...[]byte) []byte {
+		m := hmac.New(sha256.New, k)
+		for _, p := range parts {
+			m.Write(p)
+		}
+		return m.Sum(nil)
+	}
+	v := bytes.Repeat([]byte{0x01}, 32)
+	k := make([]byte, 32)
+	k = mac(k, v, []byte{0x00}, x, h1)
+	v = mac(k, v)
+	k = mac(k, v, []byte{0x01}, x, h1)
+	v = mac(k, v)
+	for {
+		v = mac(k, v)
+		candidate := new(big.Int).SetBytes(v)
+		if candidate.Sign() > 0 && candidate.Cmp(secpN) < 0 && !retry(candidate) {
+			return
+		}
+		k = mac(k, v, []byte{0x00})
+		v = mac(k, v)
+	}
+}
+
+// 签名锚定交易的账户
+type evmSigner struct {
+	key     *big.Int
+	address string
+}
+
+// 解析十六进制的secp256k1私钥
+func newEVMSigner(privateKey string) (*evmSigner, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(privateKey), "0x"))
+	if err != nil || len(b) != 32 {
+		return nil, errors.New("锚定私钥必须是32字节的十六进制")
+	}
+	key := new(big.Int).SetBytes(b)
+	if key.Sign() == 0 || key.Cmp(secpN) >= 0 {
+		return nil, errors.New("锚定私钥超出secp256k1的范围")
+	}
+	return &evmSigner{key: key, address: evmAddressOf(secpBaseMul(key))}, nil
+}
+
+// 签名32字节的哈希，返回 r、s 和恢复标识，s 取较小的一半
+func (s *evmSigner) sign(hash []byte) (r, sig *big.Int, recovery uint) {
+	e := new(big.Int).SetBytes(hash)
+	rfc6979Nonce(s.key, hash, func(k *big.Int) bool {
+		point := secpBaseMul(k)
+		r = new(big.Int).Mod(point.x, secpN)
+		if r.Sign() == 0 {
+			return true
+		}
+		sig = new(big.Int).Mul(r, s.key)
+		sig.Add(sig, e)
+		sig.Mul(sig, new(big.Int).ModInverse(k, secpN)).Mod(sig, secpN)
+		if sig.Sign() == 0 {
+			return true
+		}
+		recovery = point.y.Bit(0)
+		if point.x.Cmp(secpN) >= 0 {
+			recovery |= 2
+		}
+		if sig.Cmp(secpHalfN) > 0 {
+			sig.Sub(secpN, sig)
+			recovery ^= 1
+		}
+		return false
+	})
+	return r, sig, recovery
+}
+
+// RLP编码，只支持字节串和列表
+func rlpHeader(offset byte, size int) []byte {
+	if size <= 55 {
+		return []byte{offset + byte(size)}
+	}
+	length := new(big.Int).SetInt64(int64(size)).Bytes()
+	return append([]byte{offset + 55 + byte(len(length))}, length...)
+}
+
+func rlpBytes(b []byte) []byte {
+	if len(b) == 1 && b[0] < 0x80 {
+		return b
+	}
+	return append(rlpHeader(0x80, len(b)), b...)
+}
+
+func rlpUint(n *big.Int) []byte {
+	return rlpBytes(n.Bytes())
+}
+
+func rlpList(items ...[]byte) []byte {
+	payload := bytes.Join(items, nil)
+	return append(rlpHeader(0xc0, len(payload)), payload...)
+}
+
+// EIP-155 旧格式交易
+type evmTx struct {
+	Nonce    uint64
+	GasPrice *big.Int
+	Gas      uint64
+	To       []byte
+	Value    *big.Int
+	Data     []byte
+}
+
+func (tx evmTx) fields() [][]byte {
+	return [][]byte{
+		rlpUint(new(big.Int).SetUint64(tx.Nonce)),
+		rlpUint(tx.GasPrice),
+		rlpUint(new(big.Int).SetUint64(tx.Gas)),
+		rlpBytes(tx.To),
+		rlpUint(tx.Value),
+		rlpBytes(tx.Data),
+	}
+}
+
+// 交易的签名哈希，包含链ID防止在其他链上重放
+func (tx evmTx) sigHash(chainID *big.Int) []byte {
+	fields := append(tx.fields(), rlpUint(chainID), rlpUint(new(big.Int)), rlpUint(new(big.Int)))
+	return keccak256(rlpList(fields...))
+}
+
+// 签名交易，返回 eth_sendRawTransaction 需要的编码
+func (s *evmSigner) signTx(tx evmTx, chainID *big.Int) []byte {
+	r, sig, recovery := s.sign(tx.sigHash(chainID))
+	v := new(big.Int).Lsh(chainID, 1)
+	v.Add(v, big.NewInt(35+int64(recovery)))
+	fields := append(tx.fields(), rlpUint(v), rlpUint(r), rlpUint(sig))
+	return rlpList(fields...)
+}
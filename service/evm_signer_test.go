@@ -0,0 +1,139 @@
+package service
+
+import (
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+// anvil 的第一个测试账户
+const testAnvilKey = "0xac0974bec39a17e36ba4a6b4d238ff944bacb478cbed5efcae784d7bf4f2ff80"
+
+// 解码RLP，列表解码为 []interface{}，字节串解码为 []byte
+func testRLPDecode(t *testing.T, data []byte) (interface{}, []byte) {
+	t.Helper()
+	prefix := data[0]
+	size := func(offset byte) (int, int) {
+		if prefix-offset <= 55 {
+			return 1, int(prefix - offset)
+		}
+		n := int(prefix - offset - 55)
+		return 1 + n, int(new(big.Int).SetBytes(data[1 : 1+n]).Int64())
+	}
+	switch {
+	case prefix < 0x80:
+		return data[:1], data[1:]
+	case prefix < 0xc0:
+		head, n := size(0x80)
+		return data[head : head+n], data[head+n:]
+	default:
+		head, n := size(0xc0)
+		payload := data[head : head+n]
+		var items []interface{}
+		for len(payload) > 0 {
+			var item interface{}
+			item, payload = testRLPDecode(t, payload)
+			items = append(items, item)
+		}
+		return items, data[head+n:]
+	}
+}
+
+// 从签名交易中恢复交易和发送者地址
+func testRecoverTx(t *testing.T, raw []byte) (evmTx, string) {
+	t.Helper()
+	decoded, _ := testRLPDecode(t, raw)
+	fields := decoded.([]interface{})
+	if len(fields) != 9 {
+		t.Fatalf("交易有 %d 个字段", len(fields))
+	}
+	num := func(i int) *big.Int { return new(big.Int).SetBytes(fields[i].([]byte)) }
+	tx := evmTx{
+		Nonce:    num(0).Uint64(),
+		GasPrice: num(1),
+		Gas:      num(2).Uint64(),
+		To:       fields[3].([]byte),
+		Value:    num(4),
+		Data:     fields[5].([]byte),
+	}
+	v, r, s := num(6), num(7), num(8)
+	recovery := new(big.Int).Sub(v, big.NewInt(35))
+	chainID := new(big.Int).Rsh(recovery, 1)
+	hash := tx.sigHash(chainID)
+
+	// 由 r 和 y 的奇偶还原点 R，公钥 Q = r⁻¹(sR - eG)
+	x := new(big.Int).Set(r)
+	y := new(big.Int).Exp(x, big.NewInt(3), secpP)
+	y.Add(y, big.NewInt(7))
+	y.ModSqrt(y, secpP)
+	if y.Bit(0) != recovery.Bit(0) {
+		y.Sub(secpP, y)
+	}
+	e := new(big.Int).SetBytes(hash)
+	e.Sub(secpN, e)
+	rInv := new(big.Int).ModInverse(r, secpN)
+	q := secpAdd(secpMul(s, secpPoint{x: x, y: y}), secpBaseMul(e))
+	return tx, evmAddressOf(secpMul(rInv, q))
+}
+
+func TestEVMSigner(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		address string
+		tx      evmTx
+		chainID int64
+		raw     string
+	}{
+		{
+			name:    "anvil测试账户",
+			key:     testAnvilKey,
+			address: "0xf39fd6e51aad88f6f4ce6ab8827279cfffb92266",
+			tx:      evmTx{Nonce: 1, GasPrice: big.NewInt(1e9), Gas: 30000, To: make([]byte, 20), Value: new(big.Int), Data: []byte("CCTA")},
+			chainID: 31337,
+		},
+		{
+			// EIP-155 规范中的示例交易
+			name:    "EIP-155示例",
+			key:     "4646464646464646464646464646464646464646464646464646464646464646",
+			address: "0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f",
+			tx: evmTx{
+				Nonce:    9,
+				GasPrice: big.NewInt(20e9),
+				Gas:      21000,
+				To:       []byte{0x35, 0x35, 0x35, 0x35, 0x35, 0x35, 0x35, 0x35, 0x35, 0x35, 0x35, 0x35, 0x35, 0x35, 0x35, 0x35, 0x35, 0x35, 0x35, 0x35},
+				Value:    big.NewInt(1e18),
+			},
+			chainID: 1,
+			raw:     "f86c098504a817c800825208943535353535353535353535353535353535353535880de0b6b3a76400008025a028ef61340bd939bc2195fe537567866003e1a15d3c71ff63e1590620aa636276a067cbe9d8997f761aecb703304b3800ccf555c9f3dc64214b297fb1966a3b6d83",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := newEVMSigner(tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if signer.address != tt.address {
+				t.Fatalf("地址 %s，期望 %s", signer.address, tt.address)
+			}
+			raw := signer.signTx(tt.tx, big.NewInt(tt.chainID))
+			if tt.raw != "" && hex.EncodeToString(raw) != tt.raw {
+				t.Fatalf("签名交易 %x", raw)
+			}
+			tx, from := testRecoverTx(t, raw)
+			if from != tt.address || tx.Nonce != tt.tx.Nonce || string(tx.Data) != string(tt.tx.Data) {
+				t.Fatalf("恢复出 %s %+v", from, tx)
+			}
+		})
+	}
+}
+
+func TestEVMSignerRejectsKeys(t *testing.T) {
+	for _, key := range []string{"", "0x1234", "zz", "0x" + hex.EncodeToString(secpN.Bytes()), "0x" + hex.EncodeToString(make([]byte, 32))} {
+		if _, err := newEVMSigner(key); err == nil {
+			t.Fatalf("接受了私钥 %q", key)
+		}
+	}
+}
@@ -0,0 +1,585 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/api"
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"time"
+)
+
+// 产品合规状态
+const (
+	ComplianceCompliant    = "compliant"     // 没有超出允许时长的超温
+	ComplianceAtRisk       = "at_risk"       // 正在超温，尚未超出允许时长
+	ComplianceNonCompliant = "non_compliant" // 有超温超出了允许时长
+)
+
+// 超温方向
+const (
+	excursionHigh = "high"
+	excursionLow  = "low"
+)
+
+// 获取产品的温湿度要求，第二个返回值表示是否为厂家配置的要求
+// 没有配置时以运输温度作为温度上限，不限制下限和湿度
+func temperatureProfile(db *gorm.DB, sku string) (configs.TemperatureProfile, bool, error) {
+	var profile configs.TemperatureProfile
+	result := db.Where("product_sku = ?", sku).Limit(1).Find(&profile)
+	if result.Error != nil {
+		return profile, false, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return profile, true, nil
+	}
+
+	var product configs.ProductInfo
+	if err := db.Select("sku, transport_temp").Where("sku = ?", sku).First(&product).Error; err != nil {
+		return profile, false, err
+	}
+	return configs.TemperatureProfile{
+		ProductSKU:     sku,
+		MinTemperature: minReadingTemperature,
+		MaxTemperature: product.TransportTemp,
+	}, false, nil
+}
+
+// 参与超温判断的一条读数，物流记录和设备读数都转换为该结构
+type excursionReading struct {
+	At          time.Time
+	Temperature float64
+	Humidity    *float64
+}
+
+// 一路读数来源，每个设备和物流记录各自独立判断超温
+type excursionStream struct {
+	SKU      string
+	Source   string
+	Device   *configs.Device // 设备读数的设备，物流记录为空
+	SignerID uint            // 超温事件的签名人
+}
+
+func (s excursionStream) deviceID() uint {
+	if s.Device == nil {
+		return 0
+	}
+	return s.Device.ID
+}
+
+func (s excursionStream) deviceSerial() string {
+	if s.Device == nil {
+		return ""
+	}
+	return s.Device.SerialNo
+}
+
+// 判断读数超出范围的方向，未超出时返回空字符串
+func outOfRange(value, min, max float64) string {
+	switch {
+	case value > max:
+		return excursionHigh
+	case value < min:
+		return excursionLow
+	}
+	return ""
+}
+
+// 超温记录的一次阶段变化，按发生顺序写入账本
+type excursionTransition struct {
+	Incident *configs.ExcursionIncident
+	Phase    string
+	State    configs.ExcursionIncident // 变化发生时的记录内容
+}
+
+// 一路读数的超温状态机，按时间顺序输入读数
+type excursionMachine struct {
+	stream      excursionStream
+	profile     configs.TemperatureProfile
+	current     map[string]*configs.ExcursionIncident // 每个指标正在进行的超温
+	touched     []*configs.ExcursionIncident          // 按第一次变化的顺序
+	seen        map[*configs.ExcursionIncident]bool
+	transitions []excursionTransition
+}
+
+// 从尚未结束的超温记录开始判断
+func newExcursionMachine(stream excursionStream, profile configs.TemperatureProfile, open []configs.ExcursionIncident) *excursionMachine {
+	m := &excursionMachine{
+		stream:  stream,
+		profile: profile,
+		current: make(map[string]*configs.ExcursionIncident),
+		seen:    make(map[*configs.ExcursionIncident]bool),
+	}
+	for i := range open {
+		m.current[open[i].Metric] = &open[i]
+	}
+	return m
+}
+
+func (m *excursionMachine) mark(incident *configs.ExcursionIncident) {
+	if !m.seen[incident] {
+		m.seen[incident] = true
+		m.touched = append(m.touched, incident)
+	}
+}
+
+func (m *excursionMachine) emit(incident *configs.ExcursionIncident, phase string) {
+	m.transitions = append(m.transitions, excursionTransition{Incident: incident, Phase: phase, State: *incident})
+}
+
+// 输入一条读数
+func (m *excursionMachine) apply(reading excursionReading) {
+	m.check(events.ExcursionMetricTemperature, reading.At, reading.Temperature, m.profile.MinTemperature, m.profile.MaxTemperature)
+	if reading.Humidity != nil && (m.profile.MinHumidity != nil || m.profile.MaxHumidity != nil) {
+		min, max := float64(minReadingHumidity), float64(maxReadingHumidity)
+		if m.profile.MinHumidity != nil {
+			min = *m.profile.MinHumidity
+		}
+		if m.profile.MaxHumidity != nil {
+			max = *m.profile.MaxHumidity
+		}
+		m.check(events.ExcursionMetricHumidity, reading.At, *reading.Humidity, min, max)
+	}
+}
+
+func (m *excursionMachine) check(metric string, at time.Time, value, min, max float64) {
+	direction := outOfRange(value, min, max)
+	incident := m.current[metric]
+	if incident != nil && incident.Direction != direction {
+		endedAt := at
+		incident.EndedAt = &endedAt
+		incident.Breach = incident.Breach || int64(endedAt.Sub(incident.StartedAt)/time.Second) > incident.AllowedSeconds
+		m.mark(incident)
+		m.emit(incident, events.ExcursionPhaseClosed)
+		delete(m.current, metric)
+		incident = nil
+	}
+	if direction == "" {
+		return
+	}
+
+	opened := incident == nil
+	if opened {
+		incident = &configs.ExcursionIncident{
+			ProductSKU:     m.stream.SKU,
+			Source:         m.stream.Source,
+			DeviceID:       m.stream.deviceID(),
+			Metric:         metric,
+			Direction:      direction,
+			StartedAt:      at,
+			PeakValue:      value,
+			LimitMin:       min,
+			LimitMax:       max,
+			AllowedSeconds: m.profile.AllowedExcursion,
+			ProfileVersion: m.profile.Version,
+		}
+		m.current[metric] = incident
+	} else if (direction == excursionHigh && value > incident.PeakValue) || (direction == excursionLow && value < incident.PeakValue) {
+		incident.PeakValue = value
+	}
+	incident.LastOutAt = at
+	incident.ReadingCount++
+	breached := !incident.Breach && int64(at.Sub(incident.StartedAt)/time.Second) > incident.AllowedSeconds
+	incident.Breach = incident.Breach || breached
+	m.mark(incident)
+	if opened {
+		m.emit(incident, events.ExcursionPhaseOpened)
+	}
+	if breached {
+		m.emit(incident, events.ExcursionPhaseBreached)
+	}
+}
+
+// 保存变化的超温记录，并把阶段变化在同一事务中写入产品账本
+func (m *excursionMachine) save(tx *gorm.DB, transitions []excursionTransition) ([]configs.ExcursionIncident, error) {
+	for _, incident := range m.touched {
+		if err := tx.Save(incident).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	blockchainService := &BlockchainService{}
+	recorded := make(map[*configs.ExcursionIncident]bool)
+	for _, transition := range transitions {
+		state := transition.State
+		state.ID = transition.Incident.ID
+		hash, err := blockchainService.AddEventTx(tx, m.stream.SKU, temperatureExcursionEvent(state, transition.Phase, m.stream.deviceSerial()), m.stream.SignerID)
+		if err != nil {
+			return nil, err
+		}
+		transition.Incident.BlockHash = hash
+		recorded[transition.Incident] = true
+	}
+
+	changed := make([]configs.ExcursionIncident, 0, len(m.touched))
+	for _, incident := range m.touched {
+		if recorded[incident] {
+			if err := tx.Model(incident).Update("block_hash", incident.BlockHash).Error; err != nil {
+				return nil, err
+			}
+		}
+		changed = append(changed, *incident)
+	}
+	return changed, nil
+}
+
+// 按时间顺序判断一路读数，打开、更新或结束超温记录
+// 超温开始、第一次超出允许时长和结束时在同一事务中写入产品账本，返回本次变化的记录
+func evaluateExcursions(tx *gorm.DB, stream excursionStream, readings []excursionReading) ([]configs.ExcursionIncident, error) {
+	if len(readings) == 0 {
+		return nil, nil
+	}
+	profile, _, err := temperatureProfile(tx, stream.SKU)
+	if err != nil {
+		return nil, err
+	}
+
+	var open []configs.ExcursionIncident
+	result := tx.Where("product_sku = ? AND source = ? AND device_id = ? AND ended_at IS NULL", stream.SKU, stream.Source, stream.deviceID()).
+		Find(&open)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	m := newExcursionMachine(stream, profile, open)
+	for _, reading := range readings {
+		m.apply(reading)
+	}
+	return m.save(tx, m.transitions)
+}
+
+// 迟到的读数早于已判断过的读数时，从受影响的超温开始按全部读数重新判断
+// load 返回不早于给定时间的全部读数（包括迟到的读数），按时间排序
+// 重新判断得到的超温沿用时间有重叠的原有记录，没有对应的原有记录向账本写入撤销事件后删除
+// 账本中已写入的阶段不再重复写入，结束结果有变化时再写入一次修正后的结束事件
+// 按之前版本的温湿度要求判断的记录保持不变，修改要求不会撤销已经发生的超温
+func reevaluateExcursions(tx *gorm.DB, stream excursionStream, from time.Time, load func(from time.Time) ([]excursionReading, error)) ([]configs.ExcursionIncident, error) {
+	profile, _, err := temperatureProfile(tx, stream.SKU)
+	if err != nil {
+		return nil, err
+	}
+
+	var affected []configs.ExcursionIncident
+	result := tx.Where("product_sku = ? AND source = ? AND device_id = ? AND profile_version = ? AND (ended_at IS NULL OR ended_at >= ?)", stream.SKU, stream.Source, stream.deviceID(), profile.Version, from).
+		Order("started_at, id").
+		Find(&affected)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	for _, incident := range affected {
+		if incident.StartedAt.Before(from) {
+			from = incident.StartedAt
+		}
+	}
+	readings, err := load(from)
+	if err != nil {
+		return nil, err
+	}
+
+	m := newExcursionMachine(stream, profile, nil)
+	for _, reading := range readings {
+		m.apply(reading)
+	}
+
+	// 同一指标中时间有重叠的超温视为同一次超温，沿用原记录
+	previous := make(map[*configs.ExcursionIncident]configs.ExcursionIncident)
+	paired := make(map[uint]bool)
+	for _, incident := range m.touched {
+		for _, old := range affected {
+			if paired[old.ID] || old.Metric != incident.Metric || !excursionsOverlap(old, *incident) {
+				continue
+			}
+			paired[old.ID] = true
+			incident.ID = old.ID
+			incident.CreatedAt = old.CreatedAt
+			incident.BlockHash = old.BlockHash
+			previous[incident] = old
+			break
+		}
+	}
+	blockchainService := &BlockchainService{}
+	for _, old := range affected {
+		if paired[old.ID] {
+			continue
+		}
+		// 之前写入账本的开始和超时事件作废，查询合规状态和历史状态时不再计入
+		event := temperatureExcursionEvent(old, events.ExcursionPhaseRetracted, stream.deviceSerial())
+		if _, err := blockchainService.AddEventTx(tx, stream.SKU, event, stream.SignerID); err != nil {
+			return nil, err
+		}
+		if err := tx.Delete(&old).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	var transitions []excursionTransition
+	for _, transition := range m.transitions {
+		old, ok := previous[transition.Incident]
+		if ok {
+			switch transition.Phase {
+			case events.ExcursionPhaseOpened:
+				continue
+			case events.ExcursionPhaseBreached:
+				if old.Breach {
+					continue
+				}
+			case events.ExcursionPhaseClosed:
+				if sameExcursionResult(old, transition.State) {
+					continue
+				}
+			}
+		}
+		transitions = append(transitions, transition)
+	}
+	return m.save(tx, transitions)
+}
+
+// 两次超温的时间是否有重叠，未结束的超温一直延续到现在
+func excursionsOverlap(a, b configs.ExcursionIncident) bool {
+	return (a.EndedAt == nil || !a.EndedAt.Before(b.StartedAt)) && (b.EndedAt == nil || !b.EndedAt.Before(a.StartedAt))
+}
+
+// 已结束的超温记录与重新判断的结果是否一致
+func sameExcursionResult(old, state configs.ExcursionIncident) bool {
+	return old.EndedAt != nil && state.EndedAt != nil && old.EndedAt.Equal(*state.EndedAt) &&
+		old.StartedAt.Equal(state.StartedAt) && old.Direction == state.Direction &&
+		old.PeakValue == state.PeakValue && old.ReadingCount == state.ReadingCount && old.Breach == state.Breach
+}
+
+// 温湿度要求，用于接口返回
+type profileInfo struct {
+	Configured       bool     `json:"configured"` // false 表示按运输温度推算
+	Version          int      `json:"version"`
+	MinTemperature   float64  `json:"min_temperature"`
+	MaxTemperature   float64  `json:"max_temperature"`
+	AllowedExcursion int64    `json:"allowed_excursion"` // 秒
+	MinHumidity      *float64 `json:"min_humidity"`
+	MaxHumidity      *float64 `json:"max_humidity"`
+	ActivationEnergy float64  `json:"activation_energy"` // kJ/mol
+}
+
+// 产品的合规情况
+type productCompliance struct {
+	Status           string                      `json:"status"`
+	Profile          profileInfo                 `json:"profile"`
+	Incidents        []configs.ExcursionIncident `json:"incidents"`
+	OpenIncidents    int                         `json:"open_incidents"`
+	Breaches         int                         `json:"breaches"`
+	LedgerExcursions int                         `json:"ledger_excursions"` // 账本中有事件且未撤销的超温记录数
+	Unrecorded       int                         `json:"unrecorded"`        // 数据库与账本中的结束状态不一致的超温记录
+}
+
+// 根据超温记录和账本中的超温事件计算产品的合规状态
+// 账本中记录为超出允许时长的超温，即使数据库记录被修改也计为不合规；账本中已撤销的超温不计入
+// 账本中没有结束事件的超温无法证明已经恢复，无论数据库中是否已结束，都按仍在超温处理
+func complianceOf(db *gorm.DB, sku string, blocks []configs.BlockchainLog) (*productCompliance, error) {
+	profile, configured, err := temperatureProfile(db, sku)
+	if err != nil {
+		return nil, err
+	}
+
+	compliance := &productCompliance{
+		Status: ComplianceCompliant,
+		Profile: profileInfo{
+			Configured:       configured,
+			Version:          profile.Version,
+			MinTemperature:   profile.MinTemperature,
+			MaxTemperature:   profile.MaxTemperature,
+			AllowedExcursion: profile.AllowedExcursion,
+			MinHumidity:      profile.MinHumidity,
+			MaxHumidity:      profile.MaxHumidity,
+			ActivationEnergy: activationEnergy(profile),
+		},
+	}
+	if err := db.Where("product_sku = ?", sku).Order("started_at, id").Find(&compliance.Incidents).Error; err != nil {
+		return nil, err
+	}
+
+	// 同一超温记录在账本中有开始、超时和结束多个事件，以最后写入的为准，撤销事件作废之前的全部事件
+	latest := make(map[uint]*events.TemperatureExcursion)
+	breached := make(map[uint]bool)
+	for _, block := range blocks {
+		event, err := decodeBlockEvent(block)
+		if err != nil {
+			continue
+		}
+		e, ok := events.Latest(event).(*events.TemperatureExcursion)
+		if !ok {
+			continue
+		}
+		if e.Phase == events.ExcursionPhaseRetracted {
+			delete(latest, e.IncidentID)
+			delete(breached, e.IncidentID)
+			continue
+		}
+		latest[e.IncidentID] = e
+		if e.Breach {
+			breached[e.IncidentID] = true
+		}
+	}
+	compliance.LedgerExcursions = len(latest)
+
+	now := time.Now()
+	overdue := func(startedAt time.Time, allowed int64) bool {
+		return int64(now.Sub(startedAt)/time.Second) > allowed
+	}
+	stored := make(map[uint]bool, len(compliance.Incidents))
+	for _, incident := range compliance.Incidents {
+		stored[incident.ID] = true
+		closed := latest[incident.ID] != nil && latest[incident.ID].Phase == events.ExcursionPhaseClosed
+		switch {
+		case incident.EndedAt == nil:
+			compliance.OpenIncidents++
+		case !closed:
+			compliance.Unrecorded++
+		}
+		if (incident.EndedAt == nil || !closed) && overdue(incident.StartedAt, incident.AllowedSeconds) {
+			breached[incident.ID] = true
+		}
+		if incident.Breach {
+			breached[incident.ID] = true
+		}
+	}
+	// 账本中未结束也未撤销、数据库中却没有的超温
+	for id, e := range latest {
+		if stored[id] || e.Phase == events.ExcursionPhaseClosed {
+			continue
+		}
+		compliance.Unrecorded++
+		if overdue(time.Unix(0, e.StartedAt), e.AllowedSeconds) {
+			breached[id] = true
+		}
+	}
+	compliance.Breaches = len(breached)
+
+	switch {
+	case compliance.Breaches > 0:
+		compliance.Status = ComplianceNonCompliant
+	case compliance.OpenIncidents > 0 || compliance.Unrecorded > 0:
+		compliance.Status = ComplianceAtRisk
+	}
+	return compliance, nil
+}
+
+// SetTemperatureProfile 设置产品的温湿度要求，超温判断只影响之后的读数，保质期按新要求重新计算
+// 每次修改版本加1并写入产品账本，之后的超温记录带有新的版本
+func (s *FactoryService) SetTemperatureProfile(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	var product configs.ProductInfo
+	result := configs.DB.Where("id = ? AND manufacturer_id = ?", c.Param("id"), userID).First(&product)
+	if result.Error != nil {
+		c.JSON(http.StatusNotFound, api.Response{
+			Code:    404,
+			Message: "产品不存在或不属于当前用户",
+		})
+		return
+	}
+
+	var req struct {
+		MinTemperature   *float64 `json:"min_temperature" binding:"required"`
+		MaxTemperature   *float64 `json:"max_temperature" binding:"required"`
+		AllowedExcursion int64    `json:"allowed_excursion"` // 秒
+		MinHumidity      *float64 `json:"min_humidity"`
+		MaxHumidity      *float64 `json:"max_humidity"`
+		ActivationEnergy float64  `json:"activation_energy"` // kJ/mol，不填使用默认值
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+
+	message := ""
+	switch {
+	case *req.MinTemperature < minReadingTemperature || *req.MaxTemperature > maxReadingTemperature || *req.MinTemperature > *req.MaxTemperature:
+		message = "温度范围错误"
+	case req.AllowedExcursion < 0:
+		message = "允许超温时长不能为负数"
+	case req.ActivationEnergy < 0 || req.ActivationEnergy > maxActivationEnergy:
+		message = "活化能超出合理范围"
+	case req.MinHumidity != nil && (*req.MinHumidity < minReadingHumidity || *req.MinHumidity > maxReadingHumidity):
+		message = "湿度下限错误"
+	case req.MaxHumidity != nil && (*req.MaxHumidity < minReadingHumidity || *req.MaxHumidity > maxReadingHumidity):
+		message = "湿度上限错误"
+	case req.MinHumidity != nil && req.MaxHumidity != nil && *req.MinHumidity > *req.MaxHumidity:
+		message = "湿度范围错误"
+	}
+	if message != "" {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: message,
+		})
+		return
+	}
+
+	var profile configs.TemperatureProfile
+	err := ledgerTransaction(func(tx *gorm.DB) error {
+		// 先锁住账本，并发修改时版本号依次递增
+		if err := lockLedger(tx); err != nil {
+			return err
+		}
+		profile = configs.TemperatureProfile{ProductSKU: product.SKU}
+		if err := tx.Where("product_sku = ?", product.SKU).Limit(1).Find(&profile).Error; err != nil {
+			return err
+		}
+		profile.MinTemperature = *req.MinTemperature
+		profile.MaxTemperature = *req.MaxTemperature
+		profile.AllowedExcursion = req.AllowedExcursion
+		profile.MinHumidity = req.MinHumidity
+		profile.MaxHumidity = req.MaxHumidity
+		profile.ActivationEnergy = req.ActivationEnergy
+		profile.Version++
+		if err := tx.Save(&profile).Error; err != nil {
+			return err
+		}
+		_, err := (&BlockchainService{}).AddEventTx(tx, product.SKU, temperatureProfileSetEvent(profile, userID.(uint)), userID.(uint))
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "保存温湿度要求失败: " + err.Error(),
+		})
+		return
+	}
+	refreshShelfLife(product.SKU)
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "设置温湿度要求成功",
+		Data:    profile,
+	})
+}
+
+// AdminGetExcursions 查询超温记录，status=open 只返回未结束的记录，breach=1 只返回超出允许时长的记录
+func (s *AdminService) AdminGetExcursions(c *gin.Context) {
+	query := configs.DB.Model(&configs.ExcursionIncident{})
+	if sku := c.Query("sku"); sku != "" {
+		query = query.Where("product_sku = ?", sku)
+	}
+	if c.Query("status") == "open" {
+		query = query.Where("ended_at IS NULL")
+	}
+	if c.Query("breach") == "1" {
+		query = query.Where("breach = ?", true)
+	}
+
+	var incidents []configs.ExcursionIncident
+	if err := query.Order("started_at DESC").Limit(1000).Find(&incidents).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "查询超温记录失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "获取超温记录成功",
+		Data:    incidents,
+	})
+}
@@ -0,0 +1,486 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 温度上限8度、允许超温60秒的要求
+func testExcursionProfile() configs.TemperatureProfile {
+	humidity := 80.0
+	return configs.TemperatureProfile{MinTemperature: 0, MaxTemperature: 8, AllowedExcursion: 60, MaxHumidity: &humidity}
+}
+
+// 按秒偏移生成读数
+func testExcursionReadings(base time.Time, points ...[2]float64) []excursionReading {
+	readings := make([]excursionReading, len(points))
+	for i, point := range points {
+		readings[i] = excursionReading{At: base.Add(time.Duration(point[0]) * time.Second), Temperature: point[1]}
+	}
+	return readings
+}
+
+// 阶段变化的简写，例如 temperature:opened
+func testTransitions(transitions []excursionTransition) string {
+	list := make([]string, len(transitions))
+	for i, transition := range transitions {
+		list[i] = transition.State.Metric + ":" + transition.Phase
+	}
+	return strings.Join(list, " ")
+}
+
+func TestExcursionMachine(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.Local)
+	humid := 90.0
+	tests := []struct {
+		name        string
+		open        []configs.ExcursionIncident
+		readings    []excursionReading
+		transitions string
+		open2       int  // 判断后仍未结束的超温数
+		breach      bool // 最后一个变化的超温是否超时
+	}{
+		{name: "一直在范围内", readings: testExcursionReadings(base, [2]float64{0, 4}, [2]float64{60, 5})},
+		{
+			name:        "超温后恢复",
+			readings:    testExcursionReadings(base, [2]float64{0, 10}, [2]float64{30, 12}, [2]float64{50, 4}),
+			transitions: "temperature:opened temperature:closed",
+		},
+		{
+			name:        "超温超过允许时长",
+			readings:    testExcursionReadings(base, [2]float64{0, 10}, [2]float64{61, 10}, [2]float64{120, 10}, [2]float64{150, 4}),
+			transitions: "temperature:opened temperature:breached temperature:closed",
+			breach:      true,
+		},
+		{
+			// 恢复时才发现超时，只写入结束事件
+			name:        "恢复时已超过允许时长",
+			readings:    testExcursionReadings(base, [2]float64{0, 10}, [2]float64{90, 4}),
+			transitions: "temperature:opened temperature:closed",
+			breach:      true,
+		},
+		{
+			name:        "尚未恢复",
+			readings:    testExcursionReadings(base, [2]float64{0, 4}, [2]float64{30, 10}),
+			transitions: "temperature:opened",
+			open2:       1,
+		},
+		{
+			name:        "高温直接变为低温",
+			readings:    testExcursionReadings(base, [2]float64{0, 10}, [2]float64{30, -2}),
+			transitions: "temperature:opened temperature:closed temperature:opened",
+			open2:       1,
+		},
+		{
+			name: "湿度单独判断",
+			readings: []excursionReading{
+				{At: base, Temperature: 4, Humidity: &humid},
+				{At: base.Add(30 * time.Second), Temperature: 10, Humidity: &humid},
+			},
+			transitions: "humidity:opened temperature:opened",
+			open2:       2,
+		},
+		{
+			// 上一批读数留下的超温继续判断，不再写入开始事件
+			name: "接着未结束的超温判断",
+			open: []configs.ExcursionIncident{{
+				ProductSKU: "SKU-1", Source: events.ExcursionSourceLogistics, Metric: events.ExcursionMetricTemperature, Direction: excursionHigh, StartedAt: base,
+				PeakValue: 10, LimitMax: 8, AllowedSeconds: 60, ReadingCount: 1,
+			}},
+			readings:    testExcursionReadings(base, [2]float64{70, 11}, [2]float64{80, 4}),
+			transitions: "temperature:breached temperature:closed",
+			breach:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newExcursionMachine(excursionStream{SKU: "SKU-1", Source: events.ExcursionSourceLogistics}, testExcursionProfile(), tt.open)
+			for _, reading := range tt.readings {
+				m.apply(reading)
+			}
+			if got := testTransitions(m.transitions); got != tt.transitions {
+				t.Fatalf("阶段变化 %q，期望 %q", got, tt.transitions)
+			}
+			if len(m.current) != tt.open2 {
+				t.Fatalf("未结束的超温 %d 个", len(m.current))
+			}
+			if len(m.touched) > 0 && m.touched[len(m.touched)-1].Breach != tt.breach {
+				t.Fatalf("超时标记 %+v", m.touched[len(m.touched)-1])
+			}
+
+			// 每个阶段的事件都能通过校验
+			for _, transition := range m.transitions {
+				state := transition.State
+				state.ID = 1
+				if err := temperatureExcursionEvent(state, transition.Phase, "").Validate(); err != nil {
+					t.Fatalf("%s 事件: %v", transition.Phase, err)
+				}
+			}
+		})
+	}
+}
+
+// 产品账本中的超温事件，简写为 记录ID:阶段
+func testLedgerExcursions(t *testing.T, sku string) (string, []*events.TemperatureExcursion) {
+	t.Helper()
+	blocks, err := skuBlocks(configs.DB, sku)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []string
+	var excursions []*events.TemperatureExcursion
+	for _, block := range blocks {
+		event, err := decodeBlockEvent(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, ok := event.(*events.TemperatureExcursion); ok {
+			list = append(list, fmt.Sprintf("%d:%s", e.IncidentID, e.Phase))
+			excursions = append(excursions, e)
+		}
+	}
+	return strings.Join(list, " "), excursions
+}
+
+func TestEvaluateExcursions(t *testing.T) {
+	testDB(t)
+	factory := testUser(t, 1)
+	testProduct(t, "SKU-1", factory.ID)
+	profile := testExcursionProfile()
+	profile.ProductSKU = "SKU-1"
+	configs.DB.Create(&profile)
+
+	stream := excursionStream{SKU: "SKU-1", Source: events.ExcursionSourceLogistics, SignerID: factory.ID}
+	base := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	batches := [][]excursionReading{
+		testExcursionReadings(base, [2]float64{0, 10}),
+		testExcursionReadings(base, [2]float64{90, 11}),
+		testExcursionReadings(base, [2]float64{120, 4}),
+	}
+	want := []string{"1:opened", "1:opened 1:breached", "1:opened 1:breached 1:closed"}
+
+	var id uint
+	for i, readings := range batches {
+		err := ledgerTransaction(func(tx *gorm.DB) error {
+			changed, err := evaluateExcursions(tx, stream, readings)
+			if err == nil && id == 0 {
+				id = changed[0].ID
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := testLedgerExcursions(t, "SKU-1")
+		if expected := strings.ReplaceAll(want[i], "1:", fmt.Sprintf("%d:", id)); got != expected {
+			t.Fatalf("第 %d 批后账本中的超温事件 %q，期望 %q", i+1, got, expected)
+		}
+	}
+
+	// 超温记录指向最后一个事件所在的区块，合规状态为不合规
+	var incident configs.ExcursionIncident
+	configs.DB.First(&incident, id)
+	head, err := NewGormLedger(configs.DB).Head("SKU-1")
+	if err != nil || incident.BlockHash != head.Hash || !incident.Breach || incident.EndedAt == nil {
+		t.Fatalf("超温记录 %+v %v", incident, err)
+	}
+	blocks, _ := skuBlocks(configs.DB, "SKU-1")
+	compliance, err := complianceOf(configs.DB, "SKU-1", blocks)
+	if err != nil || compliance.Status != ComplianceNonCompliant || compliance.LedgerExcursions != 1 || compliance.Unrecorded != 0 {
+		t.Fatalf("合规状态 %+v %v", compliance, err)
+	}
+}
+
+func TestLateReadings(t *testing.T) {
+	base := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	tests := []struct {
+		name    string
+		batches [][][2]float64 // 按上报顺序的批次，每条读数为 秒偏移, 温度
+		events  string         // 账本中的超温事件，记录ID用 A、B 表示创建的先后
+		open    int
+		breach  bool
+	}{
+		{
+			name:    "按顺序上报",
+			batches: [][][2]float64{{{0, 10}, {30, 12}}, {{50, 4}}},
+			events:  "A:opened A:closed",
+		},
+		{
+			// 迟到的正常读数把一次超温分成两次
+			name:    "迟到的读数结束了超温",
+			batches: [][][2]float64{{{0, 10}, {40, 10}}, {{20, 4}}},
+			events:  "A:opened A:closed B:opened",
+			open:    1,
+		},
+		{
+			// 迟到的超温读数使超温提前开始，持续时长超过允许时长
+			name:    "迟到的读数使超温超时",
+			batches: [][][2]float64{{{100, 10}, {130, 4}}, {{20, 10}}},
+			events:  "A:opened A:closed A:breached A:closed",
+			breach:  true,
+		},
+		{
+			name:    "迟到的读数在范围内",
+			batches: [][][2]float64{{{100, 10}, {130, 4}}, {{20, 4}}},
+			events:  "A:opened A:closed",
+		},
+		{
+			// 迟到的读数不影响已结束的超温，只在之前的空档中新开一次超温
+			name:    "迟到的读数早于已有超温",
+			batches: [][][2]float64{{{100, 10}, {130, 4}}, {{20, 10}, {30, 4}}},
+			events:  "A:opened A:closed B:opened B:closed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDB(t)
+			factory := testUser(t, 1)
+			testProduct(t, "SKU-1", factory.ID)
+			profile := testExcursionProfile()
+			profile.ProductSKU = "SKU-1"
+			configs.DB.Create(&profile)
+			device := testDevice(t, factory.ID)
+			configs.DB.Create(&configs.DeviceBinding{DeviceID: device.ID, ProductSKU: "SKU-1", BoundAt: base.Add(-time.Minute)})
+
+			for _, batch := range tt.batches {
+				var inputs []telemetryReadingInput
+				for _, point := range batch {
+					temperature := point[1]
+					inputs = append(inputs, telemetryReadingInput{RecordedAt: base.Add(time.Duration(point[0]) * time.Second), Temperature: &temperature})
+				}
+				if _, err := ingestTelemetry(device, inputs); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var incidents []configs.ExcursionIncident
+			configs.DB.Where("product_sku = ?", "SKU-1").Order("id").Find(&incidents)
+			names := make(map[uint]string)
+			for _, incident := range incidents {
+				names[incident.ID] = string(rune('A' + len(names)))
+			}
+			got, excursions := testLedgerExcursions(t, "SKU-1")
+			for id, name := range names {
+				got = strings.ReplaceAll(got, fmt.Sprintf("%d:", id), name+":")
+			}
+			if got != tt.events {
+				t.Fatalf("账本中的超温事件 %q，期望 %q", got, tt.events)
+			}
+
+			open, breach := 0, false
+			for _, incident := range incidents {
+				if incident.EndedAt == nil {
+					open++
+				}
+				breach = breach || incident.Breach
+			}
+			if open != tt.open || breach != tt.breach {
+				t.Fatalf("超温记录 %+v", incidents)
+			}
+
+			// 账本中每个超温记录最后的事件与数据库记录一致
+			last := make(map[uint]*events.TemperatureExcursion)
+			for _, e := range excursions {
+				last[e.IncidentID] = e
+			}
+			for _, incident := range incidents {
+				e := last[incident.ID]
+				if e == nil || e.StartedAt != incident.StartedAt.UnixNano() || e.ReadingCount != incident.ReadingCount || e.Breach != incident.Breach {
+					t.Fatalf("超温记录 %+v 与账本事件 %+v 不一致", incident, e)
+				}
+			}
+		})
+	}
+}
+
+func TestComplianceLedgerState(t *testing.T) {
+	tests := []struct {
+		name       string
+		started    time.Duration // 超温开始于多久之前
+		setup      func(t *testing.T, stream excursionStream, incident configs.ExcursionIncident)
+		status     string
+		ledger     int
+		unrecorded int
+	}{
+		{
+			name:    "未结束",
+			started: 10 * time.Second,
+			setup:   func(*testing.T, excursionStream, configs.ExcursionIncident) {},
+			status:  ComplianceAtRisk,
+			ledger:  1,
+		},
+		{
+			// 数据库中的记录被改为已结束，账本中没有结束事件
+			name:    "数据库结束但账本未结束",
+			started: 10 * time.Second,
+			setup: func(t *testing.T, _ excursionStream, incident configs.ExcursionIncident) {
+				configs.DB.Model(&incident).Update("ended_at", time.Now())
+			},
+			status:     ComplianceAtRisk,
+			ledger:     1,
+			unrecorded: 1,
+		},
+		{
+			name:    "数据库结束但账本未结束且已超时",
+			started: time.Hour,
+			setup: func(t *testing.T, _ excursionStream, incident configs.ExcursionIncident) {
+				configs.DB.Model(&incident).Updates(map[string]interface{}{"ended_at": incident.StartedAt.Add(time.Second), "breach": false})
+			},
+			status:     ComplianceNonCompliant,
+			ledger:     1,
+			unrecorded: 1,
+		},
+		{
+			name:    "数据库记录被删除",
+			started: 10 * time.Second,
+			setup: func(t *testing.T, _ excursionStream, incident configs.ExcursionIncident) {
+				configs.DB.Delete(&incident)
+			},
+			status:     ComplianceAtRisk,
+			ledger:     1,
+			unrecorded: 1,
+		},
+		{
+			name:    "账本中已撤销",
+			started: 10 * time.Second,
+			setup: func(t *testing.T, stream excursionStream, incident configs.ExcursionIncident) {
+				testAddEvent(t, stream.SKU, temperatureExcursionEvent(incident, events.ExcursionPhaseRetracted, ""), stream.SignerID)
+				configs.DB.Delete(&incident)
+			},
+			status: ComplianceCompliant,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDB(t)
+			factory := testUser(t, 1)
+			testProduct(t, "SKU-1", factory.ID)
+			profile := testExcursionProfile()
+			profile.ProductSKU = "SKU-1"
+			configs.DB.Create(&profile)
+
+			stream := excursionStream{SKU: "SKU-1", Source: events.ExcursionSourceLogistics, SignerID: factory.ID}
+			readings := testExcursionReadings(time.Now().Add(-tt.started).Truncate(time.Millisecond), [2]float64{0, 10})
+			var incident configs.ExcursionIncident
+			err := ledgerTransaction(func(tx *gorm.DB) error {
+				changed, err := evaluateExcursions(tx, stream, readings)
+				if err == nil {
+					incident = changed[0]
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.setup(t, stream, incident)
+
+			blocks, _ := skuBlocks(configs.DB, "SKU-1")
+			compliance, err := complianceOf(configs.DB, "SKU-1", blocks)
+			if err != nil || compliance.Status != tt.status || compliance.LedgerExcursions != tt.ledger || compliance.Unrecorded != tt.unrecorded {
+				t.Fatalf("合规状态 %+v %v", compliance, err)
+			}
+		})
+	}
+}
+
+func TestReevaluateRetractsExcursions(t *testing.T) {
+	testDB(t)
+	factory := testUser(t, 1)
+	testProduct(t, "SKU-1", factory.ID)
+	profile := testExcursionProfile()
+	profile.ProductSKU = "SKU-1"
+	configs.DB.Create(&profile)
+
+	stream := excursionStream{SKU: "SKU-1", Source: events.ExcursionSourceLogistics, SignerID: factory.ID}
+	base := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	var id uint
+	err := ledgerTransaction(func(tx *gorm.DB) error {
+		changed, err := evaluateExcursions(tx, stream, testExcursionReadings(base, [2]float64{0, 10}, [2]float64{90, 11}))
+		if err == nil {
+			id = changed[0].ID
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新判断时全部读数都在范围内，原有的超温被撤销
+	err = ledgerTransaction(func(tx *gorm.DB) error {
+		_, err := reevaluateExcursions(tx, stream, base, func(time.Time) ([]excursionReading, error) {
+			return testExcursionReadings(base, [2]float64{0, 4}, [2]float64{90, 5}), nil
+		})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := testLedgerExcursions(t, "SKU-1")
+	if want := fmt.Sprintf("%d:opened %d:breached %d:retracted", id, id, id); got != want {
+		t.Fatalf("账本中的超温事件 %q，期望 %q", got, want)
+	}
+	var count int64
+	configs.DB.Model(&configs.ExcursionIncident{}).Count(&count)
+	blocks, _ := skuBlocks(configs.DB, "SKU-1")
+	compliance, err := complianceOf(configs.DB, "SKU-1", blocks)
+	if err != nil || count != 0 || compliance.Status != ComplianceCompliant || compliance.LedgerExcursions != 0 || compliance.Breaches != 0 {
+		t.Fatalf("超温记录 %d 条，合规状态 %+v %v", count, compliance, err)
+	}
+}
+
+func TestSetTemperatureProfile(t *testing.T) {
+	testDB(t)
+	factory := testUser(t, 1)
+	product := testProduct(t, "SKU-1", factory.ID)
+	handler := func(c *gin.Context) {
+		c.Params = gin.Params{{Key: "id", Value: fmt.Sprint(product.ID)}}
+		(&FactoryService{}).SetTemperatureProfile(c)
+	}
+
+	// 每次修改版本加1，并在产品账本中留下记录
+	for version := 1; version <= 2; version++ {
+		body := map[string]any{"min_temperature": 0, "max_temperature": 8 + version, "allowed_excursion": 60}
+		w := testHandle(handler, factory, http.MethodPut, "/", body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("状态码 %d: %s", w.Code, w.Body.String())
+		}
+	}
+	var sets []*events.TemperatureProfileSet
+	blocks, _ := skuBlocks(configs.DB, "SKU-1")
+	for _, block := range blocks {
+		if event, err := decodeBlockEvent(block); err == nil {
+			if e, ok := event.(*events.TemperatureProfileSet); ok {
+				sets = append(sets, e)
+			}
+		}
+	}
+	if len(sets) != 2 || sets[1].Version != 2 || sets[1].MaxTemperature != 10 || sets[1].SetBy != factory.ID {
+		t.Fatalf("账本中的温湿度要求 %+v", sets)
+	}
+
+	// 之后的超温记录带有判断时使用的版本
+	stream := excursionStream{SKU: "SKU-1", Source: events.ExcursionSourceLogistics, SignerID: factory.ID}
+	var incident configs.ExcursionIncident
+	err := ledgerTransaction(func(tx *gorm.DB) error {
+		changed, err := evaluateExcursions(tx, stream, testExcursionReadings(time.Now(), [2]float64{0, 12}))
+		if err == nil {
+			incident = changed[0]
+		}
+		return err
+	})
+	_, excursions := testLedgerExcursions(t, "SKU-1")
+	if err != nil || incident.ProfileVersion != 2 || len(excursions) != 1 || excursions[0].ProfileVersion != 2 {
+		t.Fatalf("超温记录 %+v %v", incident, err)
+	}
+}
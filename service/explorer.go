@@ -0,0 +1,384 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// 区块浏览器列表中的区块摘要，不含记录数据
+type blockSummary struct {
+	ID           uint   `json:"id"`
+	ProductSKU   string `json:"product_sku"`
+	RecordType   int    `json:"record_type"`
+	Hash         string `json:"hash"`
+	PreviousHash string `json:"previous_hash"`
+	BlockHeight  int64  `json:"block_height"`
+	GlobalHeight int64  `json:"global_height"`
+	HashVersion  int    `json:"hash_version"`
+	Timestamp    int64  `json:"timestamp"`
+	SignerID     uint   `json:"signer_id"`
+	SealedHeight int64  `json:"sealed_height"`
+}
+
+func summaryOf(block configs.BlockchainLog) blockSummary {
+	return blockSummary{
+		ID:           block.ID,
+		ProductSKU:   block.ProductSKU,
+		RecordType:   block.RecordType,
+		Hash:         block.Hash,
+		PreviousHash: block.PreviousHash,
+		BlockHeight:  block.BlockHeight,
+		GlobalHeight: block.GlobalHeight,
+		HashVersion:  block.HashVersion,
+		Timestamp:    block.Timestamp,
+		SignerID:     block.SignerID,
+		SealedHeight: block.SealedHeight,
+	}
+}
+
+// GetBlockByHash 按哈希获取区块
+func (s *BlockchainService) GetBlockByHash(c *gin.Context) {
+	hash := c.Query("hash")
+	if hash == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "请提供区块哈希",
+		})
+		return
+	}
+
+	block, archived, err := blockByHash(hash)
+	if errors.Is(err, ErrBlockNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "区块不存在",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "查询区块失败",
+		})
+		return
+	}
+
+	// 签名者名称和所属打包区块
+	var signerName string
+	if block.SignerID != 0 {
+		var signer configs.User
+		if err := configs.DB.Select("id, real_name").First(&signer, block.SignerID).Error; err == nil {
+			signerName = signer.RealName
+		}
+	}
+	var sealed *configs.SealedBlock
+	if block.SealedHeight > 0 {
+		var sb configs.SealedBlock
+		if err := configs.DB.Where("height = ?", block.SealedHeight).First(&sb).Error; err == nil {
+			sealed = &sb
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "获取区块成功",
+		"data": gin.H{
+			"block":        block,
+			"archived":     archived,
+			"signer_name":  signerName,
+			"sealed_block": sealed,
+		},
+	})
+}
+
+// GetRecentBlocks 按全局高度倒序列出所有SKU的区块，cursor 为上一页最后一个区块的全局高度
+func (s *BlockchainService) GetRecentBlocks(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	query := configs.DB.Where("global_height > 0")
+	before := int64(-1)
+	if cursor := c.Query("cursor"); cursor != "" {
+		height, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": "cursor 参数错误",
+			})
+			return
+		}
+		query = query.Where("global_height < ?", height)
+		before = height
+	}
+
+	var blocks []configs.BlockchainLog
+	result := query.Order("global_height DESC").
+		Limit(limit).
+		Find(&blocks)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "查询区块失败",
+		})
+		return
+	}
+
+	// 数据库中不足一页时从冷存储继续读取已归档的区块
+	if archived := archivedHeight(); len(blocks) < limit && archived > 0 {
+		to := archived
+		if before >= 0 && before-1 < to {
+			to = before - 1
+		}
+		if len(blocks) > 0 && blocks[len(blocks)-1].GlobalHeight-1 < to {
+			to = blocks[len(blocks)-1].GlobalHeight - 1
+		}
+		from := to - int64(limit-len(blocks)) + 1
+		if to >= 1 {
+			archivedBlocks, err := ledgerArchive.Range(from, to)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"code":    500,
+					"message": "查询归档区块失败",
+				})
+				return
+			}
+			for i := len(archivedBlocks) - 1; i >= 0; i-- {
+				blocks = append(blocks, archivedBlocks[i])
+			}
+		}
+	}
+
+	list := make([]blockSummary, 0, len(blocks))
+	for _, block := range blocks {
+		list = append(list, summaryOf(block))
+	}
+
+	// 不足一页说明已经到链的起点
+	var nextCursor string
+	if len(blocks) == limit && blocks[len(blocks)-1].GlobalHeight > 1 {
+		nextCursor = strconv.FormatInt(blocks[len(blocks)-1].GlobalHeight, 10)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "获取区块列表成功",
+		"data": gin.H{
+			"blocks":      list,
+			"next_cursor": nextCursor,
+		},
+	})
+}
+
+// GetChainSummary 获取单个SKU的链摘要
+func (s *BlockchainService) GetChainSummary(c *gin.Context) {
+	sku := c.Query("sku")
+	if sku == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "请提供产品SKU",
+		})
+		return
+	}
+
+	head, err := NewGormLedger(configs.DB).Head(sku)
+	if errors.Is(err, ErrBlockNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "该SKU没有区块链记录",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "查询链头失败",
+		})
+		return
+	}
+
+	var genesis configs.BlockchainLog
+	if first, err := skuBlocksPage(configs.DB, sku, 0, 1); err == nil && len(first) > 0 {
+		genesis = first[0]
+	}
+
+	counts, err := chainCounts(sku, time.Time{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "统计区块失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "获取链摘要成功",
+		"data": gin.H{
+			"product_sku":     sku,
+			"height":          head.BlockHeight,
+			"total_blocks":    counts.Total,
+			"unsealed_blocks": counts.Unsealed,
+			"head":            summaryOf(*head),
+			"first_block_at":  genesis.CreatedAt,
+			"last_update_at":  head.CreatedAt,
+			"record_types":    typeCountsOf(counts),
+		},
+	})
+}
+
+// GetChainStats 获取全局统计：区块总数、每日区块数和各记录类型的区块数
+func (s *BlockchainService) GetChainStats(c *gin.Context) {
+	days, _ := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if days < 1 || days > 365 {
+		days = 30
+	}
+	now := time.Now()
+	since := time.Date(now.Year(), now.Month(), now.Day()-days+1, 0, 0, 0, 0, now.Location())
+
+	fail := func(message string) {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": message,
+		})
+	}
+
+	counts, err := chainCounts("", since)
+	if err != nil {
+		fail("统计区块失败")
+		return
+	}
+
+	var sealedBlocks int64
+	if err := configs.DB.Model(&configs.SealedBlock{}).Count(&sealedBlocks).Error; err != nil {
+		fail("统计打包区块失败")
+		return
+	}
+
+	var head int64
+	if err := configs.DB.Model(&configs.BlockchainLog{}).Select("COALESCE(MAX(global_height), 0)").Scan(&head).Error; err != nil {
+		fail("查询全局高度失败")
+		return
+	}
+	if archived := archivedHeight(); head < archived {
+		head = archived
+	}
+
+	// 只在冷存储中还有区块的SKU也要计入
+	var skus []string
+	if err := configs.DB.Model(&configs.BlockchainLog{}).Distinct().Pluck("product_sku", &skus).Error; err != nil {
+		fail("统计SKU失败")
+		return
+	}
+	if ledgerArchive != nil {
+		skus = append(skus, ledgerArchive.SKUs()...)
+	}
+	distinct := make(map[string]bool, len(skus))
+	for _, sku := range skus {
+		distinct[sku] = true
+	}
+
+	dayKeys := make([]string, 0, len(counts.Days))
+	for day := range counts.Days {
+		dayKeys = append(dayKeys, day)
+	}
+	sort.Strings(dayKeys)
+	perDay := make([]dayCount, 0, len(dayKeys))
+	for _, day := range dayKeys {
+		perDay = append(perDay, dayCount{Day: day, Count: counts.Days[day]})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "获取统计信息成功",
+		"data": gin.H{
+			"total_blocks":   counts.Total,
+			"total_skus":     len(distinct),
+			"global_height":  head,
+			"sealed_blocks":  sealedBlocks,
+			"blocks_per_day": perDay,
+			"record_types":   typeCountsOf(counts),
+		},
+	})
+}
+
+// 按记录类型统计的区块数
+type recordTypeCount struct {
+	RecordType int   `json:"record_type"`
+	Count      int64 `json:"count"`
+}
+
+// 每日新增的区块数
+type dayCount struct {
+	Day   string `json:"day"`
+	Count int64  `json:"count"`
+}
+
+// 统计数据库和冷存储中的区块，sku 为空时统计全部区块
+// 已归档的区块不在数据库中，总数、未打包数、记录类型和每日区块数都合并两边，各项数字来自同一组区块
+func chainCounts(sku string, since time.Time) (ledgerCounts, error) {
+	counts := ledgerCounts{RecordTypes: make(map[int]int64), Days: make(map[string]int64)}
+	if ledgerArchive != nil {
+		counts = ledgerArchive.Counts(sku, since)
+	}
+	scope := func() *gorm.DB {
+		query := configs.DB.Model(&configs.BlockchainLog{})
+		if sku != "" {
+			query = query.Where("product_sku = ?", sku)
+		}
+		return query
+	}
+
+	var total, unsealed int64
+	if err := scope().Count(&total).Error; err != nil {
+		return counts, err
+	}
+	if err := scope().Where("sealed_height = 0").Count(&unsealed).Error; err != nil {
+		return counts, err
+	}
+	counts.Total += total
+	counts.Unsealed += unsealed
+
+	var types []recordTypeCount
+	if err := scope().Select("record_type, COUNT(*) AS count").Group("record_type").Scan(&types).Error; err != nil {
+		return counts, err
+	}
+	for _, t := range types {
+		counts.RecordTypes[t.RecordType] += t.Count
+	}
+
+	if !since.IsZero() {
+		var days []dayCount
+		result := scope().
+			Select("DATE_FORMAT(created_at, '%Y-%m-%d') AS day, COUNT(*) AS count").
+			Where("created_at >= ?", since).
+			Group("day").
+			Scan(&days)
+		if result.Error != nil {
+			return counts, result.Error
+		}
+		for _, d := range days {
+			counts.Days[d.Day] += d.Count
+		}
+	}
+	return counts, nil
+}
+
+// 按记录类型排序的区块数
+func typeCountsOf(counts ledgerCounts) []recordTypeCount {
+	list := make([]recordTypeCount, 0, len(counts.RecordTypes))
+	for recordType, count := range counts.RecordTypes {
+		list = append(list, recordTypeCount{RecordType: recordType, Count: count})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].RecordType < list[j].RecordType
+	})
+	return list
+}
@@ -0,0 +1,253 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// 写入 SKU-1 三个区块、SKU-2 两个区块，交替写入
+// 全局高度1是签名者首次签名时写入的密钥登记区块，产品区块从全局高度2开始
+func testExplorerChain(t *testing.T) configs.User {
+	t.Helper()
+	testDB(t)
+	user := testUser(t, 1)
+	blockchainService := &BlockchainService{}
+	for i, sku := range []string{"SKU-1", "SKU-2", "SKU-1", "SKU-2", "SKU-1"} {
+		if _, err := blockchainService.AddToBlockchain(sku, 1+i%2, fmt.Sprintf(`{"n":%d}`, i), user.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return user
+}
+
+// 解析接口返回的 data 字段
+func testResponseData(t *testing.T, body []byte, data any) {
+	t.Helper()
+	var resp struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(resp.Data, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetBlockByHash(t *testing.T) {
+	user := testExplorerChain(t)
+	var block configs.BlockchainLog
+	if err := configs.DB.Where("global_height = ?", 3).First(&block).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		code   int
+	}{
+		{name: "存在的区块", target: "/api/blockchain/block?hash=" + block.Hash, code: http.StatusOK},
+		{name: "不存在的区块", target: "/api/blockchain/block?hash=" + hashData("none"), code: http.StatusNotFound},
+		{name: "缺少哈希", target: "/api/blockchain/block", code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := testHandle((&BlockchainService{}).GetBlockByHash, user, http.MethodGet, tt.target, nil)
+			if w.Code != tt.code {
+				t.Fatalf("状态码 %d: %s", w.Code, w.Body.String())
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			var data struct {
+				Block      configs.BlockchainLog `json:"block"`
+				SignerName string                `json:"signer_name"`
+			}
+			testResponseData(t, w.Body.Bytes(), &data)
+			if data.Block.Hash != block.Hash || data.Block.GlobalHeight != 3 || data.SignerName != user.RealName {
+				t.Fatalf("返回 %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestGetRecentBlocks(t *testing.T) {
+	user := testExplorerChain(t)
+
+	tests := []struct {
+		name  string
+		limit int
+		pages [][]int64 // 每页区块的全局高度
+	}{
+		{name: "一页取完", limit: 10, pages: [][]int64{{6, 5, 4, 3, 2, 1}}},
+		{name: "整除分页", limit: 3, pages: [][]int64{{6, 5, 4}, {3, 2, 1}}},
+		{name: "多页", limit: 4, pages: [][]int64{{6, 5, 4, 3}, {2, 1}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cursor := ""
+			for i, want := range tt.pages {
+				target := fmt.Sprintf("/api/blockchain/recent?limit=%d", tt.limit)
+				if cursor != "" {
+					target += "&cursor=" + cursor
+				}
+				w := testHandle((&BlockchainService{}).GetRecentBlocks, user, http.MethodGet, target, nil)
+				if w.Code != http.StatusOK {
+					t.Fatalf("状态码 %d: %s", w.Code, w.Body.String())
+				}
+				var data struct {
+					Blocks     []blockSummary `json:"blocks"`
+					NextCursor string         `json:"next_cursor"`
+				}
+				testResponseData(t, w.Body.Bytes(), &data)
+
+				var got []int64
+				for _, block := range data.Blocks {
+					got = append(got, block.GlobalHeight)
+				}
+				if fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Fatalf("第 %d 页 %v，期望 %v", i+1, got, want)
+				}
+				// 最后一页不再返回游标
+				if (i == len(tt.pages)-1) != (data.NextCursor == "") {
+					t.Fatalf("第 %d 页游标 %q", i+1, data.NextCursor)
+				}
+				cursor = data.NextCursor
+			}
+		})
+	}
+
+	w := testHandle((&BlockchainService{}).GetRecentBlocks, user, http.MethodGet, "/api/blockchain/recent?cursor=x", nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("无效游标的状态码 %d", w.Code)
+	}
+}
+
+func TestGetChainSummary(t *testing.T) {
+	user := testExplorerChain(t)
+
+	tests := []struct {
+		name   string
+		sku    string
+		code   int
+		height int64
+		types  int
+	}{
+		{name: "SKU-1", sku: "SKU-1", code: http.StatusOK, height: 3, types: 1},
+		{name: "SKU-2", sku: "SKU-2", code: http.StatusOK, height: 2, types: 1},
+		{name: "没有区块的SKU", sku: "SKU-3", code: http.StatusNotFound},
+		{name: "缺少SKU", code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := testHandle((&BlockchainService{}).GetChainSummary, user, http.MethodGet, "/api/blockchain/summary?sku="+tt.sku, nil)
+			if w.Code != tt.code {
+				t.Fatalf("状态码 %d: %s", w.Code, w.Body.String())
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			var data struct {
+				Height         int64        `json:"height"`
+				TotalBlocks    int64        `json:"total_blocks"`
+				UnsealedBlocks int64        `json:"unsealed_blocks"`
+				Head           blockSummary `json:"head"`
+				RecordTypes    []struct{}   `json:"record_types"`
+			}
+			testResponseData(t, w.Body.Bytes(), &data)
+			if data.Height != tt.height || data.TotalBlocks != tt.height || data.UnsealedBlocks != tt.height ||
+				data.Head.ProductSKU != tt.sku || len(data.RecordTypes) != tt.types {
+				t.Fatalf("返回 %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestGetChainStats(t *testing.T) {
+	user := testExplorerChain(t)
+
+	w := testHandle((&BlockchainService{}).GetChainStats, user, http.MethodGet, "/api/blockchain/stats?days=7", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("状态码 %d: %s", w.Code, w.Body.String())
+	}
+	var data struct {
+		TotalBlocks  int64 `json:"total_blocks"`
+		TotalSKUs    int64 `json:"total_skus"`
+		GlobalHeight int64 `json:"global_height"`
+		BlocksPerDay []struct {
+			Count int64 `json:"count"`
+		} `json:"blocks_per_day"`
+		RecordTypes []struct {
+			RecordType int   `json:"record_type"`
+			Count      int64 `json:"count"`
+		} `json:"record_types"`
+	}
+	testResponseData(t, w.Body.Bytes(), &data)
+
+	if data.TotalBlocks != 6 || data.TotalSKUs != 3 || data.GlobalHeight != 6 {
+		t.Fatalf("返回 %s", w.Body.String())
+	}
+	var perDay int64
+	for _, day := range data.BlocksPerDay {
+		perDay += day.Count
+	}
+	if perDay != 6 {
+		t.Fatalf("每日区块合计 %d", perDay)
+	}
+	if len(data.RecordTypes) != 3 || data.RecordTypes[0].Count != 3 || data.RecordTypes[1].Count != 2 || data.RecordTypes[2].RecordType != events.RecordKeyRotated {
+		t.Fatalf("记录类型统计 %+v", data.RecordTypes)
+	}
+}
+
+// 归档后的区块只在冷存储中，摘要和统计的各项数字都要把它们计入
+func TestChainCountsIncludeArchive(t *testing.T) {
+	user, record := testArchiveLedger(t, 4)
+	if _, err := ArchiveSnapshot(record.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&BlockchainService{}).AddToBlockchain("SKU-1", 1, `{"n":4}`, user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("SKU摘要", func(t *testing.T) {
+		w := testHandle((&BlockchainService{}).GetChainSummary, user, http.MethodGet, "/api/blockchain/summary?sku=SKU-1", nil)
+		var data struct {
+			TotalBlocks    int64             `json:"total_blocks"`
+			UnsealedBlocks int64             `json:"unsealed_blocks"`
+			RecordTypes    []recordTypeCount `json:"record_types"`
+		}
+		testResponseData(t, w.Body.Bytes(), &data)
+		if data.TotalBlocks != 3 || data.UnsealedBlocks != 1 || len(data.RecordTypes) != 1 || data.RecordTypes[0].Count != 3 {
+			t.Fatalf("返回 %s", w.Body.String())
+		}
+	})
+
+	t.Run("全局统计", func(t *testing.T) {
+		w := testHandle((&BlockchainService{}).GetChainStats, user, http.MethodGet, "/api/blockchain/stats?days=7", nil)
+		var data struct {
+			TotalBlocks  int64             `json:"total_blocks"`
+			TotalSKUs    int64             `json:"total_skus"`
+			BlocksPerDay []dayCount        `json:"blocks_per_day"`
+			RecordTypes  []recordTypeCount `json:"record_types"`
+		}
+		testResponseData(t, w.Body.Bytes(), &data)
+		// 服务端和签名者的密钥登记区块、四个归档区块和一个新区块
+		var perDay, perType int64
+		for _, day := range data.BlocksPerDay {
+			perDay += day.Count
+		}
+		for _, typ := range data.RecordTypes {
+			perType += typ.Count
+		}
+		if data.TotalBlocks != 7 || data.TotalSKUs != 3 || perDay != 7 || perType != 7 {
+			t.Fatalf("返回 %s", w.Body.String())
+		}
+	})
+}
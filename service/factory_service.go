@@ -4,13 +4,11 @@ import (
 	"back_Blockchain_cold_chain_traceability_system/api"
 	"back_Blockchain_cold_chain_traceability_system/configs"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"time"
 )
@@ -63,19 +61,9 @@ func (s *FactoryService) AddProduct(c *gin.Context) {
 	uuidStr := uuid.New().String()[:8]
 	sku := fmt.Sprintf("P%s%s%s", strconv.FormatUint(uint64(manufacturerID), 10), timeStr, uuidStr)
 
-	// 保存图片
-	imageURL := ""
+	// 保存图片，文件按内容的SHA-256命名，摘要随产品审核通过写入区块
+	imageURL, imageSHA256 := "", ""
 	if req.ImageBase64 != "" {
-		// 确保上传目录存在
-		uploadDir := "./uploads/products"
-		if err := os.MkdirAll(uploadDir, 0755); err != nil {
-			c.JSON(http.StatusInternalServerError, api.Response{
-				Code:    500,
-				Message: "创建上传目录失败",
-			})
-			return
-		}
-
 		// 解码Base64图片
 		imageData, err := base64.StdEncoding.DecodeString(req.ImageBase64)
 		if err != nil {
@@ -86,19 +74,14 @@ func (s *FactoryService) AddProduct(c *gin.Context) {
 			return
 		}
 
-		// 保存图片
-		filename := sku + ".jpg"
-		filePath := filepath.Join(uploadDir, filename)
-		if err := os.WriteFile(filePath, imageData, 0644); err != nil {
+		imageURL, imageSHA256, err = saveUpload("products", imageData)
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, api.Response{
 				Code:    500,
-				Message: "保存图片失败",
+				Message: "保存图片失败: " + err.Error(),
 			})
 			return
 		}
-
-		// 设置图片URL
-		imageURL = "/uploads/products/" + filename
 	}
 
 	// 创建产品记录
@@ -119,6 +102,7 @@ func (s *FactoryService) AddProduct(c *gin.Context) {
 		SafetyTesting:    req.SafetyTesting,
 		QualityRating:    req.QualityRating,
 		ImageURL:         imageURL,
+		ImageSHA256:      imageSHA256,
 		Status:           0, // 默认待审核
 	}
 
@@ -135,8 +119,9 @@ func (s *FactoryService) AddProduct(c *gin.Context) {
 		Code:    200,
 		Message: "添加产品成功，请等待审核",
 		Data: gin.H{
-			"product_id": product.ID,
-			"sku":        product.SKU,
+			"product_id":   product.ID,
+			"sku":          product.SKU,
+			"image_sha256": product.ImageSHA256,
 		},
 	})
 }
@@ -262,20 +247,24 @@ func (s *FactoryService) ConfirmTransfer(c *gin.Context) {
 		Status:     1, // 厂家直接确认
 	}
 
-	result = configs.DB.Create(&transfer)
-	if result.Error != nil {
+	// 交接记录和区块在同一事务中写入
+	blockchainService := &BlockchainService{}
+	err := ledgerTransaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&transfer).Error; err != nil {
+			return err
+		}
+
+		_, err := blockchainService.AddEventTx(tx, req.ProductSKU, custodyTransferredEvent(transfer), userID.(uint))
+		return err
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, api.Response{
 			Code:    500,
-			Message: "创建交接记录失败: " + result.Error.Error(),
+			Message: "创建交接记录失败: " + err.Error(),
 		})
 		return
 	}
 
-	// 记录到区块链
-	blockchainService := &BlockchainService{}
-	transferData, _ := json.Marshal(transfer)
-	blockchainService.AddToBlockchain(req.ProductSKU, 3, string(transferData))
-
 	c.JSON(http.StatusOK, api.Response{
 		Code:    200,
 		Message: "确认交接成功",
@@ -365,26 +354,8 @@ func (s *FactoryService) UpdateProduct(c *gin.Context) {
 		}
 	}
 
-	// 处理图片更新
+	// 处理图片更新，旧图片不再被引用后由定期清理删除
 	if updateData.ImageBase64 != "" {
-		// 确保上传目录存在
-		uploadDir := "./uploads/products"
-		if err := os.MkdirAll(uploadDir, 0755); err != nil {
-			c.JSON(http.StatusInternalServerError, api.Response{
-				Code:    500,
-				Message: "创建上传目录失败",
-			})
-			return
-		}
-
-		// 删除旧图片（如果存在）
-		if product.ImageURL != "" {
-			oldImagePath := "." + product.ImageURL
-			if _, err := os.Stat(oldImagePath); err == nil {
-				os.Remove(oldImagePath)
-			}
-		}
-
 		// 解码并保存新图片
 		imageData, err := base64.StdEncoding.DecodeString(updateData.ImageBase64)
 		if err != nil {
@@ -395,17 +366,14 @@ func (s *FactoryService) UpdateProduct(c *gin.Context) {
 			return
 		}
 
-		filename := product.SKU + "_" + strconv.FormatInt(time.Now().Unix(), 10) + ".jpg"
-		filePath := filepath.Join(uploadDir, filename)
-		if err := os.WriteFile(filePath, imageData, 0644); err != nil {
+		product.ImageURL, product.ImageSHA256, err = saveUpload("products", imageData)
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, api.Response{
 				Code:    500,
-				Message: "保存图片失败",
+				Message: "保存图片失败: " + err.Error(),
 			})
 			return
 		}
-
-		product.ImageURL = "/uploads/products/" + filename
 	}
 
 	// 保存更新
@@ -418,6 +386,9 @@ func (s *FactoryService) UpdateProduct(c *gin.Context) {
 		return
 	}
 
+	// 保质期和运输温度可能变化
+	refreshShelfLife(product.SKU)
+
 	c.JSON(http.StatusOK, api.Response{
 		Code:    200,
 		Message: "更新产品成功",
@@ -486,6 +457,7 @@ func SetupFactoryRoutes(router *gin.Engine) {
 		factoryGroup.POST("/product", factoryService.AddProduct)
 		factoryGroup.GET("/products", factoryService.GetProductList)
 		factoryGroup.PUT("/product/:id", factoryService.UpdateProduct)
+		factoryGroup.PUT("/product/:id/temperature-profile", factoryService.SetTemperatureProfile)
 		factoryGroup.POST("/transfer/confirm", factoryService.ConfirmTransfer)
 		factoryGroup.GET("/transfers/pending", factoryService.GetPendingTransfers)
 	}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"errors"
+	"gorm.io/gorm"
+)
+
+// ErrBlockNotFound 区块不存在
+var ErrBlockNotFound = errors.New("区块不存在")
+
+// Ledger 账本存储接口，区块按全局高度寻址
+type Ledger interface {
+	// Append 追加一个已计算好哈希和签名的区块，区块必须接在当前全局链头之后
+	Append(block *configs.BlockchainLog) error
+	// Get 按全局高度获取区块
+	Get(globalHeight int64) (*configs.BlockchainLog, error)
+	// Range 获取全局高度在 [from, to] 之间的区块
+	Range(from, to int64) ([]configs.BlockchainLog, error)
+	// Verify 从头到尾验证整个账本
+	Verify() (chainVerifyResult, error)
+	// Head 获取链头，sku 为空时返回全局链头
+	Head(sku string) (*configs.BlockchainLog, error)
+}
+
+var (
+	_ Ledger = (*GormLedger)(nil)
+	_ Ledger = (*FileLedger)(nil)
+)
+
+// GormLedger 基于MySQL blockchain_logs 表的账本
+// 已归档到冷存储的区块从归档文件账本中读取，对调用方透明
+type GormLedger struct {
+	db *gorm.DB
+}
+
+// NewGormLedger 创建MySQL账本，传入事务时所有操作都在该事务中进行
+func NewGormLedger(db *gorm.DB) *GormLedger {
+	return &GormLedger{db: db}
+}
+
+// Append 写入区块
+func (l *GormLedger) Append(block *configs.BlockchainLog) error {
+	return l.db.Create(block).Error
+}
+
+// Get 按全局高度获取区块
+func (l *GormLedger) Get(globalHeight int64) (*configs.BlockchainLog, error) {
+	var block configs.BlockchainLog
+	result := l.db.Where("global_height = ?", globalHeight).First(&block)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		if globalHeight <= archivedHeight() {
+			return ledgerArchive.Get(globalHeight)
+		}
+		return nil, ErrBlockNotFound
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &block, nil
+}
+
+// Range 获取全局高度区间内的区块
+func (l *GormLedger) Range(from, to int64) ([]configs.BlockchainLog, error) {
+	var blocks []configs.BlockchainLog
+	if archived := archivedHeight(); from <= archived {
+		end := to
+		if end > archived {
+			end = archived
+		}
+		var err error
+		blocks, err = ledgerArchive.Range(from, end)
+		if err != nil {
+			return nil, err
+		}
+		from = archived + 1
+	}
+	if from > to {
+		return blocks, nil
+	}
+
+	var live []configs.BlockchainLog
+	result := l.db.Where("global_height BETWEEN ? AND ?", from, to).
+		Order("global_height").
+		Find(&live)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return append(blocks, live...), nil
+}
+
+// 全局账本验证时每批加载的区块数
+const verifyBatch = 1000
+
+// Verify 验证全局账本，包括区块签名，按批加载区块
+func (l *GormLedger) Verify() (chainVerifyResult, error) {
+	head, err := l.Head("")
+	if errors.Is(err, ErrBlockNotFound) {
+		return chainVerifyResult{Valid: true, Verified: true}, nil
+	}
+	if err != nil {
+		return chainVerifyResult{}, err
+	}
+	return l.VerifyFrom(chainStart{}, head.GlobalHeight)
+}
+
+// VerifyFrom 从起点之后验证全局账本直到 to，起点通常是可信快照的链头
+func (l *GormLedger) VerifyFrom(start chainStart, to int64) (chainVerifyResult, error) {
+	v := newChainVerifier(true, start)
+	for from := start.Height + 1; from <= to; from += verifyBatch {
+		end := from + verifyBatch - 1
+		if end > to {
+			end = to
+		}
+		blocks, err := l.Range(from, end)
+		if err != nil {
+			return chainVerifyResult{}, err
+		}
+		ok, err := v.addWithKeys(blocks)
+		if err != nil {
+			return chainVerifyResult{}, err
+		}
+		if !ok {
+			break
+		}
+	}
+	return v.finish()
+}
+
+// Head 获取链头
+func (l *GormLedger) Head(sku string) (*configs.BlockchainLog, error) {
+	var block configs.BlockchainLog
+	var result *gorm.DB
+	if sku == "" {
+		result = l.db.Where("global_height > 0").
+			Order("global_height DESC").
+			First(&block)
+	} else {
+		result = l.db.Where("product_sku = ?", sku).
+			Order("block_height DESC").
+			First(&block)
+	}
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		// SKU的区块已全部归档，或归档后还没有新区块
+		if ledgerArchive != nil {
+			return ledgerArchive.Head(sku)
+		}
+		return nil, ErrBlockNotFound
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &block, nil
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
+	"encoding/json"
+	"errors"
+	"gorm.io/gorm"
+)
+
+// 审核通过的产品对应的上链事件
+func productCreatedEvent(product configs.ProductInfo, approvedBy uint) *events.ProductCreated {
+	return &events.ProductCreated{
+		ProductID:        product.ID,
+		SKU:              product.SKU,
+		Name:             product.Name,
+		Brand:            product.Brand,
+		Specification:    product.Specification,
+		ProductionDate:   product.ProductionDate.Format(events.DateLayout),
+		ExpirationDate:   product.ExpirationDate.Format(events.DateLayout),
+		BatchNumber:      product.BatchNumber,
+		ManufacturerID:   product.ManufacturerID,
+		MaterialSource:   product.MaterialSource,
+		ProcessLocation:  product.ProcessLocation,
+		ProcessMethod:    product.ProcessMethod,
+		TransportTemp:    product.TransportTemp,
+		StorageCondition: product.StorageCondition,
+		SafetyTesting:    product.SafetyTesting,
+		QualityRating:    product.QualityRating,
+		ImageURL:         product.ImageURL,
+		ImageSHA256:      product.ImageSHA256,
+		ApprovedBy:       approvedBy,
+	}
+}
+
+// 物流记录对应的上链事件
+func logisticsUpdatedEvent(record configs.LogisticsRecord) *events.LogisticsUpdated {
+	return &events.LogisticsUpdated{
+		RecordID:          record.ID,
+		ProductSKU:        record.ProductSKU,
+		TrackingNo:        record.TrackingNo,
+		WarehouseLocation: record.WarehouseLocation,
+		Temperature:       record.Temperature,
+		Humidity:          record.Humidity,
+		ImageURL:          record.ImageURL,
+		ImageSHA256:       record.ImageSHA256,
+		OperatorID:        record.OperatorID,
+		OperatorType:      record.OperatorType,
+	}
+}
+
+// 读数批次对应的上链事件，绑定多个产品时每个产品各写一个
+func telemetryBatchEvent(batch configs.TelemetryBatch, device configs.Device, sku string) *events.TelemetryBatchRecorded {
+	return &events.TelemetryBatchRecorded{
+		BatchID:        batch.ID,
+		ProductSKU:     sku,
+		DeviceSerial:   device.SerialNo,
+		ReadingCount:   batch.ReadingCount,
+		FirstAt:        batch.FirstAt.UnixNano(),
+		LastAt:         batch.LastAt.UnixNano(),
+		MinTemperature: batch.MinTemperature,
+		MaxTemperature: batch.MaxTemperature,
+		BatchSHA256:    batch.BatchSHA256,
+	}
+}
+
+// 超温记录在某个阶段对应的上链事件
+func temperatureExcursionEvent(incident configs.ExcursionIncident, phase, deviceSerial string) *events.TemperatureExcursion {
+	event := &events.TemperatureExcursion{
+		IncidentID:     incident.ID,
+		ProductSKU:     incident.ProductSKU,
+		Phase:          phase,
+		Source:         incident.Source,
+		DeviceSerial:   deviceSerial,
+		Metric:         incident.Metric,
+		Direction:      incident.Direction,
+		StartedAt:      incident.StartedAt.UnixNano(),
+		PeakValue:      incident.PeakValue,
+		LimitMin:       incident.LimitMin,
+		LimitMax:       incident.LimitMax,
+		AllowedSeconds: incident.AllowedSeconds,
+		ReadingCount:   incident.ReadingCount,
+		Breach:         incident.Breach,
+		ProfileVersion: incident.ProfileVersion,
+	}
+	if incident.EndedAt != nil {
+		event.EndedAt = incident.EndedAt.UnixNano()
+	}
+	return event
+}
+
+// 温湿度要求对应的上链事件
+func temperatureProfileSetEvent(profile configs.TemperatureProfile, setBy uint) *events.TemperatureProfileSet {
+	return &events.TemperatureProfileSet{
+		ProductSKU:       profile.ProductSKU,
+		Version:          profile.Version,
+		MinTemperature:   profile.MinTemperature,
+		MaxTemperature:   profile.MaxTemperature,
+		AllowedSeconds:   profile.AllowedExcursion,
+		MinHumidity:      profile.MinHumidity,
+		MaxHumidity:      profile.MaxHumidity,
+		ActivationEnergy: profile.ActivationEnergy,
+		SetBy:            setBy,
+	}
+}
+
+// 交接记录对应的上链事件
+func custodyTransferredEvent(transfer configs.TransferRecord) *events.CustodyTransferred {
+	return &events.CustodyTransferred{
+		TransferID: transfer.ID,
+		ProductSKU: transfer.ProductSKU,
+		FromUserID: transfer.FromUserID,
+		ToUserID:   transfer.ToUserID,
+		Remarks:    transfer.Remarks,
+	}
+}
+
+// AddEventTx 校验事件并在事务中写入区块链
+func (s *BlockchainService) AddEventTx(tx *gorm.DB, productSKU string, event events.Event, signerID uint) (string, error) {
+	data, err := events.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+	return s.AddToBlockchainTx(tx, productSKU, event.RecordType(), string(data), signerID)
+}
+
+// 把区块数据解码为事件，旧版区块保存的是数据库模型的JSON，按记录类型转换
+func decodeBlockEvent(block configs.BlockchainLog) (events.Event, error) {
+	data := []byte(block.RecordData)
+	if events.IsEnvelope(data) {
+		event, err := events.Unmarshal(data)
+		if custom, ok := event.(*events.Custom); ok {
+			custom.Record = block.RecordType
+		}
+		return event, err
+	}
+
+	switch block.RecordType {
+	case events.RecordProductCreated:
+		var product configs.ProductInfo
+		if err := json.Unmarshal(data, &product); err != nil {
+			return nil, err
+		}
+		return productCreatedEvent(product, block.SignerID), nil
+	case events.RecordLogisticsUpdated:
+		var record configs.LogisticsRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, err
+		}
+		return logisticsUpdatedEvent(record), nil
+	case events.RecordCustodyTransferred:
+		var transfer configs.TransferRecord
+		if err := json.Unmarshal(data, &transfer); err != nil {
+			return nil, err
+		}
+		return custodyTransferredEvent(transfer), nil
+	}
+	return nil, errors.New("未知的记录类型")
+}
+
+// 附带解码后事件的区块
+type blockWithEvent struct {
+	configs.BlockchainLog
+	Event      *events.Record `json:"event"`
+	EventError string         `json:"event_error,omitempty"`
+}
+
+// 解码一组区块的事件，无法解码的区块返回错误原因而不是整体失败
+func withEvents(blocks []configs.BlockchainLog) []blockWithEvent {
+	list := make([]blockWithEvent, 0, len(blocks))
+	for _, block := range blocks {
+		item := blockWithEvent{BlockchainLog: block}
+		event, err := decodeBlockEvent(block)
+		if err != nil {
+			item.EventError = err.Error()
+		} else {
+			record := events.NewRecord(event)
+			item.Event = &record
+		}
+		list = append(list, item)
+	}
+	return list
+}
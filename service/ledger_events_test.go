@@ -0,0 +1,119 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDecodeBlockEvent(t *testing.T) {
+	transfer := configs.TransferRecord{ProductSKU: "SKU-1", FromUserID: 1, ToUserID: 2, Remarks: "交接"}
+	transfer.ID = 7
+	legacyTransfer, _ := json.Marshal(transfer)
+
+	product := configs.ProductInfo{
+		SKU:            "SKU-1",
+		Name:           "牛奶",
+		BatchNumber:    "B1",
+		ManufacturerID: 2,
+		ProductionDate: time.Date(2026, 1, 1, 0, 0, 0, 0, time.Local),
+		ExpirationDate: time.Date(2026, 1, 31, 0, 0, 0, 0, time.Local),
+	}
+	product.ID = 5
+	legacyProduct, _ := json.Marshal(product)
+
+	typed, err := events.Marshal(custodyTransferredEvent(transfer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		block       configs.BlockchainLog
+		wantType    string
+		wantID      uint
+		wantRecord  int
+		wantVersion int
+		wantErr     bool
+	}{
+		{
+			name:     "事件格式",
+			block:    configs.BlockchainLog{RecordType: events.RecordCustodyTransferred, RecordData: string(typed)},
+			wantType: events.TypeCustodyTransferred,
+			wantID:   7,
+		},
+		{
+			name:     "旧版交接记录",
+			block:    configs.BlockchainLog{RecordType: events.RecordCustodyTransferred, RecordData: string(legacyTransfer)},
+			wantType: events.TypeCustodyTransferred,
+			wantID:   7,
+		},
+		{
+			// 旧版产品记录没有审核人，以区块签名者代替
+			name:     "旧版产品记录",
+			block:    configs.BlockchainLog{RecordType: events.RecordProductCreated, RecordData: string(legacyProduct), SignerID: 9},
+			wantType: events.TypeProductCreated,
+			wantID:   5,
+		},
+		{
+			// 第1版事件按原结构解码，业务处理时转换为当前版本
+			name: "第1版物流事件",
+			block: configs.BlockchainLog{
+				RecordType: events.RecordLogisticsUpdated,
+				RecordData: `{"payload":{"humidity":60,"image_url":"","operator_id":2,"operator_type":1,"product_sku":"SKU-1","record_id":3,"temperature":4,"tracking_no":"T1","warehouse_location":"一号仓"},"type":"LogisticsUpdated","version":1}`,
+			},
+			wantType:    events.TypeLogisticsUpdated,
+			wantID:      3,
+			wantVersion: 1,
+		},
+		{
+			// 注册表事件的记录类型来自区块
+			name:       "注册表事件",
+			block:      configs.BlockchainLog{RecordType: 101, RecordData: `{"payload":{"a":1},"type":"ColdRoomCleaned","version":1}`},
+			wantType:   "ColdRoomCleaned",
+			wantRecord: 101,
+		},
+		{
+			name:    "旧版记录类型未知",
+			block:   configs.BlockchainLog{RecordType: 9, RecordData: `{"ID":1}`},
+			wantErr: true,
+		},
+		{
+			name:    "数据无法解析",
+			block:   configs.BlockchainLog{RecordType: events.RecordLogisticsUpdated, RecordData: `not json`},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := decodeBlockEvent(tt.block)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("应返回错误，解码为 %+v", event)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.EventType() != tt.wantType {
+				t.Fatalf("事件类型 %s", event.EventType())
+			}
+			if id, _ := eventSubject(event); id != tt.wantID {
+				t.Fatalf("记录ID %d", id)
+			}
+			if tt.wantVersion != 0 && event.EventVersion() != tt.wantVersion {
+				t.Fatalf("事件版本 %d", event.EventVersion())
+			}
+			if tt.wantRecord != 0 && event.RecordType() != tt.wantRecord {
+				t.Fatalf("记录类型 %d", event.RecordType())
+			}
+			if created, ok := event.(*events.ProductCreated); ok && created.ApprovedBy != tt.block.SignerID {
+				t.Fatalf("审核人 %d", created.ApprovedBy)
+			}
+		})
+	}
+}
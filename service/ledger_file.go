@@ -0,0 +1,565 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 段文件命名: segment-000001.log
+const (
+	segmentPrefix = "segment-"
+	segmentSuffix = ".log"
+)
+
+// 文件账本中的一行，只保存验证区块所需的字段，与数据库表结构无关
+type ledgerEntry struct {
+	ProductSKU         string `json:"product_sku"`
+	RecordType         int    `json:"record_type"`
+	RecordData         string `json:"record_data"`
+	Hash               string `json:"hash"`
+	PreviousHash       string `json:"previous_hash"`
+	BlockHeight        int64  `json:"block_height"`
+	GlobalHeight       int64  `json:"global_height"`
+	GlobalPreviousHash string `json:"global_previous_hash"`
+	HashVersion        int    `json:"hash_version"`
+	Timestamp          int64  `json:"timestamp"`
+	SignerID           uint   `json:"signer_id"`
+	SignerKeyID        uint   `json:"signer_key_id"`
+	Signature          string `json:"signature"`
+	CreatedAt          int64  `json:"created_at,omitempty"` // Unix纳秒，与MySQL中的创建时间一致
+
+	// 以下字段只在归档账本中保存，区块移出数据库后继续用于证明和对账
+	ID           uint  `json:"id,omitempty"`
+	LegacyStatus int   `json:"legacy_status,omitempty"`
+	SealedHeight int64 `json:"sealed_height,omitempty"`
+	LeafIndex    int   `json:"leaf_index,omitempty"`
+}
+
+func entryOf(block configs.BlockchainLog) ledgerEntry {
+	e := ledgerEntry{
+		ProductSKU:         block.ProductSKU,
+		RecordType:         block.RecordType,
+		RecordData:         block.RecordData,
+		Hash:               block.Hash,
+		PreviousHash:       block.PreviousHash,
+		BlockHeight:        block.BlockHeight,
+		GlobalHeight:       block.GlobalHeight,
+		GlobalPreviousHash: block.GlobalPreviousHash,
+		HashVersion:        block.HashVersion,
+		Timestamp:          block.Timestamp,
+		SignerID:           block.SignerID,
+		SignerKeyID:        block.SignerKeyID,
+		Signature:          block.Signature,
+	}
+	if !block.CreatedAt.IsZero() {
+		e.CreatedAt = block.CreatedAt.UnixNano()
+	}
+	return e
+}
+
+// 归档账本的一行，额外保存数据库中的字段
+func archiveEntryOf(block configs.BlockchainLog) ledgerEntry {
+	e := entryOf(block)
+	e.ID = block.ID
+	e.LegacyStatus = block.LegacyStatus
+	e.SealedHeight = block.SealedHeight
+	e.LeafIndex = block.LeafIndex
+	return e
+}
+
+func (e ledgerEntry) block() configs.BlockchainLog {
+	block := configs.BlockchainLog{
+		ProductSKU:         e.ProductSKU,
+		RecordType:         e.RecordType,
+		RecordData:         e.RecordData,
+		Hash:               e.Hash,
+		PreviousHash:       e.PreviousHash,
+		BlockHeight:        e.BlockHeight,
+		GlobalHeight:       e.GlobalHeight,
+		GlobalPreviousHash: e.GlobalPreviousHash,
+		HashVersion:        e.HashVersion,
+		Timestamp:          e.Timestamp,
+		SignerID:           e.SignerID,
+		SignerKeyID:        e.SignerKeyID,
+		Signature:          e.Signature,
+		LegacyStatus:       e.LegacyStatus,
+		SealedHeight:       e.SealedHeight,
+		LeafIndex:          e.LeafIndex,
+	}
+	block.ID = e.ID
+	if e.CreatedAt != 0 {
+		block.CreatedAt = time.Unix(0, e.CreatedAt)
+	}
+	return block
+}
+
+// 区块在段文件中的位置
+type entryLocation struct {
+	segment     int
+	offset      int64
+	length      int
+	blockHeight int64 // 区块在SKU链中的高度，用于分页读取SKU的区块
+	recordType  int   // 以下字段用于不读取段文件直接统计区块
+	sealed      bool
+	createdAt   int64
+	latestAt    int64 // 到该区块为止最晚的区块时间，随全局高度单调不减
+}
+
+// FileLedger 本地只追加的段文件账本
+// 每个区块一行JSON，写入后立即fsync，段文件达到上限后滚动到下一个文件
+type FileLedger struct {
+	mu          sync.RWMutex
+	dir         string
+	segmentSize int64
+	file        *os.File // 当前写入的段文件
+	segment     int
+	size        int64
+	index       []entryLocation // index[h-1] 为全局高度 h 的区块位置
+	head        *configs.BlockchainLog
+	skuHeads    map[string]configs.BlockchainLog
+	skuIndex    map[string][]int64 // 各SKU区块的全局高度
+	hashIndex   map[string]int64   // 区块哈希对应的全局高度
+	idIndex     map[uint]int64     // 归档账本中数据库记录ID对应的全局高度
+	archive     bool               // 归档账本，额外保存数据库中的字段
+}
+
+// OpenFileLedger 打开文件账本，重放所有段文件重建索引
+// 最后一个段文件末尾不完整的行（写入时崩溃）会被截断
+func OpenFileLedger(dir string, segmentSize int64) (*FileLedger, error) {
+	if segmentSize <= 0 {
+		segmentSize = 64 << 20
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	l := &FileLedger{
+		dir:         dir,
+		segmentSize: segmentSize,
+		skuHeads:    make(map[string]configs.BlockchainLog),
+		skuIndex:    make(map[string][]int64),
+		hashIndex:   make(map[string]int64),
+		idIndex:     make(map[uint]int64),
+	}
+
+	segments, err := l.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	for i, segment := range segments {
+		if err := l.loadSegment(segment, i == len(segments)-1); err != nil {
+			return nil, err
+		}
+	}
+
+	l.segment = 1
+	if len(segments) > 0 {
+		l.segment = segments[len(segments)-1]
+	}
+	if err := l.openSegment(l.segment); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *FileLedger) segmentPath(segment int) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%s%06d%s", segmentPrefix, segment, segmentSuffix))
+}
+
+func (l *FileLedger) listSegments() ([]int, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		var segment int
+		if _, err := fmt.Sscanf(name, segmentPrefix+"%06d"+segmentSuffix, &segment); err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+// 读取段文件并重建索引
+func (l *FileLedger) loadSegment(segment int, last bool) error {
+	path := l.segmentPath(segment)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) == 0 {
+				return nil
+			}
+			// 末尾不完整的行只可能出现在最后一个段文件中
+			if !last {
+				return fmt.Errorf("段文件 %s 末尾不完整", path)
+			}
+			return os.Truncate(path, offset)
+		}
+		if err != nil {
+			return err
+		}
+
+		var entry ledgerEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("段文件 %s 偏移 %d 解析失败: %v", path, offset, err)
+		}
+		block := entry.block()
+		if err := l.checkLink(&block); err != nil {
+			return fmt.Errorf("段文件 %s 偏移 %d: %v", path, offset, err)
+		}
+		l.track(block, entryLocation{segment: segment, offset: offset, length: len(line)})
+		offset += int64(len(line))
+	}
+}
+
+func (l *FileLedger) openSegment(segment int) error {
+	f, err := os.OpenFile(l.segmentPath(segment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.file = f
+	l.segment = segment
+	l.size = info.Size()
+	return syncDir(l.dir)
+}
+
+// 新建文件后同步目录，保证文件本身在崩溃后仍然存在
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// 检查区块是否接在当前全局链头之后
+func (l *FileLedger) checkLink(block *configs.BlockchainLog) error {
+	var height int64
+	var hash string
+	if l.head != nil {
+		height = l.head.GlobalHeight
+		hash = l.head.Hash
+	}
+	if block.GlobalHeight != height+1 {
+		return fmt.Errorf("全局高度应为 %d，实际为 %d", height+1, block.GlobalHeight)
+	}
+	if block.GlobalPreviousHash != hash {
+		return errors.New("全局前置哈希与链头不匹配")
+	}
+	return nil
+}
+
+func (l *FileLedger) track(block configs.BlockchainLog, loc entryLocation) {
+	loc.blockHeight = block.BlockHeight
+	loc.recordType = block.RecordType
+	loc.sealed = block.SealedHeight != 0
+	if !block.CreatedAt.IsZero() {
+		loc.createdAt = block.CreatedAt.UnixNano()
+	}
+	loc.latestAt = blockTime(block)
+	if n := len(l.index); n > 0 && l.index[n-1].latestAt > loc.latestAt {
+		loc.latestAt = l.index[n-1].latestAt
+	}
+	l.index = append(l.index, loc)
+	l.head = &block
+	l.skuHeads[block.ProductSKU] = block
+	l.skuIndex[block.ProductSKU] = append(l.skuIndex[block.ProductSKU], block.GlobalHeight)
+	l.hashIndex[block.Hash] = block.GlobalHeight
+	if block.ID != 0 {
+		l.idIndex[block.ID] = block.GlobalHeight
+	}
+}
+
+// Append 追加区块并fsync
+func (l *FileLedger) Append(block *configs.BlockchainLog) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkLink(block); err != nil {
+		return err
+	}
+
+	entry := entryOf(*block)
+	if l.archive {
+		entry = archiveEntryOf(*block)
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if l.size > 0 && l.size+int64(len(line)) > l.segmentSize {
+		if err := l.file.Close(); err != nil {
+			return err
+		}
+		if err := l.openSegment(l.segment + 1); err != nil {
+			return err
+		}
+	}
+
+	offset := l.size
+	if _, err := l.file.Write(line); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.size += int64(len(line))
+
+	l.track(*block, entryLocation{segment: l.segment, offset: offset, length: len(line)})
+	return nil
+}
+
+// Get 按全局高度读取区块
+func (l *FileLedger) Get(globalHeight int64) (*configs.BlockchainLog, error) {
+	blocks, err := l.Range(globalHeight, globalHeight)
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) == 0 {
+		return nil, ErrBlockNotFound
+	}
+	return &blocks[0], nil
+}
+
+// GetByHash 按区块哈希读取区块
+func (l *FileLedger) GetByHash(hash string) (*configs.BlockchainLog, error) {
+	l.mu.RLock()
+	height, ok := l.hashIndex[hash]
+	l.mu.RUnlock()
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+	return l.Get(height)
+}
+
+// GetByID 按数据库记录ID读取归档的区块
+func (l *FileLedger) GetByID(id uint) (*configs.BlockchainLog, error) {
+	l.mu.RLock()
+	height, ok := l.idIndex[id]
+	l.mu.RUnlock()
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+	return l.Get(height)
+}
+
+// Range 读取全局高度区间内的区块
+func (l *FileLedger) Range(from, to int64) ([]configs.BlockchainLog, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if from < 1 {
+		from = 1
+	}
+	if to > int64(len(l.index)) {
+		to = int64(len(l.index))
+	}
+
+	var heights []int64
+	for h := from; h <= to; h++ {
+		heights = append(heights, h)
+	}
+	return l.read(heights)
+}
+
+// SKUBlocks 按区块高度顺序读取某个SKU的全部区块
+func (l *FileLedger) SKUBlocks(sku string) ([]configs.BlockchainLog, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.read(l.skuIndex[sku])
+}
+
+// SKUCount 某个SKU的区块数
+func (l *FileLedger) SKUCount(sku string) int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return int64(len(l.skuIndex[sku]))
+}
+
+// SKUs 账本中出现过的全部SKU
+func (l *FileLedger) SKUs() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	skus := make([]string, 0, len(l.skuIndex))
+	for sku := range l.skuIndex {
+		skus = append(skus, sku)
+	}
+	return skus
+}
+
+// ledgerCounts 账本中区块的分类计数
+type ledgerCounts struct {
+	Total       int64
+	Unsealed    int64
+	RecordTypes map[int]int64
+	Days        map[string]int64 // 创建日期(本地时间) -> 区块数，只统计 since 之后的区块
+}
+
+// Counts 统计账本中的区块，sku 为空时统计全部区块，只使用内存中的索引
+func (l *FileLedger) Counts(sku string, since time.Time) ledgerCounts {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	counts := ledgerCounts{RecordTypes: make(map[int]int64), Days: make(map[string]int64)}
+	add := func(loc entryLocation) {
+		counts.Total++
+		if !loc.sealed {
+			counts.Unsealed++
+		}
+		counts.RecordTypes[loc.recordType]++
+		if loc.createdAt != 0 && loc.createdAt >= since.UnixNano() {
+			counts.Days[time.Unix(0, loc.createdAt).Format("2006-01-02")]++
+		}
+	}
+	if sku == "" {
+		for _, loc := range l.index {
+			add(loc)
+		}
+		return counts
+	}
+	for _, h := range l.skuIndex[sku] {
+		add(l.index[h-1])
+	}
+	return counts
+}
+
+// FirstAfter 返回第一个区块时间晚于 at 的全局高度，没有时返回0
+// 区块时间不保证递增，按单调的 latestAt 二分查找，第一个 latestAt 晚于 at 的区块就是第一个晚于 at 的区块
+func (l *FileLedger) FirstAfter(at int64) int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	i := sort.Search(len(l.index), func(i int) bool {
+		return l.index[i].latestAt > at
+	})
+	if i == len(l.index) {
+		return 0
+	}
+	return int64(i) + 1
+}
+
+// SKUBlocksAfter 读取某个SKU区块高度大于 after 的区块，最多 limit 个
+func (l *FileLedger) SKUBlocksAfter(sku string, after int64, limit int) ([]configs.BlockchainLog, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	heights := l.skuIndex[sku]
+	i := sort.Search(len(heights), func(i int) bool {
+		return l.index[heights[i]-1].blockHeight > after
+	})
+	heights = heights[i:]
+	if limit > 0 && len(heights) > limit {
+		heights = heights[:limit]
+	}
+	return l.read(heights)
+}
+
+// 按全局高度读取区块，调用方需持有读锁
+func (l *FileLedger) read(heights []int64) ([]configs.BlockchainLog, error) {
+	files := make(map[int]*os.File)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var blocks []configs.BlockchainLog
+	for _, h := range heights {
+		loc := l.index[h-1]
+		f, ok := files[loc.segment]
+		if !ok {
+			var err error
+			f, err = os.Open(l.segmentPath(loc.segment))
+			if err != nil {
+				return nil, err
+			}
+			files[loc.segment] = f
+		}
+
+		buf := make([]byte, loc.length)
+		if _, err := f.ReadAt(buf, loc.offset); err != nil {
+			return nil, err
+		}
+		var entry ledgerEntry
+		if err := json.Unmarshal(buf, &entry); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, entry.block())
+	}
+	return blocks, nil
+}
+
+// Verify 验证文件账本的哈希链
+// 文件账本不依赖数据库，因此不检查签名密钥的有效期
+func (l *FileLedger) Verify() (chainVerifyResult, error) {
+	l.mu.RLock()
+	height := int64(len(l.index))
+	l.mu.RUnlock()
+
+	blocks, err := l.Range(1, height)
+	if err != nil {
+		return chainVerifyResult{}, err
+	}
+	return verifyGlobalChain(blocks, nil), nil
+}
+
+// Head 获取链头
+func (l *FileLedger) Head(sku string) (*configs.BlockchainLog, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if sku == "" {
+		if l.head == nil {
+			return nil, ErrBlockNotFound
+		}
+		head := *l.head
+		return &head, nil
+	}
+
+	head, ok := l.skuHeads[sku]
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+	return &head, nil
+}
+
+// Close 关闭当前段文件
+func (l *FileLedger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
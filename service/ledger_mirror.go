@@ -0,0 +1,230 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"time"
+)
+
+// 每次从MySQL同步的区块数量
+const mirrorSyncBatch = 500
+
+// LedgerMirror 把MySQL账本中已提交的区块同步到独立的文件账本
+// 只同步已提交的数据，文件账本中不会出现被回滚的区块
+type LedgerMirror struct {
+	source Ledger
+	target *FileLedger
+	notify chan struct{}
+}
+
+// 当前运行的账本镜像
+var ledgerMirror *LedgerMirror
+
+// StartLedgerMirror 按全局配置启动文件账本镜像，未配置目录时不启动
+func StartLedgerMirror(ctx context.Context) (*LedgerMirror, error) {
+	if configs.GlobalLedgerConfig.MirrorDir == "" {
+		return nil, nil
+	}
+
+	target, err := OpenFileLedger(configs.GlobalLedgerConfig.MirrorDir, configs.GlobalLedgerConfig.MirrorSegment)
+	if err != nil {
+		return nil, err
+	}
+
+	mirror := &LedgerMirror{
+		source: NewGormLedger(configs.DB),
+		target: target,
+		notify: make(chan struct{}, 1),
+	}
+	ledgerMirror = mirror
+	go mirror.Run(ctx)
+	return mirror, nil
+}
+
+// Notify 通知镜像有新区块
+func (m *LedgerMirror) Notify() {
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run 运行同步循环
+func (m *LedgerMirror) Run(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		if err := m.Sync(); err != nil {
+			log.Printf("同步文件账本失败: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			m.target.Close()
+			return
+		case <-ticker.C:
+		case <-m.notify:
+		}
+	}
+}
+
+// Sync 把文件账本追赶到MySQL账本的链头
+// MySQL中已同步的区块被改写时，新区块无法接上文件账本的链头，同步会停止并报错
+func (m *LedgerMirror) Sync() error {
+	for {
+		var from int64 = 1
+		head, err := m.target.Head("")
+		if err == nil {
+			from = head.GlobalHeight + 1
+		} else if !errors.Is(err, ErrBlockNotFound) {
+			return err
+		}
+
+		blocks, err := m.source.Range(from, from+mirrorSyncBatch-1)
+		if err != nil {
+			return err
+		}
+		if len(blocks) == 0 {
+			return nil
+		}
+
+		for i := range blocks {
+			if err := m.target.Append(&blocks[i]); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// 高度不一致的区块
+type ledgerMismatch struct {
+	GlobalHeight int64  `json:"global_height"`
+	SourceHash   string `json:"source_hash"`
+	MirrorHash   string `json:"mirror_hash"`
+}
+
+// 交叉核对结果
+type crossCheckResult struct {
+	Consistent   bool             `json:"consistent"`
+	SourceHeight int64            `json:"source_height"`
+	MirrorHeight int64            `json:"mirror_height"`
+	Mismatches   []ledgerMismatch `json:"mismatches,omitempty"`
+}
+
+// 交叉核对最多报告的不一致区块数
+const maxReportedMismatches = 100
+
+// CrossCheck 逐块比较MySQL账本和文件账本
+// 文件账本落后于MySQL的部分视为尚未同步，不算作不一致
+func (m *LedgerMirror) CrossCheck() (crossCheckResult, error) {
+	res := crossCheckResult{Consistent: true}
+
+	if head, err := m.source.Head(""); err == nil {
+		res.SourceHeight = head.GlobalHeight
+	} else if !errors.Is(err, ErrBlockNotFound) {
+		return res, err
+	}
+	if head, err := m.target.Head(""); err == nil {
+		res.MirrorHeight = head.GlobalHeight
+	} else if !errors.Is(err, ErrBlockNotFound) {
+		return res, err
+	}
+
+	// 文件账本比MySQL高，说明MySQL中有区块被删除
+	for h := res.SourceHeight + 1; h <= res.MirrorHeight && len(res.Mismatches) < maxReportedMismatches; h++ {
+		mirrored, err := m.target.Get(h)
+		if err != nil {
+			return res, err
+		}
+		res.Consistent = false
+		res.Mismatches = append(res.Mismatches, ledgerMismatch{GlobalHeight: h, MirrorHash: mirrored.Hash})
+	}
+
+	end := res.MirrorHeight
+	if res.SourceHeight < end {
+		end = res.SourceHeight
+	}
+	for from := int64(1); from <= end; from += mirrorSyncBatch {
+		to := from + mirrorSyncBatch - 1
+		if to > end {
+			to = end
+		}
+
+		sourceBlocks, err := m.source.Range(from, to)
+		if err != nil {
+			return res, err
+		}
+		mirrorBlocks, err := m.target.Range(from, to)
+		if err != nil {
+			return res, err
+		}
+
+		sourceByHeight := make(map[int64]configs.BlockchainLog, len(sourceBlocks))
+		for _, block := range sourceBlocks {
+			sourceByHeight[block.GlobalHeight] = block
+		}
+		for _, block := range mirrorBlocks {
+			// 旧版区块不在全局链中，全局链中的旧版区块是被降级的新版区块
+			source, ok := sourceByHeight[block.GlobalHeight]
+			if ok && sameLedgerEntry(source, block) && block.HashVersion != HashVersionLegacy && computeBlockHash(block) == block.Hash {
+				continue
+			}
+			res.Consistent = false
+			if len(res.Mismatches) < maxReportedMismatches {
+				res.Mismatches = append(res.Mismatches, ledgerMismatch{
+					GlobalHeight: block.GlobalHeight,
+					SourceHash:   source.Hash,
+					MirrorHash:   block.Hash,
+				})
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// 比较两个账本中同一高度的区块，文件账本中保存的字段必须全部一致
+// 早期写入的文件账本条目没有创建时间，此时不比较创建时间
+func sameLedgerEntry(source, mirrored configs.BlockchainLog) bool {
+	a, b := entryOf(source), entryOf(mirrored)
+	if b.CreatedAt == 0 {
+		a.CreatedAt = 0
+	}
+	return a == b
+}
+
+// CrossCheckLedger 交叉核对MySQL账本和文件账本
+func (s *BlockchainService) CrossCheckLedger(c *gin.Context) {
+	if ledgerMirror == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "未启用文件账本",
+		})
+		return
+	}
+
+	res, err := ledgerMirror.CrossCheck()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "交叉核对账本失败: " + err.Error(),
+		})
+		return
+	}
+
+	message := "账本交叉核对一致"
+	if !res.Consistent {
+		message = "账本交叉核对不一致"
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": message,
+		"data":    res,
+	})
+}
@@ -0,0 +1,234 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"errors"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+// 构造用于交叉核对的全局链，创建时间带有纳秒以外的精度
+func testMirrorChain() []configs.BlockchainLog {
+	chain := testGlobalChain("A", "A", "B", "A")
+	for i := range chain {
+		// 文件账本按本地时区还原创建时间，与从MySQL读出的时间一致
+		chain[i].CreatedAt = time.Unix(1700000000+int64(i), 123000000)
+	}
+	return chain
+}
+
+// 把区块写入新的文件账本
+func testFileLedger(t *testing.T, blocks []configs.BlockchainLog) *FileLedger {
+	t.Helper()
+	ledger, err := OpenFileLedger(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ledger.Close() })
+	for i := range blocks {
+		block := blocks[i]
+		if err := ledger.Append(&block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ledger
+}
+
+func TestFileLedgerKeepsCreatedAt(t *testing.T) {
+	chain := testMirrorChain()
+	dir := t.TempDir()
+	ledger, err := OpenFileLedger(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range chain {
+		if err := ledger.Append(&chain[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ledger.Close()
+
+	// 重新打开后创建时间不变
+	reopened, err := OpenFileLedger(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	block, err := reopened.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !block.CreatedAt.Equal(chain[0].CreatedAt) || computeBlockHash(*block) != block.Hash {
+		t.Fatalf("区块的创建时间没有保存: %v", block.CreatedAt)
+	}
+}
+
+func TestCrossCheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		source     func([]configs.BlockchainLog) []configs.BlockchainLog
+		mirror     func([]configs.BlockchainLog) []configs.BlockchainLog
+		consistent bool
+		mismatches int
+	}{
+		{
+			name:       "两边一致",
+			consistent: true,
+		},
+		{
+			name: "MySQL中的区块创建时间被改写",
+			source: func(b []configs.BlockchainLog) []configs.BlockchainLog {
+				b[0].CreatedAt = b[0].CreatedAt.Add(time.Microsecond)
+				return b
+			},
+			mismatches: 1,
+		},
+		{
+			// 两边都把区块降级为旧版，哈希虽然无法复现，也不能当作旧版区块放过
+			name: "两边同样降级区块的哈希版本",
+			source: func(b []configs.BlockchainLog) []configs.BlockchainLog {
+				b[1].HashVersion = HashVersionLegacy
+				return b
+			},
+			mirror: func(b []configs.BlockchainLog) []configs.BlockchainLog {
+				b[1].HashVersion = HashVersionLegacy
+				return b
+			},
+			mismatches: 1,
+		},
+		{
+			name: "MySQL中的新版区块被篡改",
+			source: func(b []configs.BlockchainLog) []configs.BlockchainLog {
+				b[2].RecordData = `{"n":9}`
+				return b
+			},
+			mismatches: 1,
+		},
+		{
+			name: "两边同样篡改新版区块",
+			source: func(b []configs.BlockchainLog) []configs.BlockchainLog {
+				b[2].RecordData = `{"n":9}`
+				return b
+			},
+			mirror: func(b []configs.BlockchainLog) []configs.BlockchainLog {
+				b[2].RecordData = `{"n":9}`
+				return b
+			},
+			mismatches: 1,
+		},
+		{
+			name: "MySQL中的区块被删除",
+			source: func(b []configs.BlockchainLog) []configs.BlockchainLog {
+				return b[:3]
+			},
+			mismatches: 1,
+		},
+		{
+			name: "文件账本尚未同步",
+			mirror: func(b []configs.BlockchainLog) []configs.BlockchainLog {
+				return b[:2]
+			},
+			consistent: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, mirror := testMirrorChain(), testMirrorChain()
+			if tt.source != nil {
+				source = tt.source(source)
+			}
+			if tt.mirror != nil {
+				mirror = tt.mirror(mirror)
+			}
+			m := &LedgerMirror{source: testFileLedger(t, source), target: testFileLedger(t, mirror)}
+			res, err := m.CrossCheck()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Consistent != tt.consistent || len(res.Mismatches) != tt.mismatches {
+				t.Fatalf("结果 %+v", res)
+			}
+		})
+	}
+}
+
+func TestLedgerWatchersNotifiedAfterCommit(t *testing.T) {
+	tests := []struct {
+		name     string
+		fail     bool
+		notified bool
+	}{
+		{name: "事务提交", notified: true},
+		{name: "事务回滚", fail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDB(t)
+			user := testUser(t, 1)
+			producer := NewBlockProducer(time.Hour, 100)
+			blockProducer = producer
+
+			var committed int64
+			err := ledgerTransaction(func(tx *gorm.DB) error {
+				if _, err := (&BlockchainService{}).AddToBlockchainTx(tx, "SKU-1", 1, `{}`, user.ID); err != nil {
+					return err
+				}
+				// 事务提交之前不应通知订阅者
+				select {
+				case <-producer.notify:
+					t.Error("事务提交之前就通知了出块器")
+				default:
+				}
+				if tt.fail {
+					return errors.New("业务写入失败")
+				}
+				return nil
+			})
+			if tt.fail != (err != nil) {
+				t.Fatal(err)
+			}
+
+			select {
+			case <-producer.notify:
+				if !tt.notified {
+					t.Fatal("事务回滚后不应通知出块器")
+				}
+				// 收到通知时新区块已经可见
+				configs.DB.Model(&configs.BlockchainLog{}).Where("product_sku = ?", "SKU-1").Count(&committed)
+				if committed != 1 {
+					t.Fatalf("收到通知时区块数为 %d", committed)
+				}
+			default:
+				if tt.notified {
+					t.Fatal("事务提交后应通知出块器")
+				}
+			}
+		})
+	}
+}
+
+func TestFileLedgerFirstAfter(t *testing.T) {
+	chain := testGlobalChain("A", "A", "B", "A")
+	base := chain[0].Timestamp
+	// 第2个区块的时间偏快，之后的区块时间回退
+	chain[1].Timestamp = base + 10
+	ledger := testFileLedger(t, chain)
+
+	tests := []struct {
+		at   int64
+		want int64
+	}{
+		{at: base - 1, want: 1},
+		{at: base, want: 2},
+		{at: base + 3, want: 2},
+		{at: base + 10, want: 0},
+	}
+	for _, tt := range tests {
+		if got := ledger.FirstAfter(tt.at); got != tt.want {
+			t.Fatalf("时间 %d 之后的第一个区块 %d，期望 %d", tt.at-base, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// Merkle树节点哈希加前缀区分叶子和内部节点，防止第二原像攻击
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// MerkleProofStep 包含证明中的一个兄弟节点
+type MerkleProofStep struct {
+	Hash     string `json:"hash"`
+	Position string `json:"position"` // left: 兄弟节点在左侧, right: 兄弟节点在右侧
+}
+
+func merkleLeaf(leaf []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	h.Write(leaf)
+	return h.Sum(nil)
+}
+
+func merkleNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// 构造Merkle树，返回从叶子层到根的每一层
+// 奇数个节点时最后一个节点直接提升到上一层，不做复制
+func buildMerkleLevels(leafHashes []string) ([][][]byte, error) {
+	if len(leafHashes) == 0 {
+		return nil, errors.New("Merkle树至少需要一个叶子")
+	}
+
+	level := make([][]byte, len(leafHashes))
+	for i, leafHash := range leafHashes {
+		raw, err := hex.DecodeString(leafHash)
+		if err != nil {
+			return nil, err
+		}
+		level[i] = merkleLeaf(raw)
+	}
+
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+		levels = append(levels, next)
+		level = next
+	}
+
+	return levels, nil
+}
+
+// MerkleRoot 计算一组叶子哈希（十六进制）的Merkle根
+func MerkleRoot(leafHashes []string) (string, error) {
+	levels, err := buildMerkleLevels(leafHashes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(levels[len(levels)-1][0]), nil
+}
+
+// MerkleProof 生成指定叶子的包含证明
+func MerkleProof(leafHashes []string, index int) ([]MerkleProofStep, error) {
+	if index < 0 || index >= len(leafHashes) {
+		return nil, errors.New("叶子序号超出范围")
+	}
+
+	levels, err := buildMerkleLevels(leafHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	var proof []MerkleProofStep
+	for _, level := range levels[:len(levels)-1] {
+		if index%2 == 1 {
+			proof = append(proof, MerkleProofStep{Hash: hex.EncodeToString(level[index-1]), Position: "left"})
+		} else if index+1 < len(level) {
+			proof = append(proof, MerkleProofStep{Hash: hex.EncodeToString(level[index+1]), Position: "right"})
+		}
+		index /= 2
+	}
+
+	return proof, nil
+}
+
+// VerifyMerkleProof 用包含证明验证叶子哈希是否属于给定的Merkle根
+func VerifyMerkleProof(leafHash string, proof []MerkleProofStep, root string) bool {
+	raw, err := hex.DecodeString(leafHash)
+	if err != nil {
+		return false
+	}
+
+	node := merkleLeaf(raw)
+	for _, step := range proof {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			return false
+		}
+		switch step.Position {
+		case "left":
+			node = merkleNode(sibling, node)
+		case "right":
+			node = merkleNode(node, sibling)
+		default:
+			return false
+		}
+	}
+
+	return hex.EncodeToString(node) == root
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// 生成 n 个叶子哈希
+func testLeaves(n int) []string {
+	leaves := make([]string, n)
+	for i := range leaves {
+		leaves[i] = hashData(fmt.Sprintf("leaf-%d", i))
+	}
+	return leaves
+}
+
+func TestMerkleProofRoundTrip(t *testing.T) {
+	// 覆盖单个叶子、偶数个、奇数个和需要多次提升的情况
+	for _, n := range []int{1, 2, 3, 4, 5, 7, 8, 9, 16, 17} {
+		t.Run(fmt.Sprintf("%d个叶子", n), func(t *testing.T) {
+			leaves := testLeaves(n)
+			root, err := MerkleRoot(leaves)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, leaf := range leaves {
+				proof, err := MerkleProof(leaves, i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !VerifyMerkleProof(leaf, proof, root) {
+					t.Fatalf("叶子 %d 的证明验证失败", i)
+				}
+				if n > 1 && VerifyMerkleProof(leaves[(i+1)%n], proof, root) {
+					t.Fatalf("叶子 %d 的证明不应能证明其他叶子", i)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyMerkleProofRejectsTampering(t *testing.T) {
+	leaves := testLeaves(5)
+	root, _ := MerkleRoot(leaves)
+	proof, _ := MerkleProof(leaves, 2)
+
+	tests := []struct {
+		name   string
+		leaf   string
+		proof  func() []MerkleProofStep
+		root   string
+		passed bool
+	}{
+		{name: "原始证明", leaf: leaves[2], proof: func() []MerkleProofStep { return proof }, root: root, passed: true},
+		{name: "篡改叶子", leaf: hashData("other"), proof: func() []MerkleProofStep { return proof }, root: root},
+		{name: "篡改根", leaf: leaves[2], proof: func() []MerkleProofStep { return proof }, root: hashData("root")},
+		{
+			name: "篡改兄弟节点",
+			leaf: leaves[2],
+			proof: func() []MerkleProofStep {
+				p := append([]MerkleProofStep(nil), proof...)
+				p[0].Hash = hashData("sibling")
+				return p
+			},
+			root: root,
+		},
+		{
+			name: "交换左右位置",
+			leaf: leaves[2],
+			proof: func() []MerkleProofStep {
+				p := append([]MerkleProofStep(nil), proof...)
+				if p[0].Position == "left" {
+					p[0].Position = "right"
+				} else {
+					p[0].Position = "left"
+				}
+				return p
+			},
+			root: root,
+		},
+		{
+			name: "未知位置",
+			leaf: leaves[2],
+			proof: func() []MerkleProofStep {
+				p := append([]MerkleProofStep(nil), proof...)
+				p[0].Position = "middle"
+				return p
+			},
+			root: root,
+		},
+		{name: "缺少证明步骤", leaf: leaves[2], proof: func() []MerkleProofStep { return proof[1:] }, root: root},
+		{name: "叶子不是十六进制", leaf: "zz", proof: func() []MerkleProofStep { return proof }, root: root},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyMerkleProof(tt.leaf, tt.proof(), tt.root); got != tt.passed {
+				t.Fatalf("验证结果 %v，期望 %v", got, tt.passed)
+			}
+		})
+	}
+}
+
+func TestMerkleLeafAndNodeAreDomainSeparated(t *testing.T) {
+	// 两个叶子的内部节点不能被当作一个叶子，否则可以伪造更短的证明
+	leaves := testLeaves(2)
+	root, _ := MerkleRoot(leaves)
+	if VerifyMerkleProof(root, nil, root) {
+		t.Fatal("内部节点不应能作为叶子通过验证")
+	}
+}
+
+func TestMerkleInvalidInput(t *testing.T) {
+	if _, err := MerkleRoot(nil); err == nil {
+		t.Fatal("没有叶子时应返回错误")
+	}
+	if _, err := MerkleRoot([]string{"zz"}); err == nil {
+		t.Fatal("叶子不是十六进制时应返回错误")
+	}
+	for _, index := range []int{-1, 3} {
+		if _, err := MerkleProof(testLeaves(3), index); err == nil {
+			t.Fatalf("序号 %d 超出范围时应返回错误", index)
+		}
+	}
+}
+
+func TestSealedRecordProof(t *testing.T) {
+	testDB(t)
+	user := testUser(t, 1)
+
+	// 加上签名者的密钥登记区块共5条待打包记录
+	blockchainService := &BlockchainService{}
+	for i := 0; i < 4; i++ {
+		if _, err := blockchainService.AddToBlockchain("SKU-1", 1, fmt.Sprintf(`{"n":%d}`, i), user.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 待打包记录不足时不封块
+	producer := NewBlockProducer(0, 3)
+	sealed, err := producer.SealPending(10)
+	if err != nil || len(sealed) != 0 {
+		t.Fatalf("记录不足时不应封块: %v %v", sealed, err)
+	}
+	sealed, err = producer.SealPending(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sealed) != 2 || sealed[0].RecordCount != 3 || sealed[1].RecordCount != 2 || sealed[1].PreviousHash != sealed[0].Hash {
+		t.Fatalf("封块结果 %+v", sealed)
+	}
+
+	var records []configs.BlockchainLog
+	if err := configs.DB.Order("global_height").Find(&records).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		w := testHandle(blockchainService.GetRecordProof, user, http.MethodGet, fmt.Sprintf("/api/blockchain/proof?record_id=%d", record.ID), nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("状态码 %d: %s", w.Code, w.Body.String())
+		}
+		var body struct {
+			Data struct {
+				LeafHash   string            `json:"leaf_hash"`
+				Proof      []MerkleProofStep `json:"proof"`
+				MerkleRoot string            `json:"merkle_root"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Data.LeafHash != record.Hash || !VerifyMerkleProof(body.Data.LeafHash, body.Data.Proof, body.Data.MerkleRoot) {
+			t.Fatalf("记录 %d 的包含证明验证失败: %s", record.ID, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,493 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"gorm.io/gorm"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnknownTopic 消息主题没有对应的订阅配置
+var ErrUnknownTopic = errors.New("消息主题没有对应的设备映射")
+
+// 按订阅过滤器匹配主题，返回各通配符依次匹配的内容
+// 共享订阅 $share/<组名>/ 前缀不参与匹配
+func matchTopic(filter, topic string) ([]string, bool) {
+	if strings.HasPrefix(filter, "$share/") {
+		parts := strings.SplitN(filter, "/", 3)
+		if len(parts) < 3 {
+			return nil, false
+		}
+		filter = parts[2]
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	var captures []string
+	for i, level := range filterLevels {
+		if level == "#" {
+			return append(captures, strings.Join(topicLevels[i:], "/")), true
+		}
+		if i >= len(topicLevels) {
+			return nil, false
+		}
+		if level == "+" {
+			captures = append(captures, topicLevels[i])
+			continue
+		}
+		if level != topicLevels[i] {
+			return nil, false
+		}
+	}
+	return captures, len(filterLevels) == len(topicLevels)
+}
+
+// 用通配符匹配的内容替换设备编号模板中的 {1}、{2} 等占位符
+func expandSerial(template string, captures []string) string {
+	serial := template
+	for i, capture := range captures {
+		serial = strings.ReplaceAll(serial, "{"+strconv.Itoa(i+1)+"}", capture)
+	}
+	return serial
+}
+
+// 解析读数时间，支持RFC 3339时间、2006-01-02 15:04:05、Unix秒（可带小数）和Unix毫秒
+func parseReadingTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		if number > 1e12 {
+			return time.UnixMilli(int64(number)), nil
+		}
+		seconds, fraction := math.Modf(number)
+		return time.Unix(int64(seconds), int64(fraction*1e9)), nil
+	}
+	return parseAsOf(value)
+}
+
+// MQTT消息中的单条读数，读数时间可以是字符串或数字，缺省时使用收到消息的时间
+type mqttReading struct {
+	RecordedAt  json.RawMessage `json:"recorded_at"`
+	Temperature *float64        `json:"temperature"`
+	Humidity    *float64        `json:"humidity"`
+}
+
+func (r mqttReading) input(received time.Time) (telemetryReadingInput, error) {
+	input := telemetryReadingInput{RecordedAt: received, Temperature: r.Temperature, Humidity: r.Humidity}
+	if len(r.RecordedAt) > 0 && string(r.RecordedAt) != "null" {
+		value := string(r.RecordedAt)
+		var text string
+		if err := json.Unmarshal(r.RecordedAt, &text); err == nil {
+			value = text
+		}
+		at, err := parseReadingTime(value)
+		if err != nil {
+			return input, fmt.Errorf("读数时间格式错误: %s", value)
+		}
+		input.RecordedAt = at
+	}
+	return input, nil
+}
+
+// 解析JSON消息，支持单条读数、读数数组和与HTTP上报相同的 {"readings": [...]}
+func parseJSONReadings(payload []byte, received time.Time) ([]telemetryReadingInput, error) {
+	var list []mqttReading
+	trimmed := bytes.TrimSpace(payload)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		if err := json.Unmarshal(trimmed, &list); err != nil {
+			return nil, err
+		}
+	default:
+		var message struct {
+			mqttReading
+			Readings []mqttReading `json:"readings"`
+		}
+		if err := json.Unmarshal(trimmed, &message); err != nil {
+			return nil, err
+		}
+		list = message.Readings
+		if list == nil {
+			list = []mqttReading{message.mqttReading}
+		}
+	}
+
+	inputs := make([]telemetryReadingInput, 0, len(list))
+	for _, reading := range list {
+		input, err := reading.input(received)
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, input)
+	}
+	return inputs, nil
+}
+
+// 解析CSV消息，每行为 读数时间,温度[,湿度]，读数时间为空时使用收到消息的时间，首行可以是表头
+func parseCSVReadings(payload []byte, received time.Time) ([]telemetryReadingInput, error) {
+	reader := csv.NewReader(bytes.NewReader(payload))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var inputs []telemetryReadingInput
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 2 {
+			return nil, fmt.Errorf("第 %d 行字段不足", line)
+		}
+
+		temperature, err := strconv.ParseFloat(record[1], 64)
+		if err != nil {
+			if line == 1 {
+				continue // 表头
+			}
+			return nil, fmt.Errorf("第 %d 行温度格式错误", line)
+		}
+		input := telemetryReadingInput{RecordedAt: received, Temperature: &temperature}
+		if record[0] != "" {
+			if input.RecordedAt, err = parseReadingTime(record[0]); err != nil {
+				return nil, fmt.Errorf("第 %d 行读数时间格式错误", line)
+			}
+		}
+		if len(record) > 2 && record[2] != "" {
+			humidity, err := strconv.ParseFloat(record[2], 64)
+			if err != nil {
+				return nil, fmt.Errorf("第 %d 行湿度格式错误", line)
+			}
+			input.Humidity = &humidity
+		}
+		inputs = append(inputs, input)
+	}
+	return inputs, nil
+}
+
+// 按配置的格式解析消息，未配置格式时以 { 或 [ 开头的消息按JSON解析，其余按CSV解析
+func parseReadings(format string, payload []byte, received time.Time) ([]telemetryReadingInput, error) {
+	switch format {
+	case "json":
+		return parseJSONReadings(payload, received)
+	case "csv":
+		return parseCSVReadings(payload, received)
+	case "":
+		trimmed := bytes.TrimSpace(payload)
+		if bytes.HasPrefix(trimmed, []byte("{")) || bytes.HasPrefix(trimmed, []byte("[")) {
+			return parseJSONReadings(trimmed, received)
+		}
+		return parseCSVReadings(trimmed, received)
+	}
+	return nil, fmt.Errorf("不支持的消息格式: %s", format)
+}
+
+// MQTTBridge 订阅冷藏车和冷库传感器的MQTT主题，把读数写入与HTTP上报相同的遥测流程
+// 收到的读数先写入暂存表再确认消息，同一设备的读数达到批次大小或到达保存间隔时作为一个批次保存
+// 保存失败的读数留在暂存表中，下次保存时重试，重启后也不会丢失
+// 设备身份由主题决定，应在MQTT服务端通过ACL限制每个设备只能发布自己的主题
+type MQTTBridge struct {
+	topics        []configs.MQTTTopic
+	qos           byte
+	flushInterval time.Duration
+	batchSize     int
+	client        mqtt.Client
+	ingest        func(device configs.Device, inputs []telemetryReadingInput, consumed func(tx *gorm.DB) error) (*telemetryIngestResult, error)
+
+	mu      sync.Mutex
+	devices map[string]*configs.Device // 设备编号对应的设备，每次保存后清空以便感知停用
+	counts  map[uint]int               // 上次保存后各设备收到的读数条数
+	full    chan struct{}
+}
+
+// NewMQTTBridge 创建桥接，Connect 之前可以直接调用 HandleMessage 和 Flush
+func NewMQTTBridge(topics []configs.MQTTTopic, qos byte, flushInterval time.Duration, batchSize int) *MQTTBridge {
+	return &MQTTBridge{
+		topics:        topics,
+		qos:           qos,
+		flushInterval: flushInterval,
+		batchSize:     batchSize,
+		ingest:        ingestTelemetryWith,
+		devices:       make(map[string]*configs.Device),
+		counts:        make(map[uint]int),
+		full:          make(chan struct{}, 1),
+	}
+}
+
+// errMQTTSpool 读数没有写入暂存表，消息不能确认
+var errMQTTSpool = errors.New("暂存MQTT读数失败")
+
+// 查询已登记且未停用的设备
+func (b *MQTTBridge) device(serialNo string) (*configs.Device, error) {
+	if device, ok := b.devices[serialNo]; ok {
+		return device, nil
+	}
+
+	var device configs.Device
+	result := configs.DB.Where("serial_no = ?", serialNo).Limit(1).Find(&device)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 || device.Disabled {
+		b.devices[serialNo] = nil
+		return nil, nil
+	}
+	b.devices[serialNo] = &device
+	return &device, nil
+}
+
+// HandleMessage 解析一条MQTT消息并把读数写入对应设备的暂存表
+// 无效的读数直接丢弃，不影响同一消息中的其他读数
+// 返回 errMQTTSpool 时读数没有保存，消息应由服务端重新投递
+func (b *MQTTBridge) HandleMessage(topic string, payload []byte) error {
+	var mapping *configs.MQTTTopic
+	var captures []string
+	for i := range b.topics {
+		if matched, ok := matchTopic(b.topics[i].Filter, topic); ok {
+			mapping, captures = &b.topics[i], matched
+			break
+		}
+	}
+	if mapping == nil {
+		return ErrUnknownTopic
+	}
+
+	received := time.Now()
+	inputs, err := parseReadings(mapping.Format, payload, received)
+	if err != nil {
+		return err
+	}
+
+	serialNo := expandSerial(mapping.Serial, captures)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	device, err := b.device(serialNo)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errMQTTSpool, err)
+	}
+	if device == nil {
+		return fmt.Errorf("设备 %s 未登记或已停用", serialNo)
+	}
+
+	latest := received.Add(telemetryClockSkew)
+	rows := make([]configs.MQTTPendingReading, 0, len(inputs))
+	for _, input := range inputs {
+		if reason := checkReading(input, latest); reason != "" {
+			log.Printf("丢弃设备 %s 的读数: %s", serialNo, reason)
+			continue
+		}
+		rows = append(rows, configs.MQTTPendingReading{
+			DeviceID:    device.ID,
+			RecordedAt:  input.RecordedAt.Truncate(time.Millisecond),
+			Temperature: *input.Temperature,
+			Humidity:    input.Humidity,
+		})
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	if err := configs.DB.CreateInBatches(rows, 1000).Error; err != nil {
+		return fmt.Errorf("%w: %v", errMQTTSpool, err)
+	}
+
+	b.counts[device.ID] += len(rows)
+	if b.counts[device.ID] >= b.batchSize {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// 重试也无法保存的读数，这类读数从暂存表中删除
+func permanentIngestError(err error) bool {
+	var invalid *readingError
+	return errors.As(err, &invalid) || errors.Is(err, ErrDeviceNotBound) || errors.Is(err, ErrTooManyReadings)
+}
+
+// Flush 把暂存的读数按设备作为批次写入遥测存储和账本
+// 数据库等暂时性错误时读数留在暂存表中，返回的错误包含各设备的失败原因
+func (b *MQTTBridge) Flush() error {
+	b.mu.Lock()
+	b.devices = make(map[string]*configs.Device)
+	b.counts = make(map[uint]int)
+	b.mu.Unlock()
+
+	var deviceIDs []uint
+	if err := configs.DB.Model(&configs.MQTTPendingReading{}).Distinct("device_id").Order("device_id").Pluck("device_id", &deviceIDs).Error; err != nil {
+		return err
+	}
+	var errs []error
+	for _, deviceID := range deviceIDs {
+		if err := b.flushDevice(deviceID); err != nil {
+			errs = append(errs, fmt.Errorf("设备 %d: %w", deviceID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// 按到达顺序分批保存一个设备的暂存读数，批次保存成功或读数无效时删除对应的暂存行
+// 每个批次固定为读出的暂存行，在保存批次的同一事务中按ID删除这些行，删除失败时批次也不保存
+func (b *MQTTBridge) flushDevice(deviceID uint) error {
+	var device configs.Device
+	result := configs.DB.Limit(1).Find(&device, deviceID)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	for {
+		var rows []configs.MQTTPendingReading
+		if err := configs.DB.Where("device_id = ?", deviceID).Order("id").Limit(maxTelemetryReadings).Find(&rows).Error; err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, len(rows))
+		for i, row := range rows {
+			ids[i] = row.ID
+		}
+		consume := func(tx *gorm.DB) error {
+			return tx.Delete(&configs.MQTTPendingReading{}, ids).Error
+		}
+
+		discard := result.RowsAffected == 0
+		if discard {
+			log.Printf("设备 %d 已删除，丢弃 %d 条暂存读数", deviceID, len(rows))
+		} else {
+			inputs := make([]telemetryReadingInput, len(rows))
+			for i := range rows {
+				inputs[i] = telemetryReadingInput{RecordedAt: rows[i].RecordedAt, Temperature: &rows[i].Temperature, Humidity: rows[i].Humidity}
+			}
+			ingested, err := b.ingest(device, inputs, consume)
+			switch {
+			case err == nil:
+				if !ingested.Duplicate {
+					log.Printf("设备 %s 的 %d 条读数已保存为批次 %d", device.SerialNo, ingested.ReadingCount, ingested.BatchID)
+				}
+			case permanentIngestError(err):
+				log.Printf("丢弃设备 %s 的 %d 条读数: %v", device.SerialNo, len(rows), err)
+				discard = true
+			default:
+				return err
+			}
+		}
+		if discard {
+			if err := consume(configs.DB); err != nil {
+				return err
+			}
+		}
+		if len(rows) < maxTelemetryReadings {
+			return nil
+		}
+	}
+}
+
+// Connect 连接MQTT服务端，连接和重连成功后订阅全部主题
+// 服务端暂时不可用时在后台持续重试，不阻塞启动
+func (b *MQTTBridge) Connect(cfg configs.MQTTConfig) {
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetConnectTimeout(cfg.ConnectTimeout).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		// 保留会话并在读数暂存后确认消息，断线或暂存失败期间的消息由服务端重新投递
+		SetCleanSession(false).
+		SetAutoAckDisabled(true).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			filters := make(map[string]byte, len(b.topics))
+			for _, topic := range b.topics {
+				filters[topic.Filter] = b.qos
+			}
+			token := client.SubscribeMultiple(filters, func(_ mqtt.Client, message mqtt.Message) {
+				err := b.HandleMessage(message.Topic(), message.Payload())
+				if err != nil {
+					log.Printf("处理MQTT消息失败 %s: %v", message.Topic(), err)
+				}
+				if !errors.Is(err, errMQTTSpool) {
+					message.Ack()
+				}
+			})
+			if token.WaitTimeout(cfg.ConnectTimeout) && token.Error() != nil {
+				log.Printf("订阅MQTT主题失败: %v", token.Error())
+				return
+			}
+			log.Printf("已连接MQTT服务端 %s，订阅 %d 个主题", cfg.Broker, len(filters))
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("MQTT连接断开: %v", err)
+		})
+
+	b.client = mqtt.NewClient(opts)
+	b.client.Connect()
+}
+
+// 保存暂存的读数，失败的读数留到下次保存
+func (b *MQTTBridge) flush() {
+	if err := b.Flush(); err != nil {
+		log.Printf("保存MQTT读数失败，稍后重试: %v", err)
+	}
+}
+
+// Run 定期保存暂存的读数，启动时先保存上次退出前未保存的读数，退出时断开连接后保存剩余读数
+func (b *MQTTBridge) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.flushInterval)
+	defer ticker.Stop()
+
+	b.flush()
+	for {
+		select {
+		case <-ctx.Done():
+			if b.client != nil {
+				b.client.Disconnect(250)
+			}
+			b.flush()
+			return
+		case <-ticker.C:
+		case <-b.full:
+		}
+		b.flush()
+	}
+}
+
+// StartMQTTBridge 按全局配置启动MQTT桥接，未启用时返回nil
+func StartMQTTBridge(ctx context.Context) (*MQTTBridge, error) {
+	cfg := configs.GlobalMQTTConfig
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if len(cfg.Topics) == 0 {
+		return nil, errors.New("没有配置MQTT订阅主题")
+	}
+	for _, topic := range cfg.Topics {
+		if topic.Serial == "" {
+			return nil, fmt.Errorf("MQTT主题 %s 没有配置设备编号模板", topic.Filter)
+		}
+		if topic.Format != "" && topic.Format != "json" && topic.Format != "csv" {
+			return nil, fmt.Errorf("MQTT主题 %s 的消息格式 %s 不支持", topic.Filter, topic.Format)
+		}
+	}
+
+	b := NewMQTTBridge(cfg.Topics, cfg.QoS, cfg.FlushInterval, cfg.BatchSize)
+	b.Connect(cfg)
+	go b.Run(ctx)
+	return b, nil
+}
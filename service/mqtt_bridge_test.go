@@ -0,0 +1,315 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	broker "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"gorm.io/gorm"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter   string
+		topic    string
+		captures []string
+		ok       bool
+	}{
+		{filter: "coldchain/devices/+/telemetry", topic: "coldchain/devices/D1/telemetry", captures: []string{"D1"}, ok: true},
+		{filter: "coldchain/devices/+/telemetry", topic: "coldchain/devices/D1/status"},
+		{filter: "coldchain/devices/+/telemetry", topic: "coldchain/devices/D1"},
+		{filter: "coldchain/devices/+/telemetry", topic: "coldchain/devices/D1/telemetry/extra"},
+		{filter: "warehouse/+/rooms/+", topic: "warehouse/W1/rooms/3", captures: []string{"W1", "3"}, ok: true},
+		{filter: "reefer/#", topic: "reefer/R1/temp", captures: []string{"R1/temp"}, ok: true},
+		{filter: "reefer/+/#", topic: "reefer/R1/a/b", captures: []string{"R1", "a/b"}, ok: true},
+		{filter: "reefer/#", topic: "warehouse/R1"},
+		{filter: "a/b", topic: "a/b", ok: true},
+		{filter: "a/+", topic: "a/", captures: []string{""}, ok: true},
+		{filter: "$share/bridge/coldchain/+/telemetry", topic: "coldchain/D1/telemetry", captures: []string{"D1"}, ok: true},
+		{filter: "$share/bridge", topic: "bridge"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter+" "+tt.topic, func(t *testing.T) {
+			captures, ok := matchTopic(tt.filter, tt.topic)
+			if ok != tt.ok || (ok && fmt.Sprint(captures) != fmt.Sprint(tt.captures)) {
+				t.Fatalf("匹配结果 %v %v，期望 %v %v", captures, ok, tt.captures, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseReadings(t *testing.T) {
+	received := time.Date(2026, 1, 1, 8, 0, 0, 0, time.Local)
+	at := time.Date(2026, 1, 1, 7, 30, 0, 0, time.Local)
+	tests := []struct {
+		name    string
+		format  string
+		payload string
+		want    string // 每条读数为 时间/温度/湿度，湿度为空时为 -
+		wantErr bool
+	}{
+		{name: "单条读数", format: "json", payload: `{"temperature": 4.5, "humidity": 60}`, want: "08:00:00/4.5/60"},
+		{name: "读数数组", format: "json", payload: fmt.Sprintf(`[{"recorded_at": "%s", "temperature": 4}, {"temperature": 5}]`, at.Format(time.RFC3339)), want: "07:30:00/4/- 08:00:00/5/-"},
+		{name: "与HTTP上报相同的格式", format: "json", payload: `{"readings": [{"recorded_at": "2026-01-01 07:30:00", "temperature": 3}]}`, want: "07:30:00/3/-"},
+		{name: "Unix秒", format: "json", payload: fmt.Sprintf(`{"recorded_at": %d, "temperature": 2}`, at.Unix()), want: "07:30:00/2/-"},
+		{name: "Unix毫秒", format: "json", payload: fmt.Sprintf(`{"recorded_at": "%d", "temperature": 2}`, at.UnixMilli()), want: "07:30:00/2/-"},
+		{name: "读数时间为null", format: "json", payload: `{"recorded_at": null, "temperature": 1}`, want: "08:00:00/1/-"},
+		{name: "读数时间格式错误", format: "json", payload: `{"recorded_at": "昨天", "temperature": 1}`, wantErr: true},
+		{name: "JSON格式错误", format: "json", payload: `{"temperature":`, wantErr: true},
+		{name: "CSV带表头", format: "csv", payload: "recorded_at,temperature,humidity\n2026-01-01 07:30:00,4,55\n,5,", want: "07:30:00/4/55 08:00:00/5/-"},
+		{name: "CSV字段不足", format: "csv", payload: "2026-01-01 07:30:00", wantErr: true},
+		{name: "CSV温度格式错误", format: "csv", payload: "2026-01-01 07:30:00,4\n2026-01-01 07:31:00,x", wantErr: true},
+		{name: "CSV湿度格式错误", format: "csv", payload: "2026-01-01 07:30:00,4,x", wantErr: true},
+		{name: "自动识别JSON", payload: `  [{"temperature": 6}]`, want: "08:00:00/6/-"},
+		{name: "自动识别CSV", payload: "2026-01-01 07:30:00,7", want: "07:30:00/7/-"},
+		{name: "不支持的格式", format: "xml", payload: "<t>1</t>", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inputs, err := parseReadings(tt.format, []byte(tt.payload), received)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("应解析失败，得到 %+v", inputs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			list := make([]string, len(inputs))
+			for i, input := range inputs {
+				humidity := "-"
+				if input.Humidity != nil {
+					humidity = fmt.Sprint(*input.Humidity)
+				}
+				list[i] = fmt.Sprintf("%s/%v/%s", input.RecordedAt.In(time.Local).Format("15:04:05"), *input.Temperature, humidity)
+			}
+			if got := strings.Join(list, " "); got != tt.want {
+				t.Fatalf("读数 %q，期望 %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// 暂存表中某个设备的读数条数
+func testSpooled(t *testing.T, deviceID uint) int64 {
+	t.Helper()
+	var count int64
+	if err := configs.DB.Model(&configs.MQTTPendingReading{}).Where("device_id = ?", deviceID).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+// 设备已保存的读数批次数
+func testBatches(t *testing.T, deviceID uint) int64 {
+	t.Helper()
+	var count int64
+	configs.DB.Model(&configs.TelemetryBatch{}).Where("device_id = ?", deviceID).Count(&count)
+	return count
+}
+
+func TestMQTTBridgeFlush(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error // 第一次保存时返回的错误
+		wantErr bool
+		spooled int64 // 第一次保存后暂存表中剩余的读数
+		batches int64 // 再次保存后的批次数
+	}{
+		{name: "保存成功", batches: 1},
+		{name: "暂时性错误保留读数", err: errors.New("数据库连接断开"), wantErr: true, spooled: 2, batches: 1},
+		{name: "设备未绑定时丢弃读数", err: ErrDeviceNotBound},
+		{name: "读数无效时丢弃读数", err: &readingError{Reason: "温度超出范围"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDB(t)
+			factory := testUser(t, 1)
+			testProduct(t, "SKU-1", factory.ID)
+			device := testDevice(t, factory.ID)
+			configs.DB.Create(&configs.DeviceBinding{DeviceID: device.ID, ProductSKU: "SKU-1", BoundAt: time.Now().Add(-time.Hour)})
+
+			topics := []configs.MQTTTopic{{Filter: "coldchain/devices/+/telemetry", Serial: "{1}"}}
+			bridge := NewMQTTBridge(topics, 1, time.Minute, 500)
+			topic := "coldchain/devices/" + device.SerialNo + "/telemetry"
+			if err := bridge.HandleMessage(topic, []byte(`[{"temperature": 4}, {"temperature": 5}]`)); err != nil {
+				t.Fatal(err)
+			}
+			// 无效的读数和未登记的设备不进入暂存表
+			if err := bridge.HandleMessage(topic, []byte(`{"temperature": 500}`)); err != nil {
+				t.Fatal(err)
+			}
+			if err := bridge.HandleMessage("coldchain/devices/D-unknown/telemetry", []byte(`{"temperature": 4}`)); err == nil {
+				t.Fatal("未登记的设备应返回错误")
+			}
+			if err := bridge.HandleMessage("other/topic", []byte(`{"temperature": 4}`)); !errors.Is(err, ErrUnknownTopic) {
+				t.Fatalf("未配置的主题 %v", err)
+			}
+			if spooled := testSpooled(t, device.ID); spooled != 2 {
+				t.Fatalf("暂存 %d 条读数", spooled)
+			}
+
+			if tt.err != nil {
+				bridge.ingest = func(configs.Device, []telemetryReadingInput, func(*gorm.DB) error) (*telemetryIngestResult, error) {
+					return nil, tt.err
+				}
+			}
+			if err := bridge.Flush(); (err != nil) != tt.wantErr {
+				t.Fatalf("第一次保存 %v", err)
+			}
+			if spooled := testSpooled(t, device.ID); spooled != tt.spooled {
+				t.Fatalf("第一次保存后暂存 %d 条读数", spooled)
+			}
+
+			// 重启后的桥接继续保存暂存的读数
+			restarted := NewMQTTBridge(topics, 1, time.Minute, 500)
+			if err := restarted.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if spooled, batches := testSpooled(t, device.ID), testBatches(t, device.ID); spooled != 0 || batches != tt.batches {
+				t.Fatalf("再次保存后暂存 %d 条读数，批次 %d 个", spooled, batches)
+			}
+		})
+	}
+}
+
+// 删除暂存行失败时批次不保存，之后收到的读数和这些读数一起保存，不会重复写入账本
+func TestMQTTBridgeFlushConsumesSpool(t *testing.T) {
+	testDB(t)
+	factory := testUser(t, 1)
+	testProduct(t, "SKU-1", factory.ID)
+	device := testDevice(t, factory.ID)
+	configs.DB.Create(&configs.DeviceBinding{DeviceID: device.ID, ProductSKU: "SKU-1", BoundAt: time.Now().Add(-time.Hour)})
+
+	topics := []configs.MQTTTopic{{Filter: "coldchain/devices/+/telemetry", Serial: "{1}"}}
+	topic := "coldchain/devices/" + device.SerialNo + "/telemetry"
+	bridge := NewMQTTBridge(topics, 1, time.Minute, 500)
+	if err := bridge.HandleMessage(topic, []byte(`[{"temperature": 4}, {"temperature": 5}]`)); err != nil {
+		t.Fatal(err)
+	}
+	bridge.ingest = func(device configs.Device, inputs []telemetryReadingInput, consumed func(*gorm.DB) error) (*telemetryIngestResult, error) {
+		return ingestTelemetryWith(device, inputs, func(tx *gorm.DB) error {
+			if err := consumed(tx); err != nil {
+				return err
+			}
+			return errors.New("删除暂存行失败")
+		})
+	}
+	if err := bridge.Flush(); err == nil {
+		t.Fatal("删除暂存行失败时应返回错误")
+	}
+	if spooled, batches := testSpooled(t, device.ID), testBatches(t, device.ID); spooled != 2 || batches != 0 {
+		t.Fatalf("暂存 %d 条读数，批次 %d 个", spooled, batches)
+	}
+
+	// 重试之前收到新的读数，新旧读数作为一个批次保存
+	if err := bridge.HandleMessage(topic, []byte(`{"temperature": 6}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewMQTTBridge(topics, 1, time.Minute, 500).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var batches []configs.TelemetryBatch
+	configs.DB.Where("device_id = ?", device.ID).Find(&batches)
+	var recorded int64
+	configs.DB.Model(&configs.BlockchainLog{}).Where("product_sku = ? AND record_type = ?", "SKU-1", events.RecordTelemetryBatchRecorded).Count(&recorded)
+	if spooled := testSpooled(t, device.ID); spooled != 0 || len(batches) != 1 || batches[0].ReadingCount != 3 || recorded != 1 {
+		t.Fatalf("暂存 %d 条读数，批次 %+v，账本中 %d 个批次", spooled, batches, recorded)
+	}
+}
+
+// 启动监听本机随机端口的MQTT服务端，返回连接地址
+func testMQTTBroker(t *testing.T) string {
+	t.Helper()
+	server := broker.New(&broker.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "tcp", Address: "127.0.0.1:0"})
+	if err := server.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return "tcp://" + tcp.Address()
+}
+
+// 通过真实的MQTT服务端发布读数，桥接断开期间的消息在重连后投递
+func TestMQTTBridgeBroker(t *testing.T) {
+	testDB(t)
+	factory := testUser(t, 1)
+	testProduct(t, "SKU-1", factory.ID)
+	device := testDevice(t, factory.ID)
+	configs.DB.Create(&configs.DeviceBinding{DeviceID: device.ID, ProductSKU: "SKU-1", BoundAt: time.Now().Add(-time.Hour)})
+
+	address := testMQTTBroker(t)
+	cfg := configs.MQTTConfig{
+		Broker:         address,
+		ClientID:       "cold-chain-bridge-test",
+		QoS:            1,
+		Topics:         []configs.MQTTTopic{{Filter: "coldchain/devices/+/telemetry", Serial: "{1}"}},
+		ConnectTimeout: 5 * time.Second,
+	}
+	connect := func() *MQTTBridge {
+		bridge := NewMQTTBridge(cfg.Topics, cfg.QoS, time.Minute, 500)
+		bridge.Connect(cfg)
+		testEventually(t, "桥接订阅", func() bool { return bridge.client.IsConnectionOpen() })
+		// 订阅在连接成功的回调中完成
+		time.Sleep(200 * time.Millisecond)
+		return bridge
+	}
+
+	publisher := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(address).SetClientID("reefer-test"))
+	if token := publisher.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("连接发布端失败: %v", token.Error())
+	}
+	defer publisher.Disconnect(100)
+	publish := func(payload string) {
+		token := publisher.Publish("coldchain/devices/"+device.SerialNo+"/telemetry", 1, false, payload)
+		if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+			t.Fatalf("发布失败: %v", token.Error())
+		}
+	}
+
+	bridge := connect()
+	publish(`{"temperature": 4}`)
+	publish(",5,60")
+	testEventually(t, "读数暂存", func() bool { return testSpooled(t, device.ID) == 2 })
+	if err := bridge.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if testBatches(t, device.ID) != 1 || testSpooled(t, device.ID) != 0 {
+		t.Fatalf("批次 %d 个，暂存 %d 条", testBatches(t, device.ID), testSpooled(t, device.ID))
+	}
+
+	// 桥接断开期间发布的消息保留在会话中，重连后收到
+	bridge.client.Disconnect(100)
+	publish(`[{"temperature": 6}, {"temperature": 7}, {"temperature": 8}]`)
+	bridge = connect()
+	defer bridge.client.Disconnect(100)
+	testEventually(t, "重连后收到读数", func() bool { return testSpooled(t, device.ID) == 3 })
+	if err := bridge.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var readings int64
+	configs.DB.Model(&configs.TelemetryBatch{}).Where("device_id = ?", device.ID).Select("COALESCE(SUM(reading_count), 0)").Scan(&readings)
+	if testBatches(t, device.ID) != 2 || readings != 5 {
+		t.Fatalf("批次 %d 个，读数 %d 条", testBatches(t, device.ID), readings)
+	}
+}
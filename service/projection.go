@@ -0,0 +1,744 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/api"
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 产品在流通中的阶段，由最近的物流或交接事件决定
+const (
+	StageCreated     = "created"
+	StageInTransit   = "in_transit"
+	StageTransferred = "transferred"
+)
+
+// 投影进度所在行
+const projectionStateID = 1
+
+// 每次重放的区块数量
+const projectionBatch = 500
+
+// 把一个区块的事件应用到产品投影上，物流更新事件返回对应的物流历史行
+// 无法解析的区块不影响状态，由对账报告
+func projectBlock(product *configs.ProductProjection, block configs.BlockchainLog, custody map[string]bool) *configs.LogisticsProjection {
+	event, err := decodeBlockEvent(block)
+	if err != nil {
+		return nil
+	}
+	product.EventCount++
+	product.LastEventType = event.EventType()
+	product.LastBlockHeight = block.BlockHeight
+	product.LastGlobalHeight = block.GlobalHeight
+	product.LastBlockHash = block.Hash
+
+	switch e := events.Latest(event).(type) {
+	case *events.ProductCreated:
+		// 产品修改后会重新写入产品创建事件，以最新的为准
+		product.ProductID = e.ProductID
+		product.Name = e.Name
+		product.BatchNumber = e.BatchNumber
+		product.ManufacturerID = e.ManufacturerID
+		product.Status = 1
+		if product.Stage == "" {
+			product.Stage = StageCreated
+		}
+		if product.CustodianID == 0 {
+			product.CustodianID = e.ManufacturerID
+			product.CustodySource = events.TypeProductCreated
+		}
+	case *events.LogisticsUpdated:
+		product.LogisticsCount++
+		product.Stage = StageInTransit
+		return &configs.LogisticsProjection{
+			ProductSKU:        block.ProductSKU,
+			RecordID:          e.RecordID,
+			TrackingNo:        e.TrackingNo,
+			WarehouseLocation: e.WarehouseLocation,
+			Temperature:       e.Temperature,
+			Humidity:          e.Humidity,
+			ImageURL:          e.ImageURL,
+			ImageSHA256:       e.ImageSHA256,
+			OperatorID:        e.OperatorID,
+			OperatorType:      e.OperatorType,
+			BlockHeight:       block.BlockHeight,
+			GlobalHeight:      block.GlobalHeight,
+			BlockHash:         block.Hash,
+			Timestamp:         block.Timestamp,
+		}
+	case *events.CustodyTransferred:
+		product.TransferCount++
+		product.TransferID = e.TransferID
+		product.CustodianID = e.ToUserID
+		product.CustodySource = events.TypeCustodyTransferred
+		product.Stage = StageTransferred
+	case *events.Custom:
+		if custody[e.Name] {
+			if to := customCustodian(e); to != 0 {
+				product.CustodianID = to
+				product.CustodySource = e.Name
+				product.Stage = StageTransferred
+			}
+		}
+	}
+	return nil
+}
+
+// 持有人改变后的持有人历史行
+func custodyRow(product configs.ProductProjection, block configs.BlockchainLog) configs.CustodyProjection {
+	return configs.CustodyProjection{
+		ProductSKU:   product.ProductSKU,
+		CustodianID:  product.CustodianID,
+		Source:       product.CustodySource,
+		BlockHeight:  block.BlockHeight,
+		GlobalHeight: block.GlobalHeight,
+		Timestamp:    blockTime(block),
+	}
+}
+
+// 产品的一段持有期，To 为空表示仍在持有
+type custodyPeriod struct {
+	CustodianID uint
+	From        time.Time
+	To          *time.Time
+}
+
+// 产品的持有历史，从持有人历史投影读取，投影尚未重放到的区块再按账本补上
+// 只重放投影之后的区块，不受投影同步延迟的影响
+func custodyHistory(db *gorm.DB, sku string) ([]custodyPeriod, error) {
+	var rows []configs.CustodyProjection
+	if err := db.Table(liveProjection.Custody).Where("product_sku = ?", sku).Order("id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	// 持有人历史与产品投影在同一事务中写入，产品投影的区块高度就是持有人历史的进度
+	product := configs.ProductProjection{ProductSKU: sku}
+	if err := db.Table(liveProjection.Products).Where("product_sku = ?", sku).Limit(1).Find(&product).Error; err != nil {
+		return nil, err
+	}
+
+	custody, err := custodyEventTypes(db)
+	if err != nil {
+		return nil, err
+	}
+	for after := product.LastBlockHeight; ; {
+		blocks, err := skuBlocksPage(db, sku, after, projectionBatch)
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range blocks {
+			holder := product.CustodianID
+			projectBlock(&product, block, custody)
+			if product.CustodianID != holder {
+				rows = append(rows, custodyRow(product, block))
+			}
+			after = block.BlockHeight
+		}
+		if len(blocks) < projectionBatch {
+			break
+		}
+	}
+
+	periods := make([]custodyPeriod, len(rows))
+	for i, row := range rows {
+		periods[i] = custodyPeriod{CustodianID: row.CustodianID, From: time.Unix(0, row.Timestamp)}
+		if i > 0 {
+			periods[i-1].To = &periods[i].From
+		}
+	}
+	return periods, nil
+}
+
+// Projector 按账本顺序重放事件，维护产品状态、持有人历史和物流历史投影
+// 投影只从账本计算，业务表损坏后可以用投影核对和恢复
+type Projector struct {
+	mu     sync.Mutex
+	notify chan struct{}
+}
+
+// 投影器，StartProjector 之前也可以手动同步和重建
+var projector = &Projector{notify: make(chan struct{}, 1)}
+
+// StartProjector 启动投影同步
+func StartProjector(ctx context.Context) *Projector {
+	go projector.Run(ctx)
+	return projector
+}
+
+// Notify 通知投影器有新区块
+func (p *Projector) Notify() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run 运行同步循环
+func (p *Projector) Run(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		if err := p.Sync(); err != nil {
+			log.Printf("同步账本投影失败: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.notify:
+		}
+	}
+}
+
+// Sync 把投影追赶到账本链头，从未完整重建过（或上次交换投影表中断）时先重建
+func (p *Projector) Sync() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var state configs.ProjectionState
+	if err := configs.DB.FirstOrCreate(&state, configs.ProjectionState{ID: projectionStateID}).Error; err != nil {
+		return err
+	}
+	if state.RebuiltAt == nil {
+		return p.rebuild()
+	}
+	return p.catchUp(&state, liveProjection)
+}
+
+// Rebuild 从账本重新生成投影表
+func (p *Projector) Rebuild() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rebuild()
+}
+
+// 投影所在的一组表
+type projectionTables struct {
+	Products  string
+	Logistics string
+	Custody   string
+}
+
+var (
+	// 对外查询的投影表
+	liveProjection = projectionTables{Products: "product_projections", Logistics: "logistics_projections", Custody: "custody_projections"}
+	// 重建时写入的影子表，完成后与投影表交换
+	shadowProjection = projectionTables{Products: "product_projections_rebuild", Logistics: "logistics_projections_rebuild", Custody: "custody_projections_rebuild"}
+	// 交换出来的旧投影表，交换后删除
+	retiredProjection = projectionTables{Products: "product_projections_old", Logistics: "logistics_projections_old", Custody: "custody_projections_old"}
+)
+
+// 在影子表中重放整个账本，完成后一次性换下投影表
+// 重建期间投影表和进度保持不变，查询和比对仍使用旧的投影
+func (p *Projector) rebuild() error {
+	migrator := configs.DB.Migrator()
+	for _, table := range []string{
+		shadowProjection.Products, shadowProjection.Logistics, shadowProjection.Custody,
+		retiredProjection.Products, retiredProjection.Logistics, retiredProjection.Custody,
+	} {
+		if err := migrator.DropTable(table); err != nil {
+			return err
+		}
+	}
+	// 按投影表的结构建影子表，索引名与投影表相同，交换后迁移不会重复建索引
+	if err := configs.DB.AutoMigrate(&configs.ProductProjection{}, &configs.LogisticsProjection{}, &configs.CustodyProjection{}); err != nil {
+		return err
+	}
+	for _, pair := range [][2]string{
+		{shadowProjection.Products, liveProjection.Products},
+		{shadowProjection.Logistics, liveProjection.Logistics},
+		{shadowProjection.Custody, liveProjection.Custody},
+	} {
+		if err := configs.DB.Exec(fmt.Sprintf("CREATE TABLE `%s` LIKE `%s`", pair[0], pair[1])).Error; err != nil {
+			return err
+		}
+	}
+
+	// 没有全局高度的旧版区块在全局账本之前写入，先按写入顺序重放
+	state := configs.ProjectionState{ID: projectionStateID}
+	custody, err := custodyEventTypes(configs.DB)
+	if err != nil {
+		return err
+	}
+	var legacy []configs.BlockchainLog
+	result := configs.DB.Where("global_height = 0").Order("id").
+		FindInBatches(&legacy, projectionBatch, func(tx *gorm.DB, _ int) error {
+			return applyProjection(legacy, custody, &state, shadowProjection)
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if err := p.catchUp(&state, shadowProjection); err != nil {
+		return err
+	}
+
+	// MySQL的DDL不能放进事务，交换前先清空重建时间，交换中途失败时下次同步会重新重建
+	if err := configs.DB.Model(&configs.ProjectionState{}).Where("id = ?", projectionStateID).
+		Update("rebuilt_at", nil).Error; err != nil {
+		return err
+	}
+	// 一条 RENAME TABLE 语句同时交换全部投影表，查询看不到交换的中间状态
+	err = configs.DB.Exec(fmt.Sprintf("RENAME TABLE `%s` TO `%s`, `%s` TO `%s`, `%s` TO `%s`, `%s` TO `%s`, `%s` TO `%s`, `%s` TO `%s`",
+		liveProjection.Products, retiredProjection.Products,
+		shadowProjection.Products, liveProjection.Products,
+		liveProjection.Logistics, retiredProjection.Logistics,
+		shadowProjection.Logistics, liveProjection.Logistics,
+		liveProjection.Custody, retiredProjection.Custody,
+		shadowProjection.Custody, liveProjection.Custody,
+	)).Error
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	state.RebuiltAt = &now
+	if err := configs.DB.Save(&state).Error; err != nil {
+		return err
+	}
+	return migrator.DropTable(retiredProjection.Products, retiredProjection.Logistics, retiredProjection.Custody)
+}
+
+// 从投影进度之后按全局高度重放，已归档的区块从冷存储读取
+func (p *Projector) catchUp(state *configs.ProjectionState, tables projectionTables) error {
+	ledger := NewGormLedger(configs.DB)
+	head, err := ledger.Head("")
+	if errors.Is(err, ErrBlockNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if head.GlobalHeight <= state.GlobalHeight {
+		return nil
+	}
+
+	custody, err := custodyEventTypes(configs.DB)
+	if err != nil {
+		return err
+	}
+	for from := state.GlobalHeight + 1; from <= head.GlobalHeight; from += projectionBatch {
+		to := from + projectionBatch - 1
+		if to > head.GlobalHeight {
+			to = head.GlobalHeight
+		}
+		blocks, err := ledger.Range(from, to)
+		if err != nil {
+			return err
+		}
+		if int64(len(blocks)) != to-from+1 {
+			return fmt.Errorf("全局高度 %d-%d 的区块不完整", from, to)
+		}
+		if err := applyProjection(blocks, custody, state, tables); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 在一个事务中应用一批区块，写入投影表时同时保存进度
+// 写入影子表时进度只保存在内存中，交换表之后才保存
+func applyProjection(blocks []configs.BlockchainLog, custody map[string]bool, state *configs.ProjectionState, tables projectionTables) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	return configs.DB.Transaction(func(tx *gorm.DB) error {
+		var skus []string
+		seen := make(map[string]bool)
+		for _, block := range blocks {
+			if !seen[block.ProductSKU] {
+				seen[block.ProductSKU] = true
+				skus = append(skus, block.ProductSKU)
+			}
+		}
+
+		var existing []configs.ProductProjection
+		if err := tx.Table(tables.Products).Where("product_sku IN ?", skus).Find(&existing).Error; err != nil {
+			return err
+		}
+		products := make(map[string]*configs.ProductProjection, len(skus))
+		for i := range existing {
+			products[existing[i].ProductSKU] = &existing[i]
+		}
+
+		var logistics []configs.LogisticsProjection
+		var custodians []configs.CustodyProjection
+		for _, block := range blocks {
+			if block.GlobalHeight > state.GlobalHeight {
+				state.GlobalHeight = block.GlobalHeight
+			}
+			// 签名密钥链不属于任何产品
+			if block.ProductSKU == SigningKeySKU {
+				continue
+			}
+			product, ok := products[block.ProductSKU]
+			if !ok {
+				product = &configs.ProductProjection{ProductSKU: block.ProductSKU}
+				products[block.ProductSKU] = product
+			}
+			holder := product.CustodianID
+			if row := projectBlock(product, block, custody); row != nil {
+				logistics = append(logistics, *row)
+			}
+			if product.CustodianID != holder {
+				custodians = append(custodians, custodyRow(*product, block))
+			}
+		}
+
+		for _, sku := range skus {
+			if products[sku] == nil {
+				continue
+			}
+			if err := tx.Table(tables.Products).Save(products[sku]).Error; err != nil {
+				return err
+			}
+		}
+		if len(logistics) > 0 {
+			if err := tx.Table(tables.Logistics).CreateInBatches(logistics, 100).Error; err != nil {
+				return err
+			}
+		}
+		if len(custodians) > 0 {
+			if err := tx.Table(tables.Custody).Create(&custodians).Error; err != nil {
+				return err
+			}
+		}
+		if tables != liveProjection {
+			return nil
+		}
+		return tx.Save(state).Error
+	})
+}
+
+// 投影与业务表差异的类型
+const (
+	DriftMissing  = "missing"  // 业务表中有记录，账本投影中没有
+	DriftExtra    = "extra"    // 账本投影中有记录，业务表中没有
+	DriftMismatch = "mismatch" // 字段值不一致
+)
+
+// DriftFinding 投影与业务表的单个差异
+type DriftFinding struct {
+	Kind           string      `json:"kind"`
+	Table          string      `json:"table"`
+	ProductSKU     string      `json:"product_sku"`
+	RowID          uint        `json:"row_id,omitempty"`
+	Field          string      `json:"field,omitempty"`
+	ProjectedValue interface{} `json:"projected_value,omitempty"`
+	LiveValue      interface{} `json:"live_value,omitempty"`
+}
+
+// DriftReport 投影与业务表的比对结果
+type DriftReport struct {
+	CheckedAt        time.Time      `json:"checked_at"`
+	GlobalHeight     int64          `json:"global_height"` // 投影已重放到的全局高度
+	ProductsChecked  int            `json:"products_checked"`
+	LogisticsChecked int            `json:"logistics_checked"`
+	Missing          int            `json:"missing"`
+	Extra            int            `json:"extra"`
+	Mismatches       int            `json:"mismatches"`
+	Findings         []DriftFinding `json:"findings"`
+}
+
+func (r *DriftReport) add(f DriftFinding) {
+	switch f.Kind {
+	case DriftMissing:
+		r.Missing++
+	case DriftExtra:
+		r.Extra++
+	case DriftMismatch:
+		r.Mismatches++
+	}
+	r.Findings = append(r.Findings, f)
+}
+
+// 比较字段，不一致时记录差异
+func (r *DriftReport) compare(table, sku string, id uint, field string, projected, live interface{}) {
+	if projected != live {
+		r.add(DriftFinding{
+			Kind:           DriftMismatch,
+			Table:          table,
+			ProductSKU:     sku,
+			RowID:          id,
+			Field:          field,
+			ProjectedValue: projected,
+			LiveValue:      live,
+		})
+	}
+}
+
+// CheckProjectionDrift 先把投影同步到链头，再与产品、交接和物流业务表比对
+func CheckProjectionDrift() (*DriftReport, error) {
+	if err := projector.Sync(); err != nil {
+		return nil, err
+	}
+
+	report := &DriftReport{CheckedAt: time.Now(), Findings: []DriftFinding{}}
+	var state configs.ProjectionState
+	if err := configs.DB.First(&state, projectionStateID).Error; err != nil {
+		return nil, err
+	}
+	report.GlobalHeight = state.GlobalHeight
+
+	if err := checkProductDrift(report); err != nil {
+		return nil, err
+	}
+	if err := checkLogisticsDrift(report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// 比对产品状态和当前持有人
+func checkProductDrift(report *DriftReport) error {
+	var batch []configs.ProductProjection
+	result := configs.DB.FindInBatches(&batch, projectionBatch, func(tx *gorm.DB, _ int) error {
+		skus := make([]string, len(batch))
+		for i, product := range batch {
+			skus[i] = product.ProductSKU
+		}
+
+		var live []configs.ProductInfo
+		if err := configs.DB.Where("sku IN ?", skus).Find(&live).Error; err != nil {
+			return err
+		}
+		products := make(map[string]configs.ProductInfo, len(live))
+		for _, product := range live {
+			products[product.SKU] = product
+		}
+
+		// 每个SKU最近一次已确认的交接
+		var transfers []configs.TransferRecord
+		if err := configs.DB.Where("product_sku IN ? AND status = 1", skus).Order("id").Find(&transfers).Error; err != nil {
+			return err
+		}
+		lastTransfer := make(map[string]configs.TransferRecord)
+		transferCount := make(map[string]int)
+		for _, transfer := range transfers {
+			lastTransfer[transfer.ProductSKU] = transfer
+			transferCount[transfer.ProductSKU]++
+		}
+
+		for _, projected := range batch {
+			report.ProductsChecked++
+			product, ok := products[projected.ProductSKU]
+			if !ok {
+				report.add(DriftFinding{
+					Kind:       DriftExtra,
+					Table:      "product_infos",
+					ProductSKU: projected.ProductSKU,
+					RowID:      projected.ProductID,
+				})
+				continue
+			}
+			report.compare("product_infos", product.SKU, product.ID, "product_id", projected.ProductID, product.ID)
+			report.compare("product_infos", product.SKU, product.ID, "name", projected.Name, product.Name)
+			report.compare("product_infos", product.SKU, product.ID, "batch_number", projected.BatchNumber, product.BatchNumber)
+			report.compare("product_infos", product.SKU, product.ID, "manufacturer_id", projected.ManufacturerID, product.ManufacturerID)
+			report.compare("product_infos", product.SKU, product.ID, "status", projected.Status, product.Status)
+
+			// 自定义事件改变的持有人没有对应的交接记录，不比对
+			switch projected.CustodySource {
+			case events.TypeProductCreated, events.TypeCustodyTransferred:
+				custodian, transferID := product.ManufacturerID, uint(0)
+				if transfer, ok := lastTransfer[product.SKU]; ok {
+					custodian, transferID = transfer.ToUserID, transfer.ID
+				}
+				report.compare("transfer_records", product.SKU, transferID, "custodian_id", projected.CustodianID, custodian)
+				report.compare("transfer_records", product.SKU, transferID, "transfer_count", projected.TransferCount, transferCount[product.SKU])
+			}
+		}
+		return nil
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	// 已发布但账本中没有事件的产品
+	var missing []configs.ProductInfo
+	result = configs.DB.Where("status = 1 AND sku NOT IN (?)", configs.DB.Model(&configs.ProductProjection{}).Select("product_sku")).
+		Find(&missing)
+	if result.Error != nil {
+		return result.Error
+	}
+	for _, product := range missing {
+		report.add(DriftFinding{
+			Kind:       DriftMissing,
+			Table:      "product_infos",
+			ProductSKU: product.SKU,
+			RowID:      product.ID,
+		})
+	}
+	return nil
+}
+
+// 比对物流历史
+func checkLogisticsDrift(report *DriftReport) error {
+	var batch []configs.LogisticsProjection
+	result := configs.DB.FindInBatches(&batch, projectionBatch, func(tx *gorm.DB, _ int) error {
+		ids := make([]uint, len(batch))
+		for i, row := range batch {
+			ids[i] = row.RecordID
+		}
+
+		var live []configs.LogisticsRecord
+		if err := configs.DB.Where("id IN ?", ids).Find(&live).Error; err != nil {
+			return err
+		}
+		records := make(map[uint]configs.LogisticsRecord, len(live))
+		for _, record := range live {
+			records[record.ID] = record
+		}
+
+		for _, projected := range batch {
+			report.LogisticsChecked++
+			record, ok := records[projected.RecordID]
+			if !ok {
+				report.add(DriftFinding{
+					Kind:       DriftExtra,
+					Table:      "logistics_records",
+					ProductSKU: projected.ProductSKU,
+					RowID:      projected.RecordID,
+				})
+				continue
+			}
+			report.compare("logistics_records", record.ProductSKU, record.ID, "product_sku", projected.ProductSKU, record.ProductSKU)
+			report.compare("logistics_records", record.ProductSKU, record.ID, "tracking_no", projected.TrackingNo, record.TrackingNo)
+			report.compare("logistics_records", record.ProductSKU, record.ID, "warehouse_location", projected.WarehouseLocation, record.WarehouseLocation)
+			report.compare("logistics_records", record.ProductSKU, record.ID, "temperature", projected.Temperature, record.Temperature)
+			report.compare("logistics_records", record.ProductSKU, record.ID, "humidity", projected.Humidity, record.Humidity)
+			report.compare("logistics_records", record.ProductSKU, record.ID, "image_sha256", projected.ImageSHA256, record.ImageSHA256)
+			report.compare("logistics_records", record.ProductSKU, record.ID, "operator_id", projected.OperatorID, record.OperatorID)
+		}
+		return nil
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	var missing []configs.LogisticsRecord
+	result = configs.DB.Where("id NOT IN (?)", configs.DB.Model(&configs.LogisticsProjection{}).Select("record_id")).
+		Find(&missing)
+	if result.Error != nil {
+		return result.Error
+	}
+	for _, record := range missing {
+		report.add(DriftFinding{
+			Kind:       DriftMissing,
+			Table:      "logistics_records",
+			ProductSKU: record.ProductSKU,
+			RowID:      record.ID,
+		})
+	}
+	return nil
+}
+
+// GetProductState 获取由账本重放得到的产品当前状态和物流历史
+func (s *BlockchainService) GetProductState(c *gin.Context) {
+	productSKU := c.Query("sku")
+	if productSKU == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "请提供产品SKU",
+		})
+		return
+	}
+
+	var product configs.ProductProjection
+	result := configs.DB.Where("product_sku = ?", productSKU).First(&product)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "未找到产品状态",
+		})
+		return
+	}
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "查询产品状态失败",
+		})
+		return
+	}
+
+	var logistics []configs.LogisticsProjection
+	result = configs.DB.Where("product_sku = ?", productSKU).Order("block_height").Find(&logistics)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "查询物流历史失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "获取产品状态成功",
+		"data": gin.H{
+			"product":   product,
+			"logistics": logistics,
+		},
+	})
+}
+
+// AdminRebuildProjections 从账本重新生成投影表，并与业务表比对
+func (s *AdminService) AdminRebuildProjections(c *gin.Context) {
+	started := time.Now()
+	if err := projector.Rebuild(); err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "重建投影失败: " + err.Error(),
+		})
+		return
+	}
+	elapsed := time.Since(started)
+
+	report, err := CheckProjectionDrift()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "比对投影失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "重建投影成功",
+		Data: gin.H{
+			"elapsed_ms": elapsed.Milliseconds(),
+			"drift":      report,
+		},
+	})
+}
+
+// AdminProjectionDrift 比对投影与业务表，发现业务表被改动或损坏的记录
+func (s *AdminService) AdminProjectionDrift(c *gin.Context) {
+	report, err := CheckProjectionDrift()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "比对投影失败: " + err.Error(),
+		})
+		return
+	}
+
+	message := "投影与业务表一致"
+	if len(report.Findings) > 0 {
+		message = "投影与业务表不一致"
+	}
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: message,
+		Data:    report,
+	})
+}
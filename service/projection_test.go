@@ -0,0 +1,174 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
+	"errors"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+// 写入产品创建、物流和交接事件，返回产品投影应有的持有人
+// 全局高度1是签名者首次签名时写入的密钥登记区块
+func testProjectionLedger(t *testing.T) (configs.User, configs.User) {
+	t.Helper()
+	testDB(t)
+	factory, saler, admin := testUser(t, 1), testUser(t, 2), testUser(t, 4)
+	product := testProduct(t, "SKU-1", factory.ID)
+
+	record := configs.LogisticsRecord{ProductSKU: "SKU-1", TrackingNo: "T1", WarehouseLocation: "一号仓", Temperature: 4, Humidity: 60, OperatorID: factory.ID, OperatorType: 1}
+	record.ID = 1
+	transfer := configs.TransferRecord{ProductSKU: "SKU-1", FromUserID: factory.ID, ToUserID: saler.ID}
+	transfer.ID = 1
+	for _, event := range []events.Event{
+		productCreatedEvent(product, admin.ID),
+		logisticsUpdatedEvent(record),
+		custodyTransferredEvent(transfer),
+	} {
+		data, err := events.Marshal(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := (&BlockchainService{}).AddToBlockchain("SKU-1", event.RecordType(), string(data), factory.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return factory, saler
+}
+
+// 当前投影表中的产品和物流历史行数
+func testProjectionRows(t *testing.T) (configs.ProductProjection, int64) {
+	t.Helper()
+	var product configs.ProductProjection
+	if err := configs.DB.Where("product_sku = ?", "SKU-1").First(&product).Error; err != nil {
+		t.Fatal(err)
+	}
+	var logistics int64
+	configs.DB.Model(&configs.LogisticsProjection{}).Count(&logistics)
+	return product, logistics
+}
+
+func TestProjectorRebuild(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func(t *testing.T)
+		wantErr bool
+	}{
+		{name: "重建结果与同步一致"},
+		{
+			// 账本缺少区块时重建失败，投影表和进度保持重建前的状态
+			name: "重建中途失败",
+			tamper: func(t *testing.T) {
+				configs.DB.Unscoped().Where("global_height = ?", 3).Delete(&configs.BlockchainLog{})
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, saler := testProjectionLedger(t)
+			if err := projector.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			var before configs.ProjectionState
+			configs.DB.First(&before, projectionStateID)
+			if before.RebuiltAt == nil || before.GlobalHeight != 4 {
+				t.Fatalf("首次同步的进度 %+v", before)
+			}
+
+			if tt.tamper != nil {
+				tt.tamper(t)
+			}
+			err := projector.Rebuild()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("重建结果 %v", err)
+			}
+
+			product, logistics := testProjectionRows(t)
+			if product.CustodianID != saler.ID || product.Stage != StageTransferred || product.EventCount != 3 || logistics != 1 {
+				t.Fatalf("投影 %+v，物流历史 %d 行", product, logistics)
+			}
+			var after configs.ProjectionState
+			configs.DB.First(&after, projectionStateID)
+			if after.GlobalHeight != 4 || after.RebuiltAt == nil || (tt.wantErr && !after.RebuiltAt.Equal(*before.RebuiltAt)) {
+				t.Fatalf("重建后的进度 %+v", after)
+			}
+
+			// 成功重建后不留下影子表和旧投影表
+			migrator := configs.DB.Migrator()
+			for _, table := range []string{shadowProjection.Products, shadowProjection.Logistics, shadowProjection.Custody, retiredProjection.Products, retiredProjection.Logistics, retiredProjection.Custody} {
+				if !tt.wantErr && migrator.HasTable(table) {
+					t.Fatalf("没有删除 %s", table)
+				}
+			}
+		})
+	}
+}
+
+func TestProjectorResumesInterruptedSwap(t *testing.T) {
+	testProjectionLedger(t)
+	if err := projector.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 交换投影表前会清空重建时间，交换中断后下次同步重新重建
+	configs.DB.Model(&configs.ProjectionState{}).Where("id = ?", projectionStateID).Update("rebuilt_at", nil)
+	configs.DB.Where("1 = 1").Delete(&configs.LogisticsProjection{})
+	if err := projector.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, logistics := testProjectionRows(t); logistics != 1 {
+		t.Fatalf("物流历史 %d 行", logistics)
+	}
+}
+
+// 业务记录和区块提交之后才通知投影器，回滚的区块不会触发同步
+func TestLedgerTransactionNotifiesAfterCommit(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		notify bool
+	}{
+		{name: "提交后通知", notify: true},
+		{name: "回滚不通知", err: errors.New("业务记录写入失败")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDB(t)
+			user := testUser(t, 1)
+			select {
+			case <-projector.notify:
+			default:
+			}
+
+			err := ledgerTransaction(func(tx *gorm.DB) error {
+				if _, err := (&BlockchainService{}).AddToBlockchainTx(tx, "SKU-1", 1, `{"n":1}`, user.ID); err != nil {
+					return err
+				}
+				select {
+				case <-projector.notify:
+					t.Error("事务提交前通知了投影器")
+				case <-time.After(10 * time.Millisecond):
+				}
+				return tt.err
+			})
+			if !errors.Is(err, tt.err) {
+				t.Fatal(err)
+			}
+
+			select {
+			case <-projector.notify:
+				if !tt.notify {
+					t.Fatal("事务回滚后通知了投影器")
+				}
+			default:
+				if tt.notify {
+					t.Fatal("事务提交后没有通知投影器")
+				}
+			}
+		})
+	}
+}
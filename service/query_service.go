@@ -3,14 +3,19 @@ package service
 import (
 	"back_Blockchain_cold_chain_traceability_system/api"
 	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
+	"database/sql"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // QueryService 实现查询相关功能
 type QueryService struct{}
 
 // TraceProduct 追溯产品信息
+// 提供 as_of 时返回该时刻的产品状态，从账本重放得到，例如 as_of=2024-03-03T14:00:00+08:00
 func (s *QueryService) TraceProduct(c *gin.Context) {
 	sku := c.Query("sku")
 	if sku == "" {
@@ -21,6 +26,19 @@ func (s *QueryService) TraceProduct(c *gin.Context) {
 		return
 	}
 
+	if value := c.Query("as_of"); value != "" {
+		asOf, err := parseAsOf(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, api.Response{
+				Code:    400,
+				Message: "as_of 参数错误，应为RFC 3339时间、2006-01-02 15:04:05 或Unix秒",
+			})
+			return
+		}
+		s.traceAsOf(c, sku, asOf)
+		return
+	}
+
 	// 查询产品基本信息
 	var product configs.ProductInfo
 	result := configs.DB.Where("sku = ? AND status = 1", sku).First(&product)
@@ -54,16 +72,42 @@ func (s *QueryService) TraceProduct(c *gin.Context) {
 		return
 	}
 
-	// 查询区块链记录
-	var blockchain []configs.BlockchainLog
-	result = configs.DB.Where("product_sku = ?", sku).
-		Order("created_at").
-		Find(&blockchain)
+	// 查询区块链记录，包括已归档的区块
+	blockchain, err := skuBlocks(configs.DB, sku)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "查询区块链记录失败: " + err.Error(),
+		})
+		return
+	}
 
-	if result.Error != nil {
+	// 按产品的温湿度要求计算合规状态
+	compliance, err := complianceOf(configs.DB, sku, blockchain)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, api.Response{
 			Code:    500,
-			Message: "查询区块链记录失败: " + result.Error.Error(),
+			Message: "查询超温记录失败: " + err.Error(),
+		})
+		return
+	}
+
+	// 读取按温度历史计算的动态保质期
+	shelfLife, err := shelfLifeOf(configs.DB, sku)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "查询保质期失败: " + err.Error(),
+		})
+		return
+	}
+
+	// 查询外部链锚定证明
+	anchors, err := anchorProofsFor(sku)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "查询锚定证明失败: " + err.Error(),
 		})
 		return
 	}
@@ -98,6 +142,7 @@ func (s *QueryService) TraceProduct(c *gin.Context) {
 			"specification":     product.Specification,
 			"production_date":   product.ProductionDate.Format("2006-01-02"),
 			"expiration_date":   product.ExpirationDate.Format("2006-01-02"),
+			"effective_expiry":  shelfLife.EffectiveExpiry,
 			"batch_number":      product.BatchNumber,
 			"material_source":   product.MaterialSource,
 			"process_location":  product.ProcessLocation,
@@ -107,11 +152,302 @@ func (s *QueryService) TraceProduct(c *gin.Context) {
 			"safety_testing":    product.SafetyTesting,
 			"quality_rating":    product.QualityRating,
 			"image_url":         product.ImageURL,
+			"image_sha256":      product.ImageSHA256,
 			"manufacturer":      manufacturer,
 		},
 		"logistics":  logistics,
 		"transfers":  transfers,
-		"blockchain": blockchain,
+		"blockchain": withEvents(blockchain),
+		"anchors":    anchors,
+		"compliance": compliance,
+		"shelf_life": shelfLife,
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "获取产品溯源信息成功",
+		Data:    traceInfo,
+	})
+}
+
+// 解析 as_of 参数，支持RFC 3339时间、本地时间 2006-01-02 15:04:05 和Unix秒
+func parseAsOf(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04:05", value, time.Local); err == nil {
+		return t, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// 区块的写入时间(Unix纳秒)，尚未迁移的旧版区块没有时间戳，使用创建时间
+func blockTime(block configs.BlockchainLog) int64 {
+	if block.Timestamp != 0 {
+		return block.Timestamp
+	}
+	return block.CreatedAt.UnixNano()
+}
+
+// 某一时刻的全局链头，即区块时间都不晚于该时刻的最长前缀的最后一个区块，没有更早的区块时返回 ErrBlockNotFound
+// 区块时间是写入节点的时钟，切换Raft领导者后可能回退，不保证随全局高度递增，因此不能按区块时间二分查找
+// 找到第一个晚于该时刻的区块，取它之前的区块：冷存储按内存中单调的索引查找，MySQL中的区块由数据库查找
+func globalHeadAt(at int64) (*configs.BlockchainLog, error) {
+	ledger := NewGormLedger(configs.DB)
+	head, err := ledger.Head("")
+	if err != nil {
+		return nil, err
+	}
+
+	var first int64
+	if archivedHeight() > 0 {
+		first = ledgerArchive.FirstAfter(at)
+	}
+	if first == 0 {
+		var found sql.NullInt64
+		result := configs.DB.Model(&configs.BlockchainLog{}).
+			Where("global_height > ?", archivedHeight()).
+			Where("timestamp > ? OR (timestamp = 0 AND created_at > ?)", at, time.Unix(0, at)).
+			Select("MIN(global_height)").
+			Scan(&found)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		first = found.Int64
+	}
+
+	switch first {
+	case 0:
+		return head, nil
+	case 1:
+		return nil, ErrBlockNotFound
+	}
+	return ledger.Get(first - 1)
+}
+
+// 按账本重放到 asOf 为止的事件，返回该时刻的产品信息、持有人、物流、交接记录和温湿度曲线
+func (s *QueryService) traceAsOf(c *gin.Context, sku string, asOf time.Time) {
+	blocks, err := skuBlocks(configs.DB, sku)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "查询区块链记录失败: " + err.Error(),
+		})
+		return
+	}
+	custody, err := custodyEventTypes(configs.DB)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "查询事件类型失败: " + err.Error(),
+		})
+		return
+	}
+
+	at := asOf.UnixNano()
+	var included []configs.BlockchainLog
+	for _, block := range blocks {
+		if blockTime(block) <= at {
+			included = append(included, block)
+		}
+	}
+	if len(included) == 0 {
+		c.JSON(http.StatusNotFound, api.Response{
+			Code:    404,
+			Message: "该时间点产品尚未上链",
+		})
+		return
+	}
+
+	state := configs.ProductProjection{ProductSKU: sku}
+	var created *events.ProductCreated
+	var logistics []configs.LogisticsProjection
+	var transfers []*events.CustodyTransferred
+	excursions := []*events.TemperatureExcursion{}
+	// 各设备截至 as_of 已写入账本的最晚读数时间
+	recordedUntil := make(map[string]time.Time)
+	for _, block := range included {
+		if row := projectBlock(&state, block, custody); row != nil {
+			logistics = append(logistics, *row)
+		}
+		event, err := decodeBlockEvent(block)
+		if err != nil {
+			continue
+		}
+		switch e := events.Latest(event).(type) {
+		case *events.ProductCreated:
+			created = e
+		case *events.CustodyTransferred:
+			transfers = append(transfers, e)
+		case *events.TelemetryBatchRecorded:
+			if last := time.Unix(0, e.LastAt); last.After(recordedUntil[e.DeviceSerial]) {
+				recordedUntil[e.DeviceSerial] = last
+			}
+		case *events.TemperatureExcursion:
+			// 同一超温记录只保留最后写入的事件，已撤销的超温不再列出
+			replaced := false
+			kept := excursions[:0]
+			for _, excursion := range excursions {
+				if excursion.IncidentID == e.IncidentID {
+					replaced = true
+					if e.Phase == events.ExcursionPhaseRetracted {
+						continue
+					}
+					excursion = e
+				}
+				kept = append(kept, excursion)
+			}
+			excursions = kept
+			if !replaced && e.Phase != events.ExcursionPhaseRetracted {
+				excursions = append(excursions, e)
+			}
+		}
+	}
+	if created == nil {
+		c.JSON(http.StatusNotFound, api.Response{
+			Code:    404,
+			Message: "该时间点产品尚未上链",
+		})
+		return
+	}
+
+	// 绑定设备截至 as_of 的温湿度曲线，只包含当时已写入账本的批次覆盖的读数
+	bindings, err := skuBindings(configs.DB, sku)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "查询设备绑定失败: " + err.Error(),
+		})
+		return
+	}
+	serials := bindingSerials(configs.DB, bindings)
+	telemetry := []telemetrySeries{}
+	for _, binding := range bindings {
+		if binding.BoundAt.After(asOf) {
+			continue
+		}
+		series := telemetrySeries{
+			DeviceID:  binding.DeviceID,
+			SerialNo:  serials[binding.DeviceID],
+			BoundAt:   binding.BoundAt,
+			UnboundAt: binding.UnboundAt,
+			Points:    []TelemetryPoint{},
+		}
+		end := asOf
+		if binding.UnboundAt != nil && binding.UnboundAt.Before(end) {
+			end = *binding.UnboundAt
+		} else {
+			// 在 as_of 时仍处于绑定状态
+			series.UnboundAt = nil
+		}
+		if recorded := recordedUntil[series.SerialNo]; recorded.Before(end) {
+			end = recorded
+		}
+		if !end.Before(binding.BoundAt) {
+			points, err := telemetryStore.Range(binding.DeviceID, binding.BoundAt, end, autoResolution(binding.BoundAt, end))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, api.Response{
+					Code:    500,
+					Message: "查询读数失败: " + err.Error(),
+				})
+				return
+			}
+			series.Points = points
+		}
+		telemetry = append(telemetry, series)
+	}
+
+	// 查询涉及的用户
+	ids := []uint{created.ManufacturerID, state.CustodianID}
+	for _, row := range logistics {
+		ids = append(ids, row.OperatorID)
+	}
+	for _, transfer := range transfers {
+		ids = append(ids, transfer.FromUserID, transfer.ToUserID)
+	}
+	var users []configs.User
+	configs.DB.Select("id, real_name, company_name, address, contact").Where("id IN ?", ids).Find(&users)
+	usersByID := make(map[uint]configs.User, len(users))
+	for _, user := range users {
+		usersByID[user.ID] = user
+	}
+
+	logisticsList := make([]gin.H, 0, len(logistics))
+	for _, row := range logistics {
+		logisticsList = append(logisticsList, gin.H{
+			"record_id":          row.RecordID,
+			"tracking_no":        row.TrackingNo,
+			"warehouse_location": row.WarehouseLocation,
+			"temperature":        row.Temperature,
+			"humidity":           row.Humidity,
+			"image_url":          row.ImageURL,
+			"image_sha256":       row.ImageSHA256,
+			"operator_id":        row.OperatorID,
+			"operator_name":      usersByID[row.OperatorID].RealName,
+			"operator_type":      row.OperatorType,
+			"block_height":       row.BlockHeight,
+			"timestamp":          row.Timestamp,
+		})
+	}
+	transferList := make([]gin.H, 0, len(transfers))
+	for _, transfer := range transfers {
+		transferList = append(transferList, gin.H{
+			"transfer_id":    transfer.TransferID,
+			"from_user_id":   transfer.FromUserID,
+			"from_user_name": usersByID[transfer.FromUserID].RealName,
+			"to_user_id":     transfer.ToUserID,
+			"to_user_name":   usersByID[transfer.ToUserID].RealName,
+			"remarks":        transfer.Remarks,
+		})
+	}
+
+	head := included[len(included)-1]
+	chainHead := gin.H{
+		"block_height": head.BlockHeight,
+		"hash":         head.Hash,
+	}
+	if global, err := globalHeadAt(at); err == nil {
+		chainHead["global_height"] = global.GlobalHeight
+		chainHead["global_hash"] = global.Hash
+	}
+
+	traceInfo := gin.H{
+		"as_of": asOf,
+		// 支撑本次结果的最后一个区块，之后的区块都晚于 as_of
+		"block_height":  head.BlockHeight,
+		"global_height": head.GlobalHeight,
+		"block_hash":    head.Hash,
+		"product": gin.H{
+			"sku":               created.SKU,
+			"name":              created.Name,
+			"brand":             created.Brand,
+			"specification":     created.Specification,
+			"production_date":   created.ProductionDate,
+			"expiration_date":   created.ExpirationDate,
+			"batch_number":      created.BatchNumber,
+			"material_source":   created.MaterialSource,
+			"process_location":  created.ProcessLocation,
+			"process_method":    created.ProcessMethod,
+			"transport_temp":    created.TransportTemp,
+			"storage_condition": created.StorageCondition,
+			"safety_testing":    created.SafetyTesting,
+			"quality_rating":    created.QualityRating,
+			"image_url":         created.ImageURL,
+			"image_sha256":      created.ImageSHA256,
+			"manufacturer":      usersByID[created.ManufacturerID],
+			"stage":             state.Stage,
+		},
+		"custodian":  usersByID[state.CustodianID],
+		"logistics":  logisticsList,
+		"transfers":  transferList,
+		"excursions": excursions,
+		"telemetry":  telemetry,
+		"chain_head": chainHead,
+		"blockchain": withEvents(included),
 	}
 
 	c.JSON(http.StatusOK, api.Response{
@@ -145,6 +481,7 @@ func (s *QueryService) VerifyProduct(c *gin.Context) {
 		})
 		return
 	}
+	blockchainCount += archivedSKUCount(sku)
 
 	// 查询产品是否存在
 	var productCount int64
@@ -184,12 +521,36 @@ func (s *QueryService) VerifyProduct(c *gin.Context) {
 		return
 	}
 
+	// 正品同时返回温湿度合规状态
+	blocks, err := skuBlocks(configs.DB, sku)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "验证产品失败: " + err.Error(),
+		})
+		return
+	}
+	compliance, err := complianceOf(configs.DB, sku, blocks)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "验证产品失败: " + err.Error(),
+		})
+		return
+	}
+
+	message := "产品验证通过，是正品"
+	if compliance.Status == ComplianceNonCompliant {
+		message = "产品验证通过，是正品，但运输或仓储过程中温湿度超出要求"
+	}
 	c.JSON(http.StatusOK, api.Response{
 		Code:    200,
 		Message: "验证完成",
 		Data: gin.H{
-			"authentic": true,
-			"message":   "产品验证通过，是正品",
+			"authentic":         true,
+			"message":           message,
+			"compliance_status": compliance.Status,
+			"compliance":        compliance,
 		},
 	})
 }
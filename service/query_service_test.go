@@ -0,0 +1,174 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestGlobalHeadAt(t *testing.T) {
+	// 前4个区块归档到冷存储，后2个留在MySQL中
+	user, record := testArchiveLedger(t, 4)
+	if _, err := ArchiveSnapshot(record.ID); err != nil {
+		t.Fatal(err)
+	}
+	for i := 4; i < 6; i++ {
+		if _, err := (&BlockchainService{}).AddToBlockchain("SKU-1", 1, fmt.Sprintf(`{"n":%d}`, i), user.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blocks, err := NewGormLedger(configs.DB).Range(1, 6)
+	if err != nil || len(blocks) != 6 {
+		t.Fatalf("读取区块 %d 个: %v", len(blocks), err)
+	}
+	at := func(height int64) int64 { return blocks[height-1].Timestamp }
+
+	tests := []struct {
+		name string
+		at   int64
+		want int64 // 0 表示没有更早的区块
+	}{
+		{name: "早于第一个区块", at: at(1) - 1},
+		{name: "第一个区块", at: at(1), want: 1},
+		{name: "归档区块之间", at: at(3) - 1, want: 2},
+		{name: "最后一个归档区块", at: at(4), want: 4},
+		{name: "归档与MySQL之间", at: at(5) - 1, want: 4},
+		{name: "MySQL中的区块", at: at(5), want: 5},
+		{name: "晚于链头", at: at(6) + 1, want: 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head, err := globalHeadAt(tt.at)
+			if tt.want == 0 {
+				if !errors.Is(err, ErrBlockNotFound) {
+					t.Fatalf("应返回 ErrBlockNotFound，得到 %+v %v", head, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if head.GlobalHeight != tt.want || head.Hash != blocks[tt.want-1].Hash {
+				t.Fatalf("链头高度 %d，期望 %d", head.GlobalHeight, tt.want)
+			}
+		})
+	}
+
+	// 空账本没有链头
+	testDB(t)
+	if _, err := globalHeadAt(at(6)); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("空账本 %v", err)
+	}
+}
+
+func TestGlobalHeadAtClockSkew(t *testing.T) {
+	testDB(t)
+	testServerKey(t)
+	user := testUser(t, 1)
+	for i := 0; i < 4; i++ {
+		if _, err := (&BlockchainService{}).AddToBlockchain("SKU-1", 1, fmt.Sprintf(`{"n":%d}`, i), user.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blocks, err := NewGormLedger(configs.DB).Range(1, 6)
+	if err != nil || len(blocks) != 6 {
+		t.Fatalf("读取区块 %d 个: %v", len(blocks), err)
+	}
+	// 第3个区块的写入节点时钟偏快，之后换了领导者，区块时间回退
+	ahead := blocks[5].Timestamp + int64(time.Hour)
+	configs.DB.Model(&configs.BlockchainLog{}).Where("global_height = ?", 3).Update("timestamp", ahead)
+	at := func(height int64) int64 { return blocks[height-1].Timestamp }
+
+	tests := []struct {
+		name string
+		at   int64
+		want int64
+	}{
+		{name: "偏快的区块之前", at: at(2), want: 2},
+		{name: "晚于后续区块但早于偏快的区块", at: at(6), want: 2},
+		{name: "偏快的区块之后", at: ahead, want: 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head, err := globalHeadAt(tt.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if head.GlobalHeight != tt.want {
+				t.Fatalf("链头高度 %d，期望 %d", head.GlobalHeight, tt.want)
+			}
+		})
+	}
+}
+
+func TestTraceAsOfTelemetry(t *testing.T) {
+	testDB(t)
+	factory := testUser(t, 1)
+	product := testProduct(t, "SKU-1", factory.ID)
+	testAddEvent(t, "SKU-1", productCreatedEvent(product, factory.ID), factory.ID)
+	start := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	device := testThermalReadings(t, "SKU-1", factory.ID, start, 4, 5, 6, 5)
+	later := []float64{7, 8}
+	inputs := make([]telemetryReadingInput, len(later))
+	for i := range later {
+		inputs[i] = telemetryReadingInput{RecordedAt: start.Add(time.Duration(30+i) * time.Minute), Temperature: &later[i]}
+	}
+	if _, err := ingestTelemetry(device, inputs); err != nil {
+		t.Fatal(err)
+	}
+
+	// 产品创建、第一批和第二批读数分别在各自的时间写入账本
+	var blocks []configs.BlockchainLog
+	configs.DB.Where("product_sku = ? AND record_type IN ?", "SKU-1", []int{events.RecordProductCreated, events.RecordTelemetryBatchRecorded}).
+		Order("block_height").
+		Find(&blocks)
+	if len(blocks) != 3 {
+		t.Fatalf("产品有 %d 个区块", len(blocks))
+	}
+	for i, offset := range []time.Duration{-2 * time.Minute, 4 * time.Minute, 32 * time.Minute} {
+		configs.DB.Model(&blocks[i]).Update("timestamp", start.Add(offset).UnixNano())
+	}
+
+	tests := []struct {
+		name   string
+		asOf   time.Duration
+		series int
+		points int
+	}{
+		{name: "设备绑定之前", asOf: -90 * time.Second},
+		// 读数已经产生但批次还没有写入账本
+		{name: "第一批写入账本之前", asOf: 2 * time.Minute, series: 1},
+		{name: "第一批写入账本之后", asOf: 10 * time.Minute, series: 1, points: 4},
+		{name: "第二批读数产生之后写入账本之前", asOf: 31 * time.Minute, series: 1, points: 4},
+		{name: "第二批写入账本之后", asOf: 40 * time.Minute, series: 1, points: 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			asOf := start.Add(tt.asOf).Format(time.RFC3339Nano)
+			w := testHandle((&QueryService{}).TraceProduct, configs.User{}, http.MethodGet, "/api/query/trace?sku=SKU-1&as_of="+url.QueryEscape(asOf), nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("状态码 %d: %s", w.Code, w.Body.String())
+			}
+			var trace struct {
+				Telemetry []telemetrySeries `json:"telemetry"`
+			}
+			testResponseData(t, w.Body.Bytes(), &trace)
+			if len(trace.Telemetry) != tt.series {
+				t.Fatalf("返回 %d 条曲线", len(trace.Telemetry))
+			}
+			if tt.series == 0 {
+				return
+			}
+			series := trace.Telemetry[0]
+			if series.DeviceID != device.ID || series.UnboundAt != nil || len(series.Points) != tt.points {
+				t.Fatalf("曲线 %+v", series)
+			}
+		})
+	}
+}
@@ -0,0 +1,654 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Raft节点角色
+const (
+	raftFollower = iota
+	raftCandidate
+	raftLeader
+)
+
+// 每次复制请求最多携带的日志条数
+const raftMaxBatch = 256
+
+var (
+	// ErrNotLeader 当前节点不是主节点，写请求需要发往主节点
+	ErrNotLeader = errors.New("当前节点不是主节点")
+	// ErrProposalLost 提案所在的日志被新的主节点覆盖
+	ErrProposalLost = errors.New("提案未被集群确认")
+	// ErrEntryRejected 日志已提交但应用时被拒绝，应用是确定性的，所有节点都会拒绝同一条日志
+	ErrEntryRejected = errors.New("日志被拒绝")
+)
+
+// RaftEntry 复制日志中的一条记录
+type RaftEntry struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Data  []byte `json:"data"` // 为空表示主节点上任时写入的空日志
+}
+
+// RequestVoteArgs 投票请求
+type RequestVoteArgs struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidate_id"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+// RequestVoteReply 投票响应
+type RequestVoteReply struct {
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"vote_granted"`
+}
+
+// AppendEntriesArgs 日志复制请求，Entries 为空时即心跳
+type AppendEntriesArgs struct {
+	Term         uint64      `json:"term"`
+	LeaderID     string      `json:"leader_id"`
+	PrevLogIndex uint64      `json:"prev_log_index"`
+	PrevLogTerm  uint64      `json:"prev_log_term"`
+	Entries      []RaftEntry `json:"entries"`
+	LeaderCommit uint64      `json:"leader_commit"`
+}
+
+// AppendEntriesReply 日志复制响应
+type AppendEntriesReply struct {
+	Term          uint64 `json:"term"`
+	Success       bool   `json:"success"`
+	ConflictIndex uint64 `json:"conflict_index"` // 失败时主节点下次从该位置重试
+}
+
+// RaftTransport 节点间通信
+// 生产环境使用HTTP，测试时可以用进程内的实现把多个节点直接连起来
+type RaftTransport interface {
+	RequestVote(peer string, args RequestVoteArgs) (RequestVoteReply, error)
+	AppendEntries(peer string, args AppendEntriesArgs) (AppendEntriesReply, error)
+}
+
+// RaftConfig Raft节点配置
+type RaftConfig struct {
+	ID                string
+	Peers             []string // 其他节点的ID
+	DataDir           string   // 任期、投票和日志的持久化目录
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+}
+
+// RaftNode 简化的Raft节点，负责选主和日志复制，不包含快照和成员变更
+type RaftNode struct {
+	mu        sync.Mutex
+	cfg       RaftConfig
+	transport RaftTransport
+	apply     func(RaftEntry) error
+	storage   *raftStorage
+
+	state       int
+	currentTerm uint64
+	votedFor    string
+	leaderID    string
+	log         []RaftEntry // log[i].Index == i+1
+	commitIndex uint64
+	lastApplied uint64
+	leaderStart uint64 // 本任期空日志的位置，提交后之前任期的日志也都已提交
+
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	replicating map[string]bool
+	waiters     map[uint64]chan error
+
+	electionDeadline time.Time
+	lastHeartbeat    time.Time
+	applyCh          chan struct{}
+	appliedCond      *sync.Cond
+}
+
+// NewRaftNode 创建节点并从磁盘恢复任期、投票和日志
+// apply 按日志顺序在每个节点上调用，必须是幂等的
+// apply 返回 ErrEntryRejected 时跳过该日志并把错误交给提案者，返回其他错误时稍后重试
+func NewRaftNode(cfg RaftConfig, transport RaftTransport, apply func(RaftEntry) error) (*RaftNode, error) {
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = 300 * time.Millisecond
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = cfg.ElectionTimeout / 5
+	}
+
+	storage, err := openRaftStorage(cfg.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	term, votedFor, entries, err := storage.load()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &RaftNode{
+		cfg:         cfg,
+		transport:   transport,
+		apply:       apply,
+		storage:     storage,
+		state:       raftFollower,
+		currentTerm: term,
+		votedFor:    votedFor,
+		log:         entries,
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		replicating: make(map[string]bool),
+		waiters:     make(map[uint64]chan error),
+		applyCh:     make(chan struct{}, 1),
+	}
+	n.appliedCond = sync.NewCond(&n.mu)
+	n.resetElectionDeadline()
+	return n, nil
+}
+
+// Run 运行选举计时和日志应用循环
+func (n *RaftNode) Run(ctx context.Context) {
+	go n.applyLoop(ctx)
+
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			n.mu.Lock()
+			n.appliedCond.Broadcast()
+			n.mu.Unlock()
+			return
+		case <-ticker.C:
+			n.tick()
+		}
+	}
+}
+
+func (n *RaftNode) tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	if n.state == raftLeader {
+		if now.Sub(n.lastHeartbeat) >= n.cfg.HeartbeatInterval {
+			n.lastHeartbeat = now
+			n.broadcastLocked()
+		}
+		return
+	}
+	if now.After(n.electionDeadline) {
+		n.startElectionLocked()
+	}
+}
+
+func (n *RaftNode) resetElectionDeadline() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+func (n *RaftNode) lastLog() (uint64, uint64) {
+	if len(n.log) == 0 {
+		return 0, 0
+	}
+	last := n.log[len(n.log)-1]
+	return last.Index, last.Term
+}
+
+func (n *RaftNode) termAt(index uint64) uint64 {
+	if index == 0 || index > uint64(len(n.log)) {
+		return 0
+	}
+	return n.log[index-1].Term
+}
+
+func (n *RaftNode) quorum() int {
+	return (len(n.cfg.Peers)+1)/2 + 1
+}
+
+// 新任期落盘失败时保留原任期，本节点在新任期内不投票也不接收日志
+func (n *RaftNode) becomeFollowerLocked(term uint64) error {
+	n.state = raftFollower
+	if term > n.currentTerm {
+		return n.persistStateLocked(term, "")
+	}
+	return nil
+}
+
+// 先落盘再更新内存中的任期和投票，失败时内存状态不变
+func (n *RaftNode) persistStateLocked(term uint64, votedFor string) error {
+	if err := n.storage.saveState(term, votedFor); err != nil {
+		log.Printf("保存Raft状态失败: %v", err)
+		return err
+	}
+	n.currentTerm = term
+	n.votedFor = votedFor
+	return nil
+}
+
+func (n *RaftNode) startElectionLocked() {
+	n.resetElectionDeadline()
+	if err := n.persistStateLocked(n.currentTerm+1, n.cfg.ID); err != nil {
+		return
+	}
+	n.state = raftCandidate
+	n.leaderID = ""
+
+	term := n.currentTerm
+	lastIndex, lastTerm := n.lastLog()
+	args := RequestVoteArgs{
+		Term:         term,
+		CandidateID:  n.cfg.ID,
+		LastLogIndex: lastIndex,
+		LastLogTerm:  lastTerm,
+	}
+
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeaderLocked()
+		return
+	}
+
+	for _, peer := range n.cfg.Peers {
+		go func(peer string) {
+			reply, err := n.transport.RequestVote(peer, args)
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if reply.Term > n.currentTerm {
+				n.becomeFollowerLocked(reply.Term)
+				return
+			}
+			if n.state != raftCandidate || n.currentTerm != term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeaderLocked()
+			}
+		}(peer)
+	}
+}
+
+func (n *RaftNode) becomeLeaderLocked() {
+	n.state = raftLeader
+	n.leaderID = n.cfg.ID
+
+	lastIndex, _ := n.lastLog()
+	for _, peer := range n.cfg.Peers {
+		n.nextIndex[peer] = lastIndex + 1
+		n.matchIndex[peer] = 0
+	}
+
+	// 写入本任期的空日志，提交后之前任期遗留的日志随之提交
+	// 空日志落盘失败时放弃主节点身份，等待下一轮选举
+	entry := RaftEntry{Index: lastIndex + 1, Term: n.currentTerm}
+	if err := n.appendLocked(entry); err != nil {
+		n.state = raftFollower
+		n.leaderID = ""
+		return
+	}
+	n.leaderStart = entry.Index
+	n.advanceCommitLocked()
+
+	n.lastHeartbeat = time.Now()
+	n.broadcastLocked()
+}
+
+// 日志落盘后才加入内存，失败时内存和磁盘中的日志都保持原样
+func (n *RaftNode) appendLocked(entries ...RaftEntry) error {
+	if err := n.storage.appendEntries(entries); err != nil {
+		log.Printf("保存Raft日志失败: %v", err)
+		return err
+	}
+	n.log = append(n.log, entries...)
+	return nil
+}
+
+func (n *RaftNode) broadcastLocked() {
+	for _, peer := range n.cfg.Peers {
+		if n.replicating[peer] {
+			continue
+		}
+		n.replicating[peer] = true
+		go n.replicateTo(peer)
+	}
+}
+
+func (n *RaftNode) replicateTo(peer string) {
+	n.mu.Lock()
+	if n.state != raftLeader {
+		n.replicating[peer] = false
+		n.mu.Unlock()
+		return
+	}
+
+	term := n.currentTerm
+	next := n.nextIndex[peer]
+	if next < 1 {
+		next = 1
+	}
+	prevIndex := next - 1
+	end := uint64(len(n.log))
+	if end-prevIndex > raftMaxBatch {
+		end = prevIndex + raftMaxBatch
+	}
+	entries := append([]RaftEntry(nil), n.log[prevIndex:end]...)
+	args := AppendEntriesArgs{
+		Term:         term,
+		LeaderID:     n.cfg.ID,
+		PrevLogIndex: prevIndex,
+		PrevLogTerm:  n.termAt(prevIndex),
+		Entries:      entries,
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	reply, err := n.transport.AppendEntries(peer, args)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.replicating[peer] = false
+	if err != nil {
+		return
+	}
+	if reply.Term > n.currentTerm {
+		n.becomeFollowerLocked(reply.Term)
+		return
+	}
+	if n.state != raftLeader || n.currentTerm != term {
+		return
+	}
+
+	if reply.Success {
+		match := prevIndex + uint64(len(entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		n.nextIndex[peer] = n.matchIndex[peer] + 1
+		n.advanceCommitLocked()
+	} else {
+		conflict := reply.ConflictIndex
+		if conflict < 1 {
+			conflict = 1
+		}
+		n.nextIndex[peer] = conflict
+	}
+
+	// 还有未复制的日志时继续发送，跟随者落盘失败时没有进展，等下一次心跳再重试
+	progressed := reply.Success || n.nextIndex[peer] < next
+	if progressed && n.nextIndex[peer] <= uint64(len(n.log)) {
+		n.replicating[peer] = true
+		go n.replicateTo(peer)
+	}
+}
+
+// 主节点上多数节点已复制的本任期日志可以提交
+func (n *RaftNode) advanceCommitLocked() {
+	for index := uint64(len(n.log)); index > n.commitIndex; index-- {
+		if n.termAt(index) != n.currentTerm {
+			break
+		}
+		count := 1
+		for _, peer := range n.cfg.Peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.signalApply()
+			return
+		}
+	}
+}
+
+func (n *RaftNode) signalApply() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (n *RaftNode) applyLoop(ctx context.Context) {
+	retry := time.NewTicker(time.Second)
+	defer retry.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.applyCh:
+		case <-retry.C:
+		}
+
+		for {
+			n.mu.Lock()
+			if n.lastApplied >= n.commitIndex {
+				n.mu.Unlock()
+				break
+			}
+			entry := n.log[n.lastApplied]
+			n.mu.Unlock()
+
+			err := n.apply(entry)
+			if err != nil && !errors.Is(err, ErrEntryRejected) {
+				log.Printf("应用Raft日志 %d 失败: %v", entry.Index, err)
+				break
+			}
+			if err != nil {
+				log.Printf("Raft日志 %d 被拒绝: %v", entry.Index, err)
+			}
+
+			n.mu.Lock()
+			n.lastApplied = entry.Index
+			if ch, ok := n.waiters[entry.Index]; ok {
+				ch <- err
+				delete(n.waiters, entry.Index)
+			}
+			n.appliedCond.Broadcast()
+			n.mu.Unlock()
+		}
+	}
+}
+
+// HandleRequestVote 处理投票请求
+func (n *RaftNode) HandleRequestVote(args RequestVoteArgs) RequestVoteReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if args.Term < n.currentTerm {
+		return RequestVoteReply{Term: n.currentTerm}
+	}
+	if args.Term > n.currentTerm {
+		if err := n.becomeFollowerLocked(args.Term); err != nil {
+			return RequestVoteReply{Term: n.currentTerm}
+		}
+	}
+
+	lastIndex, lastTerm := n.lastLog()
+	upToDate := args.LastLogTerm > lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex >= lastIndex)
+	if (n.votedFor == "" || n.votedFor == args.CandidateID) && upToDate {
+		// 投票落盘后才同意，避免重启后在同一任期投给另一个候选人
+		if err := n.persistStateLocked(n.currentTerm, args.CandidateID); err != nil {
+			return RequestVoteReply{Term: n.currentTerm}
+		}
+		n.resetElectionDeadline()
+		return RequestVoteReply{Term: n.currentTerm, VoteGranted: true}
+	}
+	return RequestVoteReply{Term: n.currentTerm}
+}
+
+// HandleAppendEntries 处理日志复制请求
+func (n *RaftNode) HandleAppendEntries(args AppendEntriesArgs) AppendEntriesReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if args.Term < n.currentTerm {
+		return AppendEntriesReply{Term: n.currentTerm}
+	}
+	if args.Term > n.currentTerm || n.state != raftFollower {
+		if err := n.becomeFollowerLocked(args.Term); err != nil {
+			return AppendEntriesReply{Term: n.currentTerm, ConflictIndex: args.PrevLogIndex + 1}
+		}
+	}
+	n.leaderID = args.LeaderID
+	n.resetElectionDeadline()
+
+	lastIndex, _ := n.lastLog()
+	if args.PrevLogIndex > lastIndex {
+		return AppendEntriesReply{Term: n.currentTerm, ConflictIndex: lastIndex + 1}
+	}
+	if args.PrevLogIndex > 0 && n.termAt(args.PrevLogIndex) != args.PrevLogTerm {
+		return AppendEntriesReply{Term: n.currentTerm, ConflictIndex: args.PrevLogIndex}
+	}
+
+	var fresh []RaftEntry
+	conflict := uint64(0)
+	for i, entry := range args.Entries {
+		if entry.Index <= uint64(len(n.log)) {
+			if n.termAt(entry.Index) == entry.Term {
+				continue
+			}
+			conflict = entry.Index
+		}
+		fresh = args.Entries[i:]
+		break
+	}
+
+	// 日志落盘后才确认，落盘失败时内存中的日志保持原样，主节点稍后从本批开头重试
+	if conflict > 0 {
+		// 与主节点冲突的未提交日志被覆盖，重写后的日志使用新的底层数组
+		updated := append(append([]RaftEntry(nil), n.log[:conflict-1]...), fresh...)
+		if err := n.storage.rewrite(updated); err != nil {
+			log.Printf("保存Raft日志失败: %v", err)
+			return AppendEntriesReply{Term: n.currentTerm, ConflictIndex: args.PrevLogIndex + 1}
+		}
+		n.failWaitersFromLocked(conflict)
+		n.log = updated
+	} else if len(fresh) > 0 {
+		if err := n.appendLocked(fresh...); err != nil {
+			return AppendEntriesReply{Term: n.currentTerm, ConflictIndex: args.PrevLogIndex + 1}
+		}
+	}
+
+	if args.LeaderCommit > n.commitIndex {
+		last := args.PrevLogIndex + uint64(len(args.Entries))
+		if args.LeaderCommit < last {
+			last = args.LeaderCommit
+		}
+		if last > n.commitIndex {
+			n.commitIndex = last
+			n.signalApply()
+		}
+	}
+
+	return AppendEntriesReply{Term: n.currentTerm, Success: true}
+}
+
+func (n *RaftNode) failWaitersFromLocked(index uint64) {
+	for i, ch := range n.waiters {
+		if i >= index {
+			ch <- ErrProposalLost
+			delete(n.waiters, i)
+		}
+	}
+}
+
+// Propose 在主节点上提交数据，等待多数节点确认并在本节点应用后返回
+func (n *RaftNode) Propose(ctx context.Context, data []byte) (uint64, error) {
+	n.mu.Lock()
+	if n.state != raftLeader {
+		n.mu.Unlock()
+		return 0, ErrNotLeader
+	}
+
+	lastIndex, _ := n.lastLog()
+	entry := RaftEntry{Index: lastIndex + 1, Term: n.currentTerm, Data: data}
+	if err := n.appendLocked(entry); err != nil {
+		n.mu.Unlock()
+		return 0, err
+	}
+	ch := make(chan error, 1)
+	n.waiters[entry.Index] = ch
+	n.advanceCommitLocked()
+	n.broadcastLocked()
+	n.mu.Unlock()
+
+	select {
+	case err := <-ch:
+		return entry.Index, err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, entry.Index)
+		n.mu.Unlock()
+		return entry.Index, ctx.Err()
+	}
+}
+
+// WaitLeaderReady 等待主节点把之前任期的日志全部提交并应用
+func (n *RaftNode) WaitLeaderReady(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		n.mu.Lock()
+		n.appliedCond.Broadcast()
+		n.mu.Unlock()
+	})
+	defer stop()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for {
+		if n.state != raftLeader {
+			return ErrNotLeader
+		}
+		if n.lastApplied >= n.leaderStart {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n.appliedCond.Wait()
+	}
+}
+
+// RaftStatus 节点状态
+type RaftStatus struct {
+	ID          string `json:"id"`
+	State       string `json:"state"`
+	Term        uint64 `json:"term"`
+	LeaderID    string `json:"leader_id"`
+	LastIndex   uint64 `json:"last_index"`
+	CommitIndex uint64 `json:"commit_index"`
+	LastApplied uint64 `json:"last_applied"`
+}
+
+// Status 获取节点状态
+func (n *RaftNode) Status() RaftStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	state := "follower"
+	switch n.state {
+	case raftCandidate:
+		state = "candidate"
+	case raftLeader:
+		state = "leader"
+	}
+	lastIndex, _ := n.lastLog()
+	return RaftStatus{
+		ID:          n.cfg.ID,
+		State:       state,
+		Term:        n.currentTerm,
+		LeaderID:    n.leaderID,
+		LastIndex:   lastIndex,
+		CommitIndex: n.commitIndex,
+		LastApplied: n.lastApplied,
+	}
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Raft持久化文件
+const (
+	raftStateFile = "raft-state.json"
+	raftLogFile   = "raft-log.jsonl"
+)
+
+// 任期和投票
+type raftState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+// raftStorage 保存Raft的任期、投票和日志，每次写入都fsync
+type raftStorage struct {
+	dir string
+}
+
+func openRaftStorage(dir string) (*raftStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &raftStorage{dir: dir}, nil
+}
+
+func (s *raftStorage) load() (uint64, string, []RaftEntry, error) {
+	var state raftState
+	data, err := os.ReadFile(filepath.Join(s.dir, raftStateFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return 0, "", nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return 0, "", nil, err
+	}
+
+	var entries []RaftEntry
+	f, err := os.Open(filepath.Join(s.dir, raftLogFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return state.Term, state.VotedFor, nil, nil
+	}
+	if err != nil {
+		return 0, "", nil, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// 末尾不完整的行是写入时崩溃留下的，该条日志未被确认，直接丢弃
+			break
+		}
+		if err != nil {
+			return 0, "", nil, err
+		}
+		var entry RaftEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return 0, "", nil, err
+		}
+		if entry.Index != uint64(len(entries))+1 {
+			return 0, "", nil, errors.New("Raft日志序号不连续")
+		}
+		entries = append(entries, entry)
+	}
+	return state.Term, state.VotedFor, entries, nil
+}
+
+func (s *raftStorage) saveState(term uint64, votedFor string) error {
+	data, err := json.Marshal(raftState{Term: term, VotedFor: votedFor})
+	if err != nil {
+		return err
+	}
+	return writeFileSync(filepath.Join(s.dir, raftStateFile), data)
+}
+
+func (s *raftStorage) appendEntries(entries []RaftEntry) error {
+	f, err := os.OpenFile(filepath.Join(s.dir, raftLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		// 写入失败时截掉已写入的部分，重启后不会加载没有确认过的日志
+		f.Truncate(info.Size())
+		return err
+	}
+	return nil
+}
+
+// 日志被截断时整体重写
+func (s *raftStorage) rewrite(entries []RaftEntry) error {
+	var data []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+	return writeFileSync(filepath.Join(s.dir, raftLogFile), data)
+}
+
+// 先写临时文件再重命名，保证文件要么是旧内容要么是完整的新内容
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
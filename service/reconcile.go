@@ -0,0 +1,523 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/api"
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 对账发现的问题类型
+const (
+	FindingOrphanRow   = "orphan_row"   // 业务记录没有对应的区块
+	FindingOrphanBlock = "orphan_block" // 区块对应的业务记录不存在或已删除
+	FindingMismatch    = "mismatch"     // 业务记录与区块中的值不一致
+	FindingBadPayload  = "bad_payload"  // 区块数据无法解析
+)
+
+// 对账时每批加载的记录数
+const reconcileBatch = 500
+
+// ReconcileFinding 对账发现的单个问题
+type ReconcileFinding struct {
+	Kind         string      `json:"kind"`
+	Table        string      `json:"table"`
+	RowID        uint        `json:"row_id,omitempty"`
+	ProductSKU   string      `json:"product_sku"`
+	BlockID      uint        `json:"block_id,omitempty"`
+	GlobalHeight int64       `json:"global_height,omitempty"`
+	Field        string      `json:"field,omitempty"`
+	LedgerValue  interface{} `json:"ledger_value,omitempty"`
+	DBValue      interface{} `json:"db_value,omitempty"`
+	Detail       string      `json:"detail,omitempty"`
+}
+
+// ReconcileReport 对账结果
+type ReconcileReport struct {
+	StartedAt     time.Time          `json:"started_at"`
+	FinishedAt    time.Time          `json:"finished_at"`
+	BlocksScanned int                `json:"blocks_scanned"`
+	RowsScanned   int                `json:"rows_scanned"`
+	OrphanRows    int                `json:"orphan_rows"`
+	OrphanBlocks  int                `json:"orphan_blocks"`
+	Mismatches    int                `json:"mismatches"`
+	Findings      []ReconcileFinding `json:"findings"`
+}
+
+func (r *ReconcileReport) add(f ReconcileFinding) {
+	switch f.Kind {
+	case FindingOrphanRow:
+		r.OrphanRows++
+	case FindingOrphanBlock:
+		r.OrphanBlocks++
+	case FindingMismatch:
+		r.Mismatches++
+	}
+	r.Findings = append(r.Findings, f)
+}
+
+// 区块中解析出的业务事件
+type ledgerPayload struct {
+	block  configs.BlockchainLog
+	fields map[string]interface{}
+}
+
+// 由业务记录构造的事件
+type reconcileRow struct {
+	id    uint
+	sku   string
+	event events.Event
+	// 业务记录是否应当有对应区块
+	expectBlock bool
+}
+
+// 参与对账的业务表
+type reconcileTable struct {
+	name       string
+	recordType int
+	// 不参与比对的事件字段，这些字段无法从业务记录还原
+	ignored map[string]bool
+	// 分批加载业务记录并转换为事件
+	scan func(fn func(rows []reconcileRow) error) error
+}
+
+var reconcileTables = []reconcileTable{
+	{
+		name:       "product_infos",
+		recordType: events.RecordProductCreated,
+		ignored:    map[string]bool{"approved_by": true},
+		scan: func(fn func(rows []reconcileRow) error) error {
+			var batch []configs.ProductInfo
+			return scanRows(&batch, func() []reconcileRow {
+				rows := make([]reconcileRow, 0, len(batch))
+				for _, product := range batch {
+					rows = append(rows, reconcileRow{
+						id:    product.ID,
+						sku:   product.SKU,
+						event: productCreatedEvent(product, 0),
+						// 只有审核通过的产品会写入区块
+						expectBlock: product.Status == 1,
+					})
+				}
+				return rows
+			}, fn)
+		},
+	},
+	{
+		name:       "logistics_records",
+		recordType: events.RecordLogisticsUpdated,
+		scan: func(fn func(rows []reconcileRow) error) error {
+			var batch []configs.LogisticsRecord
+			return scanRows(&batch, func() []reconcileRow {
+				rows := make([]reconcileRow, 0, len(batch))
+				for _, record := range batch {
+					rows = append(rows, reconcileRow{
+						id:          record.ID,
+						sku:         record.ProductSKU,
+						event:       logisticsUpdatedEvent(record),
+						expectBlock: true,
+					})
+				}
+				return rows
+			}, fn)
+		},
+	},
+	{
+		name:       "transfer_records",
+		recordType: events.RecordCustodyTransferred,
+		scan: func(fn func(rows []reconcileRow) error) error {
+			var batch []configs.TransferRecord
+			return scanRows(&batch, func() []reconcileRow {
+				rows := make([]reconcileRow, 0, len(batch))
+				for _, transfer := range batch {
+					rows = append(rows, reconcileRow{
+						id:          transfer.ID,
+						sku:         transfer.ProductSKU,
+						event:       custodyTransferredEvent(transfer),
+						expectBlock: true,
+					})
+				}
+				return rows
+			}, fn)
+		},
+	},
+}
+
+// 分批读取业务记录，convert 把当前批次转换为事件
+func scanRows(batch interface{}, convert func() []reconcileRow, fn func(rows []reconcileRow) error) error {
+	result := configs.DB.FindInBatches(batch, reconcileBatch, func(tx *gorm.DB, _ int) error {
+		return fn(convert())
+	})
+	return result.Error
+}
+
+// 事件对应的业务记录ID和SKU
+func eventSubject(event events.Event) (uint, string) {
+	switch e := events.Latest(event).(type) {
+	case *events.ProductCreated:
+		return e.ProductID, e.SKU
+	case *events.LogisticsUpdated:
+		return e.RecordID, e.ProductSKU
+	case *events.CustodyTransferred:
+		return e.TransferID, e.ProductSKU
+	}
+	return 0, ""
+}
+
+// 把事件转换为字段表，便于逐字段比对
+func eventFields(event events.Event) (map[string]interface{}, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// 加载某类记录的全部区块，包括已归档的区块，同一业务记录有多个区块时以最新的为准
+func loadLedgerPayloads(table reconcileTable, report *ReconcileReport) (map[uint]ledgerPayload, error) {
+	payloads := make(map[uint]ledgerPayload)
+	scan := func(block configs.BlockchainLog) error {
+		report.BlocksScanned++
+		finding := ReconcileFinding{
+			Table:        table.name,
+			ProductSKU:   block.ProductSKU,
+			BlockID:      block.ID,
+			GlobalHeight: block.GlobalHeight,
+		}
+
+		event, err := decodeBlockEvent(block)
+		if err != nil {
+			finding.Kind = FindingBadPayload
+			finding.Detail = "区块数据无法解析: " + err.Error()
+			report.add(finding)
+			return nil
+		}
+		id, sku := eventSubject(event)
+		if id == 0 {
+			finding.Kind = FindingBadPayload
+			finding.Detail = "区块数据缺少记录ID"
+			report.add(finding)
+			return nil
+		}
+		if sku != block.ProductSKU {
+			finding.Kind = FindingMismatch
+			finding.RowID = id
+			finding.Field = "sku"
+			finding.LedgerValue = sku
+			finding.DBValue = block.ProductSKU
+			finding.Detail = "区块数据中的SKU与区块不一致"
+			report.add(finding)
+		}
+
+		// 旧版本的事件先转换为当前版本，与业务记录构造的事件按同一组字段比对
+		fields, err := eventFields(events.Latest(event))
+		if err != nil {
+			return err
+		}
+		if prev, ok := payloads[id]; !ok || block.ID > prev.block.ID {
+			block.RecordData = ""
+			payloads[id] = ledgerPayload{block: block, fields: fields}
+		}
+		return nil
+	}
+
+	// 冷存储中的区块保留了原来的ID，可以与数据库中的区块比较新旧
+	archived := archivedHeight()
+	for from := int64(1); from <= archived; from += reconcileBatch {
+		blocks, err := ledgerArchive.Range(from, from+reconcileBatch-1)
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range blocks {
+			if block.RecordType != table.recordType {
+				continue
+			}
+			if err := scan(block); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var batch []configs.BlockchainLog
+	result := configs.DB.Where("record_type = ?", table.recordType).
+		FindInBatches(&batch, reconcileBatch, func(tx *gorm.DB, _ int) error {
+			for _, block := range batch {
+				if err := scan(block); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return payloads, nil
+}
+
+// 对一张业务表对账
+func reconcileOne(table reconcileTable, report *ReconcileReport) error {
+	payloads, err := loadLedgerPayloads(table, report)
+	if err != nil {
+		return err
+	}
+
+	err = table.scan(func(rows []reconcileRow) error {
+		for _, row := range rows {
+			report.RowsScanned++
+
+			payload, ok := payloads[row.id]
+			if !ok {
+				if row.expectBlock {
+					report.add(ReconcileFinding{
+						Kind:       FindingOrphanRow,
+						Table:      table.name,
+						RowID:      row.id,
+						ProductSKU: row.sku,
+						Detail:     "业务记录没有对应的区块",
+					})
+				}
+				continue
+			}
+			delete(payloads, row.id)
+
+			if !row.expectBlock {
+				report.add(ReconcileFinding{
+					Kind:         FindingMismatch,
+					Table:        table.name,
+					RowID:        row.id,
+					ProductSKU:   row.sku,
+					BlockID:      payload.block.ID,
+					GlobalHeight: payload.block.GlobalHeight,
+					Detail:       "业务记录已上链，但当前状态不应有区块",
+				})
+			}
+
+			fields, err := eventFields(row.event)
+			if err != nil {
+				return err
+			}
+
+			// 字段按名称排序，保证结果稳定
+			names := make([]string, 0, len(fields))
+			for name := range fields {
+				if !table.ignored[name] {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				if reflect.DeepEqual(payload.fields[name], fields[name]) {
+					continue
+				}
+				report.add(ReconcileFinding{
+					Kind:         FindingMismatch,
+					Table:        table.name,
+					RowID:        row.id,
+					ProductSKU:   row.sku,
+					BlockID:      payload.block.ID,
+					GlobalHeight: payload.block.GlobalHeight,
+					Field:        name,
+					LedgerValue:  payload.fields[name],
+					DBValue:      fields[name],
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// 剩下的区块找不到业务记录
+	ids := make([]uint, 0, len(payloads))
+	for id := range payloads {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		payload := payloads[id]
+		report.add(ReconcileFinding{
+			Kind:         FindingOrphanBlock,
+			Table:        table.name,
+			RowID:        id,
+			ProductSKU:   payload.block.ProductSKU,
+			BlockID:      payload.block.ID,
+			GlobalHeight: payload.block.GlobalHeight,
+			Detail:       "区块对应的业务记录不存在或已删除",
+		})
+	}
+	return nil
+}
+
+// 同一时刻只运行一次对账
+var reconcileMu sync.Mutex
+
+// Reconcile 逐条比对业务表与区块中的记录数据，并保存对账结果
+func Reconcile() (*ReconcileReport, error) {
+	reconcileMu.Lock()
+	defer reconcileMu.Unlock()
+
+	report := &ReconcileReport{StartedAt: time.Now(), Findings: []ReconcileFinding{}}
+	var runErr error
+	for _, table := range reconcileTables {
+		if runErr = reconcileOne(table, report); runErr != nil {
+			break
+		}
+	}
+	report.FinishedAt = time.Now()
+
+	findings, err := json.Marshal(report.Findings)
+	if err != nil {
+		return nil, err
+	}
+	run := configs.ReconciliationRun{
+		StartedAt:     report.StartedAt,
+		FinishedAt:    report.FinishedAt,
+		BlocksScanned: report.BlocksScanned,
+		RowsScanned:   report.RowsScanned,
+		OrphanRows:    report.OrphanRows,
+		OrphanBlocks:  report.OrphanBlocks,
+		Mismatches:    report.Mismatches,
+		Findings:      string(findings),
+	}
+	if runErr != nil {
+		run.Error = runErr.Error()
+	}
+	if err := configs.DB.Create(&run).Error; err != nil {
+		log.Printf("保存对账结果失败: %v", err)
+	}
+
+	if runErr != nil {
+		return nil, runErr
+	}
+	return report, nil
+}
+
+// StartReconcileJob 定期对账，发现问题时记录日志
+func StartReconcileJob(ctx context.Context) {
+	every := configs.GlobalLedgerConfig.ReconcileEvery
+	if every <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			report, err := Reconcile()
+			if err != nil {
+				log.Printf("对账失败: %v", err)
+				continue
+			}
+			if len(report.Findings) > 0 {
+				log.Printf("对账发现问题: %d 条业务记录缺少区块, %d 个区块缺少业务记录, %d 处数据不一致",
+					report.OrphanRows, report.OrphanBlocks, report.Mismatches)
+			}
+		}
+	}()
+}
+
+// AdminReconcile 立即执行一次对账
+func (s *AdminService) AdminReconcile(c *gin.Context) {
+	report, err := Reconcile()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "对账失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "对账完成",
+		Data:    report,
+	})
+}
+
+// AdminReconcileRuns 获取历次对账结果
+func (s *AdminService) AdminReconcileRuns(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 10
+	}
+
+	var total int64
+	configs.DB.Model(&configs.ReconciliationRun{}).Count(&total)
+
+	var runs []configs.ReconciliationRun
+	result := configs.DB.Order("id DESC").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Find(&runs)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "查询对账记录失败",
+		})
+		return
+	}
+
+	list := make([]gin.H, 0, len(runs))
+	for _, run := range runs {
+		findings := []ReconcileFinding{}
+		if run.Findings != "" {
+			if err := json.Unmarshal([]byte(run.Findings), &findings); err != nil {
+				c.JSON(http.StatusInternalServerError, api.Response{
+					Code:    500,
+					Message: "解析对账记录失败",
+				})
+				return
+			}
+		}
+		list = append(list, gin.H{
+			"id":             run.ID,
+			"started_at":     run.StartedAt,
+			"finished_at":    run.FinishedAt,
+			"blocks_scanned": run.BlocksScanned,
+			"rows_scanned":   run.RowsScanned,
+			"orphan_rows":    run.OrphanRows,
+			"orphan_blocks":  run.OrphanBlocks,
+			"mismatches":     run.Mismatches,
+			"error":          run.Error,
+			"findings":       findings,
+		})
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "获取对账记录成功",
+		Data: gin.H{
+			"total":     total,
+			"page":      page,
+			"page_size": pageSize,
+			"runs":      list,
+		},
+	})
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
+	"testing"
+)
+
+// 写入一个已上链的产品、一条物流记录和一条交接记录，业务表与区块一致
+func testReconcileData(t *testing.T) (configs.ProductInfo, configs.LogisticsRecord, configs.TransferRecord) {
+	t.Helper()
+	testDB(t)
+	factory := testUser(t, 1)
+	saler := testUser(t, 2)
+	admin := testUser(t, 4)
+	product := testProduct(t, "SKU-1", factory.ID)
+
+	record := configs.LogisticsRecord{
+		ProductSKU:        product.SKU,
+		TrackingNo:        "T1",
+		WarehouseLocation: "一号仓",
+		Temperature:       4,
+		Humidity:          60,
+		ImageURL:          "x",
+		OperatorID:        factory.ID,
+		OperatorType:      1,
+	}
+	if err := configs.DB.Create(&record).Error; err != nil {
+		t.Fatal(err)
+	}
+	transfer := configs.TransferRecord{ProductSKU: product.SKU, FromUserID: factory.ID, ToUserID: saler.ID, Status: 1}
+	if err := configs.DB.Create(&transfer).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	blockchainService := &BlockchainService{}
+	for _, event := range []events.Event{
+		productCreatedEvent(product, admin.ID),
+		logisticsUpdatedEvent(record),
+		custodyTransferredEvent(transfer),
+	} {
+		if _, err := blockchainService.AddEventTx(configs.DB, product.SKU, event, factory.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return product, record, transfer
+}
+
+func TestReconcile(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, product configs.ProductInfo, record configs.LogisticsRecord, transfer configs.TransferRecord)
+		want   map[string]int // 问题类型 -> 数量
+		field  string         // 不一致的字段
+	}{
+		{name: "业务表与区块一致", want: map[string]int{}},
+		{
+			name: "修改物流温度",
+			tamper: func(t *testing.T, _ configs.ProductInfo, record configs.LogisticsRecord, _ configs.TransferRecord) {
+				configs.DB.Model(&record).Update("temperature", 25)
+			},
+			want:  map[string]int{FindingMismatch: 1},
+			field: "temperature",
+		},
+		{
+			name: "修改产品品牌",
+			tamper: func(t *testing.T, product configs.ProductInfo, _ configs.LogisticsRecord, _ configs.TransferRecord) {
+				configs.DB.Model(&product).Update("brand", "伪造品牌")
+			},
+			want:  map[string]int{FindingMismatch: 1},
+			field: "brand",
+		},
+		{
+			name: "修改交接接收方",
+			tamper: func(t *testing.T, _ configs.ProductInfo, _ configs.LogisticsRecord, transfer configs.TransferRecord) {
+				configs.DB.Model(&transfer).Update("to_user_id", transfer.ToUserID+100)
+			},
+			want:  map[string]int{FindingMismatch: 1},
+			field: "to_user_id",
+		},
+		{
+			name: "补录没有区块的物流记录",
+			tamper: func(t *testing.T, _ configs.ProductInfo, record configs.LogisticsRecord, _ configs.TransferRecord) {
+				record.ID = 0
+				configs.DB.Create(&record)
+			},
+			want: map[string]int{FindingOrphanRow: 1},
+		},
+		{
+			name: "删除交接记录",
+			tamper: func(t *testing.T, _ configs.ProductInfo, _ configs.LogisticsRecord, transfer configs.TransferRecord) {
+				configs.DB.Unscoped().Delete(&transfer)
+			},
+			want: map[string]int{FindingOrphanBlock: 1},
+		},
+		{
+			// 已上链的产品被改回未审核状态
+			name: "撤销产品审核",
+			tamper: func(t *testing.T, product configs.ProductInfo, _ configs.LogisticsRecord, _ configs.TransferRecord) {
+				configs.DB.Model(&product).Update("status", 0)
+			},
+			want: map[string]int{FindingMismatch: 1},
+		},
+		{
+			name: "区块数据无法解析",
+			tamper: func(t *testing.T, product configs.ProductInfo, _ configs.LogisticsRecord, _ configs.TransferRecord) {
+				if _, err := (&BlockchainService{}).AddToBlockchain(product.SKU, events.RecordLogisticsUpdated, `not json`, product.ManufacturerID); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: map[string]int{FindingBadPayload: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			product, record, transfer := testReconcileData(t)
+			if tt.tamper != nil {
+				tt.tamper(t, product, record, transfer)
+			}
+
+			report, err := Reconcile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]int)
+			for _, f := range report.Findings {
+				got[f.Kind]++
+				if f.Kind == FindingMismatch && tt.field != "" && f.Field != tt.field {
+					t.Errorf("不一致的字段为 %s，期望 %s", f.Field, tt.field)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("对账结果 %+v，期望 %v", report.Findings, tt.want)
+			}
+			for kind, n := range tt.want {
+				if got[kind] != n {
+					t.Fatalf("对账结果 %+v，期望 %v", report.Findings, tt.want)
+				}
+			}
+			if report.BlocksScanned < 3 || report.RowsScanned < 2 {
+				t.Fatalf("扫描数量 %d 个区块 %d 条记录", report.BlocksScanned, report.RowsScanned)
+			}
+
+			// 每次对账都保存结果
+			var runs int64
+			configs.DB.Model(&configs.ReconciliationRun{}).Count(&runs)
+			if runs != 1 {
+				t.Fatalf("保存了 %d 次对账结果", runs)
+			}
+		})
+	}
+}
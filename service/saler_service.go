@@ -3,12 +3,11 @@ package service
 import (
 	"back_Blockchain_cold_chain_traceability_system/api"
 	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
 	"encoding/base64"
-	"encoding/json"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"time"
 )
@@ -154,19 +153,9 @@ func (s *SalerService) AddLogistics(c *gin.Context) {
 		return
 	}
 
-	// 处理图片
-	imageURL := ""
+	// 处理图片，文件按内容的SHA-256命名，摘要写入物流事件
+	imageURL, imageSHA256 := "", ""
 	if req.ImageBase64 != "" {
-		// 确保上传目录存在
-		uploadDir := "./uploads/logistics"
-		if err := os.MkdirAll(uploadDir, 0755); err != nil {
-			c.JSON(http.StatusInternalServerError, api.Response{
-				Code:    500,
-				Message: "创建上传目录失败",
-			})
-			return
-		}
-
 		// 解码Base64图片
 		imageData, err := base64.StdEncoding.DecodeString(req.ImageBase64)
 		if err != nil {
@@ -177,18 +166,14 @@ func (s *SalerService) AddLogistics(c *gin.Context) {
 			return
 		}
 
-		// 保存图片
-		filename := req.ProductSKU + "_" + strconv.FormatInt(time.Now().Unix(), 10) + ".jpg"
-		filePath := filepath.Join(uploadDir, filename)
-		if err := os.WriteFile(filePath, imageData, 0644); err != nil {
+		imageURL, imageSHA256, err = saveUpload("logistics", imageData)
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, api.Response{
 				Code:    500,
-				Message: "保存图片失败",
+				Message: "保存图片失败: " + err.Error(),
 			})
 			return
 		}
-
-		imageURL = "/uploads/logistics/" + filename
 	}
 
 	// 创建物流记录
@@ -199,23 +184,36 @@ func (s *SalerService) AddLogistics(c *gin.Context) {
 		Temperature:       req.Temperature,
 		Humidity:          req.Humidity,
 		ImageURL:          imageURL,
+		ImageSHA256:       imageSHA256,
 		OperatorID:        userID.(uint),
 		OperatorType:      userType.(int),
 	}
 
-	result = configs.DB.Create(&logistics)
-	if result.Error != nil {
+	// 物流记录和区块在同一事务中写入
+	blockchainService := &BlockchainService{}
+	err := ledgerTransaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&logistics).Error; err != nil {
+			return err
+		}
+
+		if _, err := blockchainService.AddEventTx(tx, req.ProductSKU, logisticsUpdatedEvent(logistics), userID.(uint)); err != nil {
+			return err
+		}
+
+		// 物流记录的温湿度同样按产品要求判断超温
+		stream := excursionStream{SKU: req.ProductSKU, Source: events.ExcursionSourceLogistics, SignerID: userID.(uint)}
+		reading := excursionReading{At: logistics.CreatedAt, Temperature: logistics.Temperature, Humidity: &logistics.Humidity}
+		_, err := evaluateExcursions(tx, stream, []excursionReading{reading})
+		return err
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, api.Response{
 			Code:    500,
-			Message: "创建物流记录失败: " + result.Error.Error(),
+			Message: "创建物流记录失败: " + err.Error(),
 		})
 		return
 	}
-
-	// 记录到区块链
-	blockchainService := &BlockchainService{}
-	logisticsData, _ := json.Marshal(logistics)
-	blockchainService.AddToBlockchain(req.ProductSKU, 2, string(logisticsData))
+	refreshShelfLife(req.ProductSKU, thermalPoint{At: logistics.CreatedAt, Temperature: logistics.Temperature})
 
 	c.JSON(http.StatusOK, api.Response{
 		Code:    200,
@@ -268,20 +266,24 @@ func (s *SalerService) ConfirmTransfer(c *gin.Context) {
 		Status:     1, // 直接确认
 	}
 
-	result = configs.DB.Create(&transfer)
-	if result.Error != nil {
+	// 交接记录和区块在同一事务中写入
+	blockchainService := &BlockchainService{}
+	err := ledgerTransaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&transfer).Error; err != nil {
+			return err
+		}
+
+		_, err := blockchainService.AddEventTx(tx, req.ProductSKU, custodyTransferredEvent(transfer), userID.(uint))
+		return err
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, api.Response{
 			Code:    500,
-			Message: "创建交接记录失败: " + result.Error.Error(),
+			Message: "创建交接记录失败: " + err.Error(),
 		})
 		return
 	}
 
-	// 记录到区块链
-	blockchainService := &BlockchainService{}
-	transferData, _ := json.Marshal(transfer)
-	blockchainService.AddToBlockchain(req.ProductSKU, 3, string(transferData))
-
 	c.JSON(http.StatusOK, api.Response{
 		Code:    200,
 		Message: "确认交接成功",
@@ -327,15 +329,31 @@ func (s *SalerService) GetProductList(c *gin.Context) {
 		return
 	}
 
-	// 查询这些产品的详细信息
-	var products []configs.ProductInfo
+	// 查询这些产品的详细信息，sort=effective_expiry 时按动态保质期排序
+	// 还没有计算过动态保质期的产品按标示的保质期参与排序
+	var products []struct {
+		configs.ProductInfo
+		EffectiveExpiry time.Time `json:"effective_expiry"`
+		MeanKineticTemp *float64  `json:"mean_kinetic_temp"`
+	}
 	var total int64
 	result = configs.DB.Model(&configs.ProductInfo{}).
 		Where("sku IN ? AND status = 1", productSKUs).
 		Count(&total)
 
-	result = configs.DB.Where("sku IN ? AND status = 1", productSKUs).
-		Order("created_at DESC").
+	order := "product_infos.created_at DESC"
+	if c.Query("sort") == "effective_expiry" {
+		order = "effective_expiry"
+		if c.Query("order") == "desc" {
+			order += " DESC"
+		}
+		order += ", product_infos.id"
+	}
+	result = configs.DB.Model(&configs.ProductInfo{}).
+		Select("product_infos.*, COALESCE(shelf_life_states.effective_expiry, product_infos.expiration_date) AS effective_expiry, shelf_life_states.mean_kinetic_temp").
+		Joins("LEFT JOIN shelf_life_states ON shelf_life_states.product_sku = product_infos.sku").
+		Where("product_infos.sku IN ? AND product_infos.status = 1", productSKUs).
+		Order(order).
 		Offset(offset).
 		Limit(pageSize).
 		Find(&products)
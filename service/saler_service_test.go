@@ -0,0 +1,51 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/api"
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"net/http"
+	"testing"
+)
+
+func TestAddLogisticsWritesRecordAndBlockTogether(t *testing.T) {
+	tests := []struct {
+		name       string
+		failLedger bool
+		status     int
+		records    int64
+	}{
+		{name: "账本写入成功", status: http.StatusOK, records: 1},
+		{name: "账本写入失败时回滚物流记录", failLedger: true, status: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDB(t)
+			factory := testUser(t, 1)
+			saler := testUser(t, 2)
+			testProduct(t, "SKU-1", factory.ID)
+			if tt.failLedger {
+				testFailLedgerWrites(t)
+			}
+
+			req := api.LogisticsInfo{
+				ProductSKU:        "SKU-1",
+				TrackingNo:        "T1",
+				WarehouseLocation: "上海",
+				Temperature:       4,
+				Humidity:          60,
+			}
+			w := testHandle((&SalerService{}).AddLogistics, saler, http.MethodPost, "/api/saler/logistics", req)
+			if w.Code != tt.status {
+				t.Fatalf("状态码 %d，期望 %d: %s", w.Code, tt.status, w.Body.String())
+			}
+
+			var records, blocks int64
+			configs.DB.Model(&configs.LogisticsRecord{}).Count(&records)
+			configs.DB.Model(&configs.BlockchainLog{}).Where("product_sku = ?", "SKU-1").Count(&blocks)
+			if records != tt.records || blocks != tt.records {
+				t.Fatalf("物流记录 %d 条，区块 %d 条，期望都是 %d", records, blocks, tt.records)
+			}
+		})
+	}
+}
@@ -0,0 +1,356 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// 计算平均动力学温度使用的常数
+const (
+	defaultActivationEnergy = 83.144         // kJ/mol，USP <1160> 推荐的默认活化能，对应 ΔH/R = 10000 K
+	maxActivationEnergy     = 500            // kJ/mol，超过该值视为录入错误
+	gasConstant             = 8.314462618e-3 // kJ/(mol·K)
+	kelvinOffset            = 273.15
+)
+
+// 一条温度记录最多代表之后这段时间的温度，更长的空档视为没有记录，按标示温度计算
+const thermalHoldLimit = 12 * time.Hour
+
+// 产品要求中的活化能，没有配置时使用默认值
+func activationEnergy(profile configs.TemperatureProfile) float64 {
+	if profile.ActivationEnergy > 0 {
+		return profile.ActivationEnergy
+	}
+	return defaultActivationEnergy
+}
+
+// 温度历史中的一条记录
+type thermalPoint struct {
+	At          time.Time
+	Temperature float64
+}
+
+// 温度历史的计算结果
+type thermalSummary struct {
+	MeanKineticTemp  *float64  `json:"mean_kinetic_temp"` // 没有温度记录时为空
+	TimeAbove        int64     `json:"time_above"`        // 高于温度上限的累计时长（秒）
+	Threshold        float64   `json:"threshold"`         // 温度上限
+	MonitoredSeconds int64     `json:"monitored_seconds"` // 有温度记录覆盖的时长（秒）
+	ReferenceTemp    float64   `json:"reference_temp"`    // 标示的储运温度
+	ActivationEnergy float64   `json:"activation_energy"` // kJ/mol
+	LostSeconds      int64     `json:"lost_seconds"`      // 因高于标示温度而损失的保质期（秒）
+	ExpirationDate   time.Time `json:"expiration_date"`
+	EffectiveExpiry  time.Time `json:"effective_expiry"`
+	ComputedAt       time.Time `json:"computed_at"` // 温度历史计算到该时间，没有计算过时为零值
+}
+
+// 平均动力学温度、超温时长和保质期损失的累计值，温度记录按时间顺序逐条加入
+// 每条记录的温度持续到下一条记录，最长 thermalHoldLimit，最后一条记录的持续时间在计算结果时才加上
+// 高于标示温度的时段按阿伦尼乌斯方程折算为额外消耗的保质期，低于标示温度不延长保质期
+type thermalAccumulator struct {
+	threshold, reference, energy float64
+
+	kinetic, monitored, above, lost float64
+	last                            *thermalPoint
+}
+
+func newThermalAccumulator(threshold, reference, energy float64) *thermalAccumulator {
+	return &thermalAccumulator{threshold: threshold, reference: reference, energy: energy}
+}
+
+// 累计一条记录从记录时间到 end 的温度
+func (a *thermalAccumulator) hold(point thermalPoint, end time.Time) {
+	if limit := point.At.Add(thermalHoldLimit); end.After(limit) {
+		end = limit
+	}
+	seconds := end.Sub(point.At).Seconds()
+	if seconds <= 0 {
+		return
+	}
+
+	ratio := a.energy / gasConstant // ΔH/R，单位K
+	kelvin := point.Temperature + kelvinOffset
+	a.kinetic += seconds * math.Exp(-ratio/kelvin)
+	a.monitored += seconds
+	if point.Temperature > a.threshold {
+		a.above += seconds
+	}
+	if factor := math.Exp(ratio * (1/(a.reference+kelvinOffset) - 1/kelvin)); factor > 1 {
+		a.lost += seconds * (factor - 1)
+	}
+}
+
+// 加入一条不早于最后一条记录的温度记录
+func (a *thermalAccumulator) add(point thermalPoint) {
+	if a.last != nil {
+		a.hold(*a.last, point.At)
+	}
+	a.last = &point
+}
+
+// 最后一条记录持续到 until 时的计算结果，不改变累计值
+func (a thermalAccumulator) summary(until time.Time, expiration time.Time) thermalSummary {
+	if a.last != nil {
+		a.hold(*a.last, until)
+	}
+	summary := thermalSummary{
+		Threshold:        a.threshold,
+		ReferenceTemp:    a.reference,
+		ActivationEnergy: a.energy,
+		ExpirationDate:   expiration,
+		ComputedAt:       until,
+	}
+	if a.monitored > 0 && a.kinetic > 0 {
+		mkt := a.energy/gasConstant/-math.Log(a.kinetic/a.monitored) - kelvinOffset
+		summary.MeanKineticTemp = &mkt
+	}
+	summary.TimeAbove = int64(a.above)
+	summary.MonitoredSeconds = int64(a.monitored)
+	summary.LostSeconds = int64(a.lost)
+	lostDuration := time.Duration(math.MaxInt64)
+	if a.lost < lostDuration.Seconds() {
+		lostDuration = time.Duration(a.lost * float64(time.Second))
+	}
+	summary.EffectiveExpiry = expiration.Add(-lostDuration)
+	return summary
+}
+
+// 按温度历史计算平均动力学温度、超温时长和动态保质期，晚于 until 的记录不计
+func summarizeThermalHistory(points []thermalPoint, until time.Time, threshold, reference, energy float64, expiration time.Time) thermalSummary {
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].At.Before(points[j].At)
+	})
+	accumulator := newThermalAccumulator(threshold, reference, energy)
+	for _, point := range points {
+		if point.At.Before(until) {
+			accumulator.add(point)
+		}
+	}
+	return accumulator.summary(until, expiration)
+}
+
+// 产品的温度历史，包括物流记录和绑定期间的设备读数
+// 设备读数使用原始读数，平均动力学温度按每条读数计算，不受汇总平均的影响
+// 超过原始读数保留期的时段只有汇总，使用15分钟汇总的平均温度
+func thermalPoints(db *gorm.DB, sku string) ([]thermalPoint, error) {
+	var points []thermalPoint
+
+	var records []configs.LogisticsRecord
+	if err := db.Select("created_at, temperature").Where("product_sku = ?", sku).Find(&records).Error; err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		points = append(points, thermalPoint{At: record.CreatedAt, Temperature: record.Temperature})
+	}
+
+	bindings, err := skuBindings(db, sku)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	// 保留期的起点取到下一个15分钟，之前的汇总时段不与原始读数重叠
+	var cutoff time.Time
+	if retention := configs.GlobalTelemetryConfig.RawRetention; retention > 0 {
+		cutoff = now.Add(-retention).Truncate(ResolutionQuarter).Add(ResolutionQuarter)
+	}
+	seen := make(map[uint]map[time.Time]bool)
+	for _, binding := range bindings {
+		from, to := binding.BoundAt, now
+		if binding.UnboundAt != nil {
+			to = *binding.UnboundAt
+		}
+		if seen[binding.DeviceID] == nil {
+			seen[binding.DeviceID] = make(map[time.Time]bool)
+		}
+		add := func(at time.Time, temperature float64) {
+			if !seen[binding.DeviceID][at] {
+				seen[binding.DeviceID][at] = true
+				points = append(points, thermalPoint{At: at, Temperature: temperature})
+			}
+		}
+
+		if from.Before(cutoff) {
+			end := cutoff.Add(-time.Nanosecond)
+			if to.Before(end) {
+				end = to
+			}
+			series, err := telemetryStore.Range(binding.DeviceID, from, end, ResolutionQuarter)
+			if err != nil {
+				return nil, err
+			}
+			for _, point := range series {
+				add(point.Time, point.AvgTemperature)
+			}
+			from = cutoff
+		}
+		if from.After(to) {
+			continue
+		}
+		readings, err := telemetryStore.Readings(binding.DeviceID, from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, reading := range readings {
+			add(reading.RecordedAt, reading.Temperature)
+		}
+	}
+	return points, nil
+}
+
+// 保存的累计值
+func shelfLifeAccumulator(state configs.ShelfLifeState) *thermalAccumulator {
+	accumulator := &thermalAccumulator{
+		threshold: state.Threshold,
+		reference: state.ReferenceTemp,
+		energy:    state.ActivationEnergy,
+		kinetic:   state.KineticSum,
+		monitored: state.MonitoredSum,
+		above:     state.AboveSum,
+		lost:      state.LostSum,
+	}
+	if state.LastAt != nil {
+		accumulator.last = &thermalPoint{At: *state.LastAt, Temperature: state.LastTemperature}
+	}
+	return accumulator
+}
+
+// 保存累计值和计算到 now 的结果，供列表排序使用
+func saveShelfLife(db *gorm.DB, state configs.ShelfLifeState, accumulator *thermalAccumulator, expiration, now time.Time) (*thermalSummary, error) {
+	summary := accumulator.summary(now, expiration)
+	state.MeanKineticTemp = summary.MeanKineticTemp
+	state.TimeAbove = summary.TimeAbove
+	state.MonitoredSeconds = summary.MonitoredSeconds
+	state.LostSeconds = summary.LostSeconds
+	state.EffectiveExpiry = summary.EffectiveExpiry
+	state.ComputedAt = now
+	state.KineticSum = accumulator.kinetic
+	state.MonitoredSum = accumulator.monitored
+	state.AboveSum = accumulator.above
+	state.LostSum = accumulator.lost
+	state.LastAt, state.LastTemperature = nil, 0
+	if accumulator.last != nil {
+		state.LastAt, state.LastTemperature = &accumulator.last.At, accumulator.last.Temperature
+	}
+	state.Threshold = accumulator.threshold
+	state.ReferenceTemp = accumulator.reference
+	state.ActivationEnergy = accumulator.energy
+	if err := db.Save(&state).Error; err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+// 按全部温度历史重新计算产品的动态保质期并保存
+// 晚于现在的记录（设备时钟略快）同样计入，与逐批累加的结果一致
+func computeShelfLife(db *gorm.DB, sku string) (*thermalSummary, error) {
+	return updateShelfLife(db, sku, nil, true)
+}
+
+// 把新的温度记录累加到已保存的结果上
+// 没有保存过、温湿度要求或标示温度变化、或有记录早于已累计的最后一条记录（迟到的读数、多个设备交错上报）时，按全部温度历史重新计算
+func updateShelfLife(db *gorm.DB, sku string, points []thermalPoint, full bool) (*thermalSummary, error) {
+	var product configs.ProductInfo
+	if err := db.Select("sku, expiration_date, transport_temp").Where("sku = ?", sku).First(&product).Error; err != nil {
+		return nil, err
+	}
+	profile, _, err := temperatureProfile(db, sku)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].At.Before(points[j].At)
+	})
+	energy := activationEnergy(profile)
+
+	var summary *thermalSummary
+	// 锁住保存的结果，并发写入的批次依次累加
+	err = db.Transaction(func(tx *gorm.DB) error {
+		state := configs.ShelfLifeState{ProductSKU: sku}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("product_sku = ?", sku).Limit(1).Find(&state).Error; err != nil {
+			return err
+		}
+		rebuild := full || state.ID == 0 || state.Threshold != profile.MaxTemperature || state.ReferenceTemp != product.TransportTemp || state.ActivationEnergy != energy ||
+			len(points) > 0 && state.LastAt != nil && points[0].At.Before(*state.LastAt)
+
+		accumulator := shelfLifeAccumulator(state)
+		added := points
+		if rebuild {
+			if added, err = thermalPoints(tx, sku); err != nil {
+				return err
+			}
+			sort.SliceStable(added, func(i, j int) bool {
+				return added[i].At.Before(added[j].At)
+			})
+			accumulator = newThermalAccumulator(profile.MaxTemperature, product.TransportTemp, energy)
+		}
+		for _, point := range added {
+			accumulator.add(point)
+		}
+		summary, err = saveShelfLife(tx, state, accumulator, product.ExpirationDate, time.Now())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// 温度记录、温湿度要求或产品信息变化后更新保存的保质期，points 为新增的温度记录
+// 失败只记录日志，不影响已写入的记录
+func refreshShelfLife(sku string, points ...thermalPoint) {
+	if _, err := updateShelfLife(configs.DB, sku, points, false); err != nil {
+		log.Printf("计算产品 %s 的保质期失败: %v", sku, err)
+	}
+}
+
+// 读取产品已保存的保质期，最后一条温度记录持续到现在
+// 没有保存过的产品没有温度历史，按标示的保质期返回
+func shelfLifeOf(db *gorm.DB, sku string) (*thermalSummary, error) {
+	var product configs.ProductInfo
+	if err := db.Select("sku, expiration_date, transport_temp").Where("sku = ?", sku).First(&product).Error; err != nil {
+		return nil, err
+	}
+	var state configs.ShelfLifeState
+	if err := db.Where("product_sku = ?", sku).Limit(1).Find(&state).Error; err != nil {
+		return nil, err
+	}
+	if state.ID == 0 {
+		profile, _, err := temperatureProfile(db, sku)
+		if err != nil {
+			return nil, err
+		}
+		return &thermalSummary{
+			Threshold:        profile.MaxTemperature,
+			ReferenceTemp:    product.TransportTemp,
+			ActivationEnergy: activationEnergy(profile),
+			ExpirationDate:   product.ExpirationDate,
+			EffectiveExpiry:  product.ExpirationDate,
+		}, nil
+	}
+
+	summary := shelfLifeAccumulator(state).summary(time.Now(), product.ExpirationDate)
+	return &summary, nil
+}
+
+// BackfillShelfLife 为还没有保存保质期的产品计算一次，返回计算的产品数
+func BackfillShelfLife() (int, error) {
+	var skus []string
+	err := configs.DB.Model(&configs.ProductInfo{}).
+		Joins("LEFT JOIN shelf_life_states ON shelf_life_states.product_sku = product_infos.sku").
+		Where("shelf_life_states.id IS NULL").
+		Pluck("product_infos.sku", &skus).Error
+	if err != nil {
+		return 0, err
+	}
+	for i, sku := range skus {
+		if _, err := computeShelfLife(configs.DB, sku); err != nil {
+			return i, err
+		}
+	}
+	return len(skus), nil
+}
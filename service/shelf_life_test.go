@@ -0,0 +1,285 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"gorm.io/gorm"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSummarizeThermalHistory(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.Local)
+	expiration := base.AddDate(0, 0, 30)
+	tests := []struct {
+		name      string
+		points    [][2]float64 // 小时偏移, 温度
+		until     float64      // 小时偏移
+		mkt       float64      // NaN 表示没有温度记录
+		above     int64
+		monitored int64
+		lost      int64 // 秒，允许1秒误差
+	}{
+		{name: "没有温度记录", until: 1, mkt: math.NaN()},
+		{name: "保持标示温度", points: [][2]float64{{0, 4}}, until: 1, mkt: 4, monitored: 3600},
+		{name: "高于标示温度", points: [][2]float64{{0, 10}}, until: 1, mkt: 10, above: 3600, monitored: 3600, lost: 4133},
+		{name: "低于标示温度不延长保质期", points: [][2]float64{{0, 0}}, until: 1, mkt: 0, monitored: 3600},
+		{
+			// 平均动力学温度按阿伦尼乌斯方程加权，高于算术平均
+			name:   "温度波动",
+			points: [][2]float64{{0, 0}, {1, 20}}, until: 2,
+			mkt: 14.816, above: 3600, monitored: 7200, lost: 22196,
+		},
+		{name: "记录乱序", points: [][2]float64{{1, 20}, {0, 0}}, until: 2, mkt: 14.816, above: 3600, monitored: 7200, lost: 22196},
+		{
+			// 超过12小时的空档视为没有记录
+			name:   "记录空档",
+			points: [][2]float64{{0, 4}, {24, 4}}, until: 25,
+			mkt: 4, monitored: 13 * 3600,
+		},
+		{name: "晚于计算时间的记录", points: [][2]float64{{0, 4}, {2, 20}}, until: 1, mkt: 4, monitored: 3600},
+	}
+
+	at := func(hours float64) time.Time { return base.Add(time.Duration(hours * float64(time.Hour))) }
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var points []thermalPoint
+			for _, point := range tt.points {
+				points = append(points, thermalPoint{At: at(point[0]), Temperature: point[1]})
+			}
+			summary := summarizeThermalHistory(points, at(tt.until), 8, 4, defaultActivationEnergy, expiration)
+
+			if math.IsNaN(tt.mkt) {
+				if summary.MeanKineticTemp != nil {
+					t.Fatalf("没有温度记录时平均动力学温度应为空，得到 %v", *summary.MeanKineticTemp)
+				}
+			} else if summary.MeanKineticTemp == nil || math.Abs(*summary.MeanKineticTemp-tt.mkt) > 0.001 {
+				t.Fatalf("平均动力学温度 %v，期望 %v", summary.MeanKineticTemp, tt.mkt)
+			}
+			if summary.TimeAbove != tt.above || summary.MonitoredSeconds != tt.monitored {
+				t.Fatalf("超温 %d 秒，记录覆盖 %d 秒", summary.TimeAbove, summary.MonitoredSeconds)
+			}
+			if diff := summary.LostSeconds - tt.lost; diff < -1 || diff > 1 {
+				t.Fatalf("损失保质期 %d 秒，期望 %d", summary.LostSeconds, tt.lost)
+			}
+			if int64(expiration.Sub(summary.EffectiveExpiry)/time.Second) != summary.LostSeconds {
+				t.Fatalf("动态保质期 %v", summary.EffectiveExpiry)
+			}
+		})
+	}
+}
+
+// 写入一组间隔1分钟的设备读数，返回绑定的设备
+func testThermalReadings(t *testing.T, sku string, ownerID uint, start time.Time, temperatures ...float64) configs.Device {
+	t.Helper()
+	device := testDevice(t, ownerID)
+	configs.DB.Create(&configs.DeviceBinding{DeviceID: device.ID, ProductSKU: sku, BoundAt: start.Add(-time.Minute)})
+	inputs := make([]telemetryReadingInput, len(temperatures))
+	for i := range temperatures {
+		inputs[i] = telemetryReadingInput{RecordedAt: start.Add(time.Duration(i) * time.Minute), Temperature: &temperatures[i]}
+	}
+	if _, err := ingestTelemetry(device, inputs); err != nil {
+		t.Fatal(err)
+	}
+	return device
+}
+
+func TestThermalPoints(t *testing.T) {
+	testDB(t)
+	factory := testUser(t, 1)
+	testProduct(t, "SKU-1", factory.ID)
+	// 同一个15分钟时段内的读数，平均温度为4.8
+	start := time.Now().Add(-2 * time.Hour).Truncate(ResolutionQuarter).Add(time.Minute)
+	testThermalReadings(t, "SKU-1", factory.ID, start, 2, 2, 2, 2, 2, 2, 2, 2, 2, 30)
+
+	retention := configs.GlobalTelemetryConfig.RawRetention
+	t.Cleanup(func() { configs.GlobalTelemetryConfig.RawRetention = retention })
+	tests := []struct {
+		name      string
+		retention time.Duration
+		points    int
+		max       float64
+	}{
+		{name: "使用原始读数", retention: 0, points: 10, max: 30},
+		{name: "原始读数保留期内", retention: 24 * time.Hour, points: 10, max: 30},
+		{name: "超过保留期使用15分钟汇总", retention: time.Hour, points: 1, max: 4.8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs.GlobalTelemetryConfig.RawRetention = tt.retention
+			points, err := thermalPoints(configs.DB, "SKU-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			max := math.Inf(-1)
+			for _, point := range points {
+				max = math.Max(max, point.Temperature)
+			}
+			if len(points) != tt.points || math.Abs(max-tt.max) > 1e-9 {
+				t.Fatalf("温度记录 %d 条，最高 %v", len(points), max)
+			}
+		})
+	}
+}
+
+// 溯源接口返回的保质期
+func testTraceShelfLife(t *testing.T, sku string) thermalSummary {
+	t.Helper()
+	w := testHandle((&QueryService{}).TraceProduct, configs.User{}, http.MethodGet, "/api/query/trace?sku="+sku, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("状态码 %d: %s", w.Code, w.Body.String())
+	}
+	var trace struct {
+		ShelfLife thermalSummary `json:"shelf_life"`
+	}
+	testResponseData(t, w.Body.Bytes(), &trace)
+	return trace.ShelfLife
+}
+
+func TestTraceShelfLife(t *testing.T) {
+	testDB(t)
+	factory := testUser(t, 1)
+	testProduct(t, "SKU-1", factory.ID)
+	plain := testProduct(t, "SKU-2", factory.ID)
+	testThermalReadings(t, "SKU-1", factory.ID, time.Now().Add(-time.Hour), 4, 12, 12, 4)
+
+	tests := []struct {
+		name   string
+		sku    string
+		cached bool
+	}{
+		// 写入读数时已经计算，查询只读取保存的结果
+		{name: "有温度记录的产品", sku: "SKU-1", cached: true},
+		{name: "没有温度记录的产品", sku: plain.SKU},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before configs.ShelfLifeState
+			found := configs.DB.Where("product_sku = ?", tt.sku).Limit(1).Find(&before).RowsAffected > 0
+			if found != tt.cached {
+				t.Fatalf("保存的保质期 %+v", before)
+			}
+
+			for i := 0; i < 2; i++ {
+				summary := testTraceShelfLife(t, tt.sku)
+				if summary.LostSeconds != before.LostSeconds || summary.TimeAbove != before.TimeAbove {
+					t.Fatalf("溯源返回的保质期 %+v，保存的 %+v", summary, before)
+				}
+				// 最后一条读数持续到查询时
+				if tt.cached && (summary.MeanKineticTemp == nil || summary.EffectiveExpiry.Sub(before.EffectiveExpiry).Abs() > time.Millisecond || summary.LostSeconds == 0 ||
+					summary.ComputedAt.Before(before.ComputedAt) || summary.MonitoredSeconds < int64(time.Since(*before.LastAt)/time.Second)) {
+					t.Fatalf("溯源返回的保质期 %+v", summary)
+				}
+				if !tt.cached && (summary.MeanKineticTemp != nil || !summary.EffectiveExpiry.Equal(summary.ExpirationDate)) {
+					t.Fatalf("没有温度记录时返回 %+v", summary)
+				}
+			}
+
+			// 查询不写入保质期
+			var after configs.ShelfLifeState
+			configs.DB.Where("product_sku = ?", tt.sku).Limit(1).Find(&after)
+			if after.ID != before.ID || !after.ComputedAt.Equal(before.ComputedAt) {
+				t.Fatalf("查询后保存的保质期 %+v", after)
+			}
+		})
+	}
+}
+
+func TestBackfillShelfLife(t *testing.T) {
+	testDB(t)
+	factory := testUser(t, 1)
+	testProduct(t, "SKU-1", factory.ID)
+	testProduct(t, "SKU-2", factory.ID)
+	testShipment(t, "T1", "SKU-1")
+
+	count, err := BackfillShelfLife()
+	if err != nil || count != 2 {
+		t.Fatalf("计算 %d 个产品: %v", count, err)
+	}
+	var state configs.ShelfLifeState
+	if err := configs.DB.Where("product_sku = ?", "SKU-1").First(&state).Error; err != nil || state.MeanKineticTemp == nil {
+		t.Fatalf("保存的保质期 %+v %v", state, err)
+	}
+
+	// 已有保质期的产品不再计算
+	if count, err := BackfillShelfLife(); err != nil || count != 0 {
+		t.Fatalf("再次计算 %d 个产品: %v", count, err)
+	}
+}
+
+// 新的读数累加到保存的结果上，迟到的读数和温湿度要求变化时按全部温度历史重新计算
+func TestShelfLifeIncremental(t *testing.T) {
+	tests := []struct {
+		name    string
+		offset  time.Duration // 第二批读数相对第一批的时间
+		profile bool          // 第二批之前修改温湿度要求
+		rebuild bool
+	}{
+		{name: "按顺序上报", offset: 10 * time.Minute},
+		{name: "迟到的读数", offset: -time.Minute, rebuild: true},
+		{name: "修改温湿度要求", offset: 10 * time.Minute, profile: true, rebuild: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDB(t)
+			factory := testUser(t, 1)
+			testProduct(t, "SKU-1", factory.ID)
+			start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+			device := testThermalReadings(t, "SKU-1", factory.ID, start, 4, 12, 12, 4)
+
+			// 改动保存的累计值，重新计算时才会被覆盖
+			const marker = 100000.0
+			configs.DB.Model(&configs.ShelfLifeState{}).Where("product_sku = ?", "SKU-1").Update("above_sum", gorm.Expr("above_sum + ?", marker))
+			if tt.profile {
+				profile := testExcursionProfile()
+				profile.ProductSKU = "SKU-1"
+				profile.MaxTemperature = 10
+				configs.DB.Create(&profile)
+			}
+
+			inputs := make([]telemetryReadingInput, 3)
+			temperatures := []float64{15, 15, 4}
+			for i := range inputs {
+				inputs[i] = telemetryReadingInput{RecordedAt: start.Add(tt.offset + time.Duration(i)*time.Minute + 30*time.Second), Temperature: &temperatures[i]}
+			}
+			if _, err := ingestTelemetry(device, inputs); err != nil {
+				t.Fatal(err)
+			}
+
+			var state configs.ShelfLifeState
+			configs.DB.Where("product_sku = ?", "SKU-1").First(&state)
+			if rebuilt := state.AboveSum < marker; rebuilt != tt.rebuild {
+				t.Fatalf("重新计算 %v，保存的累计值 %+v", rebuilt, state)
+			}
+
+			// 去掉改动后与按全部温度历史计算的结果一致
+			incremental := shelfLifeAccumulator(state)
+			if !tt.rebuild {
+				incremental.above -= marker
+			}
+			if _, err := computeShelfLife(configs.DB, "SKU-1"); err != nil {
+				t.Fatal(err)
+			}
+			var full configs.ShelfLifeState
+			configs.DB.Where("product_sku = ?", "SKU-1").First(&full)
+			expected := shelfLifeAccumulator(full)
+			for _, pair := range [][2]float64{
+				{incremental.kinetic, expected.kinetic},
+				{incremental.monitored, expected.monitored},
+				{incremental.above, expected.above},
+				{incremental.lost, expected.lost},
+			} {
+				if math.Abs(pair[0]-pair[1]) > 1e-6*math.Max(1, math.Abs(pair[1])) {
+					t.Fatalf("累计值 %+v，重新计算 %+v", incremental, expected)
+				}
+			}
+			if !incremental.last.At.Equal(expected.last.At) {
+				t.Fatalf("最后一条读数 %v，重新计算 %v", incremental.last.At, expected.last.At)
+			}
+		})
+	}
+}
@@ -0,0 +1,497 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// KeyAlgorithmEd25519 签名算法
+const KeyAlgorithmEd25519 = "ed25519"
+
+// ErrKeySecretMissing 没有配置托管私钥的加密密钥
+var ErrKeySecretMissing = errors.New("未配置托管私钥的加密密钥，请设置 LEDGER_KEY_SECRET 或 LEDGER_KEY_SECRET_FILE")
+
+// 用配置中的密钥派生AES-256密钥
+func custodialCipher() (cipher.AEAD, error) {
+	return custodialCipherWith(configs.GlobalLedgerConfig.KeyEncryptSecret)
+}
+
+// 用指定密钥派生AES-256密钥，密钥为空时拒绝加解密
+func custodialCipherWith(secret string) (cipher.AEAD, error) {
+	if secret == "" {
+		return nil, ErrKeySecretMissing
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 加密托管私钥
+func encryptPrivateKey(priv ed25519.PrivateKey) (string, error) {
+	aead, err := custodialCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, priv.Seed(), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// 解密托管私钥
+func decryptPrivateKey(encrypted string) (ed25519.PrivateKey, error) {
+	aead, err := custodialCipher()
+	if err != nil {
+		return nil, err
+	}
+	return openPrivateKey(aead, encrypted)
+}
+
+func openPrivateKey(aead cipher.AEAD, encrypted string) (ed25519.PrivateKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < aead.NonceSize() {
+		return nil, errors.New("托管私钥格式错误")
+	}
+	seed, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ReencryptUserKeys 把用旧密钥加密的托管私钥改用当前密钥加密，返回重新加密的数量
+// 已经能用当前密钥解密的私钥保持不变，因此可以重复执行
+func ReencryptUserKeys(oldSecret string) (int, error) {
+	current, err := custodialCipher()
+	if err != nil {
+		return 0, err
+	}
+	old, err := custodialCipherWith(oldSecret)
+	if err != nil {
+		return 0, err
+	}
+
+	reencrypted := 0
+	err = configs.DB.Transaction(func(tx *gorm.DB) error {
+		var keys []configs.UserKey
+		if err := tx.Where("private_key <> ''").Find(&keys).Error; err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if _, err := openPrivateKey(current, key.PrivateKey); err == nil {
+				continue
+			}
+			priv, err := openPrivateKey(old, key.PrivateKey)
+			if err != nil {
+				return fmt.Errorf("密钥 %d 无法用新旧密钥解密: %w", key.ID, err)
+			}
+			encrypted, err := encryptPrivateKey(priv)
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(&configs.UserKey{}).Where("id = ?", key.ID).Update("private_key", encrypted).Error; err != nil {
+				return err
+			}
+			reencrypted++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return reencrypted, nil
+}
+
+// CheckCustodialKeys 检查加密密钥已配置，且所有托管私钥都能用它解密
+// 密钥配错时拒绝启动，避免之后签名失败或用错误的密钥加密新私钥
+func CheckCustodialKeys() error {
+	aead, err := custodialCipher()
+	if err != nil {
+		return err
+	}
+	var keys []configs.UserKey
+	if err := configs.DB.Where("private_key <> ''").Find(&keys).Error; err != nil {
+		return err
+	}
+	failed := 0
+	for _, key := range keys {
+		if _, err := openPrivateKey(aead, key.PrivateKey); err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d 个托管私钥无法用当前密钥解密，更换密钥时请设置 LEDGER_OLD_KEY_SECRET", failed)
+	}
+	return nil
+}
+
+// SigningKeySKU 记录签名密钥登记和轮换事件的系统链，产品SKU以P开头，不会与它冲突
+const SigningKeySKU = "_signing_keys"
+
+// 为用户生成新的托管密钥，并把公钥和有效期写入账本
+// revoked 为同时吊销的旧密钥，首次生成时为nil；调用方需持有账本锁
+func createUserKey(tx *gorm.DB, userID uint, revoked *configs.UserKey) (*configs.UserKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encryptPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	key := configs.UserKey{
+		UserID:     userID,
+		Algorithm:  KeyAlgorithmEd25519,
+		PublicKey:  hex.EncodeToString(pub),
+		PrivateKey: encrypted,
+	}
+	if err := registerKey(tx, &key, revoked); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// 保存密钥并把登记事件写入密钥链，轮换时新密钥从旧密钥吊销的时刻生效
+func registerKey(tx *gorm.DB, key *configs.UserKey, revoked *configs.UserKey) error {
+	key.ValidFrom = time.Now().UnixNano()
+	if revoked != nil {
+		key.ValidFrom = revoked.RevokedAt
+	}
+	if err := tx.Create(key).Error; err != nil {
+		return err
+	}
+
+	// 登记事件用新密钥签名，写入时新密钥已经是当前的密钥
+	event := &events.KeyRotated{
+		UserID:    key.UserID,
+		KeyID:     key.ID,
+		Algorithm: key.Algorithm,
+		PublicKey: key.PublicKey,
+		ValidFrom: key.ValidFrom,
+	}
+	if revoked != nil {
+		event.RevokedKeyID = revoked.ID
+		event.RevokedAt = revoked.RevokedAt
+	}
+	_, err := (&BlockchainService{}).AddEventTx(tx, SigningKeySKU, event, key.UserID)
+	return err
+}
+
+// 获取用户当前有效的密钥，没有则自动生成托管密钥
+// 生成密钥会写入账本，需在 ledgerTransaction 开启的事务中调用
+func activeUserKey(tx *gorm.DB, userID uint) (*configs.UserKey, error) {
+	key, err := currentUserKey(tx, userID)
+	if err != nil || key != nil {
+		return key, err
+	}
+	// 持有账本锁后再查一次，并发的首次签名只会生成一个密钥
+	if err := lockLedger(tx); err != nil {
+		return nil, err
+	}
+	if key, err = currentUserKey(tx, userID); err != nil || key != nil {
+		return key, err
+	}
+	if userID == ServerSignerID {
+		return nil, errors.New("服务端签名密钥尚未登记到账本")
+	}
+	return createUserKey(tx, userID, nil)
+}
+
+// 用户当前有效的密钥，没有时返回nil
+func currentUserKey(tx *gorm.DB, userID uint) (*configs.UserKey, error) {
+	var key configs.UserKey
+	result := tx.Where("user_id = ? AND revoked_at = 0", userID).
+		Order("valid_from DESC").
+		Limit(1).
+		Find(&key)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, result.Error
+	}
+	return &key, nil
+}
+
+// RotateUserKey 吊销用户当前的密钥并生成新的托管密钥，吊销和新密钥一起写入账本
+// 轮换时持有账本锁，正在签名的区块要么在吊销之前写入，要么等轮换完成后使用新密钥
+// 旧密钥保留用于验证吊销之前签名的区块，需在 ledgerTransaction 开启的事务中调用
+func RotateUserKey(tx *gorm.DB, userID uint) (*configs.UserKey, error) {
+	if err := lockLedger(tx); err != nil {
+		return nil, err
+	}
+
+	current, err := currentUserKey(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return createUserKey(tx, userID, nil)
+	}
+
+	if err := revokeKey(tx, current); err != nil {
+		return nil, err
+	}
+	return createUserKey(tx, userID, current)
+}
+
+// 吊销密钥所属用户当前的全部密钥
+func revokeKey(tx *gorm.DB, current *configs.UserKey) error {
+	current.RevokedAt = time.Now().UnixNano()
+	return tx.Model(&configs.UserKey{}).
+		Where("user_id = ? AND revoked_at = 0", current.UserID).
+		Update("revoked_at", current.RevokedAt).Error
+}
+
+// ServerSignerID 服务端签名密钥在密钥链上登记时使用的用户ID，用户ID从1开始，不会与它冲突
+const ServerSignerID uint = 0
+
+// RegisterServerKey 把当前服务端公钥登记到账本的密钥链上，更换了服务端密钥时吊销之前登记的公钥
+// 检查点和快照只信任账本中登记过的服务端公钥，历史公钥在吊销之前签发的数据仍然有效
+// 服务端私钥保存在密钥文件中，数据库中的密钥行只记录公钥；集群中的节点应使用同一个服务端密钥
+func RegisterServerKey() error {
+	public := ServerPublicKey()
+	if public == "" {
+		return errors.New("服务端签名密钥未初始化")
+	}
+	if current, err := currentUserKey(configs.DB, ServerSignerID); err != nil || (current != nil && current.PublicKey == public) {
+		return err
+	}
+	return ledgerTransaction(func(tx *gorm.DB) error {
+		if err := lockLedger(tx); err != nil {
+			return err
+		}
+		current, err := currentUserKey(tx, ServerSignerID)
+		if err != nil {
+			return err
+		}
+		if current != nil && current.PublicKey == public {
+			return nil
+		}
+		if current != nil {
+			if err := revokeKey(tx, current); err != nil {
+				return err
+			}
+		}
+		key := configs.UserKey{UserID: ServerSignerID, Algorithm: KeyAlgorithmEd25519, PublicKey: public}
+		return registerKey(tx, &key, current)
+	})
+}
+
+// 账本中登记的服务端公钥在 at 时是否可信，登记之前签发的数据也认可，吊销之后签发的不再认可
+func checkServerKey(db *gorm.DB, publicKey string, at int64) error {
+	keys, err := ledgerSignerKeys(db)
+	if err != nil {
+		return err
+	}
+	registered := false
+	for _, key := range keys {
+		if key.UserID != ServerSignerID || key.PublicKey != publicKey {
+			continue
+		}
+		if key.RevokedAt == 0 || at < key.RevokedAt {
+			return nil
+		}
+		registered = true
+	}
+	if registered {
+		return errors.New("签名时服务端密钥已被吊销")
+	}
+	return errors.New("签名公钥不是账本中登记的服务端密钥")
+}
+
+// 用托管密钥为区块签名
+// 密钥需在区块时间戳之前取得，保证签名时密钥已生效
+func signBlock(block *configs.BlockchainLog, key *configs.UserKey) error {
+	if key.UserID == ServerSignerID {
+		// 服务端密钥链上的区块用密钥文件中的服务端私钥签名
+		if serverKey == nil || key.PublicKey != ServerPublicKey() {
+			return errors.New("服务端签名密钥与账本中登记的不一致")
+		}
+		block.SignerID = key.UserID
+		block.SignerKeyID = key.ID
+		block.Signature = hex.EncodeToString(ed25519.Sign(serverKey, headerOf(*block).Encode()))
+		return nil
+	}
+	if key.PrivateKey == "" {
+		return errors.New("用户密钥未托管，无法由服务端签名")
+	}
+	priv, err := decryptPrivateKey(key.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	block.SignerID = key.UserID
+	block.SignerKeyID = key.ID
+	block.Signature = hex.EncodeToString(ed25519.Sign(priv, headerOf(*block).Encode()))
+	return nil
+}
+
+// 检查区块签名，密钥必须属于签名者且在区块时间戳时有效
+func checkBlockSignature(block configs.BlockchainLog, keys map[uint]configs.UserKey) string {
+	key, ok := keys[block.SignerKeyID]
+	if !ok || key.UserID != block.SignerID {
+		return "签名密钥不存在"
+	}
+	if block.Timestamp < key.ValidFrom || (key.RevokedAt != 0 && block.Timestamp >= key.RevokedAt) {
+		return "签名时密钥不在有效期内"
+	}
+
+	pub, err := hex.DecodeString(key.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return "签名公钥格式错误"
+	}
+	sig, err := hex.DecodeString(block.Signature)
+	if err != nil || !ed25519.Verify(pub, headerOf(block).Encode(), sig) {
+		return "区块签名无效"
+	}
+	return ""
+}
+
+// 从账本中的密钥事件加载全部签名密钥
+// 公钥和有效期以账本为准，user_keys 表只用于保存托管私钥，改写表中的公钥不影响验证
+func ledgerSignerKeys(db *gorm.DB) (map[uint]configs.UserKey, error) {
+	blocks, err := skuBlocks(db, SigningKeySKU)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[uint]configs.UserKey)
+	for _, block := range blocks {
+		if err := addSignerKey(keys, block); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// 把密钥链上一个区块登记或轮换的密钥加入 keys
+func addSignerKey(keys map[uint]configs.UserKey, block configs.BlockchainLog) error {
+	event, err := decodeBlockEvent(block)
+	if err != nil {
+		return fmt.Errorf("解析密钥区块 %s 失败: %w", block.Hash, err)
+	}
+	e, ok := event.(*events.KeyRotated)
+	if !ok {
+		return nil
+	}
+	keys[e.KeyID] = configs.UserKey{
+		Model:     gorm.Model{ID: e.KeyID},
+		UserID:    e.UserID,
+		Algorithm: e.Algorithm,
+		PublicKey: e.PublicKey,
+		ValidFrom: e.ValidFrom,
+	}
+	if old, ok := keys[e.RevokedKeyID]; ok && old.UserID == e.UserID {
+		old.RevokedAt = e.RevokedAt
+		keys[old.ID] = old
+	}
+	return nil
+}
+
+// 加载区块用到的签名密钥，账本中没有登记的密钥不返回，验证时按密钥不存在处理
+func loadSignerKeys(blocks []configs.BlockchainLog) (map[uint]configs.UserKey, error) {
+	keys := make(map[uint]configs.UserKey)
+	needed := false
+	for _, block := range blocks {
+		if block.SignerKeyID != 0 {
+			needed = true
+			break
+		}
+	}
+	if !needed {
+		return keys, nil
+	}
+
+	all, err := ledgerSignerKeys(configs.DB)
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range blocks {
+		if key, ok := all[block.SignerKeyID]; ok {
+			keys[key.ID] = key
+		}
+	}
+	return keys, nil
+}
+
+// 服务端签名密钥，用于签名检查点等由服务端出具的数据
+var serverKey ed25519.PrivateKey
+
+// InitServerKey 加载服务端签名密钥，文件不存在时生成新密钥
+func InitServerKey(path string) error {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return errors.New("服务端密钥格式错误")
+		}
+		serverKey = ed25519.NewKeyFromSeed(seed)
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(priv.Seed())), 0600); err != nil {
+		return err
+	}
+	serverKey = priv
+	return nil
+}
+
+// ServerPublicKey 获取服务端签名公钥(hex)
+func ServerPublicKey() string {
+	if serverKey == nil {
+		return ""
+	}
+	return hex.EncodeToString(serverKey.Public().(ed25519.PublicKey))
+}
+
+// 用服务端密钥签名
+func signWithServerKey(message []byte) (string, error) {
+	if serverKey == nil {
+		return "", errors.New("服务端签名密钥未初始化")
+	}
+	return hex.EncodeToString(ed25519.Sign(serverKey, message)), nil
+}
+
+// 用指定公钥验证签名
+func verifyEd25519(publicKey, signature string, message []byte) bool {
+	pub, err := hex.DecodeString(publicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(pub, message, sig)
+}
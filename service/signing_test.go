@@ -0,0 +1,207 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"gorm.io/gorm"
+	"testing"
+)
+
+// 在测试期间使用指定的加密密钥
+func testKeySecret(t *testing.T, secret string) {
+	t.Helper()
+	previous := configs.GlobalLedgerConfig.KeyEncryptSecret
+	configs.GlobalLedgerConfig.KeyEncryptSecret = secret
+	t.Cleanup(func() {
+		configs.GlobalLedgerConfig.KeyEncryptSecret = previous
+	})
+}
+
+func TestCustodialKeyRequiresSecret(t *testing.T) {
+	testKeySecret(t, "")
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := encryptPrivateKey(priv); !errors.Is(err, ErrKeySecretMissing) {
+		t.Fatalf("未配置密钥时加密应失败: %v", err)
+	}
+	if _, err := decryptPrivateKey("AAAA"); !errors.Is(err, ErrKeySecretMissing) {
+		t.Fatalf("未配置密钥时解密应失败: %v", err)
+	}
+}
+
+func TestDecryptPrivateKey(t *testing.T) {
+	testKeySecret(t, "secret-a")
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	encrypted, err := encryptPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := base64.StdEncoding.DecodeString(encrypted)
+	raw[len(raw)-1] ^= 1
+	tampered := base64.StdEncoding.EncodeToString(raw)
+
+	tests := []struct {
+		name      string
+		secret    string
+		encrypted string
+		ok        bool
+	}{
+		{name: "正确的密钥", secret: "secret-a", encrypted: encrypted, ok: true},
+		{name: "错误的密钥", secret: "secret-b", encrypted: encrypted},
+		{name: "密文被篡改", secret: "secret-a", encrypted: tampered},
+		{name: "密文过短", secret: "secret-a", encrypted: "AAAA"},
+		{name: "不是Base64", secret: "secret-a", encrypted: "%%"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs.GlobalLedgerConfig.KeyEncryptSecret = tt.secret
+			got, err := decryptPrivateKey(tt.encrypted)
+			if tt.ok != (err == nil) {
+				t.Fatalf("解密结果 %v", err)
+			}
+			if tt.ok && !got.Equal(priv) {
+				t.Fatal("解密得到的私钥不一致")
+			}
+		})
+	}
+}
+
+func TestReencryptUserKeys(t *testing.T) {
+	testDB(t)
+	testKeySecret(t, "old-secret")
+	user := testUser(t, 1)
+	blockchainService := &BlockchainService{}
+	if _, err := blockchainService.AddToBlockchain("SKU-1", 1, `{}`, user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// 换用新密钥后已有私钥无法解密，启动检查应失败
+	configs.GlobalLedgerConfig.KeyEncryptSecret = "new-secret"
+	if err := CheckCustodialKeys(); err == nil {
+		t.Fatal("已有私钥无法解密时检查应失败")
+	}
+	if _, err := ReencryptUserKeys("wrong-secret"); err == nil {
+		t.Fatal("旧密钥错误时重新加密应失败")
+	}
+
+	count, err := ReencryptUserKeys("old-secret")
+	if err != nil || count != 1 {
+		t.Fatalf("重新加密 %d 个: %v", count, err)
+	}
+	if err := CheckCustodialKeys(); err != nil {
+		t.Fatal(err)
+	}
+	count, err = ReencryptUserKeys("old-secret")
+	if err != nil || count != 0 {
+		t.Fatalf("重复执行不应再次加密: %d %v", count, err)
+	}
+
+	// 重新加密后仍使用原来的密钥签名，已有区块的签名继续有效
+	if _, err := blockchainService.AddToBlockchain("SKU-1", 1, `{"n":2}`, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	var keys int64
+	configs.DB.Model(&configs.UserKey{}).Count(&keys)
+	res, _, err := verifySKULedger("SKU-1", true)
+	if err != nil || !res.Valid || !res.Verified || keys != 1 {
+		t.Fatalf("重新加密后验证失败: %+v %v，密钥 %d 个", res, err, keys)
+	}
+}
+
+func TestRotateUserKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, oldKey configs.UserKey)
+		reason string
+	}{
+		{name: "轮换前后的区块都能验证"},
+		{
+			// 账本中登记了原来的公钥，只改数据库里的公钥不影响验证
+			name: "改写数据库中的公钥",
+			tamper: func(t *testing.T, oldKey configs.UserKey) {
+				pub, _, _ := ed25519.GenerateKey(rand.Reader)
+				configs.DB.Model(&oldKey).Update("public_key", hex.EncodeToString(pub))
+			},
+		},
+		{
+			// 换上自己的公钥后重新签名历史区块，账本中登记的公钥对不上
+			name: "换公钥后重新签名历史区块",
+			tamper: func(t *testing.T, oldKey configs.UserKey) {
+				pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+				configs.DB.Model(&oldKey).Update("public_key", hex.EncodeToString(pub))
+				var block configs.BlockchainLog
+				configs.DB.Where("product_sku = ? AND block_height = 1", "SKU-1").First(&block)
+				block.Signature = hex.EncodeToString(ed25519.Sign(priv, headerOf(block).Encode()))
+				configs.DB.Model(&block).Update("signature", block.Signature)
+			},
+			reason: "区块签名无效",
+		},
+		{
+			// 吊销时间以账本为准，在数据库中恢复旧密钥不能让它继续签名
+			name: "改写数据库中的吊销时间",
+			tamper: func(t *testing.T, oldKey configs.UserKey) {
+				configs.DB.Model(&oldKey).Update("revoked_at", 0)
+				configs.DB.Model(&configs.UserKey{}).Where("user_id = ? AND id <> ?", oldKey.UserID, oldKey.ID).Update("revoked_at", 1)
+				key := oldKey
+				if err := ledgerTransaction(func(tx *gorm.DB) error {
+					_, err := (&BlockchainService{}).AddToBlockchainTx(tx, "SKU-1", 1, `{"n":3}`, key.UserID)
+					return err
+				}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			reason: "签名时密钥不在有效期内",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDB(t)
+			user := testUser(t, 1)
+			blockchainService := &BlockchainService{}
+			if _, err := blockchainService.AddToBlockchain("SKU-1", 1, `{"n":1}`, user.ID); err != nil {
+				t.Fatal(err)
+			}
+			var oldKey configs.UserKey
+			configs.DB.Where("user_id = ?", user.ID).First(&oldKey)
+
+			var newKey *configs.UserKey
+			err := ledgerTransaction(func(tx *gorm.DB) error {
+				var err error
+				newKey, err = RotateUserKey(tx, user.ID)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := blockchainService.AddToBlockchain("SKU-1", 1, `{"n":2}`, user.ID); err != nil {
+				t.Fatal(err)
+			}
+
+			// 账本中的密钥链记录了首次登记和轮换
+			keys, err := ledgerSignerKeys(configs.DB)
+			if err != nil || len(keys) != 2 || keys[oldKey.ID].RevokedAt == 0 || keys[oldKey.ID].RevokedAt != keys[newKey.ID].ValidFrom {
+				t.Fatalf("账本中的密钥 %+v %v", keys, err)
+			}
+
+			if tt.tamper != nil {
+				tt.tamper(t, oldKey)
+			}
+			for _, sku := range []string{"SKU-1", SigningKeySKU} {
+				res, _, err := verifySKULedger(sku, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if sku == SigningKeySKU && !res.Valid {
+					t.Fatalf("密钥链验证结果 %+v", res)
+				}
+				if sku == "SKU-1" && (res.Valid != (tt.reason == "") || res.Reason != tt.reason) {
+					t.Fatalf("验证结果 %+v", res)
+				}
+			}
+		})
+	}
+}
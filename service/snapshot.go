@@ -0,0 +1,780 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/api"
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ErrSnapshotUntrusted 快照签名或SKU链头验证失败
+var ErrSnapshotUntrusted = errors.New("快照不可信")
+
+// 冷存储中的归档账本，与文件账本镜像格式相同，未启用归档时为nil
+var ledgerArchive *FileLedger
+
+// OpenLedgerArchive 打开冷存储目录中的归档账本，目录为空时不启用归档
+func OpenLedgerArchive(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	archive, err := OpenFileLedger(dir, configs.GlobalLedgerConfig.MirrorSegment)
+	if err != nil {
+		return err
+	}
+	archive.archive = true
+	ledgerArchive = archive
+	return nil
+}
+
+// 已归档到冷存储的最高全局高度
+func archivedHeight() int64 {
+	if ledgerArchive == nil {
+		return 0
+	}
+	head, err := ledgerArchive.Head("")
+	if err != nil {
+		return 0
+	}
+	return head.GlobalHeight
+}
+
+// 某个SKU已归档的区块数
+func archivedSKUCount(sku string) int64 {
+	if ledgerArchive == nil {
+		return 0
+	}
+	return ledgerArchive.SKUCount(sku)
+}
+
+// 冷存储中一段全局高度的区块哈希
+func archivedLeaves(from, to int64) ([]string, error) {
+	blocks, err := ledgerArchive.Range(from, to)
+	if err != nil {
+		return nil, err
+	}
+	leaves := make([]string, len(blocks))
+	for i, block := range blocks {
+		leaves[i] = block.Hash
+	}
+	return leaves, nil
+}
+
+// 按区块高度顺序获取SKU的全部区块，包括已归档的区块
+func skuBlocks(db *gorm.DB, sku string) ([]configs.BlockchainLog, error) {
+	return skuBlocksPage(db, sku, 0, -1)
+}
+
+// 按哈希或记录ID查找区块，数据库中没有时从冷存储读取，archived 表示区块已归档
+func findBlock(query string, arg interface{}, fromArchive func() (*configs.BlockchainLog, error)) (block *configs.BlockchainLog, archived bool, err error) {
+	block = &configs.BlockchainLog{}
+	err = configs.DB.Where(query, arg).First(block).Error
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return block, false, err
+	}
+	if archivedHeight() == 0 {
+		return nil, false, ErrBlockNotFound
+	}
+	block, err = fromArchive()
+	return block, err == nil, err
+}
+
+func blockByHash(hash string) (*configs.BlockchainLog, bool, error) {
+	return findBlock("hash = ?", hash, func() (*configs.BlockchainLog, error) {
+		return ledgerArchive.GetByHash(hash)
+	})
+}
+
+func blockByID(id uint) (*configs.BlockchainLog, bool, error) {
+	return findBlock("id = ?", id, func() (*configs.BlockchainLog, error) {
+		return ledgerArchive.GetByID(id)
+	})
+}
+
+// 按区块高度顺序获取SKU中区块高度大于 after 的区块，最多 limit 个，limit 小于等于0时不限制
+// 已归档的区块从冷存储读取
+func skuBlocksPage(db *gorm.DB, sku string, after int64, limit int) ([]configs.BlockchainLog, error) {
+	archived := archivedHeight()
+
+	// 没有全局高度的旧版区块不会被归档，始终从数据库读取
+	var blocks []configs.BlockchainLog
+	result := db.Where("product_sku = ? AND block_height > ? AND (global_height = 0 OR global_height > ?)", sku, after, archived).
+		Order("block_height").
+		Limit(limit).
+		Find(&blocks)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if archived == 0 {
+		return blocks, nil
+	}
+
+	old, err := ledgerArchive.SKUBlocksAfter(sku, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(old) == 0 {
+		return blocks, nil
+	}
+	blocks = append(old, blocks...)
+	sort.SliceStable(blocks, func(i, j int) bool {
+		return blocks[i].BlockHeight < blocks[j].BlockHeight
+	})
+	if limit > 0 && len(blocks) > limit {
+		blocks = blocks[:limit]
+	}
+	return blocks, nil
+}
+
+// 验证SKU链，默认从最新快照中该SKU的链头之后开始分批验证，full 为true时从第一个区块开始验证
+// 快照不可信时返回验证失败，SKU不存在时 found 为false
+func verifySKULedger(sku string, full bool) (res chainVerifyResult, found bool, err error) {
+	if full {
+		blocks, err := skuBlocks(configs.DB, sku)
+		if err != nil || len(blocks) == 0 {
+			return res, false, err
+		}
+		res, err = verifyBlocks(blocks, false)
+		return res, true, err
+	}
+
+	snapshot, err := latestSnapshot(configs.DB)
+	if errors.Is(err, ErrSnapshotUntrusted) {
+		return chainVerifyResult{Reason: err.Error()}, true, nil
+	}
+	if err != nil {
+		return res, false, err
+	}
+	var start chainStart
+	var snapshotID uint
+	if snapshot != nil {
+		if head, ok := snapshot.Head(sku); ok {
+			start = chainStart{Height: head.BlockHeight, Hash: head.Hash}
+			snapshotID = snapshot.ID
+		}
+	}
+
+	v := newChainVerifier(false, start)
+	if v.legacyCutoff, err = legacyCutoff(configs.DB); err != nil {
+		return res, false, err
+	}
+	cursor := start.Height
+	for {
+		var blocks []configs.BlockchainLog
+		result := configs.DB.Where("product_sku = ? AND block_height > ?", sku, cursor).
+			Order("block_height").
+			Limit(verifyBatch).
+			Find(&blocks)
+		if result.Error != nil {
+			return res, false, result.Error
+		}
+		if len(blocks) == 0 {
+			break
+		}
+		ok, err := v.addWithKeys(blocks)
+		if err != nil {
+			return res, false, err
+		}
+		if !ok {
+			break
+		}
+		cursor = blocks[len(blocks)-1].BlockHeight
+	}
+	if snapshotID == 0 && v.res.TotalBlocks == 0 {
+		return res, false, nil
+	}
+
+	res, err = v.finish()
+	res.SnapshotID = snapshotID
+	res.StartHeight = start.Height
+	return res, true, err
+}
+
+// SnapshotHeader 快照中被签名的部分
+type SnapshotHeader struct {
+	PreviousHeight int64
+	GlobalHeight   int64
+	GlobalHash     string
+	SealedHeight   int64
+	SealedHash     string
+	BlockCount     int
+	BlocksRoot     string
+	SKUCount       int
+	SKUHeadsRoot   string
+	Timestamp      int64
+}
+
+// Encode 按固定字段顺序编码快照头
+func (h SnapshotHeader) Encode() []byte {
+	buf := make([]byte, 0, 320)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.PreviousHeight))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.GlobalHeight))
+	buf = appendString(buf, h.GlobalHash)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.SealedHeight))
+	buf = appendString(buf, h.SealedHash)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(int64(h.BlockCount)))
+	buf = appendString(buf, h.BlocksRoot)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(int64(h.SKUCount)))
+	buf = appendString(buf, h.SKUHeadsRoot)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.Timestamp))
+	return buf
+}
+
+// Snapshot 对外发布的快照
+type Snapshot struct {
+	ID             uint       `json:"id"`
+	PreviousHeight int64      `json:"previous_height"`
+	GlobalHeight   int64      `json:"global_height"`
+	GlobalHash     string     `json:"global_hash"`
+	SealedHeight   int64      `json:"sealed_height"`
+	SealedHash     string     `json:"sealed_hash"`
+	BlockCount     int        `json:"block_count"`
+	BlocksRoot     string     `json:"blocks_root"`
+	SKUCount       int        `json:"sku_count"`
+	SKUHeadsRoot   string     `json:"sku_heads_root"`
+	SKUHeads       []SKUHead  `json:"sku_heads,omitempty"`
+	Timestamp      int64      `json:"timestamp"`
+	ServerKey      string     `json:"server_key"`
+	Signature      string     `json:"signature"`
+	ArchivedAt     *time.Time `json:"archived_at,omitempty"`
+}
+
+func (s Snapshot) header() SnapshotHeader {
+	return SnapshotHeader{
+		PreviousHeight: s.PreviousHeight,
+		GlobalHeight:   s.GlobalHeight,
+		GlobalHash:     s.GlobalHash,
+		SealedHeight:   s.SealedHeight,
+		SealedHash:     s.SealedHash,
+		BlockCount:     s.BlockCount,
+		BlocksRoot:     s.BlocksRoot,
+		SKUCount:       s.SKUCount,
+		SKUHeadsRoot:   s.SKUHeadsRoot,
+		Timestamp:      s.Timestamp,
+	}
+}
+
+// VerifySignature 验证快照签名和SKU链头的Merkle根，
+// 签名公钥必须是账本中登记、且在快照生成时未被吊销的服务端密钥
+func (s Snapshot) VerifySignature() error {
+	if len(s.SKUHeads) != s.SKUCount {
+		return errors.New("SKU链头数量不匹配")
+	}
+	root, err := skuHeadsRoot(s.SKUHeads)
+	if err != nil {
+		return err
+	}
+	if root != s.SKUHeadsRoot {
+		return errors.New("SKU链头的Merkle根不匹配")
+	}
+	if err := checkServerKey(configs.DB, s.ServerKey, s.Timestamp); err != nil {
+		return err
+	}
+	if !verifyEd25519(s.ServerKey, s.Signature, s.header().Encode()) {
+		return errors.New("快照签名无效")
+	}
+	return nil
+}
+
+// Head 快照中某个SKU的链头
+func (s Snapshot) Head(sku string) (SKUHead, bool) {
+	i := sort.Search(len(s.SKUHeads), func(i int) bool {
+		return s.SKUHeads[i].ProductSKU >= sku
+	})
+	if i < len(s.SKUHeads) && s.SKUHeads[i].ProductSKU == sku {
+		return s.SKUHeads[i], true
+	}
+	return SKUHead{}, false
+}
+
+func skuHeadsRoot(heads []SKUHead) (string, error) {
+	if len(heads) == 0 {
+		return "", nil
+	}
+	leaves := make([]string, len(heads))
+	for i, head := range heads {
+		leaves[i] = head.Leaf()
+	}
+	return MerkleRoot(leaves)
+}
+
+func snapshotOf(record configs.LedgerSnapshot) (Snapshot, error) {
+	s := Snapshot{
+		ID:             record.ID,
+		PreviousHeight: record.PreviousHeight,
+		GlobalHeight:   record.GlobalHeight,
+		GlobalHash:     record.GlobalHash,
+		SealedHeight:   record.SealedHeight,
+		SealedHash:     record.SealedHash,
+		BlockCount:     record.BlockCount,
+		BlocksRoot:     record.BlocksRoot,
+		SKUCount:       record.SKUCount,
+		SKUHeadsRoot:   record.SKUHeadsRoot,
+		Timestamp:      record.Timestamp,
+		ServerKey:      record.ServerKey,
+		Signature:      record.Signature,
+		ArchivedAt:     record.ArchivedAt,
+	}
+	if record.SKUHeads != "" {
+		if err := json.Unmarshal([]byte(record.SKUHeads), &s.SKUHeads); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// 最新的快照并验证签名，没有快照时返回nil
+func latestSnapshot(db *gorm.DB) (*Snapshot, error) {
+	var record configs.LedgerSnapshot
+	result := db.Order("global_height DESC").First(&record)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	s, err := snapshotOf(record)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.VerifySignature(); err != nil {
+		return nil, fmt.Errorf("%w: 快照 %d %v", ErrSnapshotUntrusted, s.ID, err)
+	}
+	return &s, nil
+}
+
+// 快照范围内的区块，只取计算快照需要的字段
+type snapshotRow struct {
+	ProductSKU   string
+	BlockHeight  int64
+	GlobalHeight int64
+	Hash         string
+}
+
+// CreateSnapshot 在打包区块边界处生成快照，sealedHeight 为0时使用最新的打包区块
+// 快照覆盖上一个快照之后到该打包区块最后一条记录为止的区块，生成前会先验证这一段账本
+func CreateSnapshot(sealedHeight int64) (*configs.LedgerSnapshot, error) {
+	var record configs.LedgerSnapshot
+	err := configs.DB.Transaction(func(tx *gorm.DB) error {
+		// 与出块器共用锁，避免快照和封块同时进行
+		var lock configs.LedgerLock
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&lock, configs.BlockSealLockID)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		var sealed configs.SealedBlock
+		query := tx.Order("height DESC")
+		if sealedHeight > 0 {
+			query = tx.Where("height = ?", sealedHeight)
+		}
+		if err := query.First(&sealed).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errors.New("打包区块不存在")
+			}
+			return err
+		}
+
+		previous, err := latestSnapshot(tx)
+		if err != nil {
+			return err
+		}
+		var start chainStart
+		heads := make(map[string]SKUHead)
+		if previous != nil {
+			start = chainStart{Height: previous.GlobalHeight, Hash: previous.GlobalHash}
+			for _, head := range previous.SKUHeads {
+				heads[head.ProductSKU] = head
+			}
+		}
+		if sealed.LastGlobalHeight <= start.Height {
+			return errors.New("该打包区块已包含在之前的快照中")
+		}
+
+		verify, err := NewGormLedger(tx).VerifyFrom(start, sealed.LastGlobalHeight)
+		if err != nil {
+			return err
+		}
+		if !verify.Valid {
+			return errors.New("账本验证失败，不能生成快照: " + verify.Reason)
+		}
+
+		var rows []snapshotRow
+		result = tx.Model(&configs.BlockchainLog{}).
+			Select("product_sku, block_height, global_height, hash").
+			Where("global_height BETWEEN ? AND ?", start.Height+1, sealed.LastGlobalHeight).
+			Order("global_height").
+			Find(&rows)
+		if result.Error != nil {
+			return result.Error
+		}
+		if int64(len(rows)) != sealed.LastGlobalHeight-start.Height {
+			return errors.New("快照范围内的区块不完整")
+		}
+
+		leaves := make([]string, len(rows))
+		for i, row := range rows {
+			leaves[i] = row.Hash
+			heads[row.ProductSKU] = SKUHead{ProductSKU: row.ProductSKU, BlockHeight: row.BlockHeight, Hash: row.Hash}
+		}
+		snapshot := Snapshot{
+			PreviousHeight: start.Height,
+			GlobalHeight:   sealed.LastGlobalHeight,
+			GlobalHash:     rows[len(rows)-1].Hash,
+			SealedHeight:   sealed.Height,
+			SealedHash:     sealed.Hash,
+			BlockCount:     len(rows),
+			Timestamp:      time.Now().UnixNano(),
+			ServerKey:      ServerPublicKey(),
+		}
+		snapshot.BlocksRoot, err = MerkleRoot(leaves)
+		if err != nil {
+			return err
+		}
+		for _, head := range heads {
+			snapshot.SKUHeads = append(snapshot.SKUHeads, head)
+		}
+		sort.Slice(snapshot.SKUHeads, func(i, j int) bool {
+			return snapshot.SKUHeads[i].ProductSKU < snapshot.SKUHeads[j].ProductSKU
+		})
+		snapshot.SKUCount = len(snapshot.SKUHeads)
+		snapshot.SKUHeadsRoot, err = skuHeadsRoot(snapshot.SKUHeads)
+		if err != nil {
+			return err
+		}
+		snapshot.Signature, err = signWithServerKey(snapshot.header().Encode())
+		if err != nil {
+			return err
+		}
+
+		headsJSON, err := json.Marshal(snapshot.SKUHeads)
+		if err != nil {
+			return err
+		}
+		record = configs.LedgerSnapshot{
+			PreviousHeight: snapshot.PreviousHeight,
+			GlobalHeight:   snapshot.GlobalHeight,
+			GlobalHash:     snapshot.GlobalHash,
+			SealedHeight:   snapshot.SealedHeight,
+			SealedHash:     snapshot.SealedHash,
+			BlockCount:     snapshot.BlockCount,
+			BlocksRoot:     snapshot.BlocksRoot,
+			SKUCount:       snapshot.SKUCount,
+			SKUHeadsRoot:   snapshot.SKUHeadsRoot,
+			SKUHeads:       string(headsJSON),
+			Timestamp:      snapshot.Timestamp,
+			ServerKey:      snapshot.ServerKey,
+			Signature:      snapshot.Signature,
+		}
+		return tx.Create(&record).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// 归档时每批复制的区块数
+const archiveBatch = 500
+
+// ArchiveSnapshot 把快照覆盖的区块复制到冷存储并从MySQL中删除
+// 复制完成后核对归档链头和Merkle根，中途失败可以重新执行，已复制的区块不会重复写入
+// 整个过程持有与出块器和 CreateSnapshot 相同的锁，避免与封块、生成快照或另一次归档交错
+func ArchiveSnapshot(id uint) (*configs.LedgerSnapshot, error) {
+	if ledgerArchive == nil {
+		return nil, errors.New("未启用冷存储归档")
+	}
+
+	var record configs.LedgerSnapshot
+	err := configs.DB.Transaction(func(tx *gorm.DB) error {
+		var lock configs.LedgerLock
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&lock, configs.BlockSealLockID)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		// 拿到锁之后再读取快照，并发的归档已经完成时直接返回
+		if err := tx.First(&record, id).Error; err != nil {
+			return err
+		}
+		if record.ArchivedAt != nil {
+			return nil
+		}
+		snapshot, err := snapshotOf(record)
+		if err != nil {
+			return err
+		}
+		if err := snapshot.VerifySignature(); err != nil {
+			return err
+		}
+
+		var earlier int64
+		tx.Model(&configs.LedgerSnapshot{}).
+			Where("global_height < ? AND archived_at IS NULL", record.GlobalHeight).
+			Count(&earlier)
+		if earlier > 0 {
+			return errors.New("请先归档更早的快照")
+		}
+
+		source := NewGormLedger(tx)
+		for from := archivedHeight() + 1; from <= record.GlobalHeight; from += archiveBatch {
+			to := from + archiveBatch - 1
+			if to > record.GlobalHeight {
+				to = record.GlobalHeight
+			}
+			blocks, err := source.Range(from, to)
+			if err != nil {
+				return err
+			}
+			for i := range blocks {
+				if err := ledgerArchive.Append(&blocks[i]); err != nil {
+					return fmt.Errorf("写入冷存储失败: %w", err)
+				}
+			}
+		}
+
+		// 确认冷存储中的区块与快照一致后才删除MySQL中的区块
+		head, err := ledgerArchive.Head("")
+		if err != nil {
+			return err
+		}
+		if head.GlobalHeight != record.GlobalHeight || head.Hash != record.GlobalHash {
+			return errors.New("冷存储链头与快照不一致")
+		}
+		archived, err := ledgerArchive.Range(record.PreviousHeight+1, record.GlobalHeight)
+		if err != nil {
+			return err
+		}
+		leaves := make([]string, len(archived))
+		for i, block := range archived {
+			leaves[i] = block.Hash
+		}
+		if root, err := MerkleRoot(leaves); err != nil || root != record.BlocksRoot {
+			return errors.New("冷存储中区块的Merkle根与快照不一致")
+		}
+
+		result = tx.Unscoped().
+			Where("global_height BETWEEN ? AND ?", 1, record.GlobalHeight).
+			Delete(&configs.BlockchainLog{})
+		if result.Error != nil {
+			return result.Error
+		}
+		now := time.Now()
+		record.ArchivedAt = &now
+		return tx.Model(&record).Update("archived_at", now).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// 归档区块的包含证明
+type archiveProof struct {
+	Block     blockWithEvent    `json:"block"`
+	Archived  bool              `json:"archived"` // 区块是否已移到冷存储
+	Snapshot  Snapshot          `json:"snapshot"`
+	LeafIndex int               `json:"leaf_index"`
+	Proof     []MerkleProofStep `json:"proof"`
+	Valid     bool              `json:"valid"`
+}
+
+// 生成区块相对于所在快照的Merkle证明，快照签名覆盖了Merkle根
+func buildArchiveProof(globalHeight int64) (*archiveProof, error) {
+	var record configs.LedgerSnapshot
+	result := configs.DB.Where("global_height >= ?", globalHeight).Order("global_height").First(&record)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, errors.New("区块不在任何快照范围内")
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	snapshot, err := snapshotOf(record)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks, err := NewGormLedger(configs.DB).Range(snapshot.PreviousHeight+1, snapshot.GlobalHeight)
+	if err != nil {
+		return nil, err
+	}
+	index := int(globalHeight - snapshot.PreviousHeight - 1)
+	if len(blocks) != snapshot.BlockCount || index < 0 || index >= len(blocks) {
+		return nil, errors.New("快照范围内的区块不完整")
+	}
+	leaves := make([]string, len(blocks))
+	for i, block := range blocks {
+		leaves[i] = block.Hash
+	}
+	proof, err := MerkleProof(leaves, index)
+	if err != nil {
+		return nil, err
+	}
+
+	block := blocks[index]
+	res := &archiveProof{
+		Block:     withEvents([]configs.BlockchainLog{block})[0],
+		Archived:  globalHeight <= archivedHeight(),
+		Snapshot:  snapshot,
+		LeafIndex: index,
+		Proof:     proof,
+	}
+	res.Valid = computeBlockHash(block) == block.Hash &&
+		VerifyMerkleProof(block.Hash, proof, snapshot.BlocksRoot) &&
+		snapshot.VerifySignature() == nil
+	return res, nil
+}
+
+// GetSnapshots 获取快照列表，不含SKU链头明细
+func (s *BlockchainService) GetSnapshots(c *gin.Context) {
+	var records []configs.LedgerSnapshot
+	result := configs.DB.Omit("sku_heads").Order("global_height DESC").Limit(100).Find(&records)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "查询快照失败",
+		})
+		return
+	}
+
+	list := make([]Snapshot, 0, len(records))
+	for _, record := range records {
+		snapshot, _ := snapshotOf(record)
+		list = append(list, snapshot)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "获取快照成功",
+		"data":    list,
+	})
+}
+
+// GetSnapshot 获取单个快照，包含全部SKU链头，可离线保存作为验证起点
+func (s *BlockchainService) GetSnapshot(c *gin.Context) {
+	var record configs.LedgerSnapshot
+	if err := configs.DB.First(&record, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "快照不存在",
+		})
+		return
+	}
+
+	snapshot, err := snapshotOf(record)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "解析快照失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "获取快照成功",
+		"data":    snapshot,
+	})
+}
+
+// GetArchiveProof 获取区块相对于快照的包含证明，区块已归档时从冷存储读取
+func (s *BlockchainService) GetArchiveProof(c *gin.Context) {
+	globalHeight, err := strconv.ParseInt(c.Query("global_height"), 10, 64)
+	if err != nil || globalHeight <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "请提供正确的全局高度",
+		})
+		return
+	}
+
+	proof, err := buildArchiveProof(globalHeight)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "生成证明失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "获取归档证明成功",
+		"data":    proof,
+	})
+}
+
+// AdminCreateSnapshot 生成快照，可指定打包区块高度
+func (s *AdminService) AdminCreateSnapshot(c *gin.Context) {
+	var req struct {
+		SealedHeight int64 `json:"sealed_height"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+
+	record, err := CreateSnapshot(req.SealedHeight)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "生成快照失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "生成快照成功",
+		Data: gin.H{
+			"id":            record.ID,
+			"global_height": record.GlobalHeight,
+			"sealed_height": record.SealedHeight,
+			"block_count":   record.BlockCount,
+		},
+	})
+}
+
+// AdminArchiveSnapshot 把快照覆盖的区块归档到冷存储
+func (s *AdminService) AdminArchiveSnapshot(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "快照ID错误",
+		})
+		return
+	}
+
+	record, err := ArchiveSnapshot(uint(id))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "归档失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "归档成功",
+		Data: gin.H{
+			"id":            record.ID,
+			"global_height": record.GlobalHeight,
+			"archived_at":   record.ArchivedAt,
+		},
+	})
+}
@@ -0,0 +1,258 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// 写入区块、封块并生成快照，启用临时目录中的冷存储
+func testArchiveLedger(t *testing.T, blocks int) (configs.User, *configs.LedgerSnapshot) {
+	t.Helper()
+	testDB(t)
+	testServerKey(t)
+	user := testUser(t, 1)
+	for i := 0; i < blocks; i++ {
+		sku := fmt.Sprintf("SKU-%d", i%2+1)
+		if _, err := (&BlockchainService{}).AddToBlockchain(sku, 1, fmt.Sprintf(`{"n":%d}`, i), user.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 加上服务端和签名者的密钥登记区块，全部记录封进一个打包区块
+	if _, err := NewBlockProducer(0, blocks+2).SealPending(1); err != nil {
+		t.Fatal(err)
+	}
+	record, err := CreateSnapshot(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := OpenLedgerArchive(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	archive := ledgerArchive
+	t.Cleanup(func() { archive.Close() })
+	return user, record
+}
+
+// 归档证明接口返回的字段
+type testProof struct {
+	Block struct {
+		GlobalHeight int64
+		Hash         string
+	} `json:"block"`
+	Archived bool              `json:"archived"`
+	Snapshot Snapshot          `json:"snapshot"`
+	Proof    []MerkleProofStep `json:"proof"`
+	Valid    bool              `json:"valid"`
+}
+
+// 调用归档证明接口
+func testArchiveProof(t *testing.T, globalHeight int64) testProof {
+	t.Helper()
+	w := testHandle((&BlockchainService{}).GetArchiveProof, configs.User{}, http.MethodGet, fmt.Sprintf("/api/blockchain/archive/proof?global_height=%d", globalHeight), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("状态码 %d: %s", w.Code, w.Body.String())
+	}
+	var proof testProof
+	testResponseData(t, w.Body.Bytes(), &proof)
+	return proof
+}
+
+func TestArchiveSnapshot(t *testing.T) {
+	user, record := testArchiveLedger(t, 4)
+
+	archived, err := ArchiveSnapshot(record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archived.ArchivedAt == nil || archivedHeight() != record.GlobalHeight {
+		t.Fatalf("归档结果 %+v，冷存储高度 %d", archived, archivedHeight())
+	}
+	var remaining int64
+	configs.DB.Model(&configs.BlockchainLog{}).Count(&remaining)
+	if remaining != 0 {
+		t.Fatalf("MySQL中还剩 %d 个区块", remaining)
+	}
+
+	// 重复归档直接返回
+	again, err := ArchiveSnapshot(record.ID)
+	if err != nil || again.ArchivedAt == nil {
+		t.Fatalf("重复归档 %+v %v", again, err)
+	}
+
+	// 归档之后继续写入，新区块接在冷存储的链头之后
+	if _, err := (&BlockchainService{}).AddToBlockchain("SKU-1", 1, `{"n":4}`, user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query    string
+		total    int
+		snapshot uint
+	}{
+		{query: "mode=global", total: 1, snapshot: record.ID},
+		{query: "mode=global&full=1", total: 7},
+		{query: "sku=SKU-1&full=1", total: 3},
+		{query: "mode=sealed&full=1", total: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			res := testVerifyRequest(t, tt.query)
+			if !res.Valid || !res.Verified || res.TotalBlocks != tt.total || res.SnapshotID != tt.snapshot {
+				t.Fatalf("验证结果 %+v", res)
+			}
+		})
+	}
+
+	for height := int64(1); height <= record.GlobalHeight; height++ {
+		t.Run(fmt.Sprintf("归档证明%d", height), func(t *testing.T) {
+			proof := testArchiveProof(t, height)
+			if !proof.Valid || !proof.Archived || proof.Block.GlobalHeight != height || proof.Snapshot.ID != record.ID {
+				t.Fatalf("归档证明 %+v", proof)
+			}
+			if !VerifyMerkleProof(proof.Block.Hash, proof.Proof, proof.Snapshot.BlocksRoot) {
+				t.Fatal("Merkle证明无效")
+			}
+		})
+	}
+
+	// 已归档的区块按哈希查询和记录的打包区块证明都从冷存储读取
+	archivedBlock, err := ledgerArchive.Get(record.GlobalHeight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("按哈希查询归档区块", func(t *testing.T) {
+		w := testHandle((&BlockchainService{}).GetBlockByHash, configs.User{}, http.MethodGet, "/api/blockchain/block?hash="+archivedBlock.Hash, nil)
+		var data struct {
+			Block    configs.BlockchainLog `json:"block"`
+			Archived bool                  `json:"archived"`
+		}
+		testResponseData(t, w.Body.Bytes(), &data)
+		if !data.Archived || data.Block.ID != archivedBlock.ID || data.Block.GlobalHeight != record.GlobalHeight {
+			t.Fatalf("返回 %s", w.Body.String())
+		}
+	})
+	t.Run("归档记录的打包区块证明", func(t *testing.T) {
+		w := testHandle((&BlockchainService{}).GetRecordProof, configs.User{}, http.MethodGet, fmt.Sprintf("/api/blockchain/proof?record_id=%d", archivedBlock.ID), nil)
+		var data struct {
+			LeafHash   string            `json:"leaf_hash"`
+			Proof      []MerkleProofStep `json:"proof"`
+			MerkleRoot string            `json:"merkle_root"`
+		}
+		testResponseData(t, w.Body.Bytes(), &data)
+		if data.LeafHash != archivedBlock.Hash || !VerifyMerkleProof(data.LeafHash, data.Proof, data.MerkleRoot) {
+			t.Fatalf("返回 %s", w.Body.String())
+		}
+	})
+}
+
+func TestSnapshotTrustsHistoricalServerKeys(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(s *Snapshot, old ed25519.PrivateKey)
+		valid  bool
+	}{
+		{name: "吊销之前签发", mutate: func(*Snapshot, ed25519.PrivateKey) {}, valid: true},
+		{
+			// 泄露的旧密钥不能再签发新的快照
+			name: "吊销之后签发",
+			mutate: func(s *Snapshot, old ed25519.PrivateKey) {
+				s.Timestamp = time.Now().Add(time.Hour).UnixNano()
+				s.Signature = hex.EncodeToString(ed25519.Sign(old, s.header().Encode()))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, record := testArchiveLedger(t, 2)
+			old := serverKey
+
+			// 更换服务端密钥后，旧密钥签发的快照仍然可以验证和归档
+			testServerKey(t)
+			s, err := snapshotOf(*record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.mutate(&s, old)
+			if err := s.VerifySignature(); (err == nil) != tt.valid {
+				t.Fatalf("验证结果 %v", err)
+			}
+			if !tt.valid {
+				return
+			}
+			if _, err := ArchiveSnapshot(record.ID); err != nil {
+				t.Fatal(err)
+			}
+			if res := testVerifyRequest(t, "sku=SKU-1"); !res.Valid {
+				t.Fatalf("验证结果 %+v", res)
+			}
+		})
+	}
+}
+
+func TestArchiveSnapshotRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, record *configs.LedgerSnapshot) uint
+	}{
+		{
+			name: "未启用冷存储",
+			setup: func(t *testing.T, record *configs.LedgerSnapshot) uint {
+				ledgerArchive = nil
+				return record.ID
+			},
+		},
+		{
+			name: "快照不存在",
+			setup: func(t *testing.T, record *configs.LedgerSnapshot) uint {
+				return record.ID + 100
+			},
+		},
+		{
+			name: "快照签名无效",
+			setup: func(t *testing.T, record *configs.LedgerSnapshot) uint {
+				configs.DB.Model(record).Update("blocks_root", hashData("x"))
+				return record.ID
+			},
+		},
+		{
+			name: "更早的快照未归档",
+			setup: func(t *testing.T, record *configs.LedgerSnapshot) uint {
+				user := testUser(t, 1)
+				if _, err := (&BlockchainService{}).AddToBlockchain("SKU-1", 1, `{"n":9}`, user.ID); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := NewBlockProducer(0, 1).SealPending(1); err != nil {
+					t.Fatal(err)
+				}
+				later, err := CreateSnapshot(0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return later.ID
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, record := testArchiveLedger(t, 2)
+			id := tt.setup(t, record)
+			if _, err := ArchiveSnapshot(id); err == nil {
+				t.Fatal("应拒绝归档")
+			}
+			// 拒绝时不删除MySQL中的区块
+			var remaining int64
+			configs.DB.Model(&configs.BlockchainLog{}).Count(&remaining)
+			if remaining < 2 {
+				t.Fatalf("MySQL中只剩 %d 个区块", remaining)
+			}
+		})
+	}
+}
@@ -0,0 +1,1289 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/api"
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// 设备类型
+const (
+	DeviceLogger = "logger" // 数据记录仪
+	DeviceReefer = "reefer" // 冷藏箱传感器
+)
+
+// 单次上报的读数上限
+const maxTelemetryReadings = 10000
+
+// 读数时间允许超前服务器时间的范围，设备时钟略有偏差时不拒绝
+const telemetryClockSkew = 5 * time.Minute
+
+// 温湿度读数的合理范围，与物流事件相同
+const (
+	minReadingTemperature = -100
+	maxReadingTemperature = 100
+	minReadingHumidity    = 0
+	maxReadingHumidity    = 100
+)
+
+// ErrDeviceNotBound 设备在读数时间范围内没有绑定任何产品
+var ErrDeviceNotBound = errors.New("设备在读数时间范围内没有绑定产品或运单")
+
+// 生成设备密钥，返回密钥和它的SHA-256
+func newDeviceKey() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	key := hex.EncodeToString(raw)
+	return key, deviceKeyHash(key), nil
+}
+
+func deviceKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// 计算批次摘要，覆盖设备编号和按时间排序的全部读数
+func telemetryBatchDigest(serialNo string, readings []configs.TelemetryReading) string {
+	h := sha256.New()
+	h.Write(appendString(nil, serialNo))
+	buf := make([]byte, 0, 25)
+	for _, reading := range readings {
+		buf = buf[:0]
+		buf = binary.BigEndian.AppendUint64(buf, uint64(reading.RecordedAt.UnixNano()))
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(reading.Temperature))
+		if reading.Humidity != nil {
+			buf = append(buf, 1)
+			buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(*reading.Humidity))
+		} else {
+			buf = append(buf, 0)
+		}
+		h.Write(buf)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// 设备绑定到产品的时间段，To 为空表示仍在绑定中
+type bindingWindow struct {
+	From time.Time
+	To   *time.Time
+}
+
+func (w bindingWindow) contains(at time.Time) bool {
+	return !at.Before(w.From) && (w.To == nil || !at.After(*w.To))
+}
+
+// 两个时间段的交集，没有交集时返回 false
+func (w bindingWindow) intersect(other bindingWindow) (bindingWindow, bool) {
+	if other.From.After(w.From) {
+		w.From = other.From
+	}
+	if other.To != nil && (w.To == nil || other.To.Before(*w.To)) {
+		w.To = other.To
+	}
+	return w, w.To == nil || !w.To.Before(w.From)
+}
+
+// 设备在时间范围内绑定的产品及绑定时间段
+// 绑定到运单时取运单下设备所属机构生产或在读数时持有的产品及持有的时间段，运单中其他机构的产品不写入
+func boundSKUs(db *gorm.DB, device configs.Device, from, to time.Time) (map[string][]bindingWindow, error) {
+	var bindings []configs.DeviceBinding
+	result := db.Where("device_id = ? AND bound_at <= ? AND (unbound_at IS NULL OR unbound_at >= ?)", device.ID, to, from).
+		Find(&bindings)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	windows := make(map[string][]bindingWindow)
+	for _, binding := range bindings {
+		window := bindingWindow{From: binding.BoundAt, To: binding.UnboundAt}
+		if binding.ProductSKU != "" {
+			windows[binding.ProductSKU] = append(windows[binding.ProductSKU], window)
+			continue
+		}
+		var skus []string
+		result := db.Model(&configs.LogisticsRecord{}).
+			Where("tracking_no = ?", binding.TrackingNo).
+			Distinct().
+			Pluck("product_sku", &skus)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		for _, sku := range skus {
+			held, err := holdingWindows(db, device.OwnerID, sku, window)
+			if err != nil {
+				return nil, err
+			}
+			for _, w := range held {
+				if _, ok := w.intersect(bindingWindow{From: from, To: &to}); ok {
+					windows[sku] = append(windows[sku], w)
+				}
+			}
+		}
+	}
+	return windows, nil
+}
+
+// 机构在时间段内生产或持有产品的部分，生产商始终可以记录自己产品的读数
+// 其他机构按读数时间的持有历史判断，交接之前上一个持有人运输途中的读数不归到新持有人
+func holdingWindows(db *gorm.DB, userID uint, sku string, window bindingWindow) ([]bindingWindow, error) {
+	var product configs.ProductInfo
+	result := db.Select("manufacturer_id").Where("sku = ?", sku).First(&product)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if product.ManufacturerID == userID {
+		return []bindingWindow{window}, nil
+	}
+
+	periods, err := custodyHistory(db, sku)
+	if err != nil {
+		return nil, err
+	}
+	var windows []bindingWindow
+	for _, period := range periods {
+		if period.CustodianID != userID {
+			continue
+		}
+		if held, ok := window.intersect(bindingWindow{From: period.From, To: period.To}); ok {
+			windows = append(windows, held)
+		}
+	}
+	return windows, nil
+}
+
+// 机构当前是否生产或持有产品
+func producesOrHolds(db *gorm.DB, userID uint, sku string) (bool, error) {
+	windows, err := holdingWindows(db, userID, sku, bindingWindow{From: time.Now()})
+	return len(windows) > 0, err
+}
+
+// 批次写入了账本的产品
+func batchSKUs(db *gorm.DB, batchID uint) ([]string, error) {
+	var skus []string
+	result := db.Model(&configs.TelemetryBatchProduct{}).
+		Where("batch_id = ?", batchID).
+		Order("product_sku").
+		Pluck("product_sku", &skus)
+	return skus, result.Error
+}
+
+// 与产品有关的全部绑定，包括绑定到产品和绑定到产品所在运单的设备
+// 运单绑定只保留设备所属机构生产或持有该产品的时间段，与 boundSKUs 写入账本的范围一致
+func skuBindings(db *gorm.DB, sku string) ([]configs.DeviceBinding, error) {
+	var trackingNos []string
+	result := db.Model(&configs.LogisticsRecord{}).
+		Where("product_sku = ?", sku).
+		Distinct().
+		Pluck("tracking_no", &trackingNos)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	var bindings []configs.DeviceBinding
+	query := db.Where("product_sku = ?", sku)
+	if len(trackingNos) > 0 {
+		query = db.Where("product_sku = ? OR tracking_no IN ?", sku, trackingNos)
+	}
+	if err := query.Order("device_id, bound_at").Find(&bindings).Error; err != nil {
+		return nil, err
+	}
+
+	var deviceIDs []uint
+	for _, binding := range bindings {
+		if binding.ProductSKU == "" {
+			deviceIDs = append(deviceIDs, binding.DeviceID)
+		}
+	}
+	if len(deviceIDs) == 0 {
+		return bindings, nil
+	}
+	var devices []configs.Device
+	if err := db.Unscoped().Where("id IN ?", deviceIDs).Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	owners := make(map[uint]uint, len(devices))
+	for _, device := range devices {
+		owners[device.ID] = device.OwnerID
+	}
+	kept := make([]configs.DeviceBinding, 0, len(bindings))
+	for _, binding := range bindings {
+		if binding.ProductSKU != "" {
+			kept = append(kept, binding)
+			continue
+		}
+		held, err := holdingWindows(db, owners[binding.DeviceID], sku, bindingWindow{From: binding.BoundAt, To: binding.UnboundAt})
+		if err != nil {
+			return nil, err
+		}
+		for _, window := range held {
+			binding.BoundAt, binding.UnboundAt = window.From, window.To
+			kept = append(kept, binding)
+		}
+	}
+	return kept, nil
+}
+
+// 设备已保存读数的最晚时间，早于该时间的读数需要重新判断受影响的时间段
+func latestReadingAt(db *gorm.DB, deviceID uint) (time.Time, error) {
+	var latest sql.NullTime
+	result := db.Model(&configs.TelemetryBatch{}).
+		Where("device_id = ?", deviceID).
+		Select("MAX(last_at)").
+		Scan(&latest)
+	return latest.Time, result.Error
+}
+
+// errReadingsPruned 需要重新判断的读数已超过原始读数保留期
+var errReadingsPruned = errors.New("原始读数已超过保留期")
+
+// 重新判断超温时读取设备在 [from, to] 之间、绑定到产品期间的读数
+// 本批次的读数尚未提交，使用内存中的，存储中已经写入的同批次读数跳过
+func lateReadingLoader(tx *gorm.DB, device configs.Device, sku string, batch configs.TelemetryBatch, readings []configs.TelemetryReading, to time.Time) func(time.Time) ([]excursionReading, error) {
+	return func(from time.Time) ([]excursionReading, error) {
+		if retention := configs.GlobalTelemetryConfig.RawRetention; retention > 0 && from.Before(time.Now().Add(-retention)) {
+			return nil, errReadingsPruned
+		}
+		windows, err := boundSKUs(tx, device, from, to)
+		if err != nil {
+			return nil, err
+		}
+		stored, err := telemetryStore.Readings(device.ID, from, to)
+		if err != nil {
+			return nil, err
+		}
+		all := make([]configs.TelemetryReading, 0, len(stored)+len(readings))
+		for _, reading := range stored {
+			if reading.BatchID != batch.ID {
+				all = append(all, reading)
+			}
+		}
+		all = append(all, readings...)
+		sort.SliceStable(all, func(i, j int) bool {
+			return all[i].RecordedAt.Before(all[j].RecordedAt)
+		})
+		return excursionReadings(all, windows[sku], from.Add(-time.Nanosecond)), nil
+	}
+}
+
+// 绑定时间段内、晚于 after 的读数
+func excursionReadings(readings []configs.TelemetryReading, windows []bindingWindow, after time.Time) []excursionReading {
+	var list []excursionReading
+	for _, reading := range readings {
+		if !reading.RecordedAt.After(after) {
+			continue
+		}
+		for _, window := range windows {
+			if window.contains(reading.RecordedAt) {
+				list = append(list, excursionReading{At: reading.RecordedAt, Temperature: reading.Temperature, Humidity: reading.Humidity})
+				break
+			}
+		}
+	}
+	return list
+}
+
+// 查询当前用户的设备
+func ownDevice(c *gin.Context) (*configs.Device, bool) {
+	userID, _ := c.Get("userID")
+	var device configs.Device
+	result := configs.DB.Where("id = ? AND owner_id = ?", c.Param("id"), userID).First(&device)
+	if result.Error != nil {
+		c.JSON(http.StatusNotFound, api.Response{
+			Code:    404,
+			Message: "设备不存在",
+		})
+		return nil, false
+	}
+	return &device, true
+}
+
+// DeviceAuthMiddleware 校验设备编号和设备密钥
+func DeviceAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		serialNo := c.GetHeader("X-Device-Serial")
+		key := c.GetHeader("X-Device-Key")
+
+		var device configs.Device
+		result := configs.DB.Where("serial_no = ?", serialNo).First(&device)
+		if serialNo == "" || key == "" || result.Error != nil ||
+			subtle.ConstantTimeCompare([]byte(deviceKeyHash(key)), []byte(device.KeyHash)) != 1 {
+			c.JSON(http.StatusUnauthorized, api.Response{
+				Code:    401,
+				Message: "无效的设备编号或密钥",
+			})
+			c.Abort()
+			return
+		}
+		if device.Disabled {
+			c.JSON(http.StatusForbidden, api.Response{
+				Code:    403,
+				Message: "设备已停用",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Set("device", device)
+		c.Next()
+	}
+}
+
+// TelemetryService 实现设备管理和温湿度读数上报
+type TelemetryService struct{}
+
+// RegisterDevice 登记设备，设备密钥只在登记时返回一次
+func (s *TelemetryService) RegisterDevice(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	var req struct {
+		SerialNo string `json:"serial_no" binding:"required"`
+		Name     string `json:"name"`
+		Kind     string `json:"kind" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+	if req.Kind != DeviceLogger && req.Kind != DeviceReefer {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "设备类型应为 logger 或 reefer",
+		})
+		return
+	}
+
+	var count int64
+	configs.DB.Unscoped().Model(&configs.Device{}).Where("serial_no = ?", req.SerialNo).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, api.Response{
+			Code:    409,
+			Message: "设备编号已登记",
+		})
+		return
+	}
+
+	key, keyHash, err := newDeviceKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "生成设备密钥失败",
+		})
+		return
+	}
+	device := configs.Device{
+		SerialNo: req.SerialNo,
+		Name:     req.Name,
+		Kind:     req.Kind,
+		OwnerID:  userID.(uint),
+		KeyHash:  keyHash,
+	}
+	if err := configs.DB.Create(&device).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "登记设备失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "登记设备成功，请妥善保存设备密钥",
+		Data: gin.H{
+			"id":         device.ID,
+			"serial_no":  device.SerialNo,
+			"device_key": key,
+		},
+	})
+}
+
+// RotateDeviceKey 重新生成设备密钥，旧密钥立即失效
+func (s *TelemetryService) RotateDeviceKey(c *gin.Context) {
+	device, ok := ownDevice(c)
+	if !ok {
+		return
+	}
+
+	key, keyHash, err := newDeviceKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "生成设备密钥失败",
+		})
+		return
+	}
+	if err := configs.DB.Model(device).Update("key_hash", keyHash).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "更新设备密钥失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "更新设备密钥成功",
+		Data: gin.H{
+			"id":         device.ID,
+			"serial_no":  device.SerialNo,
+			"device_key": key,
+		},
+	})
+}
+
+// UpdateDevice 修改设备名称或停用设备
+func (s *TelemetryService) UpdateDevice(c *gin.Context) {
+	device, ok := ownDevice(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name     *string `json:"name"`
+		Disabled *bool   `json:"disabled"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+	updates := map[string]interface{}{}
+	if req.Name != nil {
+		updates["name"] = *req.Name
+	}
+	if req.Disabled != nil {
+		updates["disabled"] = *req.Disabled
+	}
+	if len(updates) > 0 {
+		if err := configs.DB.Model(device).Updates(updates).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, api.Response{
+				Code:    500,
+				Message: "更新设备失败: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "更新设备成功",
+	})
+}
+
+// 设备列表项，不返回密钥摘要
+type deviceInfo struct {
+	ID         uint                    `json:"id"`
+	SerialNo   string                  `json:"serial_no"`
+	Name       string                  `json:"name"`
+	Kind       string                  `json:"kind"`
+	OwnerID    uint                    `json:"owner_id"`
+	Disabled   bool                    `json:"disabled"`
+	LastSeenAt *time.Time              `json:"last_seen_at"`
+	Bindings   []configs.DeviceBinding `json:"bindings"`
+}
+
+// 查询设备及其当前绑定
+func listDevices(query *gorm.DB) ([]deviceInfo, error) {
+	var devices []configs.Device
+	if err := query.Order("id").Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	ids := make([]uint, len(devices))
+	for i, device := range devices {
+		ids[i] = device.ID
+	}
+	var bindings []configs.DeviceBinding
+	if err := configs.DB.Where("device_id IN ? AND unbound_at IS NULL", ids).Find(&bindings).Error; err != nil {
+		return nil, err
+	}
+	byDevice := make(map[uint][]configs.DeviceBinding)
+	for _, binding := range bindings {
+		byDevice[binding.DeviceID] = append(byDevice[binding.DeviceID], binding)
+	}
+
+	list := make([]deviceInfo, 0, len(devices))
+	for _, device := range devices {
+		list = append(list, deviceInfo{
+			ID:         device.ID,
+			SerialNo:   device.SerialNo,
+			Name:       device.Name,
+			Kind:       device.Kind,
+			OwnerID:    device.OwnerID,
+			Disabled:   device.Disabled,
+			LastSeenAt: device.LastSeenAt,
+			Bindings:   byDevice[device.ID],
+		})
+	}
+	return list, nil
+}
+
+// GetDevices 获取当前用户的设备
+func (s *TelemetryService) GetDevices(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	list, err := listDevices(configs.DB.Where("owner_id = ?", userID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "查询设备失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "获取设备列表成功",
+		Data:    list,
+	})
+}
+
+// BindDevice 把设备绑定到产品或运单
+// 绑定产品时当前用户必须是产品的生产商或当前持有人，绑定运单时当前用户必须记录过该运单的物流
+func (s *TelemetryService) BindDevice(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	device, ok := ownDevice(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		ProductSKU string `json:"product_sku"`
+		TrackingNo string `json:"tracking_no"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+	if (req.ProductSKU == "") == (req.TrackingNo == "") {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "请提供产品SKU或运单号其中之一",
+		})
+		return
+	}
+
+	if req.ProductSKU != "" {
+		var product configs.ProductInfo
+		if err := configs.DB.Where("sku = ? AND status = 1", req.ProductSKU).First(&product).Error; err != nil {
+			c.JSON(http.StatusNotFound, api.Response{
+				Code:    404,
+				Message: "产品不存在或未上架",
+			})
+			return
+		}
+		allowed, err := producesOrHolds(configs.DB, userID.(uint), product.SKU)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, api.Response{
+				Code:    500,
+				Message: "查询产品持有人失败: " + err.Error(),
+			})
+			return
+		}
+		if !allowed {
+			c.JSON(http.StatusForbidden, api.Response{
+				Code:    403,
+				Message: "只能绑定自己生产或持有的产品",
+			})
+			return
+		}
+	} else {
+		var count int64
+		configs.DB.Model(&configs.LogisticsRecord{}).
+			Where("tracking_no = ? AND operator_id = ?", req.TrackingNo, userID).
+			Count(&count)
+		if count == 0 {
+			c.JSON(http.StatusForbidden, api.Response{
+				Code:    403,
+				Message: "只能绑定自己记录过物流的运单",
+			})
+			return
+		}
+	}
+
+	binding := configs.DeviceBinding{
+		DeviceID:   device.ID,
+		ProductSKU: req.ProductSKU,
+		TrackingNo: req.TrackingNo,
+		BoundAt:    time.Now(),
+	}
+	if err := configs.DB.Create(&binding).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "绑定设备失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "绑定设备成功",
+		Data:    binding,
+	})
+}
+
+// UnbindDevice 解除绑定，之后上报的读数不再写入该产品的账本
+func (s *TelemetryService) UnbindDevice(c *gin.Context) {
+	device, ok := ownDevice(c)
+	if !ok {
+		return
+	}
+
+	result := configs.DB.Model(&configs.DeviceBinding{}).
+		Where("id = ? AND device_id = ? AND unbound_at IS NULL", c.Param("binding_id"), device.ID).
+		Update("unbound_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "解除绑定失败: " + result.Error.Error(),
+		})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, api.Response{
+			Code:    404,
+			Message: "绑定不存在或已解除",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "解除绑定成功",
+	})
+}
+
+// 上报的单条读数
+type telemetryReadingInput struct {
+	RecordedAt  time.Time `json:"recorded_at" binding:"required"`
+	Temperature *float64  `json:"temperature" binding:"required"`
+	Humidity    *float64  `json:"humidity"`
+}
+
+// ErrTooManyReadings 单次上报的读数过多
+var ErrTooManyReadings = errors.New("单次最多上报 " + strconv.Itoa(maxTelemetryReadings) + " 条读数")
+
+// 单条读数的校验错误
+type readingError struct {
+	Index  int
+	Reason string
+}
+
+func (e *readingError) Error() string {
+	return "第 " + strconv.Itoa(e.Index+1) + " 条读数错误: " + e.Reason
+}
+
+// 校验单条读数，返回错误原因
+func checkReading(input telemetryReadingInput, latest time.Time) string {
+	switch {
+	case input.Temperature == nil:
+		return "缺少温度"
+	case input.RecordedAt.IsZero():
+		return "缺少读数时间"
+	case input.RecordedAt.After(latest):
+		return "读数时间晚于当前时间"
+	case *input.Temperature < minReadingTemperature || *input.Temperature > maxReadingTemperature:
+		return "温度超出合理范围"
+	case input.Humidity != nil && (*input.Humidity < minReadingHumidity || *input.Humidity > maxReadingHumidity):
+		return "湿度超出合理范围"
+	}
+	return ""
+}
+
+// 一次读数上报的结果
+type telemetryIngestResult struct {
+	BatchID      uint                        `json:"batch_id"`
+	BatchSHA256  string                      `json:"batch_sha256"`
+	ReadingCount int                         `json:"reading_count"`
+	ProductSKUs  []string                    `json:"product_skus"`
+	Blocks       map[string]string           `json:"blocks,omitempty"`
+	Excursions   []configs.ExcursionIncident `json:"excursions,omitempty"`
+	Duplicate    bool                        `json:"duplicate"`
+}
+
+// 校验并保存一批读数，HTTP上报和MQTT桥接共用
+// 读数保存到遥测表，批次摘要写入设备在读数时间范围内绑定的每个产品的账本，并按产品要求判断超温
+// 相同内容的批次重复上报时直接返回已有批次
+func ingestTelemetry(device configs.Device, inputs []telemetryReadingInput) (*telemetryIngestResult, error) {
+	return ingestTelemetryWith(device, inputs, nil)
+}
+
+// 与 ingestTelemetry 相同，consumed 不为空时在保存批次的同一事务中执行，重复批次时也会执行
+// MQTT桥接用它删除已保存的暂存行，批次保存和暂存行删除要么都成功要么都不生效
+func ingestTelemetryWith(device configs.Device, inputs []telemetryReadingInput, consumed func(tx *gorm.DB) error) (*telemetryIngestResult, error) {
+	if len(inputs) > maxTelemetryReadings {
+		return nil, ErrTooManyReadings
+	}
+
+	latest := time.Now().Add(telemetryClockSkew)
+	readings := make([]configs.TelemetryReading, 0, len(inputs))
+	for i, input := range inputs {
+		if reason := checkReading(input, latest); reason != "" {
+			return nil, &readingError{Index: i, Reason: reason}
+		}
+		// 读数时间按数据库的毫秒精度保存，摘要也按毫秒计算
+		readings = append(readings, configs.TelemetryReading{
+			DeviceID:    device.ID,
+			RecordedAt:  input.RecordedAt.Truncate(time.Millisecond),
+			Temperature: *input.Temperature,
+			Humidity:    input.Humidity,
+		})
+	}
+	if len(readings) == 0 {
+		return nil, &readingError{Reason: "没有读数"}
+	}
+	sort.SliceStable(readings, func(i, j int) bool {
+		return readings[i].RecordedAt.Before(readings[j].RecordedAt)
+	})
+
+	batch := configs.TelemetryBatch{
+		DeviceID:       device.ID,
+		BatchSHA256:    telemetryBatchDigest(device.SerialNo, readings),
+		ReadingCount:   len(readings),
+		FirstAt:        readings[0].RecordedAt,
+		LastAt:         readings[len(readings)-1].RecordedAt,
+		MinTemperature: readings[0].Temperature,
+		MaxTemperature: readings[0].Temperature,
+	}
+	for _, reading := range readings {
+		batch.MinTemperature = math.Min(batch.MinTemperature, reading.Temperature)
+		batch.MaxTemperature = math.Max(batch.MaxTemperature, reading.Temperature)
+	}
+
+	var existing configs.TelemetryBatch
+	result := configs.DB.Where("device_id = ? AND batch_sha256 = ?", device.ID, batch.BatchSHA256).First(&existing)
+	if result.Error == nil {
+		skus, err := batchSKUs(configs.DB, existing.ID)
+		if err != nil {
+			return nil, err
+		}
+		if consumed != nil {
+			if err := consumed(configs.DB); err != nil {
+				return nil, err
+			}
+		}
+		return &telemetryIngestResult{
+			BatchID:      existing.ID,
+			BatchSHA256:  existing.BatchSHA256,
+			ReadingCount: existing.ReadingCount,
+			ProductSKUs:  skus,
+			Duplicate:    true,
+		}, nil
+	}
+
+	// 批次、读数、各产品的区块和超温记录在同一事务中写入
+	blockchainService := &BlockchainService{}
+	ingested := &telemetryIngestResult{Blocks: make(map[string]string)}
+	// 各产品绑定期间的读数，事务提交后累加到保质期
+	thermal := make(map[string][]thermalPoint)
+	err := ledgerTransaction(func(tx *gorm.DB) error {
+		windows, err := boundSKUs(tx, device, batch.FirstAt, batch.LastAt)
+		if err != nil {
+			return err
+		}
+		if len(windows) == 0 {
+			return ErrDeviceNotBound
+		}
+		skus := make([]string, 0, len(windows))
+		for sku := range windows {
+			skus = append(skus, sku)
+		}
+		sort.Strings(skus)
+		after, err := latestReadingAt(tx, device.ID)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Create(&batch).Error; err != nil {
+			return err
+		}
+		products := make([]configs.TelemetryBatchProduct, len(skus))
+		for i, sku := range skus {
+			products[i] = configs.TelemetryBatchProduct{BatchID: batch.ID, ProductSKU: sku}
+		}
+		if err := tx.Create(&products).Error; err != nil {
+			return err
+		}
+		for i := range readings {
+			readings[i].BatchID = batch.ID
+		}
+		if err := telemetryStore.Append(tx, batch, readings); err != nil {
+			return err
+		}
+
+		for _, sku := range skus {
+			hash, err := blockchainService.AddEventTx(tx, sku, telemetryBatchEvent(batch, device, sku), device.OwnerID)
+			if err != nil {
+				return err
+			}
+			ingested.Blocks[sku] = hash
+			for _, reading := range excursionReadings(readings, windows[sku], time.Time{}) {
+				thermal[sku] = append(thermal[sku], thermalPoint{At: reading.At, Temperature: reading.Temperature})
+			}
+
+			// 补传的读数早于已判断过的读数时重新判断受影响的时间段，超过原始读数保留期时只判断较新的读数
+			stream := excursionStream{SKU: sku, Source: events.ExcursionSourceTelemetry, Device: &device, SignerID: device.OwnerID}
+			var changed []configs.ExcursionIncident
+			late := !after.IsZero() && !batch.FirstAt.After(after)
+			if late {
+				to := after
+				if batch.LastAt.After(to) {
+					to = batch.LastAt
+				}
+				changed, err = reevaluateExcursions(tx, stream, batch.FirstAt, lateReadingLoader(tx, device, sku, batch, readings, to))
+			}
+			if !late || errors.Is(err, errReadingsPruned) {
+				changed, err = evaluateExcursions(tx, stream, excursionReadings(readings, windows[sku], after))
+			}
+			if err != nil {
+				return err
+			}
+			ingested.Excursions = append(ingested.Excursions, changed...)
+		}
+		ingested.ProductSKUs = skus
+		if consumed != nil {
+			if err := consumed(tx); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&device).Update("last_seen_at", time.Now()).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sku := range ingested.ProductSKUs {
+		refreshShelfLife(sku, thermal[sku]...)
+	}
+
+	ingested.BatchID = batch.ID
+	ingested.BatchSHA256 = batch.BatchSHA256
+	ingested.ReadingCount = batch.ReadingCount
+	return ingested, nil
+}
+
+// IngestTelemetry 批量上报温湿度读数
+func (s *TelemetryService) IngestTelemetry(c *gin.Context) {
+	device := c.MustGet("device").(configs.Device)
+
+	var req struct {
+		Readings []telemetryReadingInput `json:"readings" binding:"required,min=1,dive"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+
+	ingested, err := ingestTelemetry(device, req.Readings)
+	var invalid *readingError
+	switch {
+	case errors.Is(err, ErrTooManyReadings):
+		c.JSON(http.StatusRequestEntityTooLarge, api.Response{
+			Code:    413,
+			Message: err.Error(),
+		})
+		return
+	case errors.As(err, &invalid):
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: err.Error(),
+		})
+		return
+	case errors.Is(err, ErrDeviceNotBound):
+		c.JSON(http.StatusConflict, api.Response{
+			Code:    409,
+			Message: err.Error(),
+		})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "保存读数失败: " + err.Error(),
+		})
+		return
+	}
+
+	message := "上报读数成功"
+	if ingested.Duplicate {
+		message = "批次已上报"
+	}
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: message,
+		Data:    ingested,
+	})
+}
+
+// VerifyTelemetryBatch 用保存的读数重新计算批次摘要，与账本中记录的摘要核对
+func (s *TelemetryService) VerifyTelemetryBatch(c *gin.Context) {
+	var batch configs.TelemetryBatch
+	if err := configs.DB.First(&batch, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, api.Response{
+			Code:    404,
+			Message: "批次不存在",
+		})
+		return
+	}
+	var device configs.Device
+	if err := configs.DB.Unscoped().First(&device, batch.DeviceID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "查询设备失败: " + err.Error(),
+		})
+		return
+	}
+
+	stored, err := telemetryStore.Readings(batch.DeviceID, batch.FirstAt, batch.LastAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "查询读数失败: " + err.Error(),
+		})
+		return
+	}
+	var readings []configs.TelemetryReading
+	for _, reading := range stored {
+		if reading.BatchID == batch.ID {
+			readings = append(readings, reading)
+		}
+	}
+
+	// 原始读数超过保留期被删除后，只能核对批次记录与账本是否一致
+	pruned := len(readings) == 0 && configs.GlobalTelemetryConfig.RawRetention > 0 &&
+		batch.LastAt.Before(time.Now().Add(-configs.GlobalTelemetryConfig.RawRetention))
+	digest := telemetryBatchDigest(device.SerialNo, readings)
+	if pruned {
+		digest = batch.BatchSHA256
+	}
+
+	// 账本中该批次的记录
+	type ledgerCheck struct {
+		ProductSKU  string `json:"product_sku"`
+		BlockHeight int64  `json:"block_height"`
+		BlockHash   string `json:"block_hash"`
+		Matches     bool   `json:"matches"`
+	}
+	skus, err := batchSKUs(configs.DB, batch.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "查询批次产品失败: " + err.Error(),
+		})
+		return
+	}
+	checks := []ledgerCheck{}
+	valid := digest == batch.BatchSHA256 && (pruned || len(readings) == batch.ReadingCount)
+	for _, sku := range skus {
+		blocks, err := skuBlocks(configs.DB, sku)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, api.Response{
+				Code:    500,
+				Message: "查询区块链记录失败: " + err.Error(),
+			})
+			return
+		}
+		found := false
+		for _, block := range blocks {
+			event, err := decodeBlockEvent(block)
+			if err != nil {
+				continue
+			}
+			if e, ok := event.(*events.TelemetryBatchRecorded); ok && e.BatchID == batch.ID {
+				found = true
+				checks = append(checks, ledgerCheck{
+					ProductSKU:  sku,
+					BlockHeight: block.BlockHeight,
+					BlockHash:   block.Hash,
+					Matches:     e.BatchSHA256 == digest,
+				})
+				valid = valid && e.BatchSHA256 == digest
+			}
+		}
+		if !found {
+			checks = append(checks, ledgerCheck{ProductSKU: sku})
+			valid = false
+		}
+	}
+
+	message := "读数与账本一致"
+	switch {
+	case !valid:
+		message = "读数与账本不一致"
+	case pruned:
+		message = "原始读数已超过保留期，批次记录与账本一致"
+	}
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: message,
+		Data: gin.H{
+			"valid":         valid,
+			"batch_id":      batch.ID,
+			"batch_sha256":  batch.BatchSHA256,
+			"actual_sha256": digest,
+			"reading_count": len(readings),
+			"raw_pruned":    pruned,
+			"ledger":        checks,
+		},
+	})
+}
+
+// 曲线查询的粒度参数
+var telemetryResolutionNames = map[string]time.Duration{
+	"raw": ResolutionRaw,
+	"1m":  ResolutionMinute,
+	"15m": ResolutionQuarter,
+	"1h":  ResolutionHour,
+}
+
+// 单次查询每条曲线的最大点数和原始读数的最大查询范围
+const (
+	maxTelemetryPoints = 10000
+	maxRawSpan         = 24 * time.Hour
+)
+
+// 未指定粒度时按时间范围选择，原始读数已删除的范围使用1分钟汇总
+func autoResolution(from, to time.Time) time.Duration {
+	span := to.Sub(from)
+	retention := configs.GlobalTelemetryConfig.RawRetention
+	switch {
+	case span <= 6*time.Hour && (retention == 0 || from.After(time.Now().Add(-retention))):
+		return ResolutionRaw
+	case span <= 3*24*time.Hour:
+		return ResolutionMinute
+	case span <= 60*24*time.Hour:
+		return ResolutionQuarter
+	}
+	return ResolutionHour
+}
+
+// 一个绑定时间段内的温湿度曲线
+type telemetrySeries struct {
+	DeviceID  uint             `json:"device_id"`
+	SerialNo  string           `json:"serial_no"`
+	BoundAt   time.Time        `json:"bound_at"`
+	UnboundAt *time.Time       `json:"unbound_at"`
+	Points    []TelemetryPoint `json:"points"`
+}
+
+// 绑定涉及的设备编号，包括已删除的设备
+func bindingSerials(db *gorm.DB, bindings []configs.DeviceBinding) map[uint]string {
+	deviceIDs := make([]uint, 0, len(bindings))
+	for _, binding := range bindings {
+		deviceIDs = append(deviceIDs, binding.DeviceID)
+	}
+	var devices []configs.Device
+	db.Unscoped().Where("id IN ?", deviceIDs).Find(&devices)
+	serials := make(map[uint]string, len(devices))
+	for _, device := range devices {
+		serials[device.ID] = device.SerialNo
+	}
+	return serials
+}
+
+// GetTelemetryRange 查询产品在时间范围内的温湿度曲线，用于绘制图表
+// 参数 sku、from、to（默认最近24小时）和 resolution（raw、1m、15m、1h，默认按范围自动选择）
+func (s *TelemetryService) GetTelemetryRange(c *gin.Context) {
+	sku := c.Query("sku")
+	if sku == "" {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "请提供产品SKU",
+		})
+		return
+	}
+
+	to := time.Now()
+	if value := c.Query("to"); value != "" {
+		parsed, err := parseAsOf(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, api.Response{
+				Code:    400,
+				Message: "to 参数错误，应为RFC 3339时间、2006-01-02 15:04:05 或Unix秒",
+			})
+			return
+		}
+		to = parsed
+	}
+	from := to.Add(-24 * time.Hour)
+	if value := c.Query("from"); value != "" {
+		parsed, err := parseAsOf(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, api.Response{
+				Code:    400,
+				Message: "from 参数错误，应为RFC 3339时间、2006-01-02 15:04:05 或Unix秒",
+			})
+			return
+		}
+		from = parsed
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "from 必须早于 to",
+		})
+		return
+	}
+
+	resolution := autoResolution(from, to)
+	if value := c.Query("resolution"); value != "" && value != "auto" {
+		named, ok := telemetryResolutionNames[value]
+		if !ok {
+			c.JSON(http.StatusBadRequest, api.Response{
+				Code:    400,
+				Message: "resolution 参数错误，应为 raw、1m、15m、1h 或 auto",
+			})
+			return
+		}
+		resolution = named
+	}
+	span := to.Sub(from)
+	if (resolution == ResolutionRaw && span > maxRawSpan) || (resolution != ResolutionRaw && span/resolution > maxTelemetryPoints) {
+		c.JSON(http.StatusBadRequest, api.Response{
+			Code:    400,
+			Message: "查询范围过大，请缩小时间范围或使用更粗的粒度",
+		})
+		return
+	}
+
+	bindings, err := skuBindings(configs.DB, sku)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "查询设备绑定失败: " + err.Error(),
+		})
+		return
+	}
+	serials := bindingSerials(configs.DB, bindings)
+
+	// 每个绑定时间段一条曲线
+	series := []telemetrySeries{}
+	for _, binding := range bindings {
+		start, end := from, to
+		if binding.BoundAt.After(start) {
+			start = binding.BoundAt
+		}
+		if binding.UnboundAt != nil && binding.UnboundAt.Before(end) {
+			end = *binding.UnboundAt
+		}
+		if start.After(end) {
+			continue
+		}
+		points, err := telemetryStore.Range(binding.DeviceID, start, end, resolution)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, api.Response{
+				Code:    500,
+				Message: "查询读数失败: " + err.Error(),
+			})
+			return
+		}
+		series = append(series, telemetrySeries{
+			DeviceID:  binding.DeviceID,
+			SerialNo:  serials[binding.DeviceID],
+			BoundAt:   binding.BoundAt,
+			UnboundAt: binding.UnboundAt,
+			Points:    points,
+		})
+	}
+
+	// 物流记录中人工录入的温湿度
+	var logistics []struct {
+		CreatedAt   time.Time `json:"time"`
+		Temperature float64   `json:"temperature"`
+		Humidity    float64   `json:"humidity"`
+		TrackingNo  string    `json:"tracking_no"`
+	}
+	configs.DB.Model(&configs.LogisticsRecord{}).
+		Select("created_at, temperature, humidity, tracking_no").
+		Where("product_sku = ? AND created_at >= ? AND created_at <= ?", sku, from, to).
+		Order("created_at").
+		Find(&logistics)
+
+	resolutionName := "raw"
+	for name, value := range telemetryResolutionNames {
+		if value == resolution {
+			resolutionName = name
+		}
+	}
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "获取温湿度曲线成功",
+		Data: gin.H{
+			"sku":        sku,
+			"from":       from,
+			"to":         to,
+			"resolution": resolutionName,
+			"series":     series,
+			"logistics":  logistics,
+		},
+	})
+}
+
+// AdminGetDevices 获取全部设备
+func (s *AdminService) AdminGetDevices(c *gin.Context) {
+	list, err := listDevices(configs.DB)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "查询设备失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "获取设备列表成功",
+		Data:    list,
+	})
+}
+
+// SetupTelemetryRoutes 设置设备和读数上报路由
+func SetupTelemetryRoutes(router *gin.Engine) {
+	telemetryService := &TelemetryService{}
+
+	// 厂家和经销商管理自己的设备
+	deviceGroup := router.Group("/api/devices")
+	deviceGroup.Use(AuthMiddleware(), TypeAuthMiddleware(1, 2))
+	{
+		deviceGroup.POST("", telemetryService.RegisterDevice)
+		deviceGroup.GET("", telemetryService.GetDevices)
+		deviceGroup.PUT("/:id", telemetryService.UpdateDevice)
+		deviceGroup.POST("/:id/key", telemetryService.RotateDeviceKey)
+		deviceGroup.POST("/:id/bindings", telemetryService.BindDevice)
+		deviceGroup.DELETE("/:id/bindings/:binding_id", telemetryService.UnbindDevice)
+	}
+
+	telemetryGroup := router.Group("/api/telemetry")
+	{
+		// 设备使用设备编号和密钥上报
+		telemetryGroup.POST("/ingest", DeviceAuthMiddleware(), telemetryService.IngestTelemetry)
+		telemetryGroup.GET("", telemetryService.GetTelemetryRange)
+		telemetryGroup.GET("/batches/:id/verify", telemetryService.VerifyTelemetryBatch)
+	}
+}
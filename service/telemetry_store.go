@@ -0,0 +1,523 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 读数的汇总粒度，0 表示原始读数
+const (
+	ResolutionRaw     time.Duration = 0
+	ResolutionMinute                = time.Minute
+	ResolutionQuarter               = 15 * time.Minute
+	ResolutionHour                  = time.Hour
+)
+
+// 写入读数时同时更新的汇总粒度
+var telemetryResolutions = []time.Duration{ResolutionMinute, ResolutionQuarter, ResolutionHour}
+
+// TelemetryPoint 曲线上的一个点，原始读数的 Count 为1
+type TelemetryPoint struct {
+	Time           time.Time `json:"time"`
+	Count          int       `json:"count"`
+	MinTemperature float64   `json:"min_temperature"`
+	MaxTemperature float64   `json:"max_temperature"`
+	AvgTemperature float64   `json:"avg_temperature"`
+	MinHumidity    *float64  `json:"min_humidity,omitempty"`
+	MaxHumidity    *float64  `json:"max_humidity,omitempty"`
+	AvgHumidity    *float64  `json:"avg_humidity,omitempty"`
+}
+
+// TelemetryStore 温湿度读数的时序存储
+// 原始读数按保留期删除，1分钟、15分钟和1小时汇总保存在MySQL中，各自有独立的保留期
+type TelemetryStore interface {
+	// Append 在事务中保存一个批次的原始读数并更新各粒度的汇总，读数已按时间排序
+	Append(tx *gorm.DB, batch configs.TelemetryBatch, readings []configs.TelemetryReading) error
+	// Readings 获取设备在 [from, to] 之间的原始读数，超过保留期的读数已被删除
+	Readings(deviceID uint, from, to time.Time) ([]configs.TelemetryReading, error)
+	// Range 按粒度获取设备在 [from, to] 之间的曲线
+	Range(deviceID uint, from, to time.Time, resolution time.Duration) ([]TelemetryPoint, error)
+	// Prune 删除早于 before 的原始读数
+	Prune(before time.Time) error
+}
+
+var (
+	_ TelemetryStore = (*GormTelemetryStore)(nil)
+	_ TelemetryStore = (*FileTelemetryStore)(nil)
+)
+
+// 当前使用的遥测存储，启动时按配置打开
+var telemetryStore TelemetryStore = &GormTelemetryStore{}
+
+// OpenTelemetryStore 按全局配置打开遥测存储
+func OpenTelemetryStore() (TelemetryStore, error) {
+	cfg := configs.GlobalTelemetryConfig
+	switch cfg.Store {
+	case "file":
+		fileStore, err := OpenFileTelemetryStore(cfg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		telemetryStore = fileStore
+	case "mysql":
+		telemetryStore = &GormTelemetryStore{}
+	default:
+		return nil, fmt.Errorf("不支持的遥测存储: %s", cfg.Store)
+	}
+	return telemetryStore, nil
+}
+
+// StartTelemetryRetention 定期删除超过保留期的原始读数和汇总
+func StartTelemetryRetention(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(configs.GlobalTelemetryConfig.RetentionInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := pruneTelemetry(time.Now()); err != nil {
+				log.Printf("清理过期读数失败: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// 按各粒度的保留期清理数据，保留期为0的粒度永久保留
+func pruneTelemetry(now time.Time) error {
+	cfg := configs.GlobalTelemetryConfig
+	if cfg.RawRetention > 0 {
+		if err := telemetryStore.Prune(now.Add(-cfg.RawRetention)); err != nil {
+			return err
+		}
+	}
+
+	retention := map[time.Duration]time.Duration{
+		ResolutionMinute:  cfg.MinuteRetention,
+		ResolutionQuarter: cfg.QuarterRetention,
+		ResolutionHour:    cfg.HourRetention,
+	}
+	for _, resolution := range telemetryResolutions {
+		if retention[resolution] <= 0 {
+			continue
+		}
+		result := configs.DB.Where("resolution = ? AND bucket_start < ?", int(resolution/time.Second), now.Add(-retention[resolution])).
+			Delete(&configs.TelemetryRollup{})
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+// 按粒度汇总一批读数
+func rollupReadings(readings []configs.TelemetryReading, resolution time.Duration) []configs.TelemetryRollup {
+	var rollups []configs.TelemetryRollup
+	index := make(map[time.Time]int)
+	for _, reading := range readings {
+		start := reading.RecordedAt.Truncate(resolution)
+		i, ok := index[start]
+		if !ok {
+			i = len(rollups)
+			index[start] = i
+			rollups = append(rollups, configs.TelemetryRollup{
+				DeviceID:       reading.DeviceID,
+				Resolution:     int(resolution / time.Second),
+				BucketStart:    start,
+				MinTemperature: reading.Temperature,
+				MaxTemperature: reading.Temperature,
+			})
+		}
+
+		rollup := &rollups[i]
+		rollup.Count++
+		rollup.SumTemperature += reading.Temperature
+		rollup.MinTemperature = math.Min(rollup.MinTemperature, reading.Temperature)
+		rollup.MaxTemperature = math.Max(rollup.MaxTemperature, reading.Temperature)
+		if reading.Humidity != nil {
+			if rollup.HumidityCount == 0 {
+				rollup.MinHumidity, rollup.MaxHumidity = *reading.Humidity, *reading.Humidity
+			}
+			rollup.HumidityCount++
+			rollup.SumHumidity += *reading.Humidity
+			rollup.MinHumidity = math.Min(rollup.MinHumidity, *reading.Humidity)
+			rollup.MaxHumidity = math.Max(rollup.MaxHumidity, *reading.Humidity)
+		}
+	}
+	return rollups
+}
+
+// 汇总已存在时合并，MySQL按书写顺序执行赋值，humidity_count 必须最后更新
+var rollupMerge = clause.Set{
+	{Column: clause.Column{Name: "min_temperature"}, Value: gorm.Expr("LEAST(min_temperature, VALUES(min_temperature))")},
+	{Column: clause.Column{Name: "max_temperature"}, Value: gorm.Expr("GREATEST(max_temperature, VALUES(max_temperature))")},
+	{Column: clause.Column{Name: "sum_temperature"}, Value: gorm.Expr("sum_temperature + VALUES(sum_temperature)")},
+	{Column: clause.Column{Name: "count"}, Value: gorm.Expr("`count` + VALUES(`count`)")},
+	{Column: clause.Column{Name: "min_humidity"}, Value: gorm.Expr("IF(VALUES(humidity_count) = 0, min_humidity, IF(humidity_count = 0, VALUES(min_humidity), LEAST(min_humidity, VALUES(min_humidity))))")},
+	{Column: clause.Column{Name: "max_humidity"}, Value: gorm.Expr("IF(VALUES(humidity_count) = 0, max_humidity, IF(humidity_count = 0, VALUES(max_humidity), GREATEST(max_humidity, VALUES(max_humidity))))")},
+	{Column: clause.Column{Name: "sum_humidity"}, Value: gorm.Expr("sum_humidity + VALUES(sum_humidity)")},
+	{Column: clause.Column{Name: "humidity_count"}, Value: gorm.Expr("humidity_count + VALUES(humidity_count)")},
+}
+
+// 在事务中把一批读数合并到各粒度的汇总
+func appendRollups(tx *gorm.DB, readings []configs.TelemetryReading) error {
+	for _, resolution := range telemetryResolutions {
+		rollups := rollupReadings(readings, resolution)
+		if len(rollups) == 0 {
+			continue
+		}
+		result := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "device_id"}, {Name: "resolution"}, {Name: "bucket_start"}},
+			DoUpdates: rollupMerge,
+		}).CreateInBatches(rollups, 500)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+// 查询汇总曲线
+func rollupRange(deviceID uint, from, to time.Time, resolution time.Duration) ([]TelemetryPoint, error) {
+	var rollups []configs.TelemetryRollup
+	result := configs.DB.Where("device_id = ? AND resolution = ? AND bucket_start >= ? AND bucket_start <= ?",
+		deviceID, int(resolution/time.Second), from.Truncate(resolution), to).
+		Order("bucket_start").
+		Find(&rollups)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	points := make([]TelemetryPoint, 0, len(rollups))
+	for _, rollup := range rollups {
+		point := TelemetryPoint{
+			Time:           rollup.BucketStart,
+			Count:          rollup.Count,
+			MinTemperature: rollup.MinTemperature,
+			MaxTemperature: rollup.MaxTemperature,
+			AvgTemperature: rollup.SumTemperature / float64(rollup.Count),
+		}
+		if rollup.HumidityCount > 0 {
+			minHumidity, maxHumidity := rollup.MinHumidity, rollup.MaxHumidity
+			avgHumidity := rollup.SumHumidity / float64(rollup.HumidityCount)
+			point.MinHumidity, point.MaxHumidity, point.AvgHumidity = &minHumidity, &maxHumidity, &avgHumidity
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+// 按粒度查询曲线，原始读数由存储提供，汇总统一从MySQL读取
+func rangeOf(store TelemetryStore, deviceID uint, from, to time.Time, resolution time.Duration) ([]TelemetryPoint, error) {
+	if resolution != ResolutionRaw {
+		return rollupRange(deviceID, from, to, resolution)
+	}
+
+	readings, err := store.Readings(deviceID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]TelemetryPoint, 0, len(readings))
+	for _, reading := range readings {
+		points = append(points, TelemetryPoint{
+			Time:           reading.RecordedAt,
+			Count:          1,
+			MinTemperature: reading.Temperature,
+			MaxTemperature: reading.Temperature,
+			AvgTemperature: reading.Temperature,
+			MinHumidity:    reading.Humidity,
+			MaxHumidity:    reading.Humidity,
+			AvgHumidity:    reading.Humidity,
+		})
+	}
+	return points, nil
+}
+
+// GormTelemetryStore 原始读数保存在MySQL telemetry_readings 表中，适合设备较少的部署
+type GormTelemetryStore struct{}
+
+// Append 写入原始读数和汇总
+func (s *GormTelemetryStore) Append(tx *gorm.DB, batch configs.TelemetryBatch, readings []configs.TelemetryReading) error {
+	if err := tx.CreateInBatches(readings, 1000).Error; err != nil {
+		return err
+	}
+	return appendRollups(tx, readings)
+}
+
+// Readings 查询原始读数
+func (s *GormTelemetryStore) Readings(deviceID uint, from, to time.Time) ([]configs.TelemetryReading, error) {
+	var readings []configs.TelemetryReading
+	result := configs.DB.Where("device_id = ? AND recorded_at >= ? AND recorded_at <= ?", deviceID, from, to).
+		Order("recorded_at, id").
+		Find(&readings)
+	return readings, result.Error
+}
+
+// Range 查询曲线
+func (s *GormTelemetryStore) Range(deviceID uint, from, to time.Time, resolution time.Duration) ([]TelemetryPoint, error) {
+	return rangeOf(s, deviceID, from, to, resolution)
+}
+
+// Prune 删除过期的原始读数
+func (s *GormTelemetryStore) Prune(before time.Time) error {
+	return configs.DB.Where("recorded_at < ?", before).Delete(&configs.TelemetryReading{}).Error
+}
+
+// 文件存储中一条读数的长度
+// 读数时间(8) + 批次ID(8) + 批次摘要前8字节(8) + 温度(8) + 是否有湿度(1) + 湿度(8)
+const telemetryRecordSize = 41
+
+// FileTelemetryStore 原始读数按设备和UTC日期追加写入本地文件，汇总保存在MySQL中
+// 目录结构为 <dir>/<设备ID>/<20060102>.tlm，按天删除过期文件
+// 文件在事务提交前写入，事务回滚时留下的读数在读取时按批次ID和摘要过滤
+type FileTelemetryStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// OpenFileTelemetryStore 打开文件存储，目录不存在时创建
+func OpenFileTelemetryStore(dir string) (*FileTelemetryStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileTelemetryStore{dir: dir}, nil
+}
+
+func (s *FileTelemetryStore) deviceDir(deviceID uint) string {
+	return filepath.Join(s.dir, strconv.FormatUint(uint64(deviceID), 10))
+}
+
+// 批次摘要的前8字节，用于识别已回滚批次留下的读数
+func batchDigestPrefix(digest string) uint64 {
+	raw, err := hex.DecodeString(digest)
+	if err != nil || len(raw) < 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(raw[:8])
+}
+
+func encodeTelemetryRecord(buf []byte, reading configs.TelemetryReading, digest uint64) []byte {
+	buf = binary.BigEndian.AppendUint64(buf, uint64(reading.RecordedAt.UnixNano()))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(reading.BatchID))
+	buf = binary.BigEndian.AppendUint64(buf, digest)
+	buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(reading.Temperature))
+	if reading.Humidity != nil {
+		buf = append(buf, 1)
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(*reading.Humidity))
+	} else {
+		buf = append(buf, 0)
+		buf = binary.BigEndian.AppendUint64(buf, 0)
+	}
+	return buf
+}
+
+func decodeTelemetryRecord(data []byte, deviceID uint) (configs.TelemetryReading, uint64) {
+	reading := configs.TelemetryReading{
+		DeviceID:    deviceID,
+		RecordedAt:  time.Unix(0, int64(binary.BigEndian.Uint64(data[0:8]))),
+		BatchID:     uint(binary.BigEndian.Uint64(data[8:16])),
+		Temperature: math.Float64frombits(binary.BigEndian.Uint64(data[24:32])),
+	}
+	if data[32] == 1 {
+		humidity := math.Float64frombits(binary.BigEndian.Uint64(data[33:41]))
+		reading.Humidity = &humidity
+	}
+	return reading, binary.BigEndian.Uint64(data[16:24])
+}
+
+// 追加写入一个日期文件，上次写入中断留下的不完整记录先截掉
+func appendTelemetryFile(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if partial := size % telemetryRecordSize; partial != 0 {
+		if err := file.Truncate(size - partial); err != nil {
+			return err
+		}
+		if _, err := file.Seek(size-partial, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func (s *FileTelemetryStore) dayFile(reading configs.TelemetryReading) string {
+	return filepath.Join(s.deviceDir(reading.DeviceID), reading.RecordedAt.UTC().Format("20060102")+".tlm")
+}
+
+// 按日期写入一个批次的原始读数文件
+func (s *FileTelemetryStore) appendFiles(batch configs.TelemetryBatch, readings []configs.TelemetryReading) error {
+	digest := batchDigestPrefix(batch.BatchSHA256)
+	files := make(map[string][]byte)
+	var order []string
+	for _, reading := range readings {
+		path := s.dayFile(reading)
+		if _, ok := files[path]; !ok {
+			order = append(order, path)
+		}
+		files[path] = encodeTelemetryRecord(files[path], reading, digest)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, path := range order {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := appendTelemetryFile(path, files[path]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Append 按日期写入原始读数文件，再在事务中更新汇总
+func (s *FileTelemetryStore) Append(tx *gorm.DB, batch configs.TelemetryBatch, readings []configs.TelemetryReading) error {
+	if err := s.appendFiles(batch, readings); err != nil {
+		return err
+	}
+	return appendRollups(tx, readings)
+}
+
+// 设备目录中与 [from, to] 有交集的日期文件
+func (s *FileTelemetryStore) dayFiles(deviceID uint, from, to time.Time) ([]string, error) {
+	entries, err := os.ReadDir(s.deviceDir(deviceID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	first := from.UTC().Format("20060102")
+	last := to.UTC().Format("20060102")
+	var paths []string
+	for _, entry := range entries {
+		day, ok := strings.CutSuffix(entry.Name(), ".tlm")
+		if !ok || day < first || day > last {
+			continue
+		}
+		paths = append(paths, filepath.Join(s.deviceDir(deviceID), entry.Name()))
+	}
+	return paths, nil
+}
+
+// Readings 读取日期文件中的读数，只返回已提交批次的读数
+func (s *FileTelemetryStore) Readings(deviceID uint, from, to time.Time) ([]configs.TelemetryReading, error) {
+	paths, err := s.dayFiles(deviceID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var readings []configs.TelemetryReading
+	var digests []uint64
+	batchIDs := make(map[uint]bool)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for offset := 0; offset+telemetryRecordSize <= len(data); offset += telemetryRecordSize {
+			reading, digest := decodeTelemetryRecord(data[offset:offset+telemetryRecordSize], deviceID)
+			if reading.RecordedAt.Before(from) || reading.RecordedAt.After(to) {
+				continue
+			}
+			readings = append(readings, reading)
+			digests = append(digests, digest)
+			batchIDs[reading.BatchID] = true
+		}
+	}
+	if len(readings) == 0 {
+		return nil, nil
+	}
+
+	// 批次ID和摘要都与已提交的批次一致才返回
+	ids := make([]uint, 0, len(batchIDs))
+	for id := range batchIDs {
+		ids = append(ids, id)
+	}
+	var batches []configs.TelemetryBatch
+	result := configs.DB.Select("id, batch_sha256").Where("id IN ? AND device_id = ?", ids, deviceID).Find(&batches)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	committed := make(map[uint]uint64, len(batches))
+	for _, batch := range batches {
+		committed[batch.ID] = batchDigestPrefix(batch.BatchSHA256)
+	}
+
+	valid := readings[:0]
+	for i, reading := range readings {
+		if digest, ok := committed[reading.BatchID]; ok && digest == digests[i] {
+			valid = append(valid, reading)
+		}
+	}
+	sort.SliceStable(valid, func(i, j int) bool {
+		return valid[i].RecordedAt.Before(valid[j].RecordedAt)
+	})
+	return valid, nil
+}
+
+// Range 查询曲线
+func (s *FileTelemetryStore) Range(deviceID uint, from, to time.Time, resolution time.Duration) ([]TelemetryPoint, error) {
+	return rangeOf(s, deviceID, from, to, resolution)
+}
+
+// Prune 删除整天都早于 before 的日期文件
+func (s *FileTelemetryStore) Prune(before time.Time) error {
+	devices, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	cutoff := before.UTC().Format("20060102")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, device := range devices {
+		if !device.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(s.dir, device.Name()))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if day, ok := strings.CutSuffix(entry.Name(), ".tlm"); ok && day < cutoff {
+				if err := os.Remove(filepath.Join(s.dir, device.Name(), entry.Name())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
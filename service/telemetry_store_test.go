@@ -0,0 +1,244 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 以固定时间为基准的读数，湿度为负数表示没有湿度
+func testTelemetryReadings(deviceID uint, base time.Time, points ...[3]float64) []configs.TelemetryReading {
+	readings := make([]configs.TelemetryReading, len(points))
+	for i, point := range points {
+		readings[i] = configs.TelemetryReading{
+			DeviceID:    deviceID,
+			RecordedAt:  base.Add(time.Duration(point[0]) * time.Second),
+			Temperature: point[1],
+		}
+		if point[2] >= 0 {
+			humidity := point[2]
+			readings[i].Humidity = &humidity
+		}
+	}
+	return readings
+}
+
+// 汇总的简写 开始时间/条数/最低/最高/合计[/湿度条数/最低/最高/合计]
+func testRollups(rollups []configs.TelemetryRollup) string {
+	list := make([]string, len(rollups))
+	for i, rollup := range rollups {
+		list[i] = fmt.Sprintf("%s/%d/%v/%v/%v", rollup.BucketStart.UTC().Format("15:04"), rollup.Count, rollup.MinTemperature, rollup.MaxTemperature, rollup.SumTemperature)
+		if rollup.HumidityCount > 0 {
+			list[i] += fmt.Sprintf("/%d/%v/%v/%v", rollup.HumidityCount, rollup.MinHumidity, rollup.MaxHumidity, rollup.SumHumidity)
+		}
+	}
+	return strings.Join(list, " ")
+}
+
+func TestRollupReadings(t *testing.T) {
+	base := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		points     [][3]float64 // 秒偏移, 温度, 湿度
+		resolution time.Duration
+		want       string
+	}{
+		{name: "没有读数", resolution: ResolutionMinute},
+		{
+			name:       "按分钟汇总",
+			points:     [][3]float64{{0, 4, -1}, {30, 6, -1}, {60, 5, -1}},
+			resolution: ResolutionMinute,
+			want:       "08:00/2/4/6/10 08:01/1/5/5/5",
+		},
+		{
+			name:       "按15分钟汇总",
+			points:     [][3]float64{{0, 4, -1}, {300, 2, -1}, {899, 8, -1}, {900, 3, -1}},
+			resolution: ResolutionQuarter,
+			want:       "08:00/3/2/8/14 08:15/1/3/3/3",
+		},
+		{
+			// 只有部分读数带湿度时，湿度只按有湿度的读数汇总
+			name:       "部分读数没有湿度",
+			points:     [][3]float64{{0, 4, -1}, {10, 5, 70}, {20, 6, 50}},
+			resolution: ResolutionMinute,
+			want:       "08:00/3/4/6/15/2/50/70/120",
+		},
+		{
+			name:       "读数乱序",
+			points:     [][3]float64{{3600, 1, -1}, {0, 2, -1}, {3610, 3, -1}},
+			resolution: ResolutionHour,
+			want:       "09:00/2/1/3/4 08:00/1/2/2/2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rollups := rollupReadings(testTelemetryReadings(1, base, tt.points...), tt.resolution)
+			if got := testRollups(rollups); got != tt.want {
+				t.Fatalf("汇总 %q，期望 %q", got, tt.want)
+			}
+			for _, rollup := range rollups {
+				if rollup.DeviceID != 1 || rollup.Resolution != int(tt.resolution/time.Second) {
+					t.Fatalf("汇总 %+v", rollup)
+				}
+			}
+		})
+	}
+}
+
+// 使用临时目录中的文件存储，结束后恢复原来的存储
+func testFileStore(t *testing.T) *FileTelemetryStore {
+	t.Helper()
+	store, err := OpenFileTelemetryStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := telemetryStore
+	telemetryStore = store
+	t.Cleanup(func() { telemetryStore = previous })
+	return store
+}
+
+// 创建读数批次记录
+func testTelemetryBatch(t *testing.T, deviceID uint, name string, readings []configs.TelemetryReading) configs.TelemetryBatch {
+	t.Helper()
+	batch := configs.TelemetryBatch{DeviceID: deviceID, BatchSHA256: hashData(name), ReadingCount: len(readings)}
+	if err := configs.DB.Create(&batch).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i := range readings {
+		readings[i].BatchID = batch.ID
+	}
+	return batch
+}
+
+// 读数的简写 时间/温度
+func testReadingList(readings []configs.TelemetryReading) string {
+	list := make([]string, len(readings))
+	for i, reading := range readings {
+		list[i] = fmt.Sprintf("%s/%v", reading.RecordedAt.UTC().Format("01-02 15:04"), reading.Temperature)
+	}
+	return strings.Join(list, " ")
+}
+
+func TestFileTelemetryStore(t *testing.T) {
+	testDB(t)
+	store := testFileStore(t)
+	// 读数跨过UTC零点，写入两个日期文件
+	base := time.Date(2026, 1, 1, 23, 58, 0, 0, time.UTC)
+	first := testTelemetryReadings(1, base, [3]float64{240, 6, -1}, [3]float64{0, 4, 60})
+	batch := testTelemetryBatch(t, 1, "a", first)
+	if err := store.Append(configs.DB, batch, first); err != nil {
+		t.Fatal(err)
+	}
+
+	// 事务回滚的批次留下的读数，以及批次ID相同但摘要不同的读数
+	rolledBack := testTelemetryReadings(1, base, [3]float64{60, 100, -1})
+	rolledBack[0].BatchID = batch.ID + 100
+	if err := store.appendFiles(configs.TelemetryBatch{BatchSHA256: hashData("x")}, rolledBack); err != nil {
+		t.Fatal(err)
+	}
+	forged := testTelemetryReadings(1, base, [3]float64{61, 200, -1})
+	forged[0].BatchID = batch.ID
+	if err := store.appendFiles(configs.TelemetryBatch{BatchSHA256: hashData("y")}, forged); err != nil {
+		t.Fatal(err)
+	}
+
+	// 上次写入中断留下的半条记录，下次写入前截掉
+	path := filepath.Join(store.deviceDir(1), "20260102.tlm")
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{1, 2, 3})
+	file.Close()
+	second := testTelemetryReadings(1, base, [3]float64{300, 5, -1})
+	batch2 := testTelemetryBatch(t, 1, "b", second)
+	if err := store.Append(configs.DB, batch2, second); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		deviceID uint
+		from, to time.Time
+		want     string
+	}{
+		{name: "全部读数", deviceID: 1, from: base.Add(-time.Hour), to: base.Add(time.Hour), want: "01-01 23:58/4 01-02 00:02/6 01-02 00:03/5"},
+		{name: "只读一天", deviceID: 1, from: base.Add(-time.Hour), to: base.Add(time.Minute), want: "01-01 23:58/4"},
+		{name: "按时间过滤", deviceID: 1, from: base.Add(5 * time.Minute), to: base.Add(time.Hour), want: "01-02 00:03/5"},
+		{name: "没有读数", deviceID: 1, from: base.Add(time.Hour), to: base.Add(2 * time.Hour)},
+		{name: "其他设备", deviceID: 2, from: base.Add(-time.Hour), to: base.Add(time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readings, err := store.Readings(tt.deviceID, tt.from, tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := testReadingList(readings); got != tt.want {
+				t.Fatalf("读数 %q，期望 %q", got, tt.want)
+			}
+		})
+	}
+
+	// 汇总写入MySQL，原始读数与湿度一起保留
+	points, err := store.Range(1, base.Add(-time.Hour), base.Add(time.Hour), ResolutionHour)
+	if err != nil || len(points) != 2 || points[0].Count != 1 || points[0].AvgHumidity == nil || points[1].Count != 2 {
+		t.Fatalf("汇总 %+v %v", points, err)
+	}
+
+	// 只删除整天都过期的日期文件
+	if err := store.Prune(base.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	readings, err := store.Readings(1, base.Add(-time.Hour), base.Add(time.Hour))
+	if err != nil || testReadingList(readings) != "01-02 00:02/6 01-02 00:03/5" {
+		t.Fatalf("清理后的读数 %q %v", testReadingList(readings), err)
+	}
+}
+
+func TestOpenTelemetryStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		store   string
+		want    string
+		wantErr bool
+	}{
+		{name: "默认使用文件", store: configs.GlobalTelemetryConfig.Store, want: "file"},
+		{name: "配置为MySQL", store: "mysql", want: "mysql"},
+		{name: "未配置", store: "", wantErr: true},
+		{name: "不支持的存储", store: "xml", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous, cfg := telemetryStore, configs.GlobalTelemetryConfig
+			t.Cleanup(func() { telemetryStore, configs.GlobalTelemetryConfig = previous, cfg })
+			configs.GlobalTelemetryConfig.Store = tt.store
+			configs.GlobalTelemetryConfig.Dir = t.TempDir()
+
+			store, err := OpenTelemetryStore()
+			if tt.wantErr {
+				if err == nil || telemetryStore != previous {
+					t.Fatalf("应返回错误且不更换存储: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			kind := "mysql"
+			if _, ok := store.(*FileTelemetryStore); ok {
+				kind = "file"
+			}
+			if kind != tt.want || store != telemetryStore {
+				t.Fatalf("打开的存储 %s，期望 %s", kind, tt.want)
+			}
+		})
+	}
+}
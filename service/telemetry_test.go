@@ -0,0 +1,264 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+// 创建属于 owner 的设备
+func testDevice(t *testing.T, ownerID uint) configs.Device {
+	t.Helper()
+	device := configs.Device{
+		SerialNo: fmt.Sprintf("D-%d", time.Now().UnixNano()),
+		Kind:     "logger",
+		OwnerID:  ownerID,
+		KeyHash:  deviceKeyHash("key"),
+	}
+	if err := configs.DB.Create(&device).Error; err != nil {
+		t.Fatal(err)
+	}
+	return device
+}
+
+// 把事件写入产品的账本
+func testAddEvent(t *testing.T, sku string, event events.Event, signerID uint) {
+	t.Helper()
+	data, err := events.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&BlockchainService{}).AddToBlockchain(sku, event.RecordType(), string(data), signerID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 在运单下写入产品的物流记录
+func testShipment(t *testing.T, trackingNo string, skus ...string) {
+	t.Helper()
+	for _, sku := range skus {
+		record := configs.LogisticsRecord{ProductSKU: sku, TrackingNo: trackingNo, WarehouseLocation: "一号仓", Temperature: 4, Humidity: 60, OperatorType: 1}
+		if err := configs.DB.Create(&record).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBoundSKUs(t *testing.T) {
+	testDB(t)
+	factory, other, saler, admin := testUser(t, 1), testUser(t, 1), testUser(t, 2), testUser(t, 4)
+	own := testProduct(t, "SKU-OWN", factory.ID)
+	foreign := testProduct(t, "SKU-OTHER", other.ID)
+	held := testProduct(t, "SKU-HELD", other.ID)
+	for _, product := range []configs.ProductInfo{own, foreign, held} {
+		testAddEvent(t, product.SKU, productCreatedEvent(product, admin.ID), admin.ID)
+	}
+	// 其他厂家把产品交给了经销商
+	transfer := configs.TransferRecord{ProductSKU: held.SKU, FromUserID: other.ID, ToUserID: saler.ID}
+	transfer.ID = 1
+	testAddEvent(t, held.SKU, custodyTransferredEvent(transfer), other.ID)
+	testShipment(t, "T1", own.SKU, foreign.SKU, held.SKU)
+
+	now := time.Now()
+	unbound := now.Add(-time.Hour)
+	tests := []struct {
+		name     string
+		owner    uint
+		bindings []configs.DeviceBinding
+		want     []string
+	}{
+		{
+			name:     "绑定到产品",
+			owner:    factory.ID,
+			bindings: []configs.DeviceBinding{{ProductSKU: foreign.SKU, BoundAt: now.Add(-2 * time.Hour)}},
+			want:     []string{foreign.SKU},
+		},
+		{
+			// 运单中其他厂家的产品不写入
+			name:     "运单中自己生产的产品",
+			owner:    factory.ID,
+			bindings: []configs.DeviceBinding{{TrackingNo: "T1", BoundAt: now.Add(-2 * time.Hour)}},
+			want:     []string{own.SKU},
+		},
+		{
+			name:     "运单中自己持有的产品",
+			owner:    saler.ID,
+			bindings: []configs.DeviceBinding{{TrackingNo: "T1", BoundAt: now.Add(-2 * time.Hour)}},
+			want:     []string{held.SKU},
+		},
+		{
+			name:     "运单中没有相关的产品",
+			owner:    admin.ID,
+			bindings: []configs.DeviceBinding{{TrackingNo: "T1", BoundAt: now.Add(-2 * time.Hour)}},
+		},
+		{
+			name:     "读数前已解除绑定",
+			owner:    factory.ID,
+			bindings: []configs.DeviceBinding{{ProductSKU: own.SKU, BoundAt: now.Add(-2 * time.Hour), UnboundAt: &unbound}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			device := testDevice(t, tt.owner)
+			for _, binding := range tt.bindings {
+				binding.DeviceID = device.ID
+				if err := configs.DB.Create(&binding).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			windows, err := boundSKUs(configs.DB, device, now.Add(-time.Minute), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for sku := range windows {
+				got = append(got, sku)
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("绑定的产品 %v，期望 %v", got, tt.want)
+			}
+
+			// 查询产品读数时使用相同的范围
+			for _, sku := range []string{own.SKU, foreign.SKU, held.SKU} {
+				bindings, err := skuBindings(configs.DB, sku)
+				if err != nil {
+					t.Fatal(err)
+				}
+				found := false
+				for _, binding := range bindings {
+					found = found || (binding.DeviceID == device.ID && binding.UnboundAt == nil)
+				}
+				if _, ok := windows[sku]; found != ok {
+					t.Fatalf("产品 %s 的绑定 %+v", sku, bindings)
+				}
+			}
+		})
+	}
+}
+
+func TestBoundSKUsCustodyAtReadingTime(t *testing.T) {
+	testDB(t)
+	factory, first, second, admin := testUser(t, 1), testUser(t, 2), testUser(t, 2), testUser(t, 4)
+	product := testProduct(t, "SKU-1", factory.ID)
+	testAddEvent(t, product.SKU, productCreatedEvent(product, admin.ID), admin.ID)
+	// 生产商交给第一个经销商，第一个经销商再交给第二个
+	for i, to := range []configs.User{first, second} {
+		from := factory
+		if i > 0 {
+			from = first
+		}
+		transfer := configs.TransferRecord{ProductSKU: product.SKU, FromUserID: from.ID, ToUserID: to.ID}
+		transfer.ID = uint(i + 1)
+		testAddEvent(t, product.SKU, custodyTransferredEvent(transfer), from.ID)
+	}
+	testShipment(t, "T1", product.SKU)
+
+	// 三个区块分别在 base、base+1h 和 base+2h 写入
+	base := time.Now().Add(-3 * time.Hour)
+	var blocks []configs.BlockchainLog
+	configs.DB.Where("product_sku = ?", product.SKU).Order("block_height").Find(&blocks)
+	for i := range blocks {
+		configs.DB.Model(&blocks[i]).Update("timestamp", base.Add(time.Duration(i)*time.Hour).UnixNano())
+	}
+	handover, handoff := base.Add(time.Hour), base.Add(2*time.Hour)
+
+	devices := map[uint]configs.Device{}
+	for _, owner := range []configs.User{first, second} {
+		device := testDevice(t, owner.ID)
+		configs.DB.Create(&configs.DeviceBinding{DeviceID: device.ID, TrackingNo: "T1", BoundAt: base})
+		devices[owner.ID] = device
+	}
+
+	tests := []struct {
+		name     string
+		owner    uint
+		from, to time.Duration // 读数时间相对 base
+		want     []bindingWindow
+	}{
+		{name: "交到自己手上之前", owner: first.ID, from: 30 * time.Minute, to: 40 * time.Minute},
+		{name: "自己持有期间", owner: first.ID, from: 70 * time.Minute, to: 80 * time.Minute, want: []bindingWindow{{From: handover, To: &handoff}}},
+		{name: "批次跨过交出的时间", owner: first.ID, from: 110 * time.Minute, to: 130 * time.Minute, want: []bindingWindow{{From: handover, To: &handoff}}},
+		// 上一个持有人运输途中的读数不归到下一个持有人
+		{name: "已经交给下一个持有人", owner: first.ID, from: 150 * time.Minute, to: 160 * time.Minute},
+		{name: "下一个持有人运输途中", owner: second.ID, from: 150 * time.Minute, to: 160 * time.Minute, want: []bindingWindow{{From: handoff}}},
+		{name: "下一个持有人接手之前", owner: second.ID, from: 70 * time.Minute, to: 80 * time.Minute},
+	}
+
+	// 投影尚未同步时从账本补上持有人历史，同步之后从投影读取
+	for _, synced := range []bool{false, true} {
+		if synced {
+			if err := projector.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s/投影已同步=%v", tt.name, synced), func(t *testing.T) {
+				windows, err := boundSKUs(configs.DB, devices[tt.owner], base.Add(tt.from), base.Add(tt.to))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := windows[product.SKU]
+				if len(got) != len(tt.want) {
+					t.Fatalf("绑定时间段 %+v，期望 %+v", got, tt.want)
+				}
+				for i, want := range tt.want {
+					if !got[i].From.Equal(want.From) || (got[i].To == nil) != (want.To == nil) || (want.To != nil && !got[i].To.Equal(*want.To)) {
+						t.Fatalf("绑定时间段 %+v，期望 %+v", got, tt.want)
+					}
+				}
+			})
+		}
+	}
+
+	// 查询产品读数时运单绑定按持有时间段截取
+	bindings, err := skuBindings(configs.DB, product.SKU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bindings) != 2 {
+		t.Fatalf("绑定 %+v", bindings)
+	}
+	for _, binding := range bindings {
+		want := bindingWindow{From: handover, To: &handoff}
+		if binding.DeviceID == devices[second.ID].ID {
+			want = bindingWindow{From: handoff}
+		}
+		if !binding.BoundAt.Equal(want.From) || (binding.UnboundAt == nil) != (want.To == nil) || (want.To != nil && !binding.UnboundAt.Equal(*want.To)) {
+			t.Fatalf("设备 %d 的绑定 %+v", binding.DeviceID, binding)
+		}
+	}
+}
+
+func TestIngestTelemetryBatchProducts(t *testing.T) {
+	testDB(t)
+	factory := testUser(t, 1)
+	testProduct(t, "SKU-1", factory.ID)
+	testProduct(t, "SKU-2", factory.ID)
+	device := testDevice(t, factory.ID)
+	for _, sku := range []string{"SKU-2", "SKU-1"} {
+		configs.DB.Create(&configs.DeviceBinding{DeviceID: device.ID, ProductSKU: sku, BoundAt: time.Now().Add(-time.Hour)})
+	}
+
+	temperature := 4.0
+	inputs := []telemetryReadingInput{{RecordedAt: time.Now().Add(-time.Minute), Temperature: &temperature}}
+	ingested, err := ingestTelemetry(device, inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skus, err := batchSKUs(configs.DB, ingested.BatchID)
+	if err != nil || fmt.Sprint(skus) != "[SKU-1 SKU-2]" || fmt.Sprint(ingested.ProductSKUs) != fmt.Sprint(skus) {
+		t.Fatalf("批次产品 %v %v: %v", skus, ingested.ProductSKUs, err)
+	}
+
+	// 重复上报返回已有批次的产品
+	again, err := ingestTelemetry(device, inputs)
+	if err != nil || !again.Duplicate || fmt.Sprint(again.ProductSKUs) != fmt.Sprint(skus) {
+		t.Fatalf("重复上报 %+v %v", again, err)
+	}
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"io"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 需要MySQL的测试通过 TEST_MYSQL_DSN 指定测试库，未设置时跳过，例如:
+// TEST_MYSQL_DSN="root:password@tcp(127.0.0.1:3306)/cold_chain_test?charset=utf8mb4&parseTime=True&loc=Local"
+// 每个测试开始前会清空该库中的所有表，不要指向有数据的库
+var (
+	testDBOnce sync.Once
+	testDBConn *gorm.DB
+	testDBErr  error
+)
+
+// 连接测试库并清空所有表，同时重置会影响账本写入的全局状态
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("未设置 TEST_MYSQL_DSN，跳过需要MySQL的测试")
+	}
+
+	testDBOnce.Do(func() {
+		testDBConn, testDBErr = gorm.Open(mysql.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+		if testDBErr != nil {
+			return
+		}
+		configs.DB = testDBConn
+		testDBErr = configs.AutoMigrateTables()
+	})
+	if testDBErr != nil {
+		t.Fatalf("连接测试库失败: %v", testDBErr)
+	}
+	configs.DB = testDBConn
+
+	tables, err := testDBConn.Migrator().GetTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		if table == "ledger_locks" {
+			continue
+		}
+		if err := testDBConn.Exec("DELETE FROM `" + table + "`").Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blockProducer = nil
+	ledgerMirror = nil
+	ledgerArchive = nil
+	consensusNode = nil
+	if configs.GlobalLedgerConfig.KeyEncryptSecret == "" {
+		configs.GlobalLedgerConfig.KeyEncryptSecret = "test_custodial_key_secret"
+	}
+	return testDBConn
+}
+
+// 创建已审核的测试用户
+func testUser(t *testing.T, userType int) configs.User {
+	t.Helper()
+	user := configs.User{
+		Username:    fmt.Sprintf("user_%d_%d", userType, time.Now().UnixNano()),
+		Password:    "x",
+		RealName:    "测试用户",
+		Address:     "测试地址",
+		Contact:     "test",
+		UserType:    userType,
+		AuditStatus: 1,
+	}
+	if err := configs.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// 创建已发布的测试产品
+func testProduct(t *testing.T, sku string, manufacturerID uint) configs.ProductInfo {
+	t.Helper()
+	now := time.Now()
+	product := configs.ProductInfo{
+		SKU:              sku,
+		Name:             "测试产品",
+		Brand:            "测试品牌",
+		Specification:    "1kg",
+		ProductionDate:   now,
+		ExpirationDate:   now.AddDate(0, 0, 30),
+		BatchNumber:      "B1",
+		ManufacturerID:   manufacturerID,
+		MaterialSource:   "测试",
+		ProcessLocation:  "测试",
+		ProcessMethod:    "测试",
+		TransportTemp:    4,
+		StorageCondition: "冷藏",
+		SafetyTesting:    "合格",
+		QualityRating:    "A",
+		ImageURL:         "x",
+		Status:           1,
+	}
+	if err := configs.DB.Create(&product).Error; err != nil {
+		t.Fatal(err)
+	}
+	return product
+}
+
+// 以指定用户身份直接调用处理函数，跳过登录鉴权
+func testHandle(handler gin.HandlerFunc, user configs.User, method, target string, body any) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	var reader io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, target, reader)
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Set("userID", user.ID)
+	c.Set("userType", user.UserType)
+	handler(c)
+	return w
+}
+
+// 让之后写入 blockchain_logs 的操作失败，模拟账本写入出错，测试结束时恢复
+func testFailLedgerWrites(t *testing.T) {
+	t.Helper()
+	name := "test:fail_ledger_writes"
+	err := configs.DB.Callback().Create().Before("gorm:create").Register(name, func(db *gorm.DB) {
+		if db.Statement.Table == "blockchain_logs" {
+			db.AddError(errors.New("模拟账本写入失败"))
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		configs.DB.Callback().Create().Remove(name)
+	})
+}
@@ -0,0 +1,554 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/digitorus/pkcs7"
+	"github.com/digitorus/timestamp"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RFC 3161 请求和响应的 Content-Type
+const (
+	timestampQueryType = "application/timestamp-query"
+	timestampReplyType = "application/timestamp-reply"
+)
+
+// 本地时间戳服务使用的策略OID，仅用于测试和内网部署
+var localTSAPolicy = asn1.ObjectIdentifier{1, 2, 3, 4, 1}
+
+// TimestampAuthority RFC 3161 时间戳服务
+type TimestampAuthority interface {
+	// Timestamp 对SHA-256摘要申请时间戳，返回 TimeStampToken(DER)
+	Timestamp(ctx context.Context, digest []byte) ([]byte, error)
+}
+
+// 通过HTTP访问的外部时间戳服务
+type httpTSA struct {
+	url    string
+	client *http.Client
+}
+
+func (t *httpTSA) Timestamp(ctx context.Context, digest []byte) ([]byte, error) {
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	req := timestamp.Request{
+		HashAlgorithm: crypto.SHA256,
+		HashedMessage: digest,
+		Certificates:  true,
+		Nonce:         nonce,
+	}
+	body, err := req.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", timestampQueryType)
+	resp, err := t.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("时间戳服务返回 %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	ts, err := timestamp.ParseResponse(data)
+	if err != nil {
+		return nil, err
+	}
+	if ts.Nonce == nil || ts.Nonce.Cmp(nonce) != 0 {
+		return nil, errors.New("时间戳响应的nonce不匹配")
+	}
+	if !bytes.Equal(ts.HashedMessage, digest) {
+		return nil, errors.New("时间戳响应的摘要不匹配")
+	}
+	return ts.RawToken, nil
+}
+
+// LocalTSA 内置的本地时间戳服务，用自签名证书签发时间戳，作为外部时间戳服务的替身
+type LocalTSA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// LoadLocalTSA 加载本地时间戳服务的证书和私钥，文件不存在时生成新的自签名证书
+func LoadLocalTSA(certFile, keyFile string) (*LocalTSA, error) {
+	certPEM, certErr := os.ReadFile(certFile)
+	keyPEM, keyErr := os.ReadFile(keyFile)
+	if certErr == nil && keyErr == nil {
+		return parseLocalTSA(certPEM, keyPEM)
+	}
+	if !errors.Is(certErr, os.ErrNotExist) && certErr != nil {
+		return nil, certErr
+	}
+	if !errors.Is(keyErr, os.ErrNotExist) && keyErr != nil {
+		return nil, keyErr
+	}
+
+	certPEM, keyPEM, err := generateLocalTSA()
+	if err != nil {
+		return nil, err
+	}
+	for path, data := range map[string][]byte{certFile: certPEM, keyFile: keyPEM} {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+	}
+	return parseLocalTSA(certPEM, keyPEM)
+}
+
+// 生成时间戳签名用的自签名证书
+func generateLocalTSA() (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Cold Chain Local TSA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+func parseLocalTSA(certPEM, keyPEM []byte) (*LocalTSA, error) {
+	certs, err := parseCertificates(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("本地时间戳服务私钥格式错误")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("本地时间戳服务私钥类型不支持签名")
+	}
+	return &LocalTSA{cert: certs[0], key: signer}, nil
+}
+
+// Certificate 本地时间戳服务的签名证书
+func (t *LocalTSA) Certificate() *x509.Certificate {
+	return t.cert
+}
+
+func (t *LocalTSA) Timestamp(ctx context.Context, digest []byte) ([]byte, error) {
+	resp, err := t.respond(&timestamp.Request{HashAlgorithm: crypto.SHA256, HashedMessage: digest, Certificates: true})
+	if err != nil {
+		return nil, err
+	}
+	ts, err := timestamp.ParseResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	return ts.RawToken, nil
+}
+
+// Respond 处理DER编码的时间戳请求，返回DER编码的时间戳响应
+func (t *LocalTSA) Respond(query []byte) ([]byte, error) {
+	req, err := timestamp.ParseRequest(query)
+	if err != nil {
+		return nil, err
+	}
+	return t.respond(req)
+}
+
+func (t *LocalTSA) respond(req *timestamp.Request) ([]byte, error) {
+	ts := timestamp.Timestamp{
+		HashAlgorithm:     req.HashAlgorithm,
+		HashedMessage:     req.HashedMessage,
+		Time:              time.Now().UTC(),
+		Accuracy:          time.Second,
+		Policy:            localTSAPolicy,
+		Nonce:             req.Nonce,
+		AddTSACertificate: req.Certificates,
+	}
+	if req.TSAPolicyOID != nil {
+		ts.Policy = req.TSAPolicyOID
+	}
+	return ts.CreateResponseWithOpts(t.cert, t.key, crypto.SHA256)
+}
+
+// 解析PEM中的所有证书
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("未找到证书")
+	}
+	return certs, nil
+}
+
+// 打包区块的时间戳摘要，对区块哈希本身做SHA-256
+func sealedBlockDigest(block configs.SealedBlock) ([]byte, error) {
+	raw, err := hex.DecodeString(block.Hash)
+	if err != nil {
+		return nil, errors.New("打包区块哈希格式错误")
+	}
+	sum := sha256.Sum256(raw)
+	return sum[:], nil
+}
+
+// 检查点的时间戳摘要，对被签名的检查点头做SHA-256
+func checkpointDigest(cp Checkpoint) []byte {
+	sum := sha256.Sum256(cp.header().Encode())
+	return sum[:]
+}
+
+// 时间戳令牌验证结果
+type timestampInfo struct {
+	Time   time.Time `json:"time"`
+	Serial string    `json:"serial"`
+	Signer string    `json:"signer"`
+}
+
+var (
+	tsaTrustMu sync.Mutex
+	tsaTrust   []*x509.Certificate // 信任的时间戳服务证书
+)
+
+// 加载信任的时间戳服务证书，本地服务启动后使用其证书，否则读取配置的证书文件
+func trustedTSACertificates() ([]*x509.Certificate, error) {
+	tsaTrustMu.Lock()
+	defer tsaTrustMu.Unlock()
+
+	if tsaTrust != nil {
+		return tsaTrust, nil
+	}
+	data, err := os.ReadFile(configs.GlobalTimestampConfig.CertFile)
+	if err != nil {
+		return nil, errors.New("未配置时间戳服务证书")
+	}
+	certs, err := parseCertificates(data)
+	if err != nil {
+		return nil, err
+	}
+	tsaTrust = certs
+	return certs, nil
+}
+
+func setTrustedTSACertificates(certs []*x509.Certificate) {
+	tsaTrustMu.Lock()
+	tsaTrust = certs
+	tsaTrustMu.Unlock()
+}
+
+// 验证时间戳令牌：签名有效、签名证书由信任的证书签发且用于时间戳、摘要与数据一致
+func verifyTimestampToken(token string, digest []byte, trusted []*x509.Certificate) (*timestampInfo, error) {
+	der, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New("时间戳令牌格式错误")
+	}
+	ts, err := timestamp.Parse(der)
+	if err != nil {
+		return nil, fmt.Errorf("时间戳令牌解析失败: %w", err)
+	}
+	if ts.HashAlgorithm != crypto.SHA256 || !bytes.Equal(ts.HashedMessage, digest) {
+		return nil, errors.New("时间戳令牌与数据摘要不匹配")
+	}
+
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return nil, err
+	}
+	// 令牌中未附带证书时用信任的证书查找签名者
+	if len(p7.Certificates) == 0 {
+		p7.Certificates = trusted
+	}
+	roots := x509.NewCertPool()
+	for _, cert := range trusted {
+		roots.AddCert(cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range p7.Certificates {
+		intermediates.AddCert(cert)
+	}
+	// 按签发时间验证证书链，证书过期后历史令牌依然有效
+	err = p7.VerifyWithOpts(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   ts.Time,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("时间戳令牌签名无效: %w", err)
+	}
+
+	info := &timestampInfo{Time: ts.Time}
+	if ts.SerialNumber != nil {
+		info.Serial = ts.SerialNumber.Text(16)
+	}
+	if signer := p7.GetOnlySigner(); signer != nil {
+		info.Signer = signer.Subject.CommonName
+	}
+	return info, nil
+}
+
+// Timestamper 为打包区块和检查点申请可信时间戳
+type Timestamper struct {
+	authority TimestampAuthority
+	interval  time.Duration
+	timeout   time.Duration
+	notify    chan struct{}
+	mu        sync.Mutex
+}
+
+// 当前运行的时间戳服务和本地时间戳服务
+var (
+	timestamper *Timestamper
+	localTSA    *LocalTSA
+)
+
+// NewTimestamper 创建时间戳服务
+func NewTimestamper(authority TimestampAuthority, interval, timeout time.Duration) *Timestamper {
+	return &Timestamper{
+		authority: authority,
+		interval:  interval,
+		timeout:   timeout,
+		notify:    make(chan struct{}, 1),
+	}
+}
+
+// StartTimestamper 按全局配置启动时间戳服务，未启用时返回nil
+// 未配置外部服务地址时启动本地时间戳服务，配置 ServeLocal 后通过 /api/tsa 对外提供
+func StartTimestamper(ctx context.Context) (*Timestamper, error) {
+	cfg := configs.GlobalTimestampConfig
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	var authority TimestampAuthority
+	if cfg.URL == "" {
+		local, err := LoadLocalTSA(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		localTSA = local
+		setTrustedTSACertificates([]*x509.Certificate{local.Certificate()})
+		authority = local
+	} else {
+		if _, err := trustedTSACertificates(); err != nil {
+			return nil, err
+		}
+		authority = &httpTSA{url: cfg.URL, client: &http.Client{Timeout: cfg.Timeout}}
+	}
+
+	t := NewTimestamper(authority, cfg.Interval, cfg.Timeout)
+	timestamper = t
+	go t.Run(ctx)
+	return t, nil
+}
+
+// Notify 通知有新的打包区块或检查点，不会阻塞调用方
+func (t *Timestamper) Notify() {
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+}
+
+// 通知时间戳服务有新数据需要盖时间戳
+func notifyTimestamper() {
+	if timestamper != nil {
+		timestamper.Notify()
+	}
+}
+
+// Run 定期为尚未盖时间戳的打包区块和检查点申请时间戳
+func (t *Timestamper) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := t.StampPending(ctx); err != nil {
+			log.Printf("申请时间戳失败: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-t.notify:
+		}
+	}
+}
+
+// StampPending 为尚未盖时间戳的打包区块和检查点申请时间戳，返回成功的数量
+// 每条记录只在生成后的时间戳期限内申请，已经盖过的（tsa_time 不为空）即使令牌被清除也不会重新申请，
+// 单条记录申请失败时记录日志并继续处理其余记录，期限内的下一轮会重试
+func (t *Timestamper) StampPending(ctx context.Context) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	since := time.Now().Add(-configs.GlobalTimestampConfig.Window).UnixNano()
+	pending := "(tsa_token IS NULL OR tsa_token = '') AND tsa_time IS NULL AND timestamp >= ?"
+
+	stamped := 0
+	var blocks []configs.SealedBlock
+	result := configs.DB.Where(pending, since).Order("height").Limit(100).Find(&blocks)
+	if result.Error != nil {
+		return stamped, result.Error
+	}
+	for _, block := range blocks {
+		digest, err := sealedBlockDigest(block)
+		if err == nil {
+			err = t.stamp(ctx, &configs.SealedBlock{}, block.ID, digest)
+		}
+		if err != nil {
+			log.Printf("为打包区块 %d 申请时间戳失败: %v", block.Height, err)
+			continue
+		}
+		stamped++
+	}
+
+	var checkpoints []configs.LedgerCheckpoint
+	result = configs.DB.Where(pending, since).Order("id").Limit(100).Find(&checkpoints)
+	if result.Error != nil {
+		return stamped, result.Error
+	}
+	for _, record := range checkpoints {
+		cp, err := checkpointOf(record)
+		if err == nil {
+			err = t.stamp(ctx, &configs.LedgerCheckpoint{}, record.ID, checkpointDigest(cp))
+		}
+		if err != nil {
+			log.Printf("为检查点 %d 申请时间戳失败: %v", record.ID, err)
+			continue
+		}
+		stamped++
+	}
+	return stamped, nil
+}
+
+// 申请时间戳并保存到指定记录
+func (t *Timestamper) stamp(ctx context.Context, model interface{}, id uint, digest []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	token, err := t.authority.Timestamp(ctx, digest)
+	if err != nil {
+		return err
+	}
+	ts, err := timestamp.Parse(token)
+	if err != nil {
+		return err
+	}
+	return configs.DB.Model(model).Where("id = ?", id).Updates(map[string]interface{}{
+		"tsa_token": base64.StdEncoding.EncodeToString(token),
+		"tsa_time":  ts.Time,
+	}).Error
+}
+
+// TimestampQuery 本地时间戳服务，按 RFC 3161 处理 application/timestamp-query 请求
+func (s *BlockchainService) TimestampQuery(c *gin.Context) {
+	if localTSA == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "本地时间戳服务未启用",
+		})
+		return
+	}
+
+	query, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<16))
+	if err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	resp, err := localTSA.Respond(query)
+	if err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	c.Data(http.StatusOK, timestampReplyType, resp)
+}
+
+// GetTSACertificate 获取信任的时间戳服务证书(PEM)，用于离线验证时间戳令牌
+func (s *BlockchainService) GetTSACertificate(c *gin.Context) {
+	certs, err := trustedTSACertificates()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	c.Data(http.StatusOK, "application/x-pem-file", buf.Bytes())
+}
@@ -0,0 +1,400 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/digitorus/timestamp"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 在临时目录中生成本地时间戳服务
+func testLocalTSA(t *testing.T) *LocalTSA {
+	t.Helper()
+	dir := t.TempDir()
+	tsa, err := LoadLocalTSA(filepath.Join(dir, "tsa_cert.pem"), filepath.Join(dir, "tsa_key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tsa
+}
+
+func TestVerifyTimestampToken(t *testing.T) {
+	tsa := testLocalTSA(t)
+	other := testLocalTSA(t)
+	digest := sha256.Sum256([]byte("block"))
+	token, err := tsa.Timestamp(context.Background(), digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   func() []byte
+		digest  []byte
+		trusted []*x509.Certificate
+		wantErr bool
+	}{
+		{name: "有效令牌", token: func() []byte { return token }, digest: digest[:], trusted: []*x509.Certificate{tsa.Certificate()}},
+		{
+			// 签名在令牌末尾，改动最后一个字节使签名无效
+			name: "令牌被篡改",
+			token: func() []byte {
+				tampered := append([]byte(nil), token...)
+				tampered[len(tampered)-1] ^= 0xff
+				return tampered
+			},
+			digest:  digest[:],
+			trusted: []*x509.Certificate{tsa.Certificate()},
+			wantErr: true,
+		},
+		{
+			name:    "数据摘要不一致",
+			token:   func() []byte { return token },
+			digest:  bytes.Repeat([]byte{1}, 32),
+			trusted: []*x509.Certificate{tsa.Certificate()},
+			wantErr: true,
+		},
+		{
+			name:    "不信任的证书",
+			token:   func() []byte { return token },
+			digest:  digest[:],
+			trusted: []*x509.Certificate{other.Certificate()},
+			wantErr: true,
+		},
+		{
+			name: "其他时间戳服务签发",
+			token: func() []byte {
+				forged, err := other.Timestamp(context.Background(), digest[:])
+				if err != nil {
+					t.Fatal(err)
+				}
+				return forged
+			},
+			digest:  digest[:],
+			trusted: []*x509.Certificate{tsa.Certificate()},
+			wantErr: true,
+		},
+		{name: "不是时间戳令牌", token: func() []byte { return []byte("token") }, digest: digest[:], trusted: []*x509.Certificate{tsa.Certificate()}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := verifyTimestampToken(base64.StdEncoding.EncodeToString(tt.token()), tt.digest, tt.trusted)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("验证结果 %v", err)
+			}
+			if err == nil && (info.Signer != "Cold Chain Local TSA" || time.Since(info.Time) > time.Minute) {
+				t.Fatalf("令牌信息 %+v", info)
+			}
+		})
+	}
+
+	// 证书文件不存在时重新加载同一份证书和私钥
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first, err := LoadLocalTSA(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadLocalTSA(certFile, keyFile)
+	if err != nil || !second.Certificate().Equal(first.Certificate()) {
+		t.Fatalf("重新加载的证书不同: %v", err)
+	}
+}
+
+func TestHTTPTimestampAuthority(t *testing.T) {
+	tsa := testLocalTSA(t)
+	digest := sha256.Sum256([]byte("checkpoint"))
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		wantErr bool
+	}{
+		{
+			name: "正常响应",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				query, _ := io.ReadAll(r.Body)
+				resp, err := tsa.Respond(query)
+				if err != nil || r.Header.Get("Content-Type") != timestampQueryType {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.Write(resp)
+			},
+		},
+		{
+			// 重放的旧响应nonce不一致
+			name: "nonce不一致",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				resp, _ := tsa.respond(&timestamp.Request{HashAlgorithm: crypto.SHA256, HashedMessage: digest[:], Certificates: true})
+				w.Write(resp)
+			},
+			wantErr: true,
+		},
+		{
+			name: "摘要不一致",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				query, _ := io.ReadAll(r.Body)
+				req, _ := timestamp.ParseRequest(query)
+				req.HashedMessage = bytes.Repeat([]byte{1}, 32)
+				resp, _ := tsa.respond(req)
+				w.Write(resp)
+			},
+			wantErr: true,
+		},
+		{
+			name: "HTTP错误",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+
+			authority := &httpTSA{url: server.URL, client: server.Client()}
+			token, err := authority.Timestamp(context.Background(), digest[:])
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("申请时间戳 %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if _, err := verifyTimestampToken(base64.StdEncoding.EncodeToString(token), digest[:], []*x509.Certificate{tsa.Certificate()}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestTimestampRouteRequiresConfig(t *testing.T) {
+	tsa := testLocalTSA(t)
+	saved, savedLocal := configs.GlobalTimestampConfig, localTSA
+	localTSA = tsa
+	t.Cleanup(func() {
+		configs.GlobalTimestampConfig, localTSA = saved, savedLocal
+	})
+
+	query, err := (&timestamp.Request{HashAlgorithm: crypto.SHA256, HashedMessage: bytes.Repeat([]byte{2}, 32)}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		serveLocal bool
+		code       int
+	}{
+		{name: "默认不对外提供", code: http.StatusNotFound},
+		{name: "配置后对外提供", serveLocal: true, code: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs.GlobalTimestampConfig.ServeLocal = tt.serveLocal
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			SetupBlockchainRoutes(router)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/api/tsa", bytes.NewReader(query))
+			req.Header.Set("Content-Type", timestampQueryType)
+			router.ServeHTTP(w, req)
+			if w.Code != tt.code {
+				t.Fatalf("状态码 %d", w.Code)
+			}
+			if tt.code == http.StatusOK {
+				if _, err := timestamp.ParseResponse(w.Body.Bytes()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// 测试用的时间戳服务，用本地时间戳服务的证书签发指定时间的令牌，前 fail 次申请失败
+type testTSA struct {
+	tsa    *LocalTSA
+	offset time.Duration
+	fail   int
+}
+
+func (a *testTSA) Timestamp(ctx context.Context, digest []byte) ([]byte, error) {
+	if a.fail > 0 {
+		a.fail--
+		return nil, errors.New("时间戳服务不可用")
+	}
+	ts := timestamp.Timestamp{
+		HashAlgorithm:     crypto.SHA256,
+		HashedMessage:     digest,
+		Time:              time.Now().Add(a.offset).UTC(),
+		Accuracy:          time.Second,
+		Policy:            localTSAPolicy,
+		AddTSACertificate: true,
+	}
+	resp, err := ts.CreateResponseWithOpts(a.tsa.cert, a.tsa.key, crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := timestamp.ParseResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	return parsed.RawToken, nil
+}
+
+// 加上服务端和签名者的密钥登记区块共4条记录，封成两个打包区块后生成检查点，
+// 打包区块的时间提前 age 并重新计算哈希，模拟早已封好的区块
+func testStampLedger(t *testing.T, age time.Duration) *LocalTSA {
+	t.Helper()
+	testDB(t)
+	testServerKey(t)
+	user := testUser(t, 1)
+	for i := 0; i < 2; i++ {
+		if _, err := (&BlockchainService{}).AddToBlockchain("SKU-1", 1, fmt.Sprintf(`{"n":%d}`, i), user.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := NewBlockProducer(0, 2).SealPending(1); err != nil {
+		t.Fatal(err)
+	}
+
+	var blocks []configs.SealedBlock
+	configs.DB.Order("height").Find(&blocks)
+	for i := range blocks {
+		if i > 0 {
+			blocks[i].PreviousHash = blocks[i-1].Hash
+		}
+		blocks[i].Timestamp -= age.Nanoseconds()
+		blocks[i].Hash = sealedHeaderOf(blocks[i]).Hash()
+		if err := configs.DB.Save(&blocks[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := CreateCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	tsa := testLocalTSA(t)
+	setTrustedTSACertificates([]*x509.Certificate{tsa.Certificate()})
+	t.Cleanup(func() { setTrustedTSACertificates(nil) })
+	return tsa
+}
+
+func TestStampPending(t *testing.T) {
+	// 区块在50分钟前封好并盖了时间戳，验证时的时间戳期限为30分钟
+	const age = 50 * time.Minute
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, tsa *LocalTSA, blocks []configs.SealedBlock)
+		reason string
+	}{
+		{name: "时间戳有效"},
+		{
+			name: "令牌被替换为其他区块的令牌",
+			tamper: func(t *testing.T, tsa *LocalTSA, blocks []configs.SealedBlock) {
+				configs.DB.Model(&blocks[1]).Update("tsa_token", blocks[0].TSAToken)
+			},
+			reason: "时间戳令牌无效: 时间戳令牌与数据摘要不匹配",
+		},
+		{
+			// 令牌被清除后不会重新申请，过了期限的区块缺少令牌即验证失败
+			name: "令牌被清除",
+			tamper: func(t *testing.T, tsa *LocalTSA, blocks []configs.SealedBlock) {
+				configs.DB.Model(&blocks[1]).Update("tsa_token", "")
+				stamped, err := NewTimestamper(tsa, time.Hour, time.Second).StampPending(context.Background())
+				if err != nil || stamped != 0 {
+					t.Fatalf("重新盖了 %d 个时间戳: %v", stamped, err)
+				}
+			},
+			reason: "打包区块缺少时间戳令牌",
+		},
+		{
+			name: "区块改写后重新盖时间戳",
+			tamper: func(t *testing.T, tsa *LocalTSA, blocks []configs.SealedBlock) {
+				digest, err := sealedBlockDigest(blocks[1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				token, err := tsa.Timestamp(context.Background(), digest)
+				if err != nil {
+					t.Fatal(err)
+				}
+				configs.DB.Model(&blocks[1]).Update("tsa_token", base64.StdEncoding.EncodeToString(token))
+			},
+			reason: "时间戳时间与打包区块时间不符",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tsa := testStampLedger(t, age)
+			stamped, err := NewTimestamper(&testTSA{tsa: tsa, offset: -age}, time.Hour, time.Second).StampPending(context.Background())
+			if err != nil || stamped != 3 {
+				t.Fatalf("盖了 %d 个时间戳: %v", stamped, err)
+			}
+
+			saved := configs.GlobalTimestampConfig
+			configs.GlobalTimestampConfig.Window = 30 * time.Minute
+			t.Cleanup(func() { configs.GlobalTimestampConfig = saved })
+			if tt.tamper != nil {
+				var blocks []configs.SealedBlock
+				configs.DB.Order("height").Find(&blocks)
+				tt.tamper(t, tsa, blocks)
+			}
+
+			res := testVerifyRequest(t, "mode=sealed")
+			if res.Valid != (tt.reason == "") || res.Reason != tt.reason {
+				t.Fatalf("验证结果 %+v", res)
+			}
+			if tt.reason == "" && (res.Timestamped != 2 || res.TimestampMissing != 0) {
+				t.Fatalf("时间戳统计 %+v", res)
+			}
+		})
+	}
+}
+
+func TestStampPendingSkipsFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		age     time.Duration
+		fail    int
+		stamped []int // 每一轮盖的时间戳数量
+	}{
+		// 第一个打包区块申请失败时继续处理其余记录，下一轮重试
+		{name: "单条失败不阻塞其余记录", fail: 1, stamped: []int{2, 1, 0}},
+		// 超过期限的打包区块不再申请，只给检查点盖时间戳
+		{name: "超过期限不补盖", age: 2 * time.Hour, stamped: []int{1, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tsa := testStampLedger(t, tt.age)
+			stamper := NewTimestamper(&testTSA{tsa: tsa, fail: tt.fail}, time.Hour, time.Second)
+			for round, want := range tt.stamped {
+				stamped, err := stamper.StampPending(context.Background())
+				if err != nil || stamped != want {
+					t.Fatalf("第 %d 轮盖了 %d 个时间戳: %v", round+1, stamped, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,384 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/api"
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"back_Blockchain_cold_chain_traceability_system/events"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 上传文件的访问前缀
+const uploadURLPrefix = "/uploads/"
+
+// 上传文件的保存目录
+var uploadRoot = "./uploads"
+
+// 清理未引用上传文件的间隔，以及文件最后一次被写入或复用后至少保留的时间
+const (
+	uploadGCInterval = time.Hour
+	uploadGCGrace    = 24 * time.Hour
+)
+
+// 按内容寻址保存的文件名
+var uploadNamePattern = regexp.MustCompile(`^([0-9a-f]{64})\.[a-z]+$`)
+
+// ErrUploadMismatch 已保存的文件内容与文件名中的摘要不一致，可能已被篡改
+var ErrUploadMismatch = errors.New("已保存的文件内容与摘要不一致")
+
+// 保护保存上传文件和清理时的删除，清理不会删掉刚被复用的文件
+var uploadMu sync.Mutex
+
+// 按内容判断文件扩展名，无法识别时沿用原来的 .jpg
+func uploadExtension(data []byte) string {
+	switch http.DetectContentType(data) {
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	case "application/pdf":
+		return ".pdf"
+	}
+	return ".jpg"
+}
+
+// 按内容寻址保存上传文件，文件名为内容的SHA-256，相同内容只保存一份
+// 返回访问地址和SHA-256(hex)，已有的同名文件内容不一致时返回 ErrUploadMismatch 并保留原文件作为证据
+func saveUpload(kind string, data []byte) (string, string, error) {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	filename := digest + uploadExtension(data)
+	dir := filepath.Join(uploadRoot, kind)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", err
+	}
+
+	uploadMu.Lock()
+	defer uploadMu.Unlock()
+
+	filePath := filepath.Join(dir, filename)
+	url := uploadURLPrefix + kind + "/" + filename
+	existing, err := fileSHA256(filePath)
+	switch {
+	case err == nil && existing != digest:
+		log.Printf("上传文件 %s 的内容与摘要不一致，实际摘要 %s", url, existing)
+		return "", "", fmt.Errorf("%w: %s", ErrUploadMismatch, url)
+	case err == nil:
+		// 复用已有文件时更新修改时间，清理时按最后一次使用计算保留期
+		now := time.Now()
+		if err := os.Chtimes(filePath, now, now); err != nil {
+			return "", "", err
+		}
+		return url, digest, nil
+	case !errors.Is(err, os.ErrNotExist):
+		return "", "", err
+	}
+
+	// 先写临时文件再改名，避免并发上传相同内容时读到写了一半的文件
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", "", err
+	}
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return "", "", err
+	}
+	return url, digest, nil
+}
+
+// 上传文件是否仍被产品或物流记录引用
+func uploadReferenced(digest string) (bool, error) {
+	for _, model := range []interface{}{&configs.ProductInfo{}, &configs.LogisticsRecord{}} {
+		var count int64
+		if err := configs.DB.Model(model).Where("image_sha256 = ?", digest).Count(&count).Error; err != nil {
+			return false, err
+		}
+		if count > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// 删除保留期之前写入、且不再被任何产品或物流记录引用的上传文件，返回删除的数量
+// 保存文件和写入引用它的记录之间有时间差，保留期内的文件即使暂时没有引用也不删除；
+// 删除前在锁内重新检查修改时间，避免删掉刚被复用的文件
+func sweepUploads(grace time.Duration) (int, error) {
+	removed := 0
+	kinds, err := os.ReadDir(uploadRoot)
+	if errors.Is(err, os.ErrNotExist) {
+		return removed, nil
+	}
+	if err != nil {
+		return removed, err
+	}
+
+	for _, kind := range kinds {
+		if !kind.IsDir() {
+			continue
+		}
+		dir := filepath.Join(uploadRoot, kind.Name())
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return removed, err
+		}
+		for _, file := range files {
+			// 旧版按随机名保存的文件没有摘要，无法判断是否被引用，不清理
+			match := uploadNamePattern.FindStringSubmatch(file.Name())
+			if match == nil {
+				continue
+			}
+			filePath := filepath.Join(dir, file.Name())
+			if info, err := os.Stat(filePath); err != nil || time.Since(info.ModTime()) < grace {
+				continue
+			}
+			referenced, err := uploadReferenced(match[1])
+			if err != nil {
+				return removed, err
+			}
+			if referenced {
+				continue
+			}
+
+			uploadMu.Lock()
+			info, err := os.Stat(filePath)
+			if err == nil && time.Since(info.ModTime()) >= grace {
+				err = os.Remove(filePath)
+				if err == nil {
+					removed++
+				}
+			}
+			uploadMu.Unlock()
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+// StartUploadGC 定期清理不再被引用的上传文件
+func StartUploadGC(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(uploadGCInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			removed, err := sweepUploads(uploadGCGrace)
+			if err != nil {
+				log.Printf("清理上传文件失败: %v", err)
+			}
+			if removed > 0 {
+				log.Printf("清理了 %d 个不再被引用的上传文件", removed)
+			}
+		}
+	}()
+}
+
+// 把访问地址转换为本地路径，只允许上传目录下的文件
+func uploadPath(url string) (string, error) {
+	if !strings.HasPrefix(url, uploadURLPrefix) {
+		return "", errors.New("不是上传文件地址")
+	}
+	rel := path.Clean("/" + strings.TrimPrefix(url, uploadURLPrefix))
+	return filepath.Join(uploadRoot, filepath.FromSlash(rel)), nil
+}
+
+// 计算文件的SHA-256
+func fileSHA256(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// 文件核对状态
+const (
+	FileOK       = "ok"
+	FileMismatch = "mismatch"  // 文件内容与链上摘要不一致
+	FileMissing  = "missing"   // 文件不存在
+	FileNoDigest = "no_digest" // 旧版区块没有记录摘要，无法核对
+)
+
+// 单个文件的核对结果
+type fileCheck struct {
+	BlockHeight int64  `json:"block_height"`
+	BlockHash   string `json:"block_hash"`
+	EventType   string `json:"event_type"`
+	URL         string `json:"url"`
+	Expected    string `json:"expected_sha256,omitempty"`
+	Actual      string `json:"actual_sha256,omitempty"`
+	Status      string `json:"status"`
+}
+
+// 文件核对汇总
+type fileCheckResult struct {
+	Valid    bool        `json:"valid"`
+	Total    int         `json:"total"`
+	OK       int         `json:"ok"`
+	Mismatch int         `json:"mismatch"`
+	Missing  int         `json:"missing"`
+	NoDigest int         `json:"no_digest"`
+	Files    []fileCheck `json:"files"`
+}
+
+// 按链上事件中的摘要核对本地文件，区块数据无法解码的跳过，由账本验证负责报告
+func verifyLedgerFiles(blocks []configs.BlockchainLog) fileCheckResult {
+	res := fileCheckResult{Valid: true, Files: []fileCheck{}}
+	for _, block := range blocks {
+		event, err := decodeBlockEvent(block)
+		if err != nil {
+			continue
+		}
+
+		var url, digest string
+		switch e := events.Latest(event).(type) {
+		case *events.ProductCreated:
+			url, digest = e.ImageURL, e.ImageSHA256
+		case *events.LogisticsUpdated:
+			url, digest = e.ImageURL, e.ImageSHA256
+		default:
+			continue
+		}
+		if url == "" {
+			continue
+		}
+
+		check := fileCheck{
+			BlockHeight: block.BlockHeight,
+			BlockHash:   block.Hash,
+			EventType:   event.EventType(),
+			URL:         url,
+			Expected:    digest,
+		}
+		filePath, err := uploadPath(url)
+		if err == nil {
+			check.Actual, err = fileSHA256(filePath)
+		}
+		switch {
+		case err != nil:
+			check.Status = FileMissing
+			res.Missing++
+		case digest == "":
+			check.Status = FileNoDigest
+			res.NoDigest++
+		case check.Actual != digest:
+			check.Status = FileMismatch
+			res.Mismatch++
+		default:
+			check.Status = FileOK
+			res.OK++
+		}
+		res.Files = append(res.Files, check)
+	}
+
+	res.Total = len(res.Files)
+	res.Valid = res.Mismatch == 0 && res.Missing == 0
+	return res
+}
+
+// VerifyFiles 重新计算产品和物流图片的SHA-256，与链上记录的摘要核对
+func (s *BlockchainService) VerifyFiles(c *gin.Context) {
+	productSKU := c.Query("sku")
+	if productSKU == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "请提供产品SKU",
+		})
+		return
+	}
+
+	blocks, err := skuBlocks(configs.DB, productSKU)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "查询区块链记录失败",
+		})
+		return
+	}
+	if len(blocks) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "未找到区块链记录",
+		})
+		return
+	}
+
+	res := verifyLedgerFiles(blocks)
+	message := "文件核对通过"
+	if !res.Valid {
+		message = "文件核对失败"
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": message,
+		"data":    res,
+	})
+}
+
+// AdminVerifyFiles 核对账本中记录的所有文件
+func (s *AdminService) AdminVerifyFiles(c *gin.Context) {
+	var blocks []configs.BlockchainLog
+	result := configs.DB.Where("record_type IN ?", []int{events.RecordProductCreated, events.RecordLogisticsUpdated}).
+		Order("global_height").
+		Find(&blocks)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "查询区块链记录失败: " + result.Error.Error(),
+		})
+		return
+	}
+
+	res := verifyLedgerFiles(blocks)
+	message := "文件核对通过"
+	if !res.Valid {
+		message = "文件核对失败"
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: message,
+		Data:    res,
+	})
+}
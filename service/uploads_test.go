@@ -0,0 +1,132 @@
+package service
+
+import (
+	"back_Blockchain_cold_chain_traceability_system/configs"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 上传目录改到临时目录
+func testUploadRoot(t *testing.T) {
+	t.Helper()
+	saved := uploadRoot
+	uploadRoot = t.TempDir()
+	t.Cleanup(func() { uploadRoot = saved })
+}
+
+// 把上传文件的修改时间改到 age 之前
+func testAgeUpload(t *testing.T, url string, age time.Duration) string {
+	t.Helper()
+	filePath, err := uploadPath(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-age)
+	if err := os.Chtimes(filePath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+func TestSaveUpload(t *testing.T) {
+	data := []byte("\x89PNG\r\n\x1a\n测试图片")
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, filePath string)
+		wantErr error
+	}{
+		{name: "新文件"},
+		{name: "复用相同内容的文件", setup: func(t *testing.T, filePath string) {}},
+		{
+			// 同名文件内容被改过时报告不一致，并保留被改过的文件
+			name: "已有文件被篡改",
+			setup: func(t *testing.T, filePath string) {
+				if err := os.WriteFile(filePath, []byte("篡改"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: ErrUploadMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testUploadRoot(t)
+			url, digest, err := saveUpload("products", data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filePath := testAgeUpload(t, url, time.Hour)
+			if tt.setup == nil {
+				return
+			}
+			tt.setup(t, filePath)
+
+			again, againDigest, err := saveUpload("products", data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("再次保存 %v", err)
+			}
+			if tt.wantErr != nil {
+				if stored, _ := os.ReadFile(filePath); string(stored) != "篡改" {
+					t.Fatal("覆盖了被篡改的文件")
+				}
+				return
+			}
+			// 复用时刷新修改时间，清理按最后一次使用计算保留期
+			info, err := os.Stat(filePath)
+			if err != nil || again != url || againDigest != digest || time.Since(info.ModTime()) > time.Minute {
+				t.Fatalf("再次保存 %s %s %v", again, againDigest, err)
+			}
+		})
+	}
+}
+
+func TestSweepUploads(t *testing.T) {
+	tests := []struct {
+		name       string
+		age        time.Duration
+		referenced bool
+		legacy     bool
+		removed    int
+	}{
+		{name: "超过保留期且没有引用", age: 2 * time.Hour, removed: 1},
+		{name: "仍被产品引用", age: 2 * time.Hour, referenced: true},
+		{name: "保留期内刚保存还没有引用", age: time.Minute},
+		{name: "旧版随机文件名", age: 2 * time.Hour, legacy: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDB(t)
+			testUploadRoot(t)
+			url, digest, err := saveUpload("products", []byte("图片"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.legacy {
+				legacy := filepath.Join(uploadRoot, "products", "legacy.jpg")
+				if err := os.Rename(filepath.Join(uploadRoot, "products", filepath.Base(url)), legacy); err != nil {
+					t.Fatal(err)
+				}
+				url = uploadURLPrefix + "products/legacy.jpg"
+			}
+			filePath := testAgeUpload(t, url, tt.age)
+			if tt.referenced {
+				user := testUser(t, 1)
+				product := testProduct(t, "SKU-1", user.ID)
+				configs.DB.Model(&product).Updates(map[string]interface{}{"image_url": url, "image_sha256": digest})
+			}
+
+			removed, err := sweepUploads(time.Hour)
+			if err != nil || removed != tt.removed {
+				t.Fatalf("删除了 %d 个文件: %v", removed, err)
+			}
+			if _, err := os.Stat(filePath); (err == nil) != (tt.removed == 0) {
+				t.Fatalf("文件状态 %v", err)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 	"net/http"
 	"time"
 )
@@ -303,6 +304,67 @@ func (s *UserService) UpdateUserInfo(c *gin.Context) {
 	})
 }
 
+// GetSigningKey 获取当前用户的签名公钥
+func (s *UserService) GetSigningKey(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	// 没有密钥时会生成新密钥并登记到账本
+	var key *configs.UserKey
+	err := ledgerTransaction(func(tx *gorm.DB) error {
+		var err error
+		key, err = activeUserKey(tx, userID.(uint))
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "获取签名密钥失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "获取签名密钥成功",
+		Data: gin.H{
+			"key_id":     key.ID,
+			"algorithm":  key.Algorithm,
+			"public_key": key.PublicKey,
+			"valid_from": key.ValidFrom,
+		},
+	})
+}
+
+// RotateSigningKey 轮换当前用户的签名密钥
+func (s *UserService) RotateSigningKey(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	var key *configs.UserKey
+	err := ledgerTransaction(func(tx *gorm.DB) error {
+		var err error
+		key, err = RotateUserKey(tx, userID.(uint))
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.Response{
+			Code:    500,
+			Message: "轮换签名密钥失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.Response{
+		Code:    200,
+		Message: "轮换签名密钥成功",
+		Data: gin.H{
+			"key_id":     key.ID,
+			"algorithm":  key.Algorithm,
+			"public_key": key.PublicKey,
+			"valid_from": key.ValidFrom,
+		},
+	})
+}
+
 // AuthMiddleware JWT认证中间件
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -419,6 +481,8 @@ func SetupUserRoutes(router *gin.Engine) {
 			authGroup.POST("/logout", userService.Logout)
 			authGroup.GET("/info", userService.GetUserInfo)
 			authGroup.PUT("/info", userService.UpdateUserInfo)
+			authGroup.GET("/key", userService.GetSigningKey)
+			authGroup.POST("/key/rotate", userService.RotateSigningKey)
 		}
 	}
 }